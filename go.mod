@@ -2,7 +2,13 @@ module simplefs
 
 go 1.18
 
-require github.com/stretchr/testify v1.7.1
+require (
+	github.com/klauspost/compress v1.15.15
+	github.com/stretchr/testify v1.7.1
+	golang.org/x/crypto v0.1.0
+	golang.org/x/sys v0.1.0
+	golang.org/x/term v0.1.0
+)
 
 require (
 	github.com/davecgh/go-spew v1.1.0 // indirect
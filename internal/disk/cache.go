@@ -0,0 +1,274 @@
+package disk
+
+import (
+	"container/list"
+	"fmt"
+	"sort"
+	"sync"
+)
+
+/*
+LRU block cache
+*/
+
+// CachePolicy decides when cached writes reach the wrapped device
+type CachePolicy int
+
+const (
+	WriteThrough CachePolicy = iota // Writes go to the device immediately
+	WriteBack                       // Writes go to the device on eviction or Sync
+)
+
+func (p CachePolicy) String() string {
+	if p == WriteBack {
+		return "write-back"
+	}
+	return "write-through"
+}
+
+// CacheStats holds the counters of a Cache
+type CacheStats struct {
+	Hits      uint32 // Number of reads served from the cache
+	Misses    uint32 // Number of reads that went to the device
+	Evictions uint32 // Number of blocks dropped to make room
+	Flushes   uint32 // Number of dirty blocks written back
+}
+
+var _ BlockDevice = (*Cache)(nil)
+
+// Cache keeps recently used blocks of a device in memory
+type Cache struct {
+	BlockDevice
+	Policy   CachePolicy // When writes reach the wrapped device
+	capacity int         // Maximum number of cached blocks
+	mu       sync.Mutex
+	lru      *list.List            // Cached blocks, most recently used first
+	blocks   map[int]*list.Element // Cached blocks by block number
+	stats    CacheStats
+}
+
+type cacheEntry struct {
+	blocknum int
+	data     []byte
+	dirty    bool
+}
+
+// Wrap dev in a block cache
+// dev: Device to cache
+// capacity: Number of blocks to keep in memory
+// policy: When writes reach dev
+func NewCache(dev BlockDevice, capacity int, policy CachePolicy) *Cache {
+	if capacity < 1 {
+		capacity = 1
+	}
+	return &Cache{
+		BlockDevice: dev,
+		Policy:      policy,
+		capacity:    capacity,
+		lru:         list.New(),
+		blocks:      make(map[int]*list.Element),
+	}
+}
+
+// Return wrapped device
+func (c *Cache) Unwrap() BlockDevice {
+	return c.BlockDevice
+}
+
+// Return cache statistics
+func (c *Cache) CacheStats() CacheStats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+// Return number of dirty blocks waiting to be written back
+func (c *Cache) Dirty() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	dirty := 0
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if e.Value.(*cacheEntry).dirty {
+			dirty++
+		}
+	}
+	return dirty
+}
+
+// Return status lines of cache and wrapped device
+func (c *Cache) Report() []string {
+	stats := c.CacheStats()
+	c.mu.Lock()
+	lines := []string{
+		fmt.Sprintf("cache: %d/%d blocks (%s)", c.lru.Len(), c.capacity, c.Policy),
+		fmt.Sprintf("    %d hits, %d misses, %d evictions, %d flushes", stats.Hits, stats.Misses, stats.Evictions, stats.Flushes),
+	}
+	c.mu.Unlock()
+	return append(lines, Report(c.BlockDevice)...)
+}
+
+// Read block through the cache
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (c *Cache) Read(blocknum int, data []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.blocks[blocknum]; ok {
+		c.lru.MoveToFront(e)
+		c.stats.Hits++
+		return copy(data, e.Value.(*cacheEntry).data), nil
+	}
+	entry, err := c.load(blocknum)
+	if err != nil {
+		return -1, err
+	}
+	return copy(data, entry.data), nil
+}
+
+// Write block through the cache
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (c *Cache) Write(blocknum int, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.BlockSize() < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, c.BlockSize())
+	}
+	if c.Policy == WriteThrough {
+		if err := c.BlockDevice.Write(blocknum, data); err != nil {
+			return err
+		}
+		if e, ok := c.blocks[blocknum]; ok {
+			copy(e.Value.(*cacheEntry).data, data)
+			c.lru.MoveToFront(e)
+		}
+		return nil
+	}
+
+	e, ok := c.blocks[blocknum]
+	if !ok {
+		// short writes keep the rest of the block
+		var entry *cacheEntry
+		var err error
+		if len(data) < c.BlockSize() {
+			entry, err = c.load(blocknum)
+		} else {
+			if err = checkBlock(blocknum, c.Size()); err == nil {
+				entry, err = c.insert(blocknum, make([]byte, c.BlockSize()))
+			}
+		}
+		if err != nil {
+			return err
+		}
+		e = c.blocks[entry.blocknum]
+	}
+	entry := e.Value.(*cacheEntry)
+	copy(entry.data, data)
+	entry.dirty = true
+	c.lru.MoveToFront(e)
+	return nil
+}
+
+// Drop blocks from the cache and release them on the wrapped device
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (c *Cache) Trim(blocknum int, count int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for i := blocknum; i < blocknum+count; i++ {
+		if e, ok := c.blocks[i]; ok {
+			c.lru.Remove(e)
+			delete(c.blocks, i)
+		}
+	}
+	return Trim(c.BlockDevice, blocknum, count)
+}
+
+// Write all dirty blocks back to the wrapped device
+func (c *Cache) Sync() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var dirty []*cacheEntry
+	for e := c.lru.Front(); e != nil; e = e.Next() {
+		if entry := e.Value.(*cacheEntry); entry.dirty {
+			dirty = append(dirty, entry)
+		}
+	}
+	sort.Slice(dirty, func(i, j int) bool { return dirty[i].blocknum < dirty[j].blocknum })
+	for _, entry := range dirty {
+		if err := c.flush(entry); err != nil {
+			return err
+		}
+	}
+	return Sync(c.BlockDevice)
+}
+
+// Return bad blocks of the wrapped device
+func (c *Cache) BadBlocks() []int {
+	return BadBlocks(c.BlockDevice)
+}
+
+// Drop all cached blocks (after writing back dirty ones)
+func (c *Cache) Invalidate() error {
+	if err := c.Sync(); err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.lru.Init()
+	c.blocks = make(map[int]*list.Element)
+	return nil
+}
+
+// Flush dirty blocks and close the wrapped device
+func (c *Cache) Close() error {
+	if err := c.Sync(); err != nil {
+		return fmt.Errorf("Unable to flush cache: %s", err.Error())
+	}
+	return c.BlockDevice.Close()
+}
+
+// read block from wrapped device into the cache
+func (c *Cache) load(blocknum int) (*cacheEntry, error) {
+	buf := make([]byte, c.BlockSize())
+	if _, err := c.BlockDevice.Read(blocknum, buf); err != nil {
+		return nil, err
+	}
+	c.stats.Misses++
+	return c.insert(blocknum, buf)
+}
+
+// add block to the cache, evicting the least recently used block if full
+func (c *Cache) insert(blocknum int, data []byte) (*cacheEntry, error) {
+	if c.lru.Len() >= c.capacity {
+		victim := c.lru.Back().Value.(*cacheEntry)
+		if err := c.flush(victim); err != nil {
+			return nil, err
+		}
+		c.lru.Remove(c.blocks[victim.blocknum])
+		delete(c.blocks, victim.blocknum)
+		c.stats.Evictions++
+	}
+	entry := &cacheEntry{blocknum: blocknum, data: data}
+	c.blocks[blocknum] = c.lru.PushFront(entry)
+	return entry, nil
+}
+
+// write dirty block back to wrapped device
+func (c *Cache) flush(entry *cacheEntry) error {
+	if !entry.dirty {
+		return nil
+	}
+	if err := c.BlockDevice.Write(entry.blocknum, entry.data); err != nil {
+		return err
+	}
+	entry.dirty = false
+	c.stats.Flushes++
+	return nil
+}
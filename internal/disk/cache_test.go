@@ -0,0 +1,136 @@
+package disk
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCache(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"hits and misses": testCacheHits,
+		"lru eviction":    testCacheEviction,
+		"write-through":   testCacheWriteThrough,
+		"write-back":      testCacheWriteBack,
+		"short writes":    testCacheShortWrite,
+		"flush on close":  testCacheClose,
+		"trim":            testCacheTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testCacheHits(t *testing.T) {
+	m := NewMemDisk(10)
+	c := NewCache(m, 4, WriteThrough)
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 3; i++ {
+		_, err := c.Read(1, buf)
+		require.NoError(t, err)
+	}
+	require.Equal(t, CacheStats{Hits: 2, Misses: 1}, c.CacheStats())
+	require.Equal(t, 1, int(c.Stats().Reads))
+	_, err := c.Read(10, buf)
+	require.Error(t, err)
+}
+
+func testCacheEviction(t *testing.T) {
+	m := NewMemDisk(10)
+	c := NewCache(m, 2, WriteThrough)
+	buf := make([]byte, BLOCK_SIZE)
+	for _, blocknum := range []int{1, 2, 1, 3, 1, 2} {
+		_, err := c.Read(blocknum, buf)
+		require.NoError(t, err)
+	}
+	// 2 was least recently used when 3 was loaded
+	require.Equal(t, CacheStats{Hits: 2, Misses: 4, Evictions: 2}, c.CacheStats())
+}
+
+func testCacheWriteThrough(t *testing.T) {
+	m := NewMemDisk(10)
+	c := NewCache(m, 4, WriteThrough)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err := c.Read(1, buf)
+	require.NoError(t, err)
+	require.NoError(t, c.Write(1, []byte("through")))
+	require.Equal(t, 1, int(m.Writes))
+	require.Equal(t, 0, c.Dirty())
+
+	_, err = c.Read(1, buf)
+	require.NoError(t, err)
+	require.Equal(t, "through", string(buf[:7]))
+	_, err = m.Read(1, buf)
+	require.NoError(t, err)
+	require.Equal(t, "through", string(buf[:7]))
+}
+
+func testCacheWriteBack(t *testing.T) {
+	m := NewMemDisk(10)
+	c := NewCache(m, 2, WriteBack)
+	data := make([]byte, BLOCK_SIZE)
+	copy(data, "back")
+	require.NoError(t, c.Write(1, data))
+	require.NoError(t, c.Write(2, data))
+	require.Equal(t, 0, int(m.Writes))
+	require.Equal(t, 2, c.Dirty())
+
+	// evicting block 1 writes it back
+	require.NoError(t, c.Write(3, data))
+	require.Equal(t, 1, int(m.Writes))
+	require.NoError(t, c.Sync())
+	require.Equal(t, 3, int(m.Writes))
+	require.Equal(t, 0, c.Dirty())
+	require.Equal(t, CacheStats{Evictions: 1, Flushes: 3}, c.CacheStats())
+
+	// clean blocks are not written again
+	require.NoError(t, c.Sync())
+	require.Equal(t, 3, int(m.Writes))
+	require.Error(t, c.Write(10, data))
+}
+
+func testCacheShortWrite(t *testing.T) {
+	m := NewMemDisk(10)
+	require.NoError(t, m.Write(1, []byte("hello world")))
+	c := NewCache(m, 2, WriteBack)
+	require.NoError(t, c.Write(1, []byte("HELLO")))
+	require.NoError(t, c.Invalidate())
+
+	buf := make([]byte, BLOCK_SIZE)
+	_, err := c.Read(1, buf)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO world", string(buf[:11]))
+}
+
+func testCacheClose(t *testing.T) {
+	d := &Disk{}
+	err := d.Open("test_image10", 10)
+	require.NoError(t, err)
+	c := NewCache(d, 4, WriteBack)
+	require.NoError(t, c.Write(2, []byte("flushed on close")))
+	require.Equal(t, 0, int(d.Writes))
+	require.NoError(t, c.Close())
+
+	m, err := LoadMemDisk("test_image10")
+	require.NoError(t, err)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = m.Read(2, buf)
+	require.NoError(t, err)
+	require.Equal(t, "flushed on close", string(buf[:16]))
+	require.NoError(t, os.Remove("test_image10"))
+}
+
+func testCacheTrim(t *testing.T) {
+	mem := NewMemDisk(10)
+	c := NewCache(mem, 4, WriteBack)
+	require.NoError(t, c.Write(2, []byte("dirty")))
+	require.NoError(t, c.Trim(2, 1))
+	require.Equal(t, 0, c.Dirty())
+	require.Equal(t, 1, int(mem.Trims))
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err := c.Read(2, rdata)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), rdata)
+	require.NoError(t, c.Sync())
+	require.Equal(t, 0, int(mem.Writes))
+}
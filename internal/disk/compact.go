@@ -0,0 +1,390 @@
+package disk
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+/*
+Compact image container
+
+A compact image stores only the non-zero blocks of a disk. It starts with
+a CompactHeader, followed by an index of CompactEntry records sorted by
+block number, followed by the payload of every stored block. A payload is
+compressed with the codec recorded in its entry, blocks that do not shrink
+are stored as is.
+*/
+
+const (
+	COMPACT_MAGIC   = "SFSCMPCT"
+	COMPACT_VERSION = 1
+)
+
+// Compression selects the codec used for the blocks of a compact image
+type Compression uint8
+
+const (
+	CompressNone    Compression = iota // Blocks are stored as is
+	CompressDeflate                    // Blocks are compressed with deflate
+	CompressZstd                       // Blocks are compressed with zstd
+)
+
+func (c Compression) String() string {
+	switch c {
+	case CompressDeflate:
+		return "deflate"
+	case CompressZstd:
+		return "zstd"
+	}
+	return "none"
+}
+
+// Return compression named name ("none", "deflate" or "zstd")
+func ParseCompression(name string) (Compression, error) {
+	for _, c := range []Compression{CompressNone, CompressDeflate, CompressZstd} {
+		if c.String() == name {
+			return c, nil
+		}
+	}
+	return CompressNone, fmt.Errorf("unknown compression %q", name)
+}
+
+// CompactHeader describes the geometry of a compact image
+type CompactHeader struct {
+	Magic       [8]byte  // Compact image magic (COMPACT_MAGIC)
+	Version     uint32   // Compact image format version
+	BlockSize   uint32   // Size of a block (in bytes)
+	Blocks      uint32   // Number of blocks in image
+	Entries     uint32   // Number of blocks stored
+	Compression uint32   // Codec the image was written with
+	Created     int64    // Creation time of the original image
+	UUID        [16]byte // Unique identifier of the original image
+}
+
+// CompactEntry locates a stored block in a compact image
+type CompactEntry struct {
+	Block  uint32      // Block number
+	Codec  Compression // Codec the payload is compressed with
+	_      [3]byte
+	Length uint32 // Size of payload (in bytes)
+	Offset uint64 // Offset of payload from start of image
+}
+
+// Return whether or not the file at path is a compact image
+func IsCompact(path string) (bool, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return false, err
+	}
+	defer file.Close()
+	magic := make([]byte, len(COMPACT_MAGIC))
+	if _, err := io.ReadFull(file, magic); err != nil {
+		return false, nil
+	}
+	return string(magic) == COMPACT_MAGIC, nil
+}
+
+// Write contents of dev as a compact image
+// w: Destination of the image
+// dev: Device to read blocks from
+// c: Codec to compress blocks with
+func WriteCompact(w io.Writer, dev BlockDevice, c Compression) error {
+	h := CompactHeader{
+		Version:     COMPACT_VERSION,
+		BlockSize:   uint32(dev.BlockSize()),
+		Blocks:      dev.Size(),
+		Compression: uint32(c),
+	}
+	copy(h.Magic[:], COMPACT_MAGIC)
+	if header := baseHeader(dev); header != nil {
+		h.Created = header.Created
+		h.UUID = header.UUID
+	}
+
+	enc, done, err := newCompressor(c)
+	if err != nil {
+		return fmt.Errorf("Unable to write compact image: %s", err.Error())
+	}
+	defer done()
+	var entries []CompactEntry
+	var payloads [][]byte
+	buf := make([]byte, dev.BlockSize())
+	zero := make([]byte, dev.BlockSize())
+	for i := 0; i < int(dev.Size()); i++ {
+		if _, err := dev.Read(i, buf); err != nil {
+			return fmt.Errorf("Unable to write compact image: %s", err.Error())
+		}
+		if bytes.Equal(buf, zero) {
+			continue
+		}
+		entry := CompactEntry{Block: uint32(i), Codec: CompressNone}
+		payload := append([]byte(nil), buf...)
+		if packed := enc(buf); packed != nil && len(packed) < len(buf) {
+			entry.Codec = c
+			payload = packed
+		}
+		entry.Length = uint32(len(payload))
+		entries = append(entries, entry)
+		payloads = append(payloads, payload)
+	}
+	h.Entries = uint32(len(entries))
+
+	offset := uint64(binary.Size(h) + len(entries)*binary.Size(CompactEntry{}))
+	for i := range entries {
+		entries[i].Offset = offset
+		offset += uint64(entries[i].Length)
+	}
+	out := bytes.NewBuffer(make([]byte, 0, offset))
+	out.Write(encode(&h))
+	out.Write(encode(entries))
+	for _, payload := range payloads {
+		out.Write(payload)
+	}
+	if _, err := w.Write(out.Bytes()); err != nil {
+		return fmt.Errorf("Unable to write compact image: %s", err.Error())
+	}
+	return nil
+}
+
+// Read a compact image into an in-memory disk
+// r: Source of the image
+func ReadCompact(r io.Reader) (*MemDisk, CompactHeader, error) {
+	var h CompactHeader
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, h, fmt.Errorf("Unable to read compact image: %s", err.Error())
+	}
+	if err := binary.Read(bytes.NewReader(data), binary.LittleEndian, &h); err != nil {
+		return nil, h, fmt.Errorf("Unable to read compact image: %s", err.Error())
+	}
+	if string(h.Magic[:]) != COMPACT_MAGIC {
+		return nil, h, errors.New("Unable to read compact image: not a compact image")
+	}
+	if h.Version != COMPACT_VERSION {
+		return nil, h, fmt.Errorf("Unable to read compact image: unsupported version %d", h.Version)
+	}
+	mem, err := NewMemDiskWithBlockSize(int(h.Blocks), int(h.BlockSize))
+	if err != nil {
+		return nil, h, fmt.Errorf("Unable to read compact image: %s", err.Error())
+	}
+	if h.Created != 0 {
+		mem.Header = &ImageHeader{Version: IMAGE_VERSION, BlockSize: h.BlockSize, Blocks: h.Blocks, Created: h.Created, UUID: h.UUID}
+		copy(mem.Header.Magic[:], IMAGE_MAGIC)
+	}
+
+	entries := make([]CompactEntry, h.Entries)
+	index := bytes.NewReader(data[binary.Size(h):])
+	if err := binary.Read(index, binary.LittleEndian, entries); err != nil {
+		return nil, h, fmt.Errorf("Unable to read compact image index: %s", err.Error())
+	}
+	dec, done, err := newDecompressor()
+	if err != nil {
+		return nil, h, fmt.Errorf("Unable to read compact image: %s", err.Error())
+	}
+	defer done()
+	for _, entry := range entries {
+		end := entry.Offset + uint64(entry.Length)
+		if end > uint64(len(data)) || entry.Block >= h.Blocks {
+			return nil, h, fmt.Errorf("Unable to read compact image: block %d is out of bounds", entry.Block)
+		}
+		block, err := dec(entry.Codec, data[entry.Offset:end])
+		if err == nil && len(block) != int(h.BlockSize) {
+			err = fmt.Errorf("expanded to %d bytes", len(block))
+		}
+		if err != nil {
+			return nil, h, fmt.Errorf("Unable to read compact image: block %d: %s", entry.Block, err.Error())
+		}
+		copy(mem.data[int(entry.Block)*mem.bs:], block)
+	}
+	return mem, h, nil
+}
+
+// return function compressing a block with c (to nil if c does not
+// compress) and function releasing its resources
+func newCompressor(c Compression) (func([]byte) []byte, func(), error) {
+	switch c {
+	case CompressNone:
+		return func([]byte) []byte { return nil }, func() {}, nil
+	case CompressDeflate:
+		return func(block []byte) []byte {
+			var out bytes.Buffer
+			// compressing into a buffer can not fail
+			w, _ := flate.NewWriter(&out, flate.BestCompression)
+			w.Write(block)
+			w.Close()
+			return out.Bytes()
+		}, func() {}, nil
+	case CompressZstd:
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedBestCompression), zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, nil, err
+		}
+		return func(block []byte) []byte { return enc.EncodeAll(block, nil) }, func() { enc.Close() }, nil
+	}
+	return nil, nil, fmt.Errorf("unknown compression %d", c)
+}
+
+// return function expanding a payload stored with a codec and function
+// releasing its resources
+func newDecompressor() (func(Compression, []byte) ([]byte, error), func(), error) {
+	zdec, err := zstd.NewReader(nil, zstd.WithDecoderConcurrency(1))
+	if err != nil {
+		return nil, nil, err
+	}
+	return func(c Compression, payload []byte) ([]byte, error) {
+		switch c {
+		case CompressNone:
+			return payload, nil
+		case CompressDeflate:
+			return io.ReadAll(flate.NewReader(bytes.NewReader(payload)))
+		case CompressZstd:
+			return zdec.DecodeAll(payload, nil)
+		}
+		return nil, fmt.Errorf("unknown compression %d", c)
+	}, zdec.Close, nil
+}
+
+var _ BlockDevice = (*CompactDisk)(nil)
+
+// CompactDisk keeps a compact image in memory and writes it back on Sync
+// and Close
+type CompactDisk struct {
+	*MemDisk
+	Path        string      // Path to compact image
+	Compression Compression // Codec blocks are written back with
+	dirty       bool        // Whether or not blocks changed since the image was written
+}
+
+// Load compact image at path
+func OpenCompact(path string) (*CompactDisk, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %s", path, err.Error())
+	}
+	defer file.Close()
+	mem, h, err := ReadCompact(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open %s: %s", path, err.Error())
+	}
+	mem.Name = path
+	return &CompactDisk{MemDisk: mem, Path: path, Compression: Compression(h.Compression)}, nil
+}
+
+// Write block to memory, the image is written back on Sync
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (c *CompactDisk) Write(blocknum int, data []byte) error {
+	if err := c.MemDisk.Write(blocknum, data); err != nil {
+		return err
+	}
+	c.dirty = true
+	return nil
+}
+
+// Write consecutive blocks to memory, the image is written back on Sync
+//
+// blocknum: First block to write to
+//
+// bufs: Buffers to write from, each holding a whole block
+func (c *CompactDisk) WriteBlocks(blocknum int, bufs [][]byte) error {
+	if err := c.MemDisk.WriteBlocks(blocknum, bufs); err != nil {
+		return err
+	}
+	c.dirty = true
+	return nil
+}
+
+// Release blocks in memory, the image is written back on Sync
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (c *CompactDisk) Trim(blocknum int, count int) error {
+	if err := c.MemDisk.Trim(blocknum, count); err != nil {
+		return err
+	}
+	c.dirty = true
+	return nil
+}
+
+// Write compact image back to its file (replacing it atomically) if any
+// block changed since it was last written
+func (c *CompactDisk) Sync() error {
+	if !c.dirty {
+		return nil
+	}
+	if err := SaveCompact(c.Path, c.MemDisk, c.Compression); err != nil {
+		return err
+	}
+	c.dirty = false
+	return nil
+}
+
+// Write compact image back to its file
+func (c *CompactDisk) Close() error {
+	return c.Sync()
+}
+
+// Return description of compact image
+func (c *CompactDisk) Report() []string {
+	stored := 0
+	zero := make([]byte, c.bs)
+	for i := 0; i < int(c.Blocks); i++ {
+		if !bytes.Equal(c.data[i*c.bs:(i+1)*c.bs], zero) {
+			stored++
+		}
+	}
+	return []string{fmt.Sprintf("compact image %s: %d of %d blocks stored (%s)", c.Path, stored, c.Blocks, c.Compression)}
+}
+
+// Write contents of dev as a compact image file (replacing it atomically)
+// path: Path to compact image
+// dev: Device to read blocks from
+// c: Codec to compress blocks with
+func SaveCompact(path string, dev BlockDevice, c Compression) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return fmt.Errorf("Unable to save %s: %s", path, err.Error())
+	}
+	defer os.Remove(tmp.Name())
+	if err := WriteCompact(tmp, dev, c); err != nil {
+		tmp.Close()
+		return fmt.Errorf("Unable to save %s: %s", path, err.Error())
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("Unable to save %s: %s", path, err.Error())
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("Unable to save %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// Convert raw image at src (with or without header) into a compact image
+// at dst
+func ConvertToCompact(src, dst string, c Compression) error {
+	mem, err := LoadMemDisk(src)
+	if err != nil {
+		return err
+	}
+	return SaveCompact(dst, mem, c)
+}
+
+// Convert compact image at src into a raw image (with header) at dst
+func ConvertToRaw(src, dst string) error {
+	compact, err := OpenCompact(src)
+	if err != nil {
+		return err
+	}
+	return compact.MemDisk.Save(dst)
+}
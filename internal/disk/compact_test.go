@@ -0,0 +1,179 @@
+package disk
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompact(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"round trip":        testCompactRoundTrip,
+		"zero blocks":       testCompactZeroBlocks,
+		"convert images":    testCompactConvert,
+		"write back":        testCompactWriteBack,
+		"clean image":       testCompactClean,
+		"invalid images":    testCompactInvalid,
+		"parse compression": testCompactParse,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// return contents of every block of dev
+func readAll(t *testing.T, dev BlockDevice) []byte {
+	var all []byte
+	buf := make([]byte, dev.BlockSize())
+	for i := 0; i < int(dev.Size()); i++ {
+		_, err := dev.Read(i, buf)
+		require.NoError(t, err)
+		all = append(all, buf...)
+	}
+	return all
+}
+
+func testCompactRoundTrip(t *testing.T) {
+	mem := NewMemDisk(8)
+	require.NoError(t, mem.Write(1, bytes.Repeat([]byte("compressible "), 300)))
+	random := make([]byte, BLOCK_SIZE)
+	for i := range random {
+		random[i] = byte(i*7919 + i*i*31)
+	}
+	require.NoError(t, mem.Write(6, random))
+
+	for _, c := range []Compression{CompressNone, CompressDeflate, CompressZstd} {
+		var image bytes.Buffer
+		require.NoError(t, WriteCompact(&image, mem, c))
+		if c != CompressNone {
+			require.Less(t, image.Len(), 2*BLOCK_SIZE, c.String())
+		}
+		img, h, err := ReadCompact(&image)
+		require.NoError(t, err, c.String())
+		require.Equal(t, uint32(c), h.Compression)
+		require.Equal(t, 2, int(h.Entries))
+		require.Equal(t, readAll(t, mem), readAll(t, img), c.String())
+	}
+}
+
+func testCompactZeroBlocks(t *testing.T) {
+	mem, err := NewMemDiskWithBlockSize(200, 1024)
+	require.NoError(t, err)
+	require.NoError(t, mem.Write(0, []byte("superblock")))
+	var image bytes.Buffer
+	require.NoError(t, WriteCompact(&image, mem, CompressNone))
+	require.Less(t, image.Len(), 1200)
+	img, h, err := ReadCompact(&image)
+	require.NoError(t, err)
+	require.Equal(t, 1, int(h.Entries))
+	require.Equal(t, 1024, img.BlockSize())
+	require.Equal(t, 200, int(img.Size()))
+	require.Equal(t, readAll(t, mem), readAll(t, img))
+}
+
+func testCompactConvert(t *testing.T) {
+	dir := t.TempDir()
+	compact := filepath.Join(dir, "image.200.sfsc")
+	raw := filepath.Join(dir, "image.200")
+	require.NoError(t, ConvertToCompact("../../data/image.200", compact, CompressZstd))
+	ok, err := IsCompact(compact)
+	require.NoError(t, err)
+	require.True(t, ok)
+	ok, err = IsCompact("../../data/image.200")
+	require.NoError(t, err)
+	require.False(t, ok)
+
+	info, err := os.Stat(compact)
+	require.NoError(t, err)
+	require.Less(t, info.Size(), int64(200*BLOCK_SIZE/4))
+
+	require.NoError(t, ConvertToRaw(compact, raw))
+	original, err := LoadMemDisk("../../data/image.200")
+	require.NoError(t, err)
+	converted, err := LoadMemDisk(raw)
+	require.NoError(t, err)
+	require.NotNil(t, converted.Header)
+	require.Equal(t, readAll(t, original), readAll(t, converted))
+}
+
+func testCompactWriteBack(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.sfsc")
+	mem := NewMemDisk(10)
+	// saving gives the disk a header to carry over
+	require.NoError(t, mem.Save(filepath.Join(t.TempDir(), "raw")))
+	require.NoError(t, SaveCompact(path, mem, CompressDeflate))
+
+	c, err := OpenCompact(path)
+	require.NoError(t, err)
+	require.Equal(t, CompressDeflate, c.Compression)
+	require.NoError(t, c.Write(3, []byte("written back")))
+	require.Contains(t, Report(c)[0], "1 of 10 blocks stored")
+	require.NoError(t, c.Close())
+
+	c, err = OpenCompact(path)
+	require.NoError(t, err)
+	require.Equal(t, mem.Header.UUID, c.Header.UUID)
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = c.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "written back", string(rdata[:12]))
+}
+
+func testCompactClean(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.sfsc")
+	require.NoError(t, SaveCompact(path, NewMemDisk(10), CompressDeflate))
+	c, err := OpenCompact(path)
+	require.NoError(t, err)
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+
+	// images without changes are left alone
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = c.Read(3, rdata)
+	require.NoError(t, err)
+	require.NoError(t, c.Sync())
+	require.NoError(t, c.Close())
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(info, after))
+
+	// changes are written once
+	c, err = OpenCompact(path)
+	require.NoError(t, err)
+	require.NoError(t, c.Trim(2, 1))
+	require.NoError(t, c.Sync())
+	synced, err := os.Stat(path)
+	require.NoError(t, err)
+	require.False(t, os.SameFile(info, synced))
+	require.NoError(t, c.Close())
+	after, err = os.Stat(path)
+	require.NoError(t, err)
+	require.True(t, os.SameFile(synced, after))
+}
+
+func testCompactInvalid(t *testing.T) {
+	_, _, err := ReadCompact(bytes.NewReader([]byte("SFSIMAGE")))
+	require.Error(t, err)
+	_, _, err = ReadCompact(bytes.NewReader(make([]byte, BLOCK_SIZE)))
+	require.Error(t, err)
+
+	var image bytes.Buffer
+	mem := NewMemDisk(2)
+	require.NoError(t, mem.Write(1, []byte("data")))
+	require.NoError(t, WriteCompact(&image, mem, CompressDeflate))
+	truncated := image.Bytes()[:image.Len()-4]
+	_, _, err = ReadCompact(bytes.NewReader(truncated))
+	require.Error(t, err)
+}
+
+func testCompactParse(t *testing.T) {
+	for _, c := range []Compression{CompressNone, CompressDeflate, CompressZstd} {
+		parsed, err := ParseCompression(c.String())
+		require.NoError(t, err)
+		require.Equal(t, c, parsed)
+	}
+	_, err := ParseCompression("lz4")
+	require.Error(t, err)
+}
@@ -0,0 +1,145 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"sync/atomic"
+)
+
+/*
+Linear concatenation of block devices
+
+The blocks of the members follow each other: block 0 of the second
+member comes right after the last block of the first one.
+*/
+
+var _ BlockDevice = (*Concat)(nil)
+
+// Concat joins its members into one larger device
+type Concat struct {
+	Counters
+	Members []BlockDevice
+	starts  []int // First block of every member, followed by size of device
+}
+
+// Concatenate members in order
+// members: Devices of the same block size
+func NewConcat(members ...BlockDevice) (*Concat, error) {
+	if len(members) == 0 {
+		return nil, errors.New("Unable to concatenate devices: no members")
+	}
+	starts := []int{0}
+	for i, member := range members {
+		if member.BlockSize() != members[0].BlockSize() {
+			return nil, fmt.Errorf("Unable to concatenate devices: member %d has blocks of %d bytes, not %d bytes",
+				i, member.BlockSize(), members[0].BlockSize())
+		}
+		starts = append(starts, starts[i]+int(member.Size()))
+	}
+	return &Concat{Members: members, starts: starts}, nil
+}
+
+// return member holding blocknum and the block number on that member
+func (c *Concat) locate(blocknum int) (member int, physical int) {
+	member = sort.SearchInts(c.starts, blocknum+1) - 1
+	return member, blocknum - c.starts[member]
+}
+
+// Return status lines of device and its members
+func (c *Concat) Report() []string {
+	lines := []string{fmt.Sprintf("concat: %d members, %d blocks", len(c.Members), c.Size())}
+	return append(lines, reportMembers(c.Members, func(i int) string {
+		return fmt.Sprintf("blocks %d-%d", c.starts[i], c.starts[i+1]-1)
+	})...)
+}
+
+// Return size of device (in terms of blocks)
+func (c *Concat) Size() uint32 {
+	return uint32(c.starts[len(c.Members)])
+}
+
+// Return size of a single block (in bytes)
+func (c *Concat) BlockSize() int {
+	return c.Members[0].BlockSize()
+}
+
+// Read block from the member holding it
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (c *Concat) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, c.Size()); err != nil {
+		return -1, err
+	}
+	member, physical := c.locate(blocknum)
+	n, err := c.Members[member].Read(physical, data)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to read %d: member %d: %w", blocknum, member, err)
+	}
+	atomic.AddUint32(&c.Reads, 1)
+	return n, nil
+}
+
+// Write block to the member holding it
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (c *Concat) Write(blocknum int, data []byte) error {
+	if err := checkBlock(blocknum, c.Size()); err != nil {
+		return err
+	}
+	member, physical := c.locate(blocknum)
+	if err := c.Members[member].Write(physical, data); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): member %d: %w", blocknum, member, err)
+	}
+	atomic.AddUint32(&c.Writes, 1)
+	return nil
+}
+
+// Release blocks on the members holding them
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (c *Concat) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, c.Size()); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, c.Size()); err != nil {
+		return err
+	}
+	for i := blocknum; i < blocknum+count; {
+		member, physical := c.locate(i)
+		run := c.starts[member+1] - i
+		if run > blocknum+count-i {
+			run = blocknum + count - i
+		}
+		if err := Trim(c.Members[member], physical, run); err != nil {
+			return fmt.Errorf("Unable to trim block (%d): member %d: %w", i, member, err)
+		}
+		i += run
+	}
+	atomic.AddUint32(&c.Trims, 1)
+	return nil
+}
+
+// Flush buffered writes of every member
+func (c *Concat) Sync() error {
+	for i, member := range c.Members {
+		if err := Sync(member); err != nil {
+			return fmt.Errorf("Unable to sync member %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Close every member
+func (c *Concat) Close() error {
+	return closeMembers(c.Members)
+}
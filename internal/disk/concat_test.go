@@ -0,0 +1,70 @@
+package disk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConcat(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"geometry": testConcatGeometry,
+		"layout":   testConcatLayout,
+		"trim":     testConcatTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testConcatGeometry(t *testing.T) {
+	_, err := NewConcat()
+	require.Error(t, err)
+	small, err := NewMemDiskWithBlockSize(10, 512)
+	require.NoError(t, err)
+	_, err = NewConcat(NewMemDisk(10), small)
+	require.Error(t, err)
+	c, err := NewConcat(NewMemDisk(10), NewMemDisk(3), NewMemDisk(7))
+	require.NoError(t, err)
+	require.Equal(t, 20, int(c.Size()))
+	require.Contains(t, c.Report()[2], "member 1: blocks 10-12")
+}
+
+func testConcatLayout(t *testing.T) {
+	a, b, c := NewMemDisk(4), NewMemDisk(1), NewMemDisk(3)
+	dev, err := NewConcat(a, b, c)
+	require.NoError(t, err)
+	fillBlocks(t, dev)
+	checkBlocks(t, dev)
+	require.Equal(t, 4, int(a.Writes))
+	require.Equal(t, 1, int(b.Writes))
+	require.Equal(t, 3, int(c.Writes))
+
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = b.Read(0, buf)
+	require.NoError(t, err)
+	require.Equal(t, 4, int(buf[0]))
+	_, err = c.Read(2, buf)
+	require.NoError(t, err)
+	require.Equal(t, 7, int(buf[0]))
+	require.Error(t, dev.Write(8, buf))
+	_, err = dev.Read(-1, buf)
+	require.Error(t, err)
+}
+
+func testConcatTrim(t *testing.T) {
+	a, b, c := NewMemDisk(4), NewMemDisk(1), NewMemDisk(3)
+	dev, err := NewConcat(a, b, c)
+	require.NoError(t, err)
+	fillBlocks(t, dev)
+	require.NoError(t, dev.Trim(2, 4))
+	require.Equal(t, 1, int(a.Trims))
+	require.Equal(t, 1, int(b.Trims))
+	require.Equal(t, 1, int(c.Trims))
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 8; i++ {
+		_, err := dev.Read(i, buf)
+		require.NoError(t, err)
+		require.Equal(t, i < 2 || i >= 6, buf[2] == 0xaa, "block %d", i)
+	}
+	require.Error(t, dev.Trim(6, 3))
+}
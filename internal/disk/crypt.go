@@ -0,0 +1,249 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/xts"
+)
+
+/*
+Encrypting block device (AES-XTS)
+
+The first block of the wrapped device holds a CryptHeader with the
+parameters of the key derivation function. Every other block is encrypted
+with AES-256-XTS keyed from the passphrase, using the block number as
+tweak.
+*/
+
+const (
+	CRYPT_MAGIC   = "SFSCRYPT"
+	CRYPT_VERSION = 1
+	CRYPT_KEY_LEN = 64 // Two AES-256 keys
+)
+
+var (
+	ErrBadPassphrase = errors.New("wrong passphrase")
+	ErrNotEncrypted  = errors.New("device is not encrypted")
+)
+
+// CryptParams are the scrypt cost parameters used to derive a key
+type CryptParams struct {
+	N int // CPU/memory cost (power of two)
+	R int // Block size
+	P int // Parallelism
+}
+
+// Cost recommended by scrypt for interactive logins
+var DefaultCryptParams = CryptParams{N: 1 << 15, R: 8, P: 1}
+
+// CryptHeader describes how the key of an encrypted device is derived
+type CryptHeader struct {
+	Magic    [8]byte  // Header magic (CRYPT_MAGIC)
+	Version  uint32   // Header format version
+	N        uint32   // scrypt CPU/memory cost
+	R        uint32   // scrypt block size
+	P        uint32   // scrypt parallelism
+	Salt     [32]byte // scrypt salt
+	KeyCheck [32]byte // HMAC-SHA256 of CRYPT_MAGIC under the derived key
+}
+
+var _ BlockDevice = (*CryptDisk)(nil)
+
+// CryptDisk encrypts every block written to the wrapped device
+type CryptDisk struct {
+	BlockDevice
+	Header CryptHeader
+	cipher *xts.Cipher
+}
+
+// Return whether or not dev starts with an encryption header
+func IsEncrypted(dev BlockDevice) (bool, error) {
+	header, err := readCryptHeader(dev)
+	if err != nil {
+		return false, err
+	}
+	return header != nil, nil
+}
+
+// Set up encryption on dev, destroying its contents
+// dev: Device to encrypt (its first block holds the header)
+// passphrase: Passphrase to derive the key from
+// params: Cost of the key derivation
+func FormatCrypt(dev BlockDevice, passphrase string, params CryptParams) (*CryptDisk, error) {
+	if dev.Size() < 2 {
+		return nil, errors.New("Unable to encrypt device: device too small")
+	}
+	h := CryptHeader{
+		Version: CRYPT_VERSION,
+		N:       uint32(params.N),
+		R:       uint32(params.R),
+		P:       uint32(params.P),
+	}
+	copy(h.Magic[:], CRYPT_MAGIC)
+	if _, err := rand.Read(h.Salt[:]); err != nil {
+		return nil, fmt.Errorf("Unable to encrypt device: %s", err.Error())
+	}
+	key, err := h.deriveKey(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to encrypt device: %s", err.Error())
+	}
+	copy(h.KeyCheck[:], keyCheck(key))
+
+	if err := dev.Write(0, encode(&h)); err != nil {
+		return nil, fmt.Errorf("Unable to encrypt device: %s", err.Error())
+	}
+	return newCryptDisk(dev, h, key)
+}
+
+// Unlock an encrypted device
+// dev: Device set up by FormatCrypt
+// passphrase: Passphrase the device was encrypted with
+func OpenCrypt(dev BlockDevice, passphrase string) (*CryptDisk, error) {
+	h, err := readCryptHeader(dev)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unlock device: %s", err.Error())
+	}
+	if h == nil {
+		return nil, fmt.Errorf("Unable to unlock device: %w", ErrNotEncrypted)
+	}
+	key, err := h.deriveKey(passphrase)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unlock device: %s", err.Error())
+	}
+	if !hmac.Equal(h.KeyCheck[:], keyCheck(key)) {
+		return nil, fmt.Errorf("Unable to unlock device: %w", ErrBadPassphrase)
+	}
+	return newCryptDisk(dev, *h, key)
+}
+
+func newCryptDisk(dev BlockDevice, h CryptHeader, key []byte) (*CryptDisk, error) {
+	if dev.BlockSize()%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("Unable to unlock device: block size %d is not a multiple of %d", dev.BlockSize(), aes.BlockSize)
+	}
+	cipher, err := xts.NewCipher(aes.NewCipher, key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to unlock device: %s", err.Error())
+	}
+	return &CryptDisk{BlockDevice: dev, Header: h, cipher: cipher}, nil
+}
+
+// read encryption header from first block of dev (nil if dev is not encrypted)
+func readCryptHeader(dev BlockDevice) (*CryptHeader, error) {
+	if dev.Size() == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, dev.BlockSize())
+	if _, err := dev.Read(0, buf); err != nil {
+		return nil, err
+	}
+	if string(buf[:len(CRYPT_MAGIC)]) != CRYPT_MAGIC {
+		return nil, nil
+	}
+	h := &CryptHeader{}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, h); err != nil {
+		return nil, err
+	}
+	if h.Version != CRYPT_VERSION {
+		return nil, fmt.Errorf("unsupported encryption header version %d", h.Version)
+	}
+	return h, nil
+}
+
+// derive the XTS key from passphrase
+func (h *CryptHeader) deriveKey(passphrase string) ([]byte, error) {
+	return scrypt.Key([]byte(passphrase), h.Salt[:], int(h.N), int(h.R), int(h.P), CRYPT_KEY_LEN)
+}
+
+// return value proving knowledge of key without revealing it
+func keyCheck(key []byte) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(CRYPT_MAGIC))
+	return mac.Sum(nil)
+}
+
+// Return wrapped device
+func (c *CryptDisk) Unwrap() BlockDevice {
+	return c.BlockDevice
+}
+
+// Return status lines of encryption and wrapped device
+func (c *CryptDisk) Report() []string {
+	lines := []string{fmt.Sprintf("crypt: aes-xts-256, scrypt N=%d r=%d p=%d", c.Header.N, c.Header.R, c.Header.P)}
+	return append(lines, Report(c.BlockDevice)...)
+}
+
+// Return size of disk (in terms of blocks), not counting the header
+func (c *CryptDisk) Size() uint32 {
+	return c.BlockDevice.Size() - 1
+}
+
+// Read and decrypt block from disk
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (c *CryptDisk) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, c.Size()); err != nil {
+		return -1, err
+	}
+	bs := c.BlockSize()
+	if len(data) < bs {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, bs)
+	}
+	buf := make([]byte, bs)
+	if _, err := c.BlockDevice.Read(blocknum+1, buf); err != nil {
+		return -1, err
+	}
+	c.cipher.Decrypt(data[:bs], buf, uint64(blocknum))
+	return bs, nil
+}
+
+// Encrypt and write block to disk
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (c *CryptDisk) Write(blocknum int, data []byte) error {
+	bs := c.BlockSize()
+	if bs < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, bs)
+	}
+	if err := checkBlock(blocknum, c.Size()); err != nil {
+		return err
+	}
+	// blocks are encrypted as a whole, short writes keep the rest of the block
+	plain := make([]byte, bs)
+	if len(data) < bs {
+		if _, err := c.Read(blocknum, plain); err != nil {
+			return err
+		}
+	}
+	copy(plain, data)
+	buf := make([]byte, bs)
+	c.cipher.Encrypt(buf, plain, uint64(blocknum))
+	return c.BlockDevice.Write(blocknum+1, buf)
+}
+
+// Flush buffered writes of the wrapped device
+func (c *CryptDisk) Sync() error {
+	return Sync(c.BlockDevice)
+}
+
+// Return bad blocks of the wrapped device behind the encryption header
+func (c *CryptDisk) BadBlocks() []int {
+	var bad []int
+	for _, blocknum := range BadBlocks(c.BlockDevice) {
+		if blocknum > 0 {
+			bad = append(bad, blocknum-1)
+		}
+	}
+	return bad
+}
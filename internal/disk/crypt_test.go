@@ -0,0 +1,143 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// cheap key derivation to keep tests fast
+var testCryptParams = CryptParams{N: 1 << 10, R: 8, P: 1}
+
+func TestCryptDisk(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"write and read": testCryptReadWrite,
+		"ciphertext":     testCryptCiphertext,
+		"unlock":         testCryptUnlock,
+		"short writes":   testCryptShortWrite,
+		"small blocks":   testCryptBlockSize,
+		"not encrypted":  testCryptNotEncrypted,
+		"sync":           testCryptSync,
+		"bad blocks":     testCryptBadBlocks,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testCryptReadWrite(t *testing.T) {
+	mem := NewMemDisk(10)
+	c, err := FormatCrypt(mem, "secret", testCryptParams)
+	require.NoError(t, err)
+	require.Equal(t, 9, int(c.Size()))
+	require.Equal(t, mem, c.Unwrap())
+
+	wdata := make([]byte, BLOCK_SIZE)
+	copy(wdata, "hello world!!")
+	require.NoError(t, c.Write(8, wdata))
+	rdata := make([]byte, BLOCK_SIZE)
+	n, err := c.Read(8, rdata)
+	require.NoError(t, err)
+	require.Equal(t, BLOCK_SIZE, n)
+	require.Equal(t, wdata, rdata)
+
+	require.Error(t, c.Write(9, wdata))
+	_, err = c.Read(9, rdata)
+	require.Error(t, err)
+	require.Contains(t, Report(c)[0], "aes-xts")
+}
+
+func testCryptCiphertext(t *testing.T) {
+	mem := NewMemDisk(4)
+	c, err := FormatCrypt(mem, "secret", testCryptParams)
+	require.NoError(t, err)
+	wdata := bytes.Repeat([]byte("fixture "), BLOCK_SIZE/8)
+	require.NoError(t, c.Write(0, wdata))
+	require.NoError(t, c.Write(1, wdata))
+
+	// the block number tweaks the cipher
+	raw1 := make([]byte, BLOCK_SIZE)
+	raw2 := make([]byte, BLOCK_SIZE)
+	_, err = mem.Read(1, raw1)
+	require.NoError(t, err)
+	_, err = mem.Read(2, raw2)
+	require.NoError(t, err)
+	require.False(t, bytes.Contains(raw1, []byte("fixture")))
+	require.NotEqual(t, raw1, raw2)
+}
+
+func testCryptUnlock(t *testing.T) {
+	mem := NewMemDisk(4)
+	c, err := FormatCrypt(mem, "secret", testCryptParams)
+	require.NoError(t, err)
+	require.NoError(t, c.Write(2, []byte("persisted")))
+
+	encrypted, err := IsEncrypted(mem)
+	require.NoError(t, err)
+	require.True(t, encrypted)
+
+	_, err = OpenCrypt(mem, "guess")
+	require.True(t, errors.Is(err, ErrBadPassphrase))
+
+	c, err = OpenCrypt(mem, "secret")
+	require.NoError(t, err)
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = c.Read(2, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "persisted", string(rdata[:9]))
+}
+
+func testCryptShortWrite(t *testing.T) {
+	c, err := FormatCrypt(NewMemDisk(4), "secret", testCryptParams)
+	require.NoError(t, err)
+	require.NoError(t, c.Write(0, []byte("hello world!!")))
+	require.NoError(t, c.Write(0, []byte("HELLO")))
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = c.Read(0, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO world!!", string(rdata[:13]))
+	require.Error(t, c.Write(0, make([]byte, BLOCK_SIZE+1)))
+}
+
+func testCryptBlockSize(t *testing.T) {
+	mem, err := NewMemDiskWithBlockSize(8, 512)
+	require.NoError(t, err)
+	c, err := FormatCrypt(mem, "secret", testCryptParams)
+	require.NoError(t, err)
+	require.Equal(t, 512, c.BlockSize())
+	wdata := bytes.Repeat([]byte{0xab}, 512)
+	require.NoError(t, c.Write(6, wdata))
+	rdata := make([]byte, 512)
+	_, err = c.Read(6, rdata)
+	require.NoError(t, err)
+	require.Equal(t, wdata, rdata)
+}
+
+func testCryptNotEncrypted(t *testing.T) {
+	mem := NewMemDisk(4)
+	encrypted, err := IsEncrypted(mem)
+	require.NoError(t, err)
+	require.False(t, encrypted)
+	_, err = OpenCrypt(mem, "secret")
+	require.True(t, errors.Is(err, ErrNotEncrypted))
+	_, err = FormatCrypt(NewMemDisk(1), "secret", testCryptParams)
+	require.Error(t, err)
+}
+
+func testCryptSync(t *testing.T) {
+	s := newSyncCounter(4)
+	c, err := FormatCrypt(s, "secret", testCryptParams)
+	require.NoError(t, err)
+	require.NoError(t, c.Write(0, []byte("hello")))
+	require.NoError(t, Sync(c))
+	require.Equal(t, 1, s.syncs)
+}
+
+func testCryptBadBlocks(t *testing.T) {
+	mem := &badBlockDisk{MemDisk: NewMemDisk(4), bad: []int{0, 2}}
+	c, err := FormatCrypt(mem, "secret", testCryptParams)
+	require.NoError(t, err)
+	// the header takes the first block of the device
+	require.Equal(t, []int{1}, BadBlocks(c))
+}
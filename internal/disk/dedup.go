@@ -0,0 +1,695 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Content-addressed deduplicating block store
+
+A DedupStore is a directory shared by any number of images. Its "blocks"
+file holds every distinct block once, in slots of the block size; its
+"index" file starts with a dedupHeader followed by one DedupSlot per slot,
+recording the SHA-256 of the slot and the number of image blocks referring
+to it. Every image is a block map in "images/<name>.map": a dedupMapHeader
+followed by one little-endian uint32 per block, 0 for a block of zeros
+(which is never stored) or its 1-based slot otherwise.
+
+Reference counts follow every write. Slots nobody refers to any more stay
+in the index, so writing the same data again picks them up, until GC
+recounts the references of all block maps and releases unreferenced slots.
+*/
+
+const (
+	DEDUP_MAGIC     = "SFSDEDUP"
+	DEDUP_MAP_MAGIC = "SFSDDMAP"
+	DEDUP_VERSION   = 1
+)
+
+// dedupHeader starts the index file of a store
+type dedupHeader struct {
+	Magic     [8]byte // Store magic (DEDUP_MAGIC)
+	Version   uint32  // Store format version
+	BlockSize uint32  // Size of a block (in bytes)
+}
+
+// DedupSlot describes a slot of the blocks file of a store
+type DedupSlot struct {
+	Hash [sha256.Size]byte // SHA-256 of the block (zero for free slots)
+	Refs uint32            // Number of image blocks referring to slot
+}
+
+// dedupMapHeader starts the block map of an image
+type dedupMapHeader struct {
+	Magic     [8]byte // Block map magic (DEDUP_MAP_MAGIC)
+	Version   uint32  // Store format version
+	BlockSize uint32  // Size of a block (in bytes)
+	Blocks    uint32  // Number of blocks in image
+}
+
+var (
+	dedupHeaderSize    = int64(binary.Size(dedupHeader{}))
+	dedupSlotSize      = int64(binary.Size(DedupSlot{}))
+	dedupMapHeaderSize = int64(binary.Size(dedupMapHeader{}))
+)
+
+// DedupUsage sums up the slots of a store
+type DedupUsage struct {
+	Stored       int // Number of blocks stored
+	Unreferenced int // Number of stored blocks no image refers to
+	References   int // Number of image blocks referring to stored blocks
+}
+
+// DedupStore keeps the blocks of many images, storing identical blocks once
+type DedupStore struct {
+	Dir       string // Directory holding the store
+	blockSize int
+	mu        sync.RWMutex
+	index     *os.File
+	data      *os.File
+	slots     []DedupSlot                  // Slot n is slots[n-1]
+	hashes    map[[sha256.Size]byte]uint32 // Slot holding every stored block
+	free      []uint32                     // Free slots, lowest last
+	open      map[string]*DedupDisk        // Images open in store
+}
+
+// Open the store in directory dir, creating it if it does not exist yet.
+// The store is locked for exclusive use while it is open.
+// dir: Directory holding the store
+// blockSize: Size of a block of a new store (0 for BLOCK_SIZE or the size of an existing store)
+func OpenDedupStore(dir string, blockSize int) (*DedupStore, error) {
+	if blockSize != 0 {
+		if err := ValidBlockSize(blockSize); err != nil {
+			return nil, fmt.Errorf("Unable to open store %s: %s", dir, err.Error())
+		}
+	}
+	if err := os.MkdirAll(filepath.Join(dir, "images"), 0700); err != nil {
+		return nil, fmt.Errorf("Unable to open store %s: %s", dir, err.Error())
+	}
+	index, err := os.OpenFile(filepath.Join(dir, "index"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open store %s: %s", dir, err.Error())
+	}
+	if err := lockFile(index, false); err != nil {
+		index.Close()
+		if errors.Is(err, ErrLocked) {
+			return nil, fmt.Errorf("Unable to open store %s: %w", dir, err)
+		}
+		return nil, fmt.Errorf("Unable to lock store %s: %s", dir, err.Error())
+	}
+	s := &DedupStore{Dir: dir, index: index, hashes: map[[sha256.Size]byte]uint32{}, open: map[string]*DedupDisk{}}
+	if err := s.load(blockSize); err != nil {
+		index.Close()
+		return nil, fmt.Errorf("Unable to open store %s: %s", dir, err.Error())
+	}
+	s.data, err = os.OpenFile(filepath.Join(dir, "blocks"), os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		index.Close()
+		return nil, fmt.Errorf("Unable to open store %s: %s", dir, err.Error())
+	}
+	return s, nil
+}
+
+// read header and slots of index file, initializing an empty file
+func (s *DedupStore) load(blockSize int) error {
+	info, err := s.index.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		if blockSize == 0 {
+			blockSize = BLOCK_SIZE
+		}
+		header := dedupHeader{Version: DEDUP_VERSION, BlockSize: uint32(blockSize)}
+		copy(header.Magic[:], DEDUP_MAGIC)
+		if _, err := s.index.WriteAt(encode(header), 0); err != nil {
+			return err
+		}
+		s.blockSize = blockSize
+		return nil
+	}
+
+	contents, err := io.ReadAll(io.NewSectionReader(s.index, 0, info.Size()))
+	if err != nil {
+		return fmt.Errorf("unable to read index: %s", err.Error())
+	}
+	reader := bytes.NewReader(contents)
+	var header dedupHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return fmt.Errorf("unable to read index: %s", err.Error())
+	}
+	if string(header.Magic[:]) != DEDUP_MAGIC {
+		return errors.New("not a dedup store")
+	}
+	if header.Version != DEDUP_VERSION {
+		return fmt.Errorf("unsupported store version %d", header.Version)
+	}
+	if err := ValidBlockSize(int(header.BlockSize)); err != nil {
+		return err
+	}
+	if blockSize != 0 && blockSize != int(header.BlockSize) {
+		return fmt.Errorf("store has a block size of %d bytes, not %d", header.BlockSize, blockSize)
+	}
+	if (info.Size()-dedupHeaderSize)%dedupSlotSize != 0 {
+		return errors.New("index is truncated")
+	}
+	s.blockSize = int(header.BlockSize)
+	s.slots = make([]DedupSlot, (info.Size()-dedupHeaderSize)/dedupSlotSize)
+	if err := binary.Read(reader, binary.LittleEndian, s.slots); err != nil {
+		return fmt.Errorf("unable to read index: %s", err.Error())
+	}
+	for i := len(s.slots) - 1; i >= 0; i-- {
+		if s.slots[i].Hash == ([sha256.Size]byte{}) {
+			s.free = append(s.free, uint32(i+1))
+		} else {
+			s.hashes[s.slots[i].Hash] = uint32(i + 1)
+		}
+	}
+	return nil
+}
+
+// Return size of a block (in bytes)
+func (s *DedupStore) BlockSize() int {
+	return s.blockSize
+}
+
+// Return names of the images in store
+func (s *DedupStore) Images() ([]string, error) {
+	entries, err := os.ReadDir(filepath.Join(s.Dir, "images"))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list images: %s", err.Error())
+	}
+	names := []string{}
+	for _, entry := range entries {
+		if name := strings.TrimSuffix(entry.Name(), ".map"); name != entry.Name() {
+			names = append(names, name)
+		}
+	}
+	return names, nil
+}
+
+// Return usage of the slots of store
+func (s *DedupStore) Usage() DedupUsage {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var usage DedupUsage
+	for _, slot := range s.slots {
+		if slot.Hash == ([sha256.Size]byte{}) {
+			continue
+		}
+		usage.Stored++
+		usage.References += int(slot.Refs)
+		if slot.Refs == 0 {
+			usage.Unreferenced++
+		}
+	}
+	return usage
+}
+
+// return path of block map of image name
+func (s *DedupStore) mapPath(name string) string {
+	return filepath.Join(s.Dir, "images", name+".map")
+}
+
+// Open image name in store, creating it if it does not exist yet. Existing
+// images keep their size unless nblocks asks for a larger one; they are
+// never shrunk.
+// name: Name of image
+// nblocks: Number of blocks in image (0 to use size of existing image)
+func (s *DedupStore) Open(name string, nblocks int) (*DedupDisk, error) {
+	if name == "" || filepath.Base(name) != name || strings.HasPrefix(name, ".") {
+		return nil, fmt.Errorf("Unable to open image %q: invalid name", name)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.open[name]; ok {
+		return nil, fmt.Errorf("Unable to open image %s: image is already open", name)
+	}
+	flags := os.O_RDWR
+	if nblocks > 0 {
+		flags |= os.O_CREATE
+	}
+	file, err := os.OpenFile(s.mapPath(name), flags, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open image %s: %s", name, err.Error())
+	}
+	d := &DedupDisk{Name: name, Store: s, file: file}
+	if err := d.load(nblocks); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to open image %s: %s", name, err.Error())
+	}
+	s.open[name] = d
+	return d, nil
+}
+
+// Drop image name and its references to stored blocks. The blocks stay
+// in the store until the next GC.
+// name: Name of image
+func (s *DedupStore) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.open[name]; ok {
+		return fmt.Errorf("Unable to remove image %s: image is open", name)
+	}
+	slots, err := s.readMap(name)
+	if err != nil {
+		return fmt.Errorf("Unable to remove image %s: %s", name, err.Error())
+	}
+	if err := os.Remove(s.mapPath(name)); err != nil {
+		return fmt.Errorf("Unable to remove image %s: %s", name, err.Error())
+	}
+	for _, slot := range slots {
+		if err := s.release(slot); err != nil {
+			return fmt.Errorf("Unable to remove image %s: %s", name, err.Error())
+		}
+	}
+	return nil
+}
+
+// read slots of block map of image name
+func (s *DedupStore) readMap(name string) ([]uint32, error) {
+	contents, err := os.ReadFile(s.mapPath(name))
+	if err != nil {
+		return nil, err
+	}
+	reader := bytes.NewReader(contents)
+	var header dedupMapHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("unable to read block map: %s", err.Error())
+	}
+	if string(header.Magic[:]) != DEDUP_MAP_MAGIC {
+		return nil, errors.New("not a block map")
+	}
+	if header.Version != DEDUP_VERSION {
+		return nil, fmt.Errorf("unsupported block map version %d", header.Version)
+	}
+	if int(header.BlockSize) != s.blockSize {
+		return nil, fmt.Errorf("block map has a block size of %d bytes, not %d", header.BlockSize, s.blockSize)
+	}
+	slots := make([]uint32, header.Blocks)
+	if err := binary.Read(reader, binary.LittleEndian, slots); err != nil {
+		return nil, fmt.Errorf("unable to read block map: %s", err.Error())
+	}
+	for blocknum, slot := range slots {
+		if int(slot) > len(s.slots) {
+			return nil, fmt.Errorf("block %d refers to missing slot %d", blocknum, slot)
+		}
+	}
+	return slots, nil
+}
+
+// Recount references of every image in the store and release the slots
+// no image refers to, returning their number
+func (s *DedupStore) GC() (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, err := s.Images()
+	if err != nil {
+		return 0, err
+	}
+	refs := make([]uint32, len(s.slots))
+	for _, name := range names {
+		slots, err := s.readMap(name)
+		if err != nil {
+			return 0, fmt.Errorf("Unable to collect garbage: image %s: %s", name, err.Error())
+		}
+		for _, slot := range slots {
+			if slot != 0 {
+				refs[slot-1]++
+			}
+		}
+	}
+
+	released := 0
+	for i := range s.slots {
+		slot := &s.slots[i]
+		if slot.Refs == refs[i] && (refs[i] > 0 || slot.Hash == ([sha256.Size]byte{})) {
+			continue
+		}
+		slot.Refs = refs[i]
+		if refs[i] == 0 {
+			delete(s.hashes, slot.Hash)
+			slot.Hash = [sha256.Size]byte{}
+			bs := int64(s.blockSize)
+			if err := punchHole(s.data, int64(i)*bs, bs); err != nil {
+				return released, fmt.Errorf("Unable to collect garbage: %s", err.Error())
+			}
+			released++
+		}
+		if err := s.writeSlot(uint32(i + 1)); err != nil {
+			return released, fmt.Errorf("Unable to collect garbage: %s", err.Error())
+		}
+	}
+
+	// free slots at the end are dropped from the files
+	used := len(s.slots)
+	for used > 0 && s.slots[used-1].Hash == ([sha256.Size]byte{}) {
+		used--
+	}
+	if err := s.index.Truncate(dedupHeaderSize + int64(used)*dedupSlotSize); err != nil {
+		return released, fmt.Errorf("Unable to collect garbage: %s", err.Error())
+	}
+	if err := s.data.Truncate(int64(used) * int64(s.blockSize)); err != nil {
+		return released, fmt.Errorf("Unable to collect garbage: %s", err.Error())
+	}
+	s.slots = s.slots[:used]
+	s.free = s.free[:0]
+	for i := used - 1; i >= 0; i-- {
+		if s.slots[i].Hash == ([sha256.Size]byte{}) {
+			s.free = append(s.free, uint32(i+1))
+		}
+	}
+	return released, nil
+}
+
+// write slot into index file
+func (s *DedupStore) writeSlot(slot uint32) error {
+	_, err := s.index.WriteAt(encode(s.slots[slot-1]), dedupHeaderSize+int64(slot-1)*dedupSlotSize)
+	return err
+}
+
+// add a reference to the slot holding block, storing it in a new slot if
+// no slot holds it yet. Blocks of zeros are not stored (slot 0).
+func (s *DedupStore) store(block []byte) (uint32, error) {
+	if isZero(block) {
+		return 0, nil
+	}
+	hash := sha256.Sum256(block)
+	slot, ok := s.hashes[hash]
+	if !ok {
+		if n := len(s.free); n > 0 {
+			slot = s.free[n-1]
+			s.free = s.free[:n-1]
+		} else {
+			s.slots = append(s.slots, DedupSlot{})
+			slot = uint32(len(s.slots))
+		}
+		// the slot is written before the index refers to it
+		if _, err := s.data.WriteAt(block, int64(slot-1)*int64(s.blockSize)); err != nil {
+			s.free = append(s.free, slot)
+			return 0, err
+		}
+		s.slots[slot-1].Hash = hash
+		s.hashes[hash] = slot
+	}
+	s.slots[slot-1].Refs++
+	return slot, s.writeSlot(slot)
+}
+
+// drop a reference to slot
+func (s *DedupStore) release(slot uint32) error {
+	if slot == 0 || s.slots[slot-1].Refs == 0 {
+		return nil
+	}
+	s.slots[slot-1].Refs--
+	return s.writeSlot(slot)
+}
+
+// Flush blocks file and index to stable storage
+func (s *DedupStore) Sync() error {
+	if err := s.data.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync store: %s", err.Error())
+	}
+	if err := s.index.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync store: %s", err.Error())
+	}
+	return nil
+}
+
+// Close store and every image open in it
+func (s *DedupStore) Close() error {
+	for _, d := range s.openImages() {
+		d.Close()
+	}
+	if err := s.data.Close(); err != nil {
+		s.index.Close()
+		return fmt.Errorf("Unable to close store: %s", err.Error())
+	}
+	if err := s.index.Close(); err != nil {
+		return fmt.Errorf("Unable to close store: %s", err.Error())
+	}
+	return nil
+}
+
+// return images open in store
+func (s *DedupStore) openImages() []*DedupDisk {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	images := make([]*DedupDisk, 0, len(s.open))
+	for _, d := range s.open {
+		images = append(images, d)
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].Name < images[j].Name })
+	return images
+}
+
+// return whether or not block holds only zeros
+func isZero(block []byte) bool {
+	for _, b := range block {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+var _ BlockDevice = (*DedupDisk)(nil)
+
+// DedupDisk is an image kept in a DedupStore
+type DedupDisk struct {
+	Counters
+	Name      string      // Name of image in store
+	Store     *DedupStore // Store holding the blocks of image
+	file      *os.File    // Block map
+	slots     []uint32    // Slot of every block (0 for blocks of zeros)
+	ownsStore bool        // Whether or not closing image closes store
+}
+
+// Open image name in the store in directory dir, creating both if they do
+// not exist yet. Closing the image closes the store.
+// dir: Directory holding the store
+// name: Name of image
+// nblocks: Number of blocks in image (0 to use size of existing image)
+// blockSize: Size of a block of a new store (0 for BLOCK_SIZE or the size of an existing store)
+func OpenDedup(dir string, name string, nblocks int, blockSize int) (*DedupDisk, error) {
+	s, err := OpenDedupStore(dir, blockSize)
+	if err != nil {
+		return nil, err
+	}
+	d, err := s.Open(name, nblocks)
+	if err != nil {
+		s.Close()
+		return nil, err
+	}
+	d.ownsStore = true
+	return d, nil
+}
+
+// read header and slots of block map, initializing or growing it to
+// nblocks blocks
+func (d *DedupDisk) load(nblocks int) error {
+	info, err := d.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() > 0 {
+		if d.slots, err = d.Store.readMap(d.Name); err != nil {
+			return err
+		}
+	}
+	if nblocks < len(d.slots) && nblocks != 0 {
+		return fmt.Errorf("image has %d blocks, refusing to shrink it to %d", len(d.slots), nblocks)
+	}
+	if nblocks <= len(d.slots) {
+		return nil
+	}
+	// grown blocks read as zeros
+	header := dedupMapHeader{Version: DEDUP_VERSION, BlockSize: uint32(d.Store.blockSize), Blocks: uint32(nblocks)}
+	copy(header.Magic[:], DEDUP_MAP_MAGIC)
+	if err := d.file.Truncate(dedupMapHeaderSize + 4*int64(nblocks)); err != nil {
+		return err
+	}
+	if _, err := d.file.WriteAt(encode(header), 0); err != nil {
+		return err
+	}
+	d.slots = append(d.slots, make([]uint32, nblocks-len(d.slots))...)
+	return nil
+}
+
+// write block map entries of count blocks starting at blocknum
+func (d *DedupDisk) writeMap(blocknum int, count int) error {
+	buf := make([]byte, 4*count)
+	for i := 0; i < count; i++ {
+		binary.LittleEndian.PutUint32(buf[4*i:], d.slots[blocknum+i])
+	}
+	_, err := d.file.WriteAt(buf, dedupMapHeaderSize+4*int64(blocknum))
+	return err
+}
+
+// Return status lines of image and store
+func (d *DedupDisk) Report() []string {
+	usage := d.Store.Usage()
+	d.Store.mu.RLock()
+	distinct := map[uint32]bool{}
+	for _, slot := range d.slots {
+		if slot != 0 {
+			distinct[slot] = true
+		}
+	}
+	d.Store.mu.RUnlock()
+	return []string{
+		fmt.Sprintf("dedup %s: image %s, %d blocks of %d bytes, %d distinct blocks stored", d.Store.Dir, d.Name, d.Size(), d.BlockSize(), len(distinct)),
+		fmt.Sprintf("    store: %d blocks stored for %d references, %d unreferenced", usage.Stored, usage.References, usage.Unreferenced),
+	}
+}
+
+// Return size of image (in terms of blocks)
+func (d *DedupDisk) Size() uint32 {
+	return uint32(len(d.slots))
+}
+
+// Return size of a single block (in bytes)
+func (d *DedupDisk) BlockSize() int {
+	return d.Store.blockSize
+}
+
+// Read block from the store
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (d *DedupDisk) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, d.Size()); err != nil {
+		return -1, err
+	}
+	bs := d.BlockSize()
+	if len(data) < bs {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, bs)
+	}
+	d.Store.mu.RLock()
+	defer d.Store.mu.RUnlock()
+	slot := d.slots[blocknum]
+	if slot == 0 {
+		for i := range data[:bs] {
+			data[i] = 0
+		}
+	} else if _, err := d.Store.data.ReadAt(data[:bs], int64(slot-1)*int64(bs)); err != nil {
+		return -1, fmt.Errorf("Unable to read %d: %s", blocknum, err.Error())
+	}
+	atomic.AddUint32(&d.Reads, 1)
+	return bs, nil
+}
+
+// Write block into the store, sharing the slot of an identical block
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (d *DedupDisk) Write(blocknum int, data []byte) error {
+	bs := d.BlockSize()
+	if bs < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, bs)
+	}
+	if err := checkBlock(blocknum, d.Size()); err != nil {
+		return err
+	}
+	d.Store.mu.Lock()
+	defer d.Store.mu.Unlock()
+	old := d.slots[blocknum]
+	block := make([]byte, bs)
+	if len(data) < bs && old != 0 {
+		// short writes keep the rest of the block
+		if _, err := d.Store.data.ReadAt(block, int64(old-1)*int64(bs)); err != nil {
+			return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+		}
+	}
+	copy(block, data)
+	slot, err := d.Store.store(block)
+	if err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+	}
+	// the old slot is released once the map no longer refers to it
+	d.slots[blocknum] = slot
+	if err := d.writeMap(blocknum, 1); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+	}
+	if err := d.Store.release(old); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+	}
+	atomic.AddUint32(&d.Writes, 1)
+	return nil
+}
+
+// Drop references of blocks, which read as zeros afterwards
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (d *DedupDisk) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, d.Size()); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, d.Size()); err != nil {
+		return err
+	}
+	d.Store.mu.Lock()
+	defer d.Store.mu.Unlock()
+	old := make([]uint32, count)
+	copy(old, d.slots[blocknum:blocknum+count])
+	for i := range old {
+		d.slots[blocknum+i] = 0
+	}
+	if err := d.writeMap(blocknum, count); err != nil {
+		return fmt.Errorf("Unable to trim blocks (%d-%d): %s", blocknum, blocknum+count-1, err.Error())
+	}
+	for _, slot := range old {
+		if err := d.Store.release(slot); err != nil {
+			return fmt.Errorf("Unable to trim blocks (%d-%d): %s", blocknum, blocknum+count-1, err.Error())
+		}
+	}
+	atomic.AddUint32(&d.Trims, 1)
+	return nil
+}
+
+// Flush block map and store to stable storage
+func (d *DedupDisk) Sync() error {
+	if err := d.file.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync image %s: %s", d.Name, err.Error())
+	}
+	return d.Store.Sync()
+}
+
+// Close image, and the store if it was opened along with the image
+func (d *DedupDisk) Close() error {
+	d.Store.mu.Lock()
+	_, open := d.Store.open[d.Name]
+	delete(d.Store.open, d.Name)
+	d.Store.mu.Unlock()
+	if !open {
+		return nil
+	}
+	err := d.file.Close()
+	if d.ownsStore {
+		if serr := d.Store.Close(); err == nil {
+			err = serr
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to close image %s: %s", d.Name, err.Error())
+	}
+	return nil
+}
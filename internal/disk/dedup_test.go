@@ -0,0 +1,220 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedup(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"shared blocks": testDedupShared,
+		"reopen":        testDedupReopen,
+		"overwrite":     testDedupOverwrite,
+		"trim":          testDedupTrim,
+		"gc":            testDedupGC,
+		"geometry":      testDedupGeometry,
+		"locking":       testDedupLocking,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// open store in a temporary directory, closed at the end of the test
+func tempStore(t *testing.T) *DedupStore {
+	s, err := OpenDedupStore(filepath.Join(t.TempDir(), "store"), 0)
+	require.NoError(t, err)
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+// return size of blocks file of store
+func storedBytes(t *testing.T, s *DedupStore) int {
+	info, err := os.Stat(filepath.Join(s.Dir, "blocks"))
+	require.NoError(t, err)
+	return int(info.Size())
+}
+
+func testDedupShared(t *testing.T) {
+	s := tempStore(t)
+	a, err := s.Open("a", 8)
+	require.NoError(t, err)
+	b, err := s.Open("b", 8)
+	require.NoError(t, err)
+	fillBlocks(t, a)
+	fillBlocks(t, b)
+	checkBlocks(t, a)
+	checkBlocks(t, b)
+	require.Equal(t, DedupUsage{Stored: 8, References: 16}, s.Usage())
+	require.Equal(t, 8*BLOCK_SIZE, storedBytes(t, s))
+
+	// identical blocks within an image are stored once, zeros not at all
+	for i := 0; i < 8; i++ {
+		require.NoError(t, a.Write(i, []byte("same")))
+	}
+	require.NoError(t, a.Write(3, make([]byte, BLOCK_SIZE)))
+	require.Equal(t, DedupUsage{Stored: 9, References: 15}, s.Usage())
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = a.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), rdata)
+	_, err = a.Read(4, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "same", string(rdata[:4]))
+	checkBlocks(t, b)
+	require.Equal(t, Stats{Reads: 10, Writes: 17}, a.Stats())
+	require.Contains(t, a.Report()[0], "image a, 8 blocks of 4096 bytes, 1 distinct blocks stored")
+	require.Contains(t, a.Report()[1], "9 blocks stored for 15 references, 0 unreferenced")
+
+	_, err = s.Open("a", 0)
+	require.Error(t, err)
+	_, err = s.Open("../a", 8)
+	require.Error(t, err)
+}
+
+func testDedupReopen(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	d, err := OpenDedup(dir, "image", 8, 0)
+	require.NoError(t, err)
+	fillBlocks(t, d)
+	require.NoError(t, d.Sync())
+	require.NoError(t, d.Close())
+
+	d, err = OpenDedup(dir, "image", 0, 0)
+	require.NoError(t, err)
+	require.Equal(t, 8, int(d.Size()))
+	checkBlocks(t, d)
+	require.NoError(t, d.Close())
+
+	// images grow but never shrink
+	_, err = OpenDedup(dir, "image", 4, 0)
+	require.Error(t, err)
+	d, err = OpenDedup(dir, "image", 12, 0)
+	require.NoError(t, err)
+	require.Equal(t, 12, int(d.Size()))
+	require.Equal(t, 8, d.Store.Usage().Stored)
+	require.NoError(t, d.Close())
+	_, err = OpenDedup(dir, "missing", 0, 0)
+	require.Error(t, err)
+	_, err = OpenDedup(dir, "image", 0, 1024)
+	require.Error(t, err)
+}
+
+func testDedupOverwrite(t *testing.T) {
+	s := tempStore(t)
+	a, err := s.Open("a", 4)
+	require.NoError(t, err)
+	b, err := s.Open("b", 4)
+	require.NoError(t, err)
+	require.NoError(t, a.Write(0, []byte("shared")))
+	require.NoError(t, b.Write(0, []byte("shared")))
+
+	// short writes change a copy, leaving the other image alone
+	require.NoError(t, a.Write(0, []byte("SH")))
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = a.Read(0, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "SHared", string(rdata[:6]))
+	_, err = b.Read(0, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "shared", string(rdata[:6]))
+	require.Equal(t, DedupUsage{Stored: 2, References: 2}, s.Usage())
+
+	// blocks nobody refers to are kept for reuse until collected
+	require.NoError(t, b.Write(0, []byte("other")))
+	require.Equal(t, DedupUsage{Stored: 3, References: 2, Unreferenced: 1}, s.Usage())
+	require.NoError(t, b.Write(1, []byte("shared")))
+	require.Equal(t, DedupUsage{Stored: 3, References: 3}, s.Usage())
+	require.Error(t, a.Write(4, rdata))
+	require.Error(t, a.Write(0, make([]byte, BLOCK_SIZE+1)))
+}
+
+func testDedupTrim(t *testing.T) {
+	s := tempStore(t)
+	d, err := s.Open("image", 8)
+	require.NoError(t, err)
+	fillBlocks(t, d)
+	require.NoError(t, Trim(d, 2, 3))
+	require.Equal(t, 1, int(d.Stats().Trims))
+	require.Equal(t, DedupUsage{Stored: 8, References: 5, Unreferenced: 3}, s.Usage())
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = d.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), rdata)
+	require.Error(t, d.Trim(6, 3))
+}
+
+func testDedupGC(t *testing.T) {
+	s := tempStore(t)
+	a, err := s.Open("a", 8)
+	require.NoError(t, err)
+	fillBlocks(t, a)
+	b, err := s.Open("b", 8)
+	require.NoError(t, err)
+	fillBlocks(t, b)
+	require.NoError(t, b.Close())
+	require.NoError(t, a.Trim(4, 4))
+	rdata := make([]byte, BLOCK_SIZE)
+	released, err := s.GC()
+	require.NoError(t, err)
+	require.Equal(t, 0, released)
+
+	// blocks of removed images are released, freed slots get reused
+	require.Error(t, s.Remove("a"))
+	require.NoError(t, s.Remove("b"))
+	names, err := s.Images()
+	require.NoError(t, err)
+	require.Equal(t, []string{"a"}, names)
+	released, err = s.GC()
+	require.NoError(t, err)
+	require.Equal(t, 4, released)
+	require.Equal(t, DedupUsage{Stored: 4, References: 4}, s.Usage())
+	require.Equal(t, 4*BLOCK_SIZE, storedBytes(t, s))
+	for i := 0; i < 4; i++ {
+		_, err = a.Read(i, rdata)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i), 0, 0xaa}, rdata[:3], "block %d", i)
+	}
+	require.NoError(t, a.Write(7, []byte("new")))
+	require.Equal(t, 5*BLOCK_SIZE, storedBytes(t, s))
+
+	// counts that went wrong are repaired
+	s.slots[0].Refs = 7
+	released, err = s.GC()
+	require.NoError(t, err)
+	require.Equal(t, 0, released)
+	require.Equal(t, DedupUsage{Stored: 5, References: 5}, s.Usage())
+}
+
+func testDedupGeometry(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "store")
+	s, err := OpenDedupStore(dir, 512)
+	require.NoError(t, err)
+	d, err := s.Open("image", 4)
+	require.NoError(t, err)
+	require.Equal(t, 512, d.BlockSize())
+	fillBlocks(t, d)
+	require.NoError(t, s.Close())
+	_, err = OpenDedupStore(dir, 4096)
+	require.Error(t, err)
+	_, err = OpenDedupStore(dir, 1000)
+	require.Error(t, err)
+	s, err = OpenDedupStore(dir, 0)
+	require.NoError(t, err)
+	defer s.Close()
+	d, err = s.Open("image", 0)
+	require.NoError(t, err)
+	checkBlocks(t, d)
+}
+
+func testDedupLocking(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("image locking is only supported on Linux")
+	}
+	s := tempStore(t)
+	_, err := OpenDedupStore(s.Dir, 0)
+	require.ErrorIs(t, err, ErrLocked)
+}
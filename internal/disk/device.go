@@ -0,0 +1,290 @@
+package disk
+
+import (
+	"fmt"
+	"sync/atomic"
+)
+
+/*
+Block device abstraction
+*/
+
+// BlockDevice is the interface the filesystem uses to talk to storage.
+// Disk is the file-backed implementation; other devices may keep their
+// blocks in memory, wrap another device or live somewhere else entirely.
+type BlockDevice interface {
+	// Read block blocknum into data, returning the number of bytes read
+	Read(blocknum int, data []byte) (int, error)
+	// Write data into block blocknum
+	Write(blocknum int, data []byte) error
+	// Return size of device (in terms of blocks)
+	Size() uint32
+	// Return size of a single block (in bytes)
+	BlockSize() int
+	// Return I/O statistics of device
+	Stats() Stats
+	// Increment mounts
+	Mount()
+	// Decrement mounts
+	UnMount()
+	// Release any resources held by device
+	Close() error
+}
+
+// Stats holds the counters every block device keeps
+type Stats struct {
+	Reads  uint32 // Number of total reads performed on device
+	Writes uint32 // Number of total writes performed on device
+	Mounts uint32 // Number of total mounts
+	Trims  uint32 // Number of total trims performed on device
+}
+
+// Counters count the I/O of a device. Devices embed them for their Stats,
+// Mount and UnMount; counters are updated atomically.
+type Counters struct {
+	Reads  uint32 // Number of total reads performed on device
+	Writes uint32 // Number of total writes performed on device
+	Trims  uint32 // Number of total trims performed on device
+	Mounts uint32 // Number of total mounts
+}
+
+// Return I/O statistics of device
+func (c *Counters) Stats() Stats {
+	return Stats{
+		Reads:  atomic.LoadUint32(&c.Reads),
+		Writes: atomic.LoadUint32(&c.Writes),
+		Mounts: atomic.LoadUint32(&c.Mounts),
+		Trims:  atomic.LoadUint32(&c.Trims),
+	}
+}
+
+// Increment mounts
+func (c *Counters) Mount() {
+	atomic.AddUint32(&c.Mounts, 1)
+}
+
+// Decrement mounts
+func (c *Counters) UnMount() {
+	for {
+		mounts := atomic.LoadUint32(&c.Mounts)
+		if mounts == 0 || atomic.CompareAndSwapUint32(&c.Mounts, mounts, mounts-1) {
+			return
+		}
+	}
+}
+
+// Op identifies the kind of a block operation
+type Op int
+
+const (
+	OpRead Op = iota
+	OpWrite
+	OpTrim
+)
+
+func (op Op) String() string {
+	switch op {
+	case OpRead:
+		return "read"
+	case OpWrite:
+		return "write"
+	case OpTrim:
+		return "trim"
+	}
+	return "unknown"
+}
+
+// Syncer is implemented by devices that can buffer writes
+type Syncer interface {
+	// Flush buffered writes to stable storage
+	Sync() error
+}
+
+// Reporter is implemented by devices that keep statistics beyond Stats
+type Reporter interface {
+	// Return human readable status lines
+	Report() []string
+}
+
+// Flush buffered writes of dev (if it buffers any)
+func Sync(dev BlockDevice) error {
+	if s, ok := dev.(Syncer); ok {
+		return s.Sync()
+	}
+	return nil
+}
+
+// Return status lines of dev (if it reports any)
+func Report(dev BlockDevice) []string {
+	if r, ok := dev.(Reporter); ok {
+		return r.Report()
+	}
+	return nil
+}
+
+// Trimmer is implemented by devices that can release the storage of
+// blocks that are no longer in use
+type Trimmer interface {
+	// Release count blocks starting at blocknum, which read as zeros afterwards
+	Trim(blocknum int, count int) error
+}
+
+// Release count blocks of dev starting at blocknum. Devices that can not
+// release storage get the blocks overwritten with zeros instead.
+func Trim(dev BlockDevice, blocknum int, count int) error {
+	if t, ok := dev.(Trimmer); ok {
+		return t.Trim(blocknum, count)
+	}
+	zero := make([]byte, dev.BlockSize())
+	for i := blocknum; i < blocknum+count; i++ {
+		if err := dev.Write(i, zero); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VectoredDevice is implemented by devices that can transfer a range of
+// consecutive blocks at once
+type VectoredDevice interface {
+	// Read consecutive blocks starting at blocknum, one into every buffer
+	ReadBlocks(blocknum int, bufs [][]byte) error
+	// Write every buffer (holding a whole block) into consecutive blocks
+	// starting at blocknum
+	WriteBlocks(blocknum int, bufs [][]byte) error
+}
+
+// Read len(bufs) consecutive blocks of dev starting at blocknum, one into
+// every buffer. Devices that can not transfer ranges get a read per block.
+func ReadBlocks(dev BlockDevice, blocknum int, bufs [][]byte) error {
+	if v, ok := dev.(VectoredDevice); ok {
+		return v.ReadBlocks(blocknum, bufs)
+	}
+	for i, buf := range bufs {
+		if _, err := dev.Read(blocknum+i, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Write every buffer (holding a whole block) into consecutive blocks of
+// dev starting at blocknum. Devices that can not transfer ranges get a
+// write per block.
+func WriteBlocks(dev BlockDevice, blocknum int, bufs [][]byte) error {
+	if v, ok := dev.(VectoredDevice); ok {
+		return v.WriteBlocks(blocknum, bufs)
+	}
+	if err := checkBuffers(blocknum, bufs, dev.BlockSize()); err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		if err := dev.Write(blocknum+i, buf); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validate that every buffer written to blocks starting at blocknum holds
+// a whole block of bs bytes
+func checkBuffers(blocknum int, bufs [][]byte, bs int) error {
+	for i, buf := range bufs {
+		if len(buf) != bs {
+			return fmt.Errorf("Unable to write to block (%d): buffer of %d bytes, not %d bytes", blocknum+i, len(buf), bs)
+		}
+	}
+	return nil
+}
+
+// BadBlockLister is implemented by devices that know blocks unable to
+// hold data
+type BadBlockLister interface {
+	// Return bad blocks in ascending order
+	BadBlocks() []int
+}
+
+// Return the blocks dev knows to be bad (if it keeps track of any)
+func BadBlocks(dev BlockDevice) []int {
+	if l, ok := dev.(BadBlockLister); ok {
+		return l.BadBlocks()
+	}
+	return nil
+}
+
+// Wrapper is implemented by devices layered on top of another device
+type Wrapper interface {
+	// Return wrapped device
+	Unwrap() BlockDevice
+}
+
+// Annotator is implemented by devices that record why I/O happens
+type Annotator interface {
+	// Set the operation responsible for the following I/O
+	Annotate(cause string)
+}
+
+// Tell every Annotator in the device stack of dev which operation
+// causes the following I/O
+func Annotate(dev BlockDevice, cause string) {
+	for dev != nil {
+		if a, ok := dev.(Annotator); ok {
+			a.Annotate(cause)
+		}
+		w, ok := dev.(Wrapper)
+		if !ok {
+			return
+		}
+		dev = w.Unwrap()
+	}
+}
+
+// AsyncDevice is implemented by devices that complete requests in the
+// background
+type AsyncDevice interface {
+	// Queue req, sending it to done once it completed
+	Submit(req *Request, done chan<- *Request) error
+	// Hold back dispatching until Unplug, letting requests collect
+	Plug()
+	// Undo a Plug
+	Unplug()
+}
+
+// Transfer every request on dev and wait for all of them. Devices that
+// queue requests get them as one batch they may reorder, other devices
+// serve them one after another. Returns the error of the first failed
+// request.
+func SubmitAll(dev BlockDevice, reqs []*Request) error {
+	a, ok := dev.(AsyncDevice)
+	if !ok {
+		for _, req := range reqs {
+			if req.Err = execute(dev, req); req.Err != nil {
+				return req.Err
+			}
+		}
+		return nil
+	}
+	done := make(chan *Request, len(reqs))
+	submitted := 0
+	var err error
+	a.Plug()
+	for _, req := range reqs {
+		if err = a.Submit(req, done); err != nil {
+			break
+		}
+		submitted++
+	}
+	a.Unplug()
+	for i := 0; i < submitted; i++ {
+		<-done
+	}
+	if err != nil {
+		return err
+	}
+	for _, req := range reqs {
+		if req.Err != nil {
+			return req.Err
+		}
+	}
+	return nil
+}
@@ -1,47 +1,296 @@
 package disk
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"os"
-	"syscall"
+	"sort"
+	"sync"
+	"sync/atomic"
 )
 
 /*
 Disk emulator
 */
-const BLOCK_SIZE = 4096
+const (
+	BLOCK_SIZE     = 4096  // Default size of a block (in bytes)
+	MIN_BLOCK_SIZE = 512   // Smallest supported block size (in bytes)
+	MAX_BLOCK_SIZE = 65536 // Largest supported block size (in bytes)
+)
+
+// Check that size is a supported block size: a power of two between
+// MIN_BLOCK_SIZE and MAX_BLOCK_SIZE
+func ValidBlockSize(size int) error {
+	if size < MIN_BLOCK_SIZE || size > MAX_BLOCK_SIZE || size&(size-1) != 0 {
+		return fmt.Errorf("block size %d is not a power of two between %d and %d", size, MIN_BLOCK_SIZE, MAX_BLOCK_SIZE)
+	}
+	return nil
+}
 
+var (
+	ErrReadOnly = errors.New("disk is read-only")
+	ErrLocked   = errors.New("disk image is in use")
+	ErrMedia    = errors.New("media error")
+)
+
+var _ BlockDevice = (*Disk)(nil)
+
+// Disk is safe for concurrent use: block I/O goes through positional
+// reads and writes on a single file and counters are updated atomically.
 type Disk struct {
-	Name           string // File name of disk image
-	FileDescriptor int    // File descriptor of disk image
-	Blocks         uint32 // Number of blocks in disk image
-	Reads          uint32 // Number of total reads performed on disk
-	Writes         uint32 // Number of total writes performed on disk
-	Mounts         uint32 // Number of total mounts
+	Counters
+	Name           string       // File name of disk image
+	FileDescriptor int          // File descriptor of disk image
+	Blocks         uint32       // Number of blocks in disk image
+	Header         *ImageHeader // Image header (nil for legacy headerless images)
+	file           *os.File     // Disk image file
+	offset         int64        // Offset of block 0 in disk image file
+	blockSize      int          // Size of a block (in bytes)
+	readOnly       bool         // Whether or not image was opened read-only
+	badMu          sync.RWMutex // Guards bad and the bad blocks recorded in Header
+	bad            map[int]bool // Blocks marked bad
 }
 
-// Open disk image
+// Open disk image (closing any image previously opened by d)
+//
+// The image is locked for exclusive use while it is open; opening an image
+// in use by another shell fails with ErrLocked.
+//
+// New images are created with a header describing their geometry. Existing
+// images (with or without header) keep their size unless nblocks asks for
+// a larger disk; they are never shrunk.
+//
 // path: Path to disk image
-// nblocks: Number of blocks in disk image
+//
+// nblocks: Number of blocks in disk image (0 to use size of existing image)
 func (d *Disk) Open(path string, nblocks int) error {
-	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	return d.OpenWithBlockSize(path, nblocks, 0)
+}
+
+// Open disk image with the given block size (closing any image previously
+// opened by d)
+//
+// The block size of new images is recorded in their header, existing
+// images keep the block size they were created with.
+//
+// path: Path to disk image
+//
+// nblocks: Number of blocks in disk image (0 to use size of existing image)
+//
+// blockSize: Size of a block (0 for BLOCK_SIZE or the size of an existing image)
+func (d *Disk) OpenWithBlockSize(path string, nblocks int, blockSize int) error {
+	if blockSize != 0 {
+		if err := ValidBlockSize(blockSize); err != nil {
+			return fmt.Errorf("Unable to open %s: %s", path, err.Error())
+		}
+	}
+	flags := os.O_RDWR
+	if nblocks > 0 {
+		flags |= os.O_CREATE
+	}
+	return d.open(path, flags, nblocks, blockSize)
+}
+
+// Open existing disk image without write access (closing any image
+// previously opened by d); writes to the disk fail with ErrReadOnly
+//
+// The image is locked for shared use: it can be opened read-only any
+// number of times, but not while it is open for writing.
+//
+// path: Path to disk image
+func (d *Disk) OpenReadOnly(path string) error {
+	return d.open(path, os.O_RDONLY, 0, 0)
+}
+
+// open disk image file with flags
+func (d *Disk) open(path string, flags int, nblocks int, blockSize int) error {
+	readOnly := flags&(os.O_WRONLY|os.O_RDWR) == 0
+	file, err := os.OpenFile(path, flags, 0600)
 	if err != nil {
 		return fmt.Errorf("Unable to open %s: %s", path, err.Error())
 	}
-	if err = file.Truncate(int64(nblocks * BLOCK_SIZE)); err != nil {
+	// reopening the image already open in d must not conflict with the
+	// lock held on it
+	if d.file != nil && sameFile(d.file, file) {
+		unlockFile(d.file)
+	}
+	if err := lockFile(file, readOnly); err != nil {
+		file.Close()
+		d.relock()
+		if errors.Is(err, ErrLocked) {
+			return fmt.Errorf("Unable to open %s: %w", path, err)
+		}
+		return fmt.Errorf("Unable to lock %s: %s", path, err.Error())
+	}
+	header, offset, blocks, err := openImage(file, nblocks, blockSize)
+	if err != nil {
+		file.Close()
+		d.relock()
 		return fmt.Errorf("Unable to open %s: %s", path, err.Error())
 	}
+	blockSize = BLOCK_SIZE
+	if header != nil {
+		blockSize = int(header.BlockSize)
+	}
+	if !readOnly {
+		if err = file.Truncate(offset + int64(blocks)*int64(blockSize)); err != nil {
+			file.Close()
+			d.relock()
+			return fmt.Errorf("Unable to open %s: %s", path, err.Error())
+		}
+	}
+	if d.file != nil {
+		d.file.Close()
+	}
+	d.file = file
 	d.FileDescriptor = int(file.Fd())
 	d.Name = path
-	d.Blocks = uint32(nblocks)
-	d.Reads = 0
-	d.Writes = 0
+	d.Blocks = uint32(blocks)
+	d.Header = header
+	d.offset = offset
+	d.blockSize = blockSize
+	d.readOnly = readOnly
+	d.badMu.Lock()
+	d.bad = map[int]bool{}
+	if header != nil {
+		for _, blocknum := range header.BadBlocks[:header.BadBlockCount] {
+			d.bad[int(blocknum)] = true
+		}
+	}
+	d.badMu.Unlock()
+	atomic.StoreUint32(&d.Reads, 0)
+	atomic.StoreUint32(&d.Writes, 0)
+	atomic.StoreUint32(&d.Trims, 0)
 	return nil
 }
 
+// take the lock on the image still open in d back after reopening it
+// failed
+func (d *Disk) relock() {
+	if d.file != nil {
+		lockFile(d.file, d.readOnly)
+	}
+}
+
+// return whether or not a and b are the same file
+func sameFile(a *os.File, b *os.File) bool {
+	ainfo, err := a.Stat()
+	if err != nil {
+		return false
+	}
+	binfo, err := b.Stat()
+	if err != nil {
+		return false
+	}
+	return os.SameFile(ainfo, binfo)
+}
+
+// Work out geometry of image file, writing a header into new images and
+// updating it when an image grows
+func openImage(file *os.File, nblocks int, blockSize int) (header *ImageHeader, offset int64, blocks int, err error) {
+	info, err := file.Stat()
+	if err != nil {
+		return
+	}
+	if info.Size() == 0 {
+		if nblocks <= 0 {
+			return nil, 0, 0, errors.New("number of blocks required for a new image")
+		}
+		if blockSize == 0 {
+			blockSize = BLOCK_SIZE
+		}
+		if header, err = NewImageHeader(nblocks, blockSize); err != nil {
+			return
+		}
+		_, err = file.WriteAt(header.Bytes(), 0)
+		return header, IMAGE_HEADER_SIZE, nblocks, err
+	}
+
+	header, err = ReadImageHeader(file)
+	if err != nil {
+		return
+	}
+	if header == nil {
+		// legacy image, a trailing partial block is kept
+		if blockSize != 0 && blockSize != BLOCK_SIZE {
+			return nil, 0, 0, fmt.Errorf("legacy image has block size %d, not %d", BLOCK_SIZE, blockSize)
+		}
+		blocks = int((info.Size() + BLOCK_SIZE - 1) / BLOCK_SIZE)
+	} else {
+		if err = ValidBlockSize(int(header.BlockSize)); err != nil {
+			return nil, 0, 0, fmt.Errorf("unsupported image: %s", err.Error())
+		}
+		if blockSize != 0 && blockSize != int(header.BlockSize) {
+			return nil, 0, 0, fmt.Errorf("image has block size %d, not %d", header.BlockSize, blockSize)
+		}
+		offset = IMAGE_HEADER_SIZE
+		blocks = int(header.Blocks)
+	}
+	if nblocks > 0 && nblocks < blocks {
+		return nil, 0, 0, fmt.Errorf("image has %d blocks, refusing to shrink it to %d", blocks, nblocks)
+	}
+	if nblocks > blocks {
+		blocks = nblocks
+		if header != nil {
+			header.Blocks = uint32(blocks)
+			_, err = file.WriteAt(header.Bytes(), 0)
+		}
+	}
+	return
+}
+
 // Close underlying disk image file
 func (d *Disk) Close() error {
-	return syscall.Close(d.FileDescriptor)
+	if d.file == nil {
+		return fmt.Errorf("Unable to close %s: disk is not open", d.Name)
+	}
+	err := d.file.Close()
+	d.file = nil
+	return err
+}
+
+// Flush disk image file to stable storage
+func (d *Disk) Sync() error {
+	if d.file == nil {
+		return fmt.Errorf("Unable to sync %s: disk is not open", d.Name)
+	}
+	return d.file.Sync()
+}
+
+// Return description and storage usage of disk image
+func (d *Disk) Report() []string {
+	var lines []string
+	if d.Header == nil {
+		lines = append(lines, fmt.Sprintf("image %s: legacy image without header", d.Name))
+	} else {
+		lines = append(lines, d.Header.String())
+	}
+	if physical, logical, err := d.Usage(); err == nil {
+		lines = append(lines, fmt.Sprintf("    %d bytes allocated of %d bytes logical", physical, logical))
+	}
+	if bad := d.BadBlocks(); len(bad) > 0 {
+		lines = append(lines, fmt.Sprintf("    bad blocks: %v", bad))
+	}
+	return lines
+}
+
+// Return number of bytes of host storage allocated to the disk image and
+// its logical size
+func (d *Disk) Usage() (physical int64, logical int64, err error) {
+	if d.file == nil {
+		return 0, 0, fmt.Errorf("Unable to stat %s: disk is not open", d.Name)
+	}
+	info, err := d.file.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("Unable to stat %s: %s", d.Name, err.Error())
+	}
+	return allocatedSize(info), info.Size(), nil
+}
+
+// Return whether or not the image was opened read-only
+func (d *Disk) ReadOnly() bool {
+	return d.readOnly
 }
 
 // Return size of disk (in terms of blocks)
@@ -49,21 +298,17 @@ func (d *Disk) Size() uint32 {
 	return d.Blocks
 }
 
-// Return whether or not disk is mounted
-func (d *Disk) Mouted() bool {
-	return d.Mounts > 0
-}
-
-// Decrement mounts
-func (d *Disk) UnMount() {
-	if d.Mounts > 0 {
-		d.Mounts--
+// Return size of a single block (in bytes)
+func (d *Disk) BlockSize() int {
+	if d.blockSize == 0 {
+		return BLOCK_SIZE
 	}
+	return d.blockSize
 }
 
-// Increment mounts
-func (d *Disk) Mount() {
-	d.Mounts++
+// Return whether or not disk is mounted
+func (d *Disk) Mouted() bool {
+	return atomic.LoadUint32(&d.Mounts) > 0
 }
 
 // Read block from disk
@@ -76,18 +321,23 @@ func (d *Disk) Read(blocknum int, data []byte) (int, error) {
 	if err != nil {
 		return -1, err
 	}
-	file := os.NewFile(uintptr(d.FileDescriptor), "image file")
-	if _, err := file.Seek(int64(blocknum*BLOCK_SIZE), os.SEEK_SET); err != nil {
-		return -1, fmt.Errorf("Unable to seek %d: %s", blocknum, err.Error())
+	bs := d.BlockSize()
+	if len(data) < bs {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, bs)
+	}
+	if bad, ok := d.firstBad(blocknum, 1); ok {
+		return -1, fmt.Errorf("Unable to read %d: %w", bad, ErrMedia)
+	}
+	read_bytes, err := d.file.ReadAt(data[:bs], d.offset+int64(blocknum)*int64(bs))
+	if errors.Is(err, io.EOF) && d.readOnly {
+		// trailing partial block of a legacy image that was not padded
+		copy(data[read_bytes:bs], make([]byte, bs-read_bytes))
+		read_bytes, err = bs, nil
 	}
-	read_bytes, err := file.Read(data)
 	if err != nil {
 		return -1, fmt.Errorf("Unable to read %d: %s", blocknum, err.Error())
 	}
-	if read_bytes != BLOCK_SIZE {
-		return -1, fmt.Errorf("Unable to read %d", blocknum)
-	}
-	d.Reads++
+	atomic.AddUint32(&d.Reads, 1)
 	return read_bytes, nil
 }
 
@@ -98,8 +348,9 @@ func (d *Disk) Read(blocknum int, data []byte) (int, error) {
 // data: Buffer to write from
 func (d *Disk) Write(blocknum int, data []byte) error {
 
-	if BLOCK_SIZE < len(data) {
-		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, BLOCK_SIZE)
+	bs := d.BlockSize()
+	if bs < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, bs)
 	}
 
 	err := d.sanityCheck(blocknum)
@@ -107,30 +358,253 @@ func (d *Disk) Write(blocknum int, data []byte) error {
 	if err != nil {
 		return err
 	}
-	file := os.NewFile(uintptr(d.FileDescriptor), "image file")
-	if _, err := file.Seek(int64(blocknum*BLOCK_SIZE), os.SEEK_SET); err != nil {
-		return fmt.Errorf("Unable to seek block (%d): %s", blocknum, err.Error())
+
+	if d.readOnly {
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, ErrReadOnly)
+	}
+	if bad, ok := d.firstBad(blocknum, 1); ok {
+		return fmt.Errorf("Unable to write to block (%d): %w", bad, ErrMedia)
 	}
 
-	written_bytes, err := file.Write(data)
+	_, err = d.file.WriteAt(data, d.offset+int64(blocknum)*int64(bs))
 	if err != nil {
 		return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
 	}
-	if written_bytes > BLOCK_SIZE {
-		fmt.Printf("written_bytes = %d\n", written_bytes)
+	atomic.AddUint32(&d.Writes, 1)
+	return nil
+}
+
+// Read consecutive blocks from disk with a single vectored read
+//
+// blocknum: First block to read from
+//
+// bufs: Buffers to read into, one per block
+func (d *Disk) ReadBlocks(blocknum int, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	if err := d.sanityCheck(blocknum); err != nil {
+		return err
+	}
+	if err := d.sanityCheck(blocknum + len(bufs) - 1); err != nil {
+		return err
+	}
+	bs := d.BlockSize()
+	iovs := make([][]byte, len(bufs))
+	for i, buf := range bufs {
+		if len(buf) < bs {
+			return fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum+i, bs)
+		}
+		iovs[i] = buf[:bs]
+	}
+	if bad, ok := d.firstBad(blocknum, len(bufs)); ok {
+		return fmt.Errorf("Unable to read %d: %w", bad, ErrMedia)
+	}
+	n, err := readv(d.file, iovs, d.offset+int64(blocknum)*int64(bs))
+	if errors.Is(err, io.EOF) && d.readOnly {
+		// trailing partial block of a legacy image that was not padded
+		for _, iov := range advance(iovs, n) {
+			copy(iov, make([]byte, len(iov)))
+		}
+		err = nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read %d-%d: %s", blocknum, blocknum+len(bufs)-1, err.Error())
+	}
+	atomic.AddUint32(&d.Reads, uint32(len(bufs)))
+	return nil
+}
+
+// Write consecutive blocks to disk with a single vectored write
+//
+// blocknum: First block to write to
+//
+// bufs: Buffers to write from, each holding a whole block
+func (d *Disk) WriteBlocks(blocknum int, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	if err := d.sanityCheck(blocknum); err != nil {
+		return err
+	}
+	if err := d.sanityCheck(blocknum + len(bufs) - 1); err != nil {
+		return err
+	}
+	if err := checkBuffers(blocknum, bufs, d.BlockSize()); err != nil {
+		return err
+	}
+	if d.readOnly {
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, ErrReadOnly)
+	}
+	if bad, ok := d.firstBad(blocknum, len(bufs)); ok {
+		return fmt.Errorf("Unable to write to block (%d): %w", bad, ErrMedia)
+	}
+	if err := writev(d.file, bufs, d.offset+int64(blocknum)*int64(d.BlockSize())); err != nil {
+		return fmt.Errorf("Unable to write to blocks (%d-%d): %s", blocknum, blocknum+len(bufs)-1, err.Error())
+	}
+	atomic.AddUint32(&d.Writes, uint32(len(bufs)))
+	return nil
+}
+
+// Release blocks of disk, punching a hole into the disk image file
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (d *Disk) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := d.sanityCheck(blocknum); err != nil {
+		return err
+	}
+	if err := d.sanityCheck(blocknum + count - 1); err != nil {
+		return err
+	}
+	if d.readOnly {
+		return fmt.Errorf("Unable to trim block (%d): %w", blocknum, ErrReadOnly)
+	}
+	bs := int64(d.BlockSize())
+	if err := punchHole(d.file, d.offset+int64(blocknum)*bs, int64(count)*bs); err != nil {
+		return fmt.Errorf("Unable to trim block (%d): %s", blocknum, err.Error())
+	}
+	atomic.AddUint32(&d.Trims, 1)
+	return nil
+}
+
+// write zeros over length bytes of file starting at offset
+func zeroRange(file *os.File, offset int64, length int64) error {
+	zero := make([]byte, 64<<10)
+	for length > 0 {
+		n := int64(len(zero))
+		if length < n {
+			n = length
+		}
+		if _, err := file.WriteAt(zero[:n], offset); err != nil {
+			return err
+		}
+		offset += n
+		length -= n
+	}
+	return nil
+}
+
+// Mark block as bad: reads and writes of it fail with ErrMedia from now
+// on. The mark is recorded in the image header, so it survives reopening
+// the image.
+// blocknum: Block to mark
+func (d *Disk) MarkBad(blocknum int) error {
+	if err := d.sanityCheck(blocknum); err != nil {
+		return err
+	}
+	return d.updateBad(blocknum, true)
+}
+
+// Remove bad block mark (see MarkBad) from block
+// blocknum: Block to repair
+func (d *Disk) ClearBad(blocknum int) error {
+	if err := d.sanityCheck(blocknum); err != nil {
+		return err
+	}
+	return d.updateBad(blocknum, false)
+}
+
+// Return blocks marked bad in ascending order
+func (d *Disk) BadBlocks() []int {
+	d.badMu.RLock()
+	defer d.badMu.RUnlock()
+	bad := make([]int, 0, len(d.bad))
+	for blocknum := range d.bad {
+		bad = append(bad, blocknum)
+	}
+	sort.Ints(bad)
+	return bad
+}
+
+// set or clear bad block mark of blocknum and write it into the header
+func (d *Disk) updateBad(blocknum int, bad bool) error {
+	d.badMu.Lock()
+	defer d.badMu.Unlock()
+	if d.bad[blocknum] == bad {
+		return nil
+	}
+	if d.Header == nil {
+		return fmt.Errorf("Unable to mark block (%d): legacy images can not record bad blocks", blocknum)
+	}
+	if d.readOnly {
+		return fmt.Errorf("Unable to mark block (%d): %w", blocknum, ErrReadOnly)
+	}
+	if bad && len(d.bad) >= MAX_BAD_BLOCKS {
+		return fmt.Errorf("Unable to mark block (%d): image already records %d bad blocks", blocknum, MAX_BAD_BLOCKS)
+	}
+	list := make([]int, 0, len(d.bad)+1)
+	for b := range d.bad {
+		if b != blocknum {
+			list = append(list, b)
+		}
+	}
+	if bad {
+		list = append(list, blocknum)
+	}
+	sort.Ints(list)
+	header := *d.Header
+	header.BadBlocks = [MAX_BAD_BLOCKS]uint32{}
+	for i, b := range list {
+		header.BadBlocks[i] = uint32(b)
+	}
+	header.BadBlockCount = uint32(len(list))
+	if _, err := d.file.WriteAt(header.Bytes(), 0); err != nil {
+		return fmt.Errorf("Unable to mark block (%d): %s", blocknum, err.Error())
+	}
+	*d.Header = header
+	if bad {
+		d.bad[blocknum] = true
+	} else {
+		delete(d.bad, blocknum)
 	}
-	d.Writes++
 	return nil
 }
 
+// return first block marked bad among count blocks starting at blocknum
+func (d *Disk) firstBad(blocknum int, count int) (int, bool) {
+	d.badMu.RLock()
+	defer d.badMu.RUnlock()
+	if len(d.bad) == 0 {
+		return 0, false
+	}
+	for i := blocknum; i < blocknum+count; i++ {
+		if d.bad[i] {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
 // validate given parameters
 // blocknum: Block to operate on
 func (d *Disk) sanityCheck(blocknum int) error {
+	return checkBlock(blocknum, d.Blocks)
+}
+
+// validate blocknum against a device of nblocks blocks
+func checkBlock(blocknum int, nblocks uint32) error {
 	if blocknum < 0 {
 		return fmt.Errorf("blocknum (%d) is negative", blocknum)
 	}
-	if blocknum >= int(d.Blocks) {
+	if blocknum >= int(nblocks) {
 		return fmt.Errorf("blocknum (%d) is too large", blocknum)
 	}
 	return nil
 }
+
+// drop the first n bytes of iovs
+func advance(iovs [][]byte, n int) [][]byte {
+	for len(iovs) > 0 && n >= len(iovs[0]) {
+		n -= len(iovs[0])
+		iovs = iovs[1:]
+	}
+	if len(iovs) > 0 {
+		iovs[0] = iovs[0][n:]
+	}
+	return iovs
+}
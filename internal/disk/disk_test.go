@@ -1,8 +1,11 @@
 package disk
 
 import (
+	"fmt"
 	"log"
 	"os"
+	"runtime"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/require"
@@ -13,6 +16,16 @@ func TestDiskEmulator(t *testing.T) {
 		"open disk image": testOpen,
 		"write to disk":   testWrite,
 		"read from disk":  testRead,
+		"concurrent I/O":  testConcurrent,
+		"image header":    testHeader,
+		"refuse shrink":   testShrink,
+		"legacy image":    testLegacy,
+		"block size":      testBlockSize,
+		"trim":            testTrim,
+		"vectored I/O":    testBlocks,
+		"many buffers":    testManyBlocks,
+		"locking":         testLocking,
+		"bad blocks":      testBadBlocks,
 	} {
 		t.Run(scenario, func(t *testing.T) {
 			disk := &Disk{}
@@ -91,3 +104,311 @@ func testRead(t *testing.T, d *Disk, tfn func(*Disk)) {
 	// read null bytes ("\x00")
 	require.NotEqual(t, "hello world!!", string(rdata[:13]))
 }
+
+func testConcurrent(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	err := d.Open("test_image10", 10)
+	require.NoError(t, err)
+	var wg sync.WaitGroup
+	for g := 0; g < 10; g++ {
+		wg.Add(1)
+		go func(blocknum int) {
+			defer wg.Done()
+			wdata := make([]byte, BLOCK_SIZE)
+			rdata := make([]byte, BLOCK_SIZE)
+			for i := 0; i < 50; i++ {
+				copy(wdata, fmt.Sprintf("block %d write %02d", blocknum, i))
+				if err := d.Write(blocknum, wdata); err != nil {
+					t.Error(err)
+					return
+				}
+				if _, err := d.Read(blocknum, rdata); err != nil {
+					t.Error(err)
+					return
+				}
+				if string(rdata[:20]) != string(wdata[:20]) {
+					t.Errorf("block %d: read %q after writing %q", blocknum, rdata[:20], wdata[:20])
+					return
+				}
+			}
+		}(g)
+	}
+	wg.Wait()
+	require.Equal(t, Stats{Reads: 500, Writes: 500}, d.Stats())
+}
+
+func testHeader(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	err := d.Open("test_image_header", 0)
+	require.Error(t, err)
+	err = d.Open("test_image_header", 10)
+	require.NoError(t, err)
+	require.NotNil(t, d.Header)
+	require.Equal(t, 10, int(d.Header.Blocks))
+	require.Equal(t, BLOCK_SIZE, int(d.Header.BlockSize))
+	uuid := d.Header.UUIDString()
+	require.Len(t, uuid, 36)
+	err = d.Write(0, []byte("block zero"))
+	require.NoError(t, err)
+
+	// geometry is read back from the header
+	err = d.Open("test_image_header", 0)
+	require.NoError(t, err)
+	require.Equal(t, 10, int(d.Blocks))
+	require.Equal(t, uuid, d.Header.UUIDString())
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = d.Read(0, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "block zero", string(rdata[:10]))
+
+	info, err := os.Stat("test_image_header")
+	require.NoError(t, err)
+	require.Equal(t, int64(IMAGE_HEADER_SIZE+10*BLOCK_SIZE), info.Size())
+}
+
+func testShrink(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	err := d.Open("test_image10", 10)
+	require.NoError(t, err)
+	err = d.Open("test_image10", 5)
+	require.Error(t, err)
+	// a failed open keeps the disk that was open
+	require.Equal(t, 10, int(d.Blocks))
+
+	// growing an image updates its header
+	err = d.Open("test_image10", 20)
+	require.NoError(t, err)
+	err = d.Open("test_image10", 0)
+	require.NoError(t, err)
+	require.Equal(t, 20, int(d.Blocks))
+	require.Equal(t, 20, int(d.Header.Blocks))
+}
+
+func testLegacy(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	legacy, err := os.ReadFile("../../data/image.5")
+	require.NoError(t, err)
+	err = os.WriteFile("test_image10", legacy, 0600)
+	require.NoError(t, err)
+
+	err = d.Open("test_image10", 0)
+	require.NoError(t, err)
+	require.Nil(t, d.Header)
+	require.Equal(t, 5, int(d.Blocks))
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = d.Read(0, rdata)
+	require.NoError(t, err)
+	require.Equal(t, legacy[:BLOCK_SIZE], rdata)
+	err = d.Open("test_image10", 4)
+	require.Error(t, err)
+
+	// legacy images grow without gaining a header
+	err = d.Open("test_image10", 10)
+	require.NoError(t, err)
+	require.Nil(t, d.Header)
+	image, err := os.ReadFile("test_image10")
+	require.NoError(t, err)
+	require.Equal(t, 10*BLOCK_SIZE, len(image))
+	require.Equal(t, legacy, image[:len(legacy)])
+}
+
+func testBlockSize(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	err := d.OpenWithBlockSize("test_image512", 10, 1000)
+	require.Error(t, err)
+	err = d.OpenWithBlockSize("test_image512", 10, 512)
+	require.NoError(t, err)
+	require.Equal(t, 512, d.BlockSize())
+	require.Equal(t, 512, int(d.Header.BlockSize))
+	info, err := os.Stat("test_image512")
+	require.NoError(t, err)
+	require.Equal(t, int64(IMAGE_HEADER_SIZE+10*512), info.Size())
+
+	wdata := make([]byte, 512)
+	copy(wdata, "small blocks")
+	require.NoError(t, d.Write(9, wdata))
+	require.Error(t, d.Write(9, make([]byte, 513)))
+
+	// reopening picks up the block size from the header
+	err = d.Open("test_image512", 0)
+	require.NoError(t, err)
+	require.Equal(t, 512, d.BlockSize())
+	rdata := make([]byte, 512)
+	n, err := d.Read(9, rdata)
+	require.NoError(t, err)
+	require.Equal(t, 512, n)
+	require.Equal(t, wdata, rdata)
+	err = d.OpenWithBlockSize("test_image512", 0, 4096)
+	require.Error(t, err)
+}
+
+func testTrim(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	err := d.Open("test_image10", 64)
+	require.NoError(t, err)
+	wdata := make([]byte, BLOCK_SIZE)
+	for i := range wdata {
+		wdata[i] = 0xff
+	}
+	for i := 0; i < 64; i++ {
+		require.NoError(t, d.Write(i, wdata))
+	}
+	require.NoError(t, d.Sync())
+	before, logical, err := d.Usage()
+	require.NoError(t, err)
+	require.Equal(t, int64(IMAGE_HEADER_SIZE+64*BLOCK_SIZE), logical)
+
+	require.NoError(t, d.Trim(8, 48))
+	require.Equal(t, 1, int(d.Stats().Trims))
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = d.Read(30, rdata)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), rdata)
+	_, err = d.Read(56, rdata)
+	require.NoError(t, err)
+	require.Equal(t, wdata, rdata)
+
+	after, logical, err := d.Usage()
+	require.NoError(t, err)
+	require.Equal(t, int64(IMAGE_HEADER_SIZE+64*BLOCK_SIZE), logical)
+	if runtime.GOOS == "linux" && after == before {
+		t.Skip("file system does not support punching holes")
+	}
+	require.LessOrEqual(t, after, before-48*BLOCK_SIZE)
+
+	require.Error(t, d.Trim(60, 8))
+	require.Error(t, d.Trim(-1, 2))
+}
+
+func testBlocks(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	err := d.Open("test_image10", 10)
+	require.NoError(t, err)
+	wbufs := make([][]byte, 4)
+	for i := range wbufs {
+		wbufs[i] = make([]byte, BLOCK_SIZE)
+		copy(wbufs[i], fmt.Sprintf("block %d", 3+i))
+	}
+	require.NoError(t, d.WriteBlocks(3, wbufs))
+	require.Equal(t, 4, int(d.Stats().Writes))
+
+	// blocks written at once read back one by one and the other way round
+	rdata := make([]byte, BLOCK_SIZE)
+	for i := range wbufs {
+		_, err = d.Read(3+i, rdata)
+		require.NoError(t, err)
+		require.Equal(t, wbufs[i], rdata)
+	}
+	rbufs := make([][]byte, 6)
+	for i := range rbufs {
+		rbufs[i] = make([]byte, BLOCK_SIZE+1)
+	}
+	require.NoError(t, d.ReadBlocks(2, rbufs))
+	require.Equal(t, 4+6, int(d.Stats().Reads))
+	require.Equal(t, make([]byte, BLOCK_SIZE+1), rbufs[0])
+	require.Equal(t, "block 4", string(rbufs[2][:7]))
+	require.Equal(t, make([]byte, BLOCK_SIZE+1), rbufs[5])
+
+	require.Error(t, d.ReadBlocks(8, rbufs[:3]))
+	require.Error(t, d.ReadBlocks(0, [][]byte{make([]byte, 10)}))
+	require.Error(t, d.WriteBlocks(0, [][]byte{make([]byte, 10)}))
+	require.Error(t, d.WriteBlocks(-1, wbufs))
+	require.NoError(t, d.ReadBlocks(0, nil))
+	require.Equal(t, 10, int(d.Stats().Reads))
+
+	// legacy images may end with a partial block
+	legacy, err := os.ReadFile("../../data/image.5")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile("test_image10", legacy[:len(legacy)-100], 0600))
+	require.NoError(t, d.OpenReadOnly("test_image10"))
+	require.NoError(t, d.ReadBlocks(3, rbufs[:2]))
+	require.Equal(t, legacy[4*BLOCK_SIZE:5*BLOCK_SIZE-100], rbufs[1][:BLOCK_SIZE-100])
+	require.Equal(t, make([]byte, 100), rbufs[1][BLOCK_SIZE-100:BLOCK_SIZE])
+	require.ErrorIs(t, d.WriteBlocks(0, wbufs[:1]), ErrReadOnly)
+}
+
+func testManyBlocks(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	// more buffers than a single preadv or pwritev call accepts
+	const nblocks = 2500
+	require.NoError(t, d.Open("test_image_many", nblocks))
+	wbufs := make([][]byte, nblocks)
+	for i := range wbufs {
+		wbufs[i] = make([]byte, BLOCK_SIZE)
+		copy(wbufs[i], fmt.Sprintf("block %d", i))
+	}
+	require.NoError(t, d.WriteBlocks(0, wbufs))
+	require.Equal(t, nblocks, int(d.Stats().Writes))
+
+	rbufs := make([][]byte, nblocks)
+	for i := range rbufs {
+		rbufs[i] = make([]byte, BLOCK_SIZE)
+	}
+	require.NoError(t, d.ReadBlocks(0, rbufs))
+	require.Equal(t, nblocks, int(d.Stats().Reads))
+	require.Equal(t, wbufs, rbufs)
+}
+
+func testLocking(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	if runtime.GOOS != "linux" {
+		t.Skip("image locking is only supported on Linux")
+	}
+	require.NoError(t, d.Open("test_image10", 10))
+	other := &Disk{}
+	err := other.Open("test_image10", 0)
+	require.ErrorIs(t, err, ErrLocked)
+	require.Contains(t, err.Error(), fmt.Sprintf("in use by process %d (", os.Getpid()))
+	require.ErrorIs(t, other.OpenReadOnly("test_image10"), ErrLocked)
+
+	// the disk holding the lock can reopen the image, and keeps the lock
+	// when that fails
+	require.NoError(t, d.Open("test_image10", 0))
+	require.Error(t, d.Open("test_image10", 5))
+	require.ErrorIs(t, other.Open("test_image10", 0), ErrLocked)
+
+	// read-only opens share the image, but keep writers out
+	require.NoError(t, d.OpenReadOnly("test_image10"))
+	require.NoError(t, other.OpenReadOnly("test_image10"))
+	require.ErrorIs(t, d.Open("test_image10", 0), ErrLocked)
+	require.NoError(t, other.Close())
+	require.NoError(t, d.Open("test_image10", 0))
+	require.Equal(t, 10, int(d.Blocks))
+}
+
+func testBadBlocks(t *testing.T, d *Disk, tfn func(*Disk)) {
+	defer tfn(d)
+	require.NoError(t, d.Open("test_image10", 10))
+	data := make([]byte, BLOCK_SIZE)
+	require.NoError(t, d.MarkBad(7))
+	require.NoError(t, d.MarkBad(3))
+	require.NoError(t, d.MarkBad(3))
+	require.Error(t, d.MarkBad(10))
+	require.Equal(t, []int{3, 7}, d.BadBlocks())
+	require.Equal(t, []int{3, 7}, BadBlocks(d))
+	require.ErrorIs(t, d.Write(3, data), ErrMedia)
+	_, err := d.Read(7, data)
+	require.ErrorIs(t, err, ErrMedia)
+	require.ErrorIs(t, d.ReadBlocks(2, [][]byte{data, data}), ErrMedia)
+	require.NoError(t, d.Write(4, data))
+	require.Contains(t, d.Report()[len(d.Report())-1], "bad blocks: [3 7]")
+
+	// marks are kept in the header
+	require.NoError(t, d.Open("test_image10", 0))
+	require.Equal(t, []int{3, 7}, d.BadBlocks())
+	require.Equal(t, 2, int(d.Header.BadBlockCount))
+	require.NoError(t, d.ClearBad(3))
+	require.NoError(t, d.Write(3, data))
+	require.NoError(t, d.OpenReadOnly("test_image10"))
+	require.Equal(t, []int{7}, d.BadBlocks())
+	require.ErrorIs(t, d.MarkBad(1), ErrReadOnly)
+	require.NoError(t, d.Close())
+
+	// legacy images have no header to keep marks in
+	legacy, err := os.ReadFile("../../data/image.5")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile("test_image10", legacy, 0600))
+	require.NoError(t, d.Open("test_image10", 0))
+	require.Error(t, d.MarkBad(1))
+	require.Empty(t, d.BadBlocks())
+}
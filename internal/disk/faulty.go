@@ -0,0 +1,202 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+Fault-injection block device
+*/
+
+var (
+	ErrInjected  = errors.New("injected fault")
+	ErrTornWrite = errors.New("torn write")
+	ErrPowerLoss = errors.New("power lost")
+)
+
+// FaultKind describes what happens when a fault triggers
+type FaultKind int
+
+const (
+	Fail      FaultKind = iota // Operation fails without touching the device
+	Partial                    // Short read, or torn write of the first Bytes bytes
+	FlipBit                    // Bit Bit of the payload is flipped silently
+	PowerLoss                  // Write lands, every later operation fails
+)
+
+// Fault scripts a single failure on a FaultyDisk
+type Fault struct {
+	Op    Op        // Operation the fault applies to
+	Nth   int       // Operation (1-based, counted per Op) the fault triggers on
+	Kind  FaultKind // What happens when the fault triggers
+	Bytes int       // Number of bytes transferred for Partial faults
+	Bit   int       // Bit offset into the block for FlipBit faults
+}
+
+var _ BlockDevice = (*FaultyDisk)(nil)
+
+// FaultyDisk wraps a device and fails operations as scripted
+type FaultyDisk struct {
+	BlockDevice
+	faults    []Fault
+	reads     int  // Number of reads seen by the wrapper
+	writes    int  // Number of writes seen by the wrapper
+	trims     int  // Number of trims seen by the wrapper
+	powerLost bool // Whether a PowerLoss fault has triggered
+}
+
+// Wrap dev in a fault-injection device
+// dev: Device to wrap
+// faults: Faults to inject
+func NewFaultyDisk(dev BlockDevice, faults ...Fault) *FaultyDisk {
+	return &FaultyDisk{BlockDevice: dev, faults: faults}
+}
+
+// Return wrapped device
+func (f *FaultyDisk) Unwrap() BlockDevice {
+	return f.BlockDevice
+}
+
+// Schedule another fault
+func (f *FaultyDisk) Inject(fault Fault) {
+	f.faults = append(f.faults, fault)
+}
+
+// Remove all scheduled faults and restore power
+func (f *FaultyDisk) Reset() {
+	f.faults = nil
+	f.powerLost = false
+}
+
+// Return whether or not a PowerLoss fault has triggered
+func (f *FaultyDisk) PowerLost() bool {
+	return f.powerLost
+}
+
+// Return fault scheduled for the nth operation op (if any)
+func (f *FaultyDisk) fault(op Op, nth int) *Fault {
+	for i := range f.faults {
+		if f.faults[i].Op == op && f.faults[i].Nth == nth {
+			return &f.faults[i]
+		}
+	}
+	return nil
+}
+
+// Read block from disk
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (f *FaultyDisk) Read(blocknum int, data []byte) (int, error) {
+	f.reads++
+	if f.powerLost {
+		return -1, fmt.Errorf("Unable to read %d: %w", blocknum, ErrPowerLoss)
+	}
+	fault := f.fault(OpRead, f.reads)
+	if fault == nil {
+		return f.BlockDevice.Read(blocknum, data)
+	}
+	switch fault.Kind {
+	case Partial:
+		buf := make([]byte, f.BlockSize())
+		if _, err := f.BlockDevice.Read(blocknum, buf); err != nil {
+			return -1, err
+		}
+		if fault.Bytes < len(data) {
+			data = data[:fault.Bytes]
+		}
+		return copy(data, buf), nil
+	case FlipBit:
+		n, err := f.BlockDevice.Read(blocknum, data)
+		if err != nil {
+			return n, err
+		}
+		flipBit(data, fault.Bit)
+		return n, nil
+	case PowerLoss:
+		f.powerLost = true
+		return -1, fmt.Errorf("Unable to read %d: %w", blocknum, ErrPowerLoss)
+	}
+	return -1, fmt.Errorf("Unable to read %d: %w", blocknum, ErrInjected)
+}
+
+// Write block to disk
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (f *FaultyDisk) Write(blocknum int, data []byte) error {
+	f.writes++
+	if f.powerLost {
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, ErrPowerLoss)
+	}
+	fault := f.fault(OpWrite, f.writes)
+	if fault == nil {
+		return f.BlockDevice.Write(blocknum, data)
+	}
+	switch fault.Kind {
+	case Partial:
+		if fault.Bytes < len(data) {
+			data = data[:fault.Bytes]
+		}
+		if err := f.BlockDevice.Write(blocknum, data); err != nil {
+			return err
+		}
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, ErrTornWrite)
+	case FlipBit:
+		buf := make([]byte, len(data))
+		copy(buf, data)
+		flipBit(buf, fault.Bit)
+		return f.BlockDevice.Write(blocknum, buf)
+	case PowerLoss:
+		err := f.BlockDevice.Write(blocknum, data)
+		f.powerLost = true
+		return err
+	}
+	return fmt.Errorf("Unable to write to block (%d): %w", blocknum, ErrInjected)
+}
+
+// flip bit (counted from the start of data)
+func flipBit(data []byte, bit int) {
+	if bit/8 < len(data) {
+		data[bit/8] ^= 1 << (bit % 8)
+	}
+}
+
+// Release blocks of the wrapped device (Partial and FlipBit faults fail
+// the trim)
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (f *FaultyDisk) Trim(blocknum int, count int) error {
+	f.trims++
+	if f.powerLost {
+		return fmt.Errorf("Unable to trim block (%d): %w", blocknum, ErrPowerLoss)
+	}
+	fault := f.fault(OpTrim, f.trims)
+	if fault == nil {
+		return Trim(f.BlockDevice, blocknum, count)
+	}
+	if fault.Kind == PowerLoss {
+		err := Trim(f.BlockDevice, blocknum, count)
+		f.powerLost = true
+		return err
+	}
+	return fmt.Errorf("Unable to trim block (%d): %w", blocknum, ErrInjected)
+}
+
+// Flush buffered writes of the wrapped device, unless power was lost
+func (f *FaultyDisk) Sync() error {
+	if f.powerLost {
+		return fmt.Errorf("Unable to sync: %w", ErrPowerLoss)
+	}
+	return Sync(f.BlockDevice)
+}
+
+// Return bad blocks of the wrapped device
+func (f *FaultyDisk) BadBlocks() []int {
+	return BadBlocks(f.BlockDevice)
+}
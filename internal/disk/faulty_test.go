@@ -0,0 +1,141 @@
+package disk
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaultyDisk(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"fail nth operation": testFaultFail,
+		"short read":         testFaultShortRead,
+		"torn write":         testFaultTornWrite,
+		"flip bits":          testFaultFlipBit,
+		"power loss":         testFaultPowerLoss,
+		"sync and trim":      testFaultSyncTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testFaultFail(t *testing.T) {
+	f := NewFaultyDisk(NewMemDisk(4), Fault{Op: OpWrite, Nth: 2}, Fault{Op: OpRead, Nth: 1})
+	buf := make([]byte, BLOCK_SIZE)
+	require.NoError(t, f.Write(0, buf))
+	require.ErrorIs(t, f.Write(1, buf), ErrInjected)
+	require.NoError(t, f.Write(1, buf))
+
+	_, err := f.Read(0, buf)
+	require.ErrorIs(t, err, ErrInjected)
+	_, err = f.Read(0, buf)
+	require.NoError(t, err)
+	// failed operations never reach the wrapped device
+	require.Equal(t, Stats{Reads: 1, Writes: 2}, f.Stats())
+}
+
+func testFaultShortRead(t *testing.T) {
+	f := NewFaultyDisk(NewMemDisk(4), Fault{Op: OpRead, Nth: 1, Kind: Partial, Bytes: 5})
+	require.NoError(t, f.Write(0, []byte("hello world")))
+	buf := make([]byte, BLOCK_SIZE)
+	n, err := f.Read(0, buf)
+	require.NoError(t, err)
+	require.Equal(t, 5, n)
+	require.Equal(t, "hello\x00", string(buf[:6]))
+}
+
+func testFaultTornWrite(t *testing.T) {
+	m := NewMemDisk(4)
+	f := NewFaultyDisk(m, Fault{Op: OpWrite, Nth: 2, Kind: Partial, Bytes: 3})
+	require.NoError(t, f.Write(0, []byte("old data")))
+	require.ErrorIs(t, f.Write(0, []byte("NEW DATA")), ErrTornWrite)
+
+	buf := make([]byte, BLOCK_SIZE)
+	_, err := m.Read(0, buf)
+	require.NoError(t, err)
+	require.Equal(t, "NEW data", string(buf[:8]))
+
+	require.NoError(t, f.Write(1, []byte("aaaaaaaa")))
+	f.Inject(Fault{Op: OpWrite, Nth: 4, Kind: Partial, Bytes: 3})
+	require.ErrorIs(t, f.Write(1, []byte("bbbbbbbb")), ErrTornWrite)
+	_, err = m.Read(1, buf)
+	require.NoError(t, err)
+	require.Equal(t, "bbbaaaaa", string(buf[:8]))
+}
+
+func testFaultFlipBit(t *testing.T) {
+	m := NewMemDisk(4)
+	f := NewFaultyDisk(m,
+		Fault{Op: OpWrite, Nth: 1, Kind: FlipBit, Bit: 0},
+		Fault{Op: OpRead, Nth: 2, Kind: FlipBit, Bit: 9},
+	)
+	data := []byte("aa")
+	require.NoError(t, f.Write(0, data))
+	// caller's buffer is left untouched
+	require.Equal(t, "aa", string(data))
+
+	buf := make([]byte, BLOCK_SIZE)
+	_, err := f.Read(0, buf)
+	require.NoError(t, err)
+	require.Equal(t, "`a", string(buf[:2]))
+	_, err = f.Read(0, buf)
+	require.NoError(t, err)
+	require.Equal(t, "`c", string(buf[:2]))
+}
+
+func testFaultPowerLoss(t *testing.T) {
+	m := NewMemDisk(4)
+	f := NewFaultyDisk(m, Fault{Op: OpWrite, Nth: 2, Kind: PowerLoss})
+	require.NoError(t, f.Write(0, []byte("one")))
+	require.NoError(t, f.Write(1, []byte("two")))
+	require.True(t, f.PowerLost())
+	require.ErrorIs(t, f.Write(2, []byte("three")), ErrPowerLoss)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err := f.Read(0, buf)
+	require.ErrorIs(t, err, ErrPowerLoss)
+
+	// image keeps everything written before power was lost
+	_, err = m.Read(1, buf)
+	require.NoError(t, err)
+	require.Equal(t, "two", string(buf[:3]))
+	_, err = m.Read(2, buf)
+	require.NoError(t, err)
+	require.Equal(t, "\x00", string(buf[:1]))
+
+	f.Reset()
+	require.NoError(t, f.Write(2, []byte("three")))
+}
+
+// syncCounter is an in-memory disk that counts syncs reaching it
+type syncCounter struct {
+	*MemDisk
+	syncs int
+}
+
+func newSyncCounter(nblocks int) *syncCounter {
+	return &syncCounter{MemDisk: NewMemDisk(nblocks)}
+}
+
+func (s *syncCounter) Sync() error {
+	s.syncs++
+	return nil
+}
+
+func testFaultSyncTrim(t *testing.T) {
+	s := newSyncCounter(4)
+	f := NewFaultyDisk(s, Fault{Op: OpWrite, Nth: 2, Kind: PowerLoss})
+	require.NoError(t, Sync(f))
+	require.Equal(t, 1, s.syncs)
+	require.NoError(t, f.Write(0, []byte("one")))
+	require.NoError(t, Trim(f, 0, 2))
+	// trims reach the device instead of being written as zeros
+	require.Equal(t, Stats{Writes: 1, Trims: 1}, f.Stats())
+	f.Inject(Fault{Op: OpTrim, Nth: 2})
+	require.ErrorIs(t, Trim(f, 0, 2), ErrInjected)
+	require.Equal(t, 1, int(f.Stats().Trims))
+
+	require.NoError(t, f.Write(1, []byte("two")))
+	require.ErrorIs(t, Sync(f), ErrPowerLoss)
+	require.ErrorIs(t, Trim(f, 0, 1), ErrPowerLoss)
+	require.Equal(t, 1, s.syncs)
+}
@@ -0,0 +1,418 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Flash (SSD) emulator with a page-mapped flash translation layer
+*/
+
+// FlashConfig describes the layout of a simulated flash device
+type FlashConfig struct {
+	PagesPerEraseBlock int // Number of pages (blocks) in an erase block
+	SpareEraseBlocks   int // Erase blocks beyond the logical capacity (over-provisioning)
+	PageSize           int // Size of a page (0 for BLOCK_SIZE)
+}
+
+var DefaultFlashConfig = FlashConfig{
+	PagesPerEraseBlock: 8,
+	SpareEraseBlocks:   4,
+}
+
+// FlashStats holds the counters of a FlashDisk
+type FlashStats struct {
+	HostWrites  uint32  // Pages written on behalf of the host
+	FlashWrites uint32  // Pages programmed, including garbage collection
+	GCRuns      uint32  // Number of erase blocks reclaimed
+	Erases      uint32  // Number of erase block erasures
+	MinErases   uint32  // Lowest erase count of any erase block
+	MaxErases   uint32  // Highest erase count of any erase block
+	MeanErases  float64 // Mean erase count of all erase blocks
+}
+
+// Return ratio of flash page writes to host page writes
+func (s FlashStats) WriteAmplification() float64 {
+	if s.HostWrites == 0 {
+		return 0
+	}
+	return float64(s.FlashWrites) / float64(s.HostWrites)
+}
+
+const (
+	pageFree = iota
+	pageValid
+	pageInvalid
+)
+
+type eraseBlock struct {
+	pages  []int // State of every page
+	valid  int   // Number of valid pages
+	next   int   // Next page to program
+	erases uint32
+}
+
+var _ BlockDevice = (*FlashDisk)(nil)
+
+// FlashDisk stores blocks as pages of erase blocks: a block is never
+// overwritten in place, every write programs a fresh page and the old one
+// is reclaimed by garbage collection.
+type FlashDisk struct {
+	Counters
+	Blocks  uint32 // Number of logical blocks
+	Config  FlashConfig
+	mu      sync.Mutex
+	backing BlockDevice   // Device the contents are loaded from and saved to (if any)
+	data    []byte        // Contents of all physical pages
+	ebs     []*eraseBlock // Erase blocks
+	free    []int         // Erased erase blocks
+	active  int           // Erase block being programmed
+	l2p     []int         // Physical page of every logical block (-1 if unmapped)
+	p2l     []int         // Logical block of every physical page
+	dirty   map[int]bool  // Blocks written or trimmed since the last Sync
+	stats   FlashStats
+}
+
+// Create an empty flash disk
+// nblocks: Number of logical blocks
+// cfg: Flash layout (erase blocks without pages get the default)
+func NewFlashDisk(nblocks int, cfg FlashConfig) *FlashDisk {
+	if cfg.PagesPerEraseBlock <= 0 {
+		cfg.PagesPerEraseBlock = DefaultFlashConfig.PagesPerEraseBlock
+	}
+	ppe := cfg.PagesPerEraseBlock
+	if cfg.SpareEraseBlocks < 2 {
+		cfg.SpareEraseBlocks = 2
+	}
+	if cfg.PageSize == 0 {
+		cfg.PageSize = BLOCK_SIZE
+	}
+	nebs := (nblocks+ppe-1)/ppe + cfg.SpareEraseBlocks
+	f := &FlashDisk{
+		Blocks: uint32(nblocks),
+		Config: cfg,
+		data:   make([]byte, nebs*ppe*cfg.PageSize),
+		ebs:    make([]*eraseBlock, nebs),
+		l2p:    make([]int, nblocks),
+		p2l:    make([]int, nebs*ppe),
+		dirty:  map[int]bool{},
+	}
+	for i := range f.ebs {
+		f.ebs[i] = &eraseBlock{pages: make([]int, ppe)}
+		f.free = append(f.free, i)
+	}
+	for i := range f.l2p {
+		f.l2p[i] = -1
+	}
+	f.active = f.takeFree()
+	return f
+}
+
+// Create a flash disk holding the contents of dev, which are written back
+// to dev on Sync and Close
+// dev: Device to load contents from
+// cfg: Flash layout (the page size is taken from dev)
+func NewFlashDiskFrom(dev BlockDevice, cfg FlashConfig) (*FlashDisk, error) {
+	cfg.PageSize = dev.BlockSize()
+	f := NewFlashDisk(int(dev.Size()), cfg)
+	buf := make([]byte, cfg.PageSize)
+	zero := make([]byte, cfg.PageSize)
+	for i := 0; i < int(dev.Size()); i++ {
+		if _, err := dev.Read(i, buf); err != nil {
+			return nil, fmt.Errorf("Unable to load flash disk: %s", err.Error())
+		}
+		// unwritten pages already read as zeros
+		if bytes.Equal(buf, zero) {
+			continue
+		}
+		if err := f.Write(i, buf); err != nil {
+			return nil, fmt.Errorf("Unable to load flash disk: %s", err.Error())
+		}
+	}
+	f.backing = dev
+	f.dirty = map[int]bool{}
+	f.ResetStats()
+	return f, nil
+}
+
+// Return device the disk was loaded from (nil if none)
+func (f *FlashDisk) Unwrap() BlockDevice {
+	return f.backing
+}
+
+// Return flash statistics
+func (f *FlashDisk) FlashStats() FlashStats {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	stats := f.stats
+	stats.MinErases = f.ebs[0].erases
+	var total uint32
+	for _, eb := range f.ebs {
+		if eb.erases < stats.MinErases {
+			stats.MinErases = eb.erases
+		}
+		if eb.erases > stats.MaxErases {
+			stats.MaxErases = eb.erases
+		}
+		total += eb.erases
+	}
+	stats.MeanErases = float64(total) / float64(len(f.ebs))
+	return stats
+}
+
+// Return erase count of every erase block
+func (f *FlashDisk) EraseCounts() []uint32 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	counts := make([]uint32, len(f.ebs))
+	for i, eb := range f.ebs {
+		counts[i] = eb.erases
+	}
+	return counts
+}
+
+// Reset write and garbage collection counters (erase counts are kept)
+func (f *FlashDisk) ResetStats() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stats = FlashStats{}
+	atomic.StoreUint32(&f.Reads, 0)
+	atomic.StoreUint32(&f.Writes, 0)
+}
+
+// Return status lines of flash disk
+func (f *FlashDisk) Report() []string {
+	stats := f.FlashStats()
+	return []string{
+		fmt.Sprintf("flash: %d erase blocks of %d pages, write amplification %.2f", len(f.ebs), f.Config.PagesPerEraseBlock, stats.WriteAmplification()),
+		fmt.Sprintf("    %d host writes, %d flash writes, %d gc runs", stats.HostWrites, stats.FlashWrites, stats.GCRuns),
+		fmt.Sprintf("    erase counts min %d, max %d, mean %.2f", stats.MinErases, stats.MaxErases, stats.MeanErases),
+	}
+}
+
+// Write blocks changed since the last Sync back to the device the disk
+// was loaded from, trimming blocks that are no longer mapped
+func (f *FlashDisk) Sync() error {
+	if f.backing == nil {
+		return nil
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for blocknum := 0; blocknum < len(f.l2p) && len(f.dirty) > 0; blocknum++ {
+		if !f.dirty[blocknum] {
+			continue
+		}
+		var err error
+		if page := f.l2p[blocknum]; page >= 0 {
+			err = f.backing.Write(blocknum, f.page(page))
+		} else {
+			err = Trim(f.backing, blocknum, 1)
+		}
+		if err != nil {
+			return fmt.Errorf("Unable to sync flash disk: %s", err.Error())
+		}
+		delete(f.dirty, blocknum)
+	}
+	return Sync(f.backing)
+}
+
+// Save contents and close the device the disk was loaded from
+func (f *FlashDisk) Close() error {
+	if f.backing == nil {
+		return nil
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	return f.backing.Close()
+}
+
+// Return size of disk (in terms of blocks)
+func (f *FlashDisk) Size() uint32 {
+	return f.Blocks
+}
+
+// Return size of a single block (in bytes)
+func (f *FlashDisk) BlockSize() int {
+	return f.Config.PageSize
+}
+
+// Read block from disk
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (f *FlashDisk) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, f.Blocks); err != nil {
+		return -1, err
+	}
+	ps := f.Config.PageSize
+	if len(data) < ps {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, ps)
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if page := f.l2p[blocknum]; page >= 0 {
+		copy(data, f.page(page))
+	} else {
+		copy(data, make([]byte, ps))
+	}
+	atomic.AddUint32(&f.Reads, 1)
+	return ps, nil
+}
+
+// Write block to disk
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (f *FlashDisk) Write(blocknum int, data []byte) error {
+	if f.Config.PageSize < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, f.Config.PageSize)
+	}
+	if err := checkBlock(blocknum, f.Blocks); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	// a page is programmed as a whole, short writes keep the rest of the block
+	buf := make([]byte, f.Config.PageSize)
+	if old := f.l2p[blocknum]; old >= 0 {
+		copy(buf, f.page(old))
+	}
+	copy(buf, data)
+	if err := f.program(blocknum, buf); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+	}
+	f.stats.HostWrites++
+	atomic.AddUint32(&f.Writes, 1)
+	f.dirty[blocknum] = true
+	return nil
+}
+
+// Unmap blocks, leaving their pages to garbage collection without
+// relocating them
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (f *FlashDisk) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, f.Blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, f.Blocks); err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i := blocknum; i < blocknum+count; i++ {
+		f.invalidate(i)
+		f.dirty[i] = true
+	}
+	atomic.AddUint32(&f.Trims, 1)
+	return nil
+}
+
+// return contents of physical page
+func (f *FlashDisk) page(page int) []byte {
+	ps := f.Config.PageSize
+	return f.data[page*ps : (page+1)*ps]
+}
+
+// write logical block to a fresh page, invalidating its previous page
+func (f *FlashDisk) program(blocknum int, data []byte) error {
+	ppe := f.Config.PagesPerEraseBlock
+	for f.ebs[f.active].next == ppe {
+		// keep an erase block in reserve for garbage collection
+		if len(f.free) > 1 {
+			f.active = f.takeFree()
+			break
+		}
+		if err := f.collect(); err != nil {
+			return err
+		}
+	}
+	eb := f.ebs[f.active]
+	page := f.active*ppe + eb.next
+	eb.pages[eb.next] = pageValid
+	eb.next++
+	eb.valid++
+	copy(f.page(page), data)
+	f.invalidate(blocknum)
+	f.l2p[blocknum] = page
+	f.p2l[page] = blocknum
+	f.stats.FlashWrites++
+	return nil
+}
+
+// mark page holding blocknum (if any) as stale
+func (f *FlashDisk) invalidate(blocknum int) {
+	old := f.l2p[blocknum]
+	if old < 0 {
+		return
+	}
+	ppe := f.Config.PagesPerEraseBlock
+	eb := f.ebs[old/ppe]
+	eb.pages[old%ppe] = pageInvalid
+	eb.valid--
+	f.l2p[blocknum] = -1
+}
+
+// reclaim the full erase block with the fewest valid pages
+func (f *FlashDisk) collect() error {
+	ppe := f.Config.PagesPerEraseBlock
+	victim := -1
+	for i, eb := range f.ebs {
+		if eb.next < ppe {
+			continue
+		}
+		if victim == -1 || eb.valid < f.ebs[victim].valid {
+			victim = i
+		}
+	}
+	if victim == -1 || f.ebs[victim].valid == ppe {
+		return errors.New("no space left for garbage collection")
+	}
+	eb := f.ebs[victim]
+	for i, state := range eb.pages {
+		if state != pageValid {
+			continue
+		}
+		page := victim*ppe + i
+		// relocation may need the reserved erase block
+		if f.ebs[f.active].next == ppe {
+			f.active = f.takeFree()
+		}
+		buf := make([]byte, f.Config.PageSize)
+		copy(buf, f.page(page))
+		if err := f.program(f.p2l[page], buf); err != nil {
+			return err
+		}
+	}
+	for i := range eb.pages {
+		eb.pages[i] = pageFree
+	}
+	ebSize := ppe * f.Config.PageSize
+	copy(f.data[victim*ebSize:(victim+1)*ebSize], make([]byte, ebSize))
+	eb.next = 0
+	eb.valid = 0
+	eb.erases++
+	f.stats.Erases++
+	f.stats.GCRuns++
+	f.free = append(f.free, victim)
+	return nil
+}
+
+// take an erased erase block off the free list
+func (f *FlashDisk) takeFree() int {
+	eb := f.free[0]
+	f.free = f.free[1:]
+	return eb
+}
@@ -0,0 +1,164 @@
+package disk
+
+import (
+	"fmt"
+	"math/rand"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlashDisk(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"read and write":      testFlashReadWrite,
+		"garbage collection":  testFlashGC,
+		"random workload":     testFlashRandom,
+		"load and save":       testFlashLoadSave,
+		"trim":                testFlashTrim,
+		"sync changed blocks": testFlashSync,
+		"default geometry":    testFlashDefaultGeometry,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testFlashReadWrite(t *testing.T) {
+	f := NewFlashDisk(16, DefaultFlashConfig)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err := f.Read(3, buf)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), buf)
+
+	require.NoError(t, f.Write(3, []byte("hello world")))
+	require.NoError(t, f.Write(3, []byte("HELLO")))
+	_, err = f.Read(3, buf)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO world", string(buf[:11]))
+	require.Equal(t, Stats{Reads: 2, Writes: 2}, f.Stats())
+
+	// overwrites are out of place
+	stats := f.FlashStats()
+	require.Equal(t, 2, int(stats.HostWrites))
+	require.Equal(t, 2, int(stats.FlashWrites))
+	require.Equal(t, 1.0, stats.WriteAmplification())
+
+	require.Error(t, f.Write(16, buf))
+	_, err = f.Read(-1, buf)
+	require.Error(t, err)
+}
+
+func testFlashGC(t *testing.T) {
+	f := NewFlashDisk(16, FlashConfig{PagesPerEraseBlock: 4, SpareEraseBlocks: 2})
+	buf := make([]byte, BLOCK_SIZE)
+	// fill the disk, then keep rewriting a single block
+	for i := 0; i < 16; i++ {
+		require.NoError(t, f.Write(i, buf))
+	}
+	for i := 0; i < 100; i++ {
+		copy(buf, fmt.Sprintf("version %03d", i))
+		require.NoError(t, f.Write(5, buf))
+	}
+	stats := f.FlashStats()
+	require.Equal(t, 116, int(stats.HostWrites))
+	require.Greater(t, stats.GCRuns, uint32(0))
+	require.Equal(t, stats.GCRuns, stats.Erases)
+	require.GreaterOrEqual(t, stats.WriteAmplification(), 1.0)
+	require.Greater(t, stats.MaxErases, uint32(0))
+
+	_, err := f.Read(5, buf)
+	require.NoError(t, err)
+	require.Equal(t, "version 099", string(buf[:11]))
+	require.Len(t, f.EraseCounts(), 6)
+}
+
+func testFlashRandom(t *testing.T) {
+	f := NewFlashDisk(32, FlashConfig{PagesPerEraseBlock: 4, SpareEraseBlocks: 2})
+	m := NewMemDisk(32)
+	rnd := rand.New(rand.NewSource(1))
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 2000; i++ {
+		blocknum := rnd.Intn(32)
+		copy(buf, fmt.Sprintf("block %d write %d", blocknum, i))
+		require.NoError(t, f.Write(blocknum, buf))
+		require.NoError(t, m.Write(blocknum, buf))
+	}
+	fbuf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 32; i++ {
+		_, err := f.Read(i, fbuf)
+		require.NoError(t, err)
+		_, err = m.Read(i, buf)
+		require.NoError(t, err)
+		require.Equal(t, buf, fbuf)
+	}
+	require.Greater(t, f.FlashStats().WriteAmplification(), 1.0)
+}
+
+func testFlashLoadSave(t *testing.T) {
+	m := NewMemDisk(10)
+	require.NoError(t, m.Write(4, []byte("persisted")))
+	f, err := NewFlashDiskFrom(m, DefaultFlashConfig)
+	require.NoError(t, err)
+	require.Equal(t, FlashStats{}, f.FlashStats())
+
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = f.Read(4, buf)
+	require.NoError(t, err)
+	require.Equal(t, "persisted", string(buf[:9]))
+
+	require.NoError(t, f.Write(7, []byte("written on flash")))
+	require.NoError(t, f.Close())
+	_, err = m.Read(7, buf)
+	require.NoError(t, err)
+	require.Equal(t, "written on flash", string(buf[:16]))
+}
+
+func testFlashTrim(t *testing.T) {
+	f := NewFlashDisk(16, FlashConfig{PagesPerEraseBlock: 4, SpareEraseBlocks: 2})
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 16; i++ {
+		require.NoError(t, f.Write(i, buf))
+	}
+	// trimmed pages are not relocated by garbage collection
+	require.NoError(t, f.Trim(0, 15))
+	for i := 0; i < 100; i++ {
+		require.NoError(t, f.Write(15, buf))
+	}
+	stats := f.FlashStats()
+	require.Equal(t, 1.0, stats.WriteAmplification())
+	require.Equal(t, 1, int(f.Stats().Trims))
+	_, err := f.Read(3, buf)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), buf)
+}
+
+func testFlashSync(t *testing.T) {
+	m := NewMemDisk(10)
+	require.NoError(t, m.Write(4, []byte("persisted")))
+	f, err := NewFlashDiskFrom(m, DefaultFlashConfig)
+	require.NoError(t, err)
+	require.Equal(t, m, f.Unwrap())
+
+	// only blocks changed since the last sync are written back
+	before := m.Stats()
+	require.NoError(t, f.Write(7, []byte("changed")))
+	require.NoError(t, f.Sync())
+	require.NoError(t, f.Sync())
+	require.Equal(t, before.Writes+1, m.Stats().Writes)
+
+	// trimmed blocks are trimmed on the device as well
+	require.NoError(t, f.Trim(4, 1))
+	require.NoError(t, f.Sync())
+	require.Equal(t, before.Writes+1, m.Stats().Writes)
+	require.Equal(t, 1, int(m.Stats().Trims))
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = m.Read(4, buf)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), buf)
+}
+
+func testFlashDefaultGeometry(t *testing.T) {
+	f := NewFlashDisk(16, FlashConfig{})
+	require.Equal(t, DefaultFlashConfig.PagesPerEraseBlock, f.Config.PagesPerEraseBlock)
+	fillBlocks(t, f)
+	checkBlocks(t, f)
+}
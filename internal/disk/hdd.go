@@ -0,0 +1,194 @@
+package disk
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+/*
+Rotational disk timing model
+*/
+
+// HDDModel describes the geometry and timing of a rotational disk
+type HDDModel struct {
+	BlocksPerTrack int           // Number of blocks stored on a single track
+	Heads          int           // Number of tracks per cylinder
+	SettleTime     time.Duration // Fixed cost of any seek
+	TrackSeek      time.Duration // Time to move the head by one cylinder
+	RPM            int           // Spindle speed in revolutions per minute
+	TransferRate   int           // Media transfer rate in bytes per second
+}
+
+// A small 7200 RPM disk
+var DefaultHDDModel = HDDModel{
+	BlocksPerTrack: 16,
+	Heads:          2,
+	SettleTime:     time.Millisecond,
+	TrackSeek:      100 * time.Microsecond,
+	RPM:            7200,
+	TransferRate:   100 << 20,
+}
+
+// Return time of a full revolution
+func (m HDDModel) Revolution() time.Duration {
+	return time.Minute / time.Duration(m.RPM)
+}
+
+// Return cylinder holding blocknum
+func (m HDDModel) Cylinder(blocknum int) int {
+	return blocknum / (m.BlocksPerTrack * m.Heads)
+}
+
+// HDDStats holds the simulated time spent by a RotationalDisk
+type HDDStats struct {
+	Seeks        uint32        // Number of operations that moved the head
+	SeekTime     time.Duration // Time spent moving the head
+	RotationTime time.Duration // Time spent waiting for the block to pass under the head
+	TransferTime time.Duration // Time spent transferring data
+}
+
+// Return total simulated time
+func (s HDDStats) Elapsed() time.Duration {
+	return s.SeekTime + s.RotationTime + s.TransferTime
+}
+
+var _ BlockDevice = (*RotationalDisk)(nil)
+
+// RotationalDisk wraps a device and accounts simulated latency of every
+// operation as if it were served by a rotational disk
+type RotationalDisk struct {
+	BlockDevice
+	Model    HDDModel
+	mu       sync.Mutex
+	cylinder int           // Cylinder the head is positioned on
+	clock    time.Duration // Simulated time since the disk was spun up
+	stats    HDDStats
+}
+
+// Wrap dev in a rotational disk timing model
+// dev: Device to wrap
+// model: Geometry and timing of the simulated disk (geometry, speed and
+// transfer rate left at zero get the default)
+func NewRotationalDisk(dev BlockDevice, model HDDModel) *RotationalDisk {
+	if model.BlocksPerTrack <= 0 {
+		model.BlocksPerTrack = DefaultHDDModel.BlocksPerTrack
+	}
+	if model.Heads <= 0 {
+		model.Heads = DefaultHDDModel.Heads
+	}
+	if model.RPM <= 0 {
+		model.RPM = DefaultHDDModel.RPM
+	}
+	if model.TransferRate <= 0 {
+		model.TransferRate = DefaultHDDModel.TransferRate
+	}
+	return &RotationalDisk{BlockDevice: dev, Model: model}
+}
+
+// Return wrapped device
+func (r *RotationalDisk) Unwrap() BlockDevice {
+	return r.BlockDevice
+}
+
+// Return simulated time statistics
+func (r *RotationalDisk) HDDStats() HDDStats {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.stats
+}
+
+// Reset simulated time statistics (head position is kept)
+func (r *RotationalDisk) ResetStats() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = HDDStats{}
+}
+
+// Return status lines of disk model and wrapped device
+func (r *RotationalDisk) Report() []string {
+	stats := r.HDDStats()
+	r.mu.Lock()
+	cylinder := r.cylinder
+	r.mu.Unlock()
+	lines := []string{
+		fmt.Sprintf("hdd: %v simulated, %d seeks, head on cylinder %d", stats.Elapsed(), stats.Seeks, cylinder),
+		fmt.Sprintf("    seek %v, rotation %v, transfer %v", stats.SeekTime, stats.RotationTime, stats.TransferTime),
+	}
+	return append(lines, Report(r.BlockDevice)...)
+}
+
+// Read block from disk
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (r *RotationalDisk) Read(blocknum int, data []byte) (int, error) {
+	n, err := r.BlockDevice.Read(blocknum, data)
+	if err == nil {
+		r.access(blocknum)
+	}
+	return n, err
+}
+
+// Write block to disk
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (r *RotationalDisk) Write(blocknum int, data []byte) error {
+	err := r.BlockDevice.Write(blocknum, data)
+	if err == nil {
+		r.access(blocknum)
+	}
+	return err
+}
+
+// move head to blocknum, wait for it and transfer it
+func (r *RotationalDisk) access(blocknum int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m := r.Model
+
+	if cylinder := m.Cylinder(blocknum); cylinder != r.cylinder {
+		distance := cylinder - r.cylinder
+		if distance < 0 {
+			distance = -distance
+		}
+		seek := m.SettleTime + time.Duration(distance)*m.TrackSeek
+		r.stats.Seeks++
+		r.stats.SeekTime += seek
+		r.clock += seek
+		r.cylinder = cylinder
+	}
+
+	revolution := m.Revolution()
+	sectorTime := revolution / time.Duration(m.BlocksPerTrack)
+	target := time.Duration(blocknum%m.BlocksPerTrack) * sectorTime
+	rotation := (target - r.clock%revolution + revolution) % revolution
+	r.stats.RotationTime += rotation
+	r.clock += rotation
+
+	transfer := time.Duration(int64(r.BlockSize()) * int64(time.Second) / int64(m.TransferRate))
+	r.stats.TransferTime += transfer
+	r.clock += transfer
+}
+
+// Release blocks of the wrapped device (trims take no simulated time)
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (r *RotationalDisk) Trim(blocknum int, count int) error {
+	return Trim(r.BlockDevice, blocknum, count)
+}
+
+// Flush buffered writes of the wrapped device
+func (r *RotationalDisk) Sync() error {
+	return Sync(r.BlockDevice)
+}
+
+// Return bad blocks of the wrapped device
+func (r *RotationalDisk) BadBlocks() []int {
+	return BadBlocks(r.BlockDevice)
+}
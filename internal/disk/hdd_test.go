@@ -0,0 +1,95 @@
+package disk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// 10 blocks per revolution of 10ms, every step costs 1ms
+var testHDDModel = HDDModel{
+	BlocksPerTrack: 10,
+	Heads:          1,
+	SettleTime:     time.Millisecond,
+	TrackSeek:      time.Millisecond,
+	RPM:            6000,
+	TransferRate:   BLOCK_SIZE * 1000,
+}
+
+func TestRotationalDisk(t *testing.T) {
+	r := NewRotationalDisk(NewMemDisk(40), testHDDModel)
+	buf := make([]byte, BLOCK_SIZE)
+
+	// sequential blocks pass under the head back to back
+	_, err := r.Read(0, buf)
+	require.NoError(t, err)
+	require.NoError(t, r.Write(1, buf))
+	require.Equal(t, HDDStats{TransferTime: 2 * time.Millisecond}, r.HDDStats())
+
+	// going back a block waits for almost a full revolution
+	_, err = r.Read(0, buf)
+	require.NoError(t, err)
+	require.Equal(t, 8*time.Millisecond, r.HDDStats().RotationTime)
+
+	// moving two cylinders
+	_, err = r.Read(25, buf)
+	require.NoError(t, err)
+	require.Equal(t, HDDStats{
+		Seeks:        1,
+		SeekTime:     3 * time.Millisecond,
+		RotationTime: 9 * time.Millisecond,
+		TransferTime: 4 * time.Millisecond,
+	}, r.HDDStats())
+	require.Equal(t, 16*time.Millisecond, r.HDDStats().Elapsed())
+
+	// failed operations take no time
+	_, err = r.Read(40, buf)
+	require.Error(t, err)
+	require.Equal(t, 16*time.Millisecond, r.HDDStats().Elapsed())
+	require.Equal(t, 4, int(r.Stats().Reads+r.Stats().Writes))
+
+	r.ResetStats()
+	require.Equal(t, HDDStats{}, r.HDDStats())
+	require.Contains(t, r.Report()[0], "head on cylinder 2")
+}
+
+func TestRotationalDiskLocality(t *testing.T) {
+	sequential := NewRotationalDisk(NewMemDisk(200), DefaultHDDModel)
+	scattered := NewRotationalDisk(NewMemDisk(200), DefaultHDDModel)
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 50; i++ {
+		require.NoError(t, sequential.Write(100+i, buf))
+		require.NoError(t, scattered.Write((i*37)%200, buf))
+	}
+	require.Less(t, sequential.HDDStats().Elapsed(), scattered.HDDStats().Elapsed())
+	require.Less(t, sequential.HDDStats().Seeks, scattered.HDDStats().Seeks)
+}
+
+func TestRotationalDiskPassThrough(t *testing.T) {
+	s := newSyncCounter(40)
+	r := NewRotationalDisk(s, testHDDModel)
+	require.NoError(t, Sync(r))
+	require.Equal(t, 1, s.syncs)
+
+	// trims reach the device without being written as zeros
+	require.NoError(t, Trim(r, 10, 20))
+	require.Equal(t, Stats{Trims: 1}, r.Stats())
+	require.Equal(t, HDDStats{}, r.HDDStats())
+}
+
+func TestRotationalDiskDefaults(t *testing.T) {
+	r := NewRotationalDisk(NewMemDisk(40), HDDModel{SettleTime: time.Millisecond})
+	require.Equal(t, DefaultHDDModel.BlocksPerTrack, r.Model.BlocksPerTrack)
+	require.Equal(t, DefaultHDDModel.Heads, r.Model.Heads)
+	require.Equal(t, DefaultHDDModel.RPM, r.Model.RPM)
+	require.Equal(t, DefaultHDDModel.TransferRate, r.Model.TransferRate)
+	require.Equal(t, time.Millisecond, r.Model.SettleTime)
+	require.Equal(t, time.Duration(0), r.Model.TrackSeek)
+
+	// a model without geometry serves I/O instead of dividing by zero
+	buf := make([]byte, BLOCK_SIZE)
+	_, err := r.Read(39, buf)
+	require.NoError(t, err)
+	require.Greater(t, r.HDDStats().Elapsed(), time.Duration(0))
+}
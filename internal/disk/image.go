@@ -0,0 +1,116 @@
+package disk
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+)
+
+/*
+Self-describing disk image format
+
+An image starts with a header of IMAGE_HEADER_SIZE bytes followed by the
+blocks of the disk. Legacy images have no header and consist of blocks
+only.
+*/
+
+const (
+	IMAGE_MAGIC       = "SFSIMAGE"
+	IMAGE_VERSION     = 1
+	IMAGE_HEADER_SIZE = 4096
+	MAX_BAD_BLOCKS    = 1000 // Number of bad blocks a header can record
+)
+
+type ImageHeader struct {
+	Magic     [8]byte  // Image magic (IMAGE_MAGIC)
+	Version   uint32   // Image format version
+	BlockSize uint32   // Size of a block (in bytes)
+	Blocks    uint32   // Number of blocks in image
+	Created   int64    // Creation time (seconds since the Unix epoch)
+	UUID      [16]byte // Unique identifier of image
+
+	BadBlockCount uint32                 // Number of blocks marked bad
+	BadBlocks     [MAX_BAD_BLOCKS]uint32 // Blocks marked bad (see Disk.MarkBad)
+}
+
+// Create header for a new image
+// nblocks: Number of blocks in image
+// blockSize: Size of a block (in bytes)
+func NewImageHeader(nblocks int, blockSize int) (*ImageHeader, error) {
+	h := &ImageHeader{
+		Version:   IMAGE_VERSION,
+		BlockSize: uint32(blockSize),
+		Blocks:    uint32(nblocks),
+		Created:   time.Now().Unix(),
+	}
+	copy(h.Magic[:], IMAGE_MAGIC)
+	if _, err := rand.Read(h.UUID[:]); err != nil {
+		return nil, fmt.Errorf("Unable to generate image UUID: %s", err.Error())
+	}
+	// RFC 4122 version 4 UUID
+	h.UUID[6] = (h.UUID[6] & 0x0f) | 0x40
+	h.UUID[8] = (h.UUID[8] & 0x3f) | 0x80
+	return h, nil
+}
+
+// Read header of image (nil if image is a legacy headerless image)
+func ReadImageHeader(r io.ReaderAt) (*ImageHeader, error) {
+	buf := make([]byte, IMAGE_HEADER_SIZE)
+	n, err := r.ReadAt(buf, 0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("Unable to read image header: %s", err.Error())
+	}
+	if n < len(IMAGE_MAGIC) || string(buf[:len(IMAGE_MAGIC)]) != IMAGE_MAGIC {
+		return nil, nil
+	}
+	if n < IMAGE_HEADER_SIZE {
+		return nil, errors.New("Unable to read image header: header is truncated")
+	}
+	h := &ImageHeader{}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, h); err != nil {
+		return nil, fmt.Errorf("Unable to read image header: %s", err.Error())
+	}
+	if h.Version != IMAGE_VERSION {
+		return nil, fmt.Errorf("Unable to read image header: unsupported version %d", h.Version)
+	}
+	if h.BadBlockCount > MAX_BAD_BLOCKS {
+		return nil, fmt.Errorf("Unable to read image header: %d bad blocks", h.BadBlockCount)
+	}
+	return h, nil
+}
+
+// Encode header into IMAGE_HEADER_SIZE bytes
+func (h *ImageHeader) Bytes() []byte {
+	out := make([]byte, IMAGE_HEADER_SIZE)
+	copy(out, encode(h))
+	return out
+}
+
+// Encode fixed size values in little endian byte order, the way every
+// on-disk structure of this package is stored
+func encode(v interface{}) []byte {
+	buf := bytes.NewBuffer(make([]byte, 0, binary.Size(v)))
+	// writing fixed size values into a buffer can not fail
+	binary.Write(buf, binary.LittleEndian, v)
+	return buf.Bytes()
+}
+
+// Return UUID of image in its canonical text form
+func (h *ImageHeader) UUIDString() string {
+	u := h.UUID
+	return fmt.Sprintf("%x-%x-%x-%x-%x", u[0:4], u[4:6], u[6:8], u[8:10], u[10:16])
+}
+
+// Return human readable description of header
+func (h *ImageHeader) String() string {
+	desc := fmt.Sprintf("image %s: %d blocks of %d bytes, created %s",
+		h.UUIDString(), h.Blocks, h.BlockSize, time.Unix(h.Created, 0).UTC().Format(time.RFC3339))
+	if h.BadBlockCount > 0 {
+		desc += fmt.Sprintf(", %d bad blocks", h.BadBlockCount)
+	}
+	return desc
+}
@@ -0,0 +1,79 @@
+package disk
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"golang.org/x/sys/unix"
+)
+
+// Take an advisory lock on file without waiting for it: a shared lock for
+// read-only access, an exclusive one otherwise. Fails with ErrLocked,
+// naming the processes holding a conflicting lock, if the file is in use.
+func lockFile(file *os.File, shared bool) error {
+	how := unix.LOCK_EX
+	if shared {
+		how = unix.LOCK_SH
+	}
+	err := unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+	for errors.Is(err, unix.EINTR) {
+		err = unix.Flock(int(file.Fd()), how|unix.LOCK_NB)
+	}
+	if errors.Is(err, unix.EWOULDBLOCK) {
+		holders := lockHolders(file)
+		if len(holders) == 0 {
+			return fmt.Errorf("%w by another process", ErrLocked)
+		}
+		return fmt.Errorf("%w by %s", ErrLocked, strings.Join(holders, ", "))
+	}
+	return err
+}
+
+// Drop advisory lock on file
+func unlockFile(file *os.File) error {
+	return unix.Flock(int(file.Fd()), unix.LOCK_UN)
+}
+
+// Return the processes holding a flock on file, as listed in /proc/locks
+// ("process <pid> (<command>)")
+func lockHolders(file *os.File) []string {
+	info, err := file.Stat()
+	if err != nil {
+		return nil
+	}
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	// locks name their file by major:minor:inode of its device
+	id := fmt.Sprintf("%02x:%02x:%d", unix.Major(uint64(stat.Dev)), unix.Minor(uint64(stat.Dev)), stat.Ino)
+	locks, err := os.Open("/proc/locks")
+	if err != nil {
+		return nil
+	}
+	defer locks.Close()
+	var holders []string
+	scanner := bufio.NewScanner(locks)
+	for scanner.Scan() {
+		// 1: FLOCK  ADVISORY  WRITE 1234 fd:01:5678 0 EOF
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 || fields[1] != "FLOCK" || fields[5] != id {
+			continue
+		}
+		pid, err := strconv.Atoi(fields[4])
+		if err != nil {
+			continue
+		}
+		holder := fmt.Sprintf("process %d", pid)
+		if comm, err := os.ReadFile(fmt.Sprintf("/proc/%d/comm", pid)); err == nil {
+			holder += fmt.Sprintf(" (%s)", strings.TrimSpace(string(comm)))
+		}
+		holders = append(holders, holder)
+	}
+	return holders
+}
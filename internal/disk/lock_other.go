@@ -0,0 +1,16 @@
+//go:build !linux
+
+package disk
+
+import "os"
+
+// Take an advisory lock on file. Image locking is only supported on
+// Linux, elsewhere images can be opened by several processes at once.
+func lockFile(file *os.File, shared bool) error {
+	return nil
+}
+
+// Drop advisory lock on file
+func unlockFile(file *os.File) error {
+	return nil
+}
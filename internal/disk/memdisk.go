@@ -0,0 +1,219 @@
+package disk
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync/atomic"
+)
+
+/*
+RAM-backed disk emulator
+*/
+
+var _ BlockDevice = (*MemDisk)(nil)
+
+type MemDisk struct {
+	Counters
+	Name   string       // File name the disk was loaded from (if any)
+	Blocks uint32       // Number of blocks in disk
+	Header *ImageHeader // Header of image the disk was loaded from (if any)
+	data   []byte       // Contents of disk
+	bs     int          // Size of a block (in bytes)
+}
+
+// Create an empty in-memory disk
+// nblocks: Number of blocks in disk
+func NewMemDisk(nblocks int) *MemDisk {
+	return &MemDisk{
+		Blocks: uint32(nblocks),
+		data:   make([]byte, nblocks*BLOCK_SIZE),
+		bs:     BLOCK_SIZE,
+	}
+}
+
+// Create an empty in-memory disk with the given block size
+// nblocks: Number of blocks in disk
+// blockSize: Size of a block (in bytes)
+func NewMemDiskWithBlockSize(nblocks int, blockSize int) (*MemDisk, error) {
+	if err := ValidBlockSize(blockSize); err != nil {
+		return nil, fmt.Errorf("Unable to create disk: %s", err.Error())
+	}
+	return &MemDisk{
+		Blocks: uint32(nblocks),
+		data:   make([]byte, nblocks*blockSize),
+		bs:     blockSize,
+	}, nil
+}
+
+// Load an in-memory disk from a disk image file (with or without header)
+// path: Path to disk image
+func LoadMemDisk(path string) (*MemDisk, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load %s: %s", path, err.Error())
+	}
+	header, err := ReadImageHeader(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to load %s: %s", path, err.Error())
+	}
+	bs := BLOCK_SIZE
+	if header != nil {
+		if err := ValidBlockSize(int(header.BlockSize)); err != nil {
+			return nil, fmt.Errorf("Unable to load %s: %s", path, err.Error())
+		}
+		bs = int(header.BlockSize)
+		data = data[IMAGE_HEADER_SIZE:]
+		if len(data) != int(header.Blocks)*bs {
+			return nil, fmt.Errorf("Unable to load %s: image is not %d blocks", path, header.Blocks)
+		}
+	}
+	if len(data)%bs != 0 {
+		return nil, fmt.Errorf("Unable to load %s: size is not a multiple of %d bytes", path, bs)
+	}
+	return &MemDisk{
+		Name:   path,
+		Blocks: uint32(len(data) / bs),
+		Header: header,
+		data:   data,
+		bs:     bs,
+	}, nil
+}
+
+// Save contents of disk to a disk image file (with header)
+// path: Path to disk image
+func (m *MemDisk) Save(path string) error {
+	if m.Header == nil {
+		header, err := NewImageHeader(int(m.Blocks), m.BlockSize())
+		if err != nil {
+			return fmt.Errorf("Unable to save %s: %s", path, err.Error())
+		}
+		m.Header = header
+	}
+	image := append(m.Header.Bytes(), m.data...)
+	if err := os.WriteFile(path, image, 0600); err != nil {
+		return fmt.Errorf("Unable to save %s: %s", path, err.Error())
+	}
+	return nil
+}
+
+// Close disk (contents are kept until disk is garbage collected)
+func (m *MemDisk) Close() error {
+	return nil
+}
+
+// Return size of disk (in terms of blocks)
+func (m *MemDisk) Size() uint32 {
+	return m.Blocks
+}
+
+// Return size of a single block (in bytes)
+func (m *MemDisk) BlockSize() int {
+	return m.bs
+}
+
+// Read block from disk
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (m *MemDisk) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, m.Blocks); err != nil {
+		return -1, err
+	}
+	read_bytes := copy(data, m.data[blocknum*m.bs:(blocknum+1)*m.bs])
+	if read_bytes != m.bs {
+		return -1, fmt.Errorf("Unable to read %d", blocknum)
+	}
+	atomic.AddUint32(&m.Reads, 1)
+	return read_bytes, nil
+}
+
+// Write block to disk
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (m *MemDisk) Write(blocknum int, data []byte) error {
+	if m.bs < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, m.bs)
+	}
+	if err := checkBlock(blocknum, m.Blocks); err != nil {
+		return err
+	}
+	copy(m.data[blocknum*m.bs:], data)
+	atomic.AddUint32(&m.Writes, 1)
+	return nil
+}
+
+// Read consecutive blocks from disk
+//
+// blocknum: First block to read from
+//
+// bufs: Buffers to read into, one per block
+func (m *MemDisk) ReadBlocks(blocknum int, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, m.Blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+len(bufs)-1, m.Blocks); err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		if len(buf) < m.bs {
+			return fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum+i, m.bs)
+		}
+	}
+	for i, buf := range bufs {
+		copy(buf, m.data[(blocknum+i)*m.bs:(blocknum+i+1)*m.bs])
+	}
+	atomic.AddUint32(&m.Reads, uint32(len(bufs)))
+	return nil
+}
+
+// Write consecutive blocks to disk
+//
+// blocknum: First block to write to
+//
+// bufs: Buffers to write from, each holding a whole block
+func (m *MemDisk) WriteBlocks(blocknum int, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, m.Blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+len(bufs)-1, m.Blocks); err != nil {
+		return err
+	}
+	if err := checkBuffers(blocknum, bufs, m.bs); err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		copy(m.data[(blocknum+i)*m.bs:], buf)
+	}
+	atomic.AddUint32(&m.Writes, uint32(len(bufs)))
+	return nil
+}
+
+// Release blocks of disk (they read as zeros afterwards)
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (m *MemDisk) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, m.Blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, m.Blocks); err != nil {
+		return err
+	}
+	copy(m.data[blocknum*m.bs:(blocknum+count)*m.bs], make([]byte, count*m.bs))
+	atomic.AddUint32(&m.Trims, 1)
+	return nil
+}
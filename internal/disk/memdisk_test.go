@@ -0,0 +1,185 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMemDisk(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"write and read":   testMemReadWrite,
+		"bounds checks":    testMemBounds,
+		"save and load":    testMemSaveLoad,
+		"load disk images": testMemLoadImage,
+		"block size":       testMemBlockSize,
+		"trim":             testMemTrim,
+		"vectored I/O":     testMemBlocks,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testMemReadWrite(t *testing.T) {
+	d := NewMemDisk(10)
+	require.Equal(t, 10, int(d.Size()))
+	wdata := make([]byte, BLOCK_SIZE)
+	copy(wdata, "hello world!!")
+	err := d.Write(3, wdata)
+	require.NoError(t, err)
+	require.Equal(t, 1, int(d.Writes))
+
+	rdata := make([]byte, BLOCK_SIZE)
+	n, err := d.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, BLOCK_SIZE, n)
+	require.Equal(t, 1, int(d.Reads))
+	require.Equal(t, "hello world!!", string(rdata[:13]))
+
+	// short writes only replace the start of a block
+	err = d.Write(3, []byte("HELLO"))
+	require.NoError(t, err)
+	_, err = d.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "HELLO world!!", string(rdata[:13]))
+	require.Equal(t, Stats{Reads: 2, Writes: 2}, d.Stats())
+}
+
+func testMemBounds(t *testing.T) {
+	d := NewMemDisk(5)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err := d.Read(-1, buf)
+	require.Error(t, err)
+	_, err = d.Read(5, buf)
+	require.Error(t, err)
+	_, err = d.Read(0, buf[:10])
+	require.Error(t, err)
+	require.Error(t, d.Write(5, buf))
+	require.Error(t, d.Write(0, make([]byte, BLOCK_SIZE+1)))
+	require.Equal(t, Stats{}, d.Stats())
+}
+
+func testMemSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "image.4")
+	d := NewMemDisk(4)
+	err := d.Write(2, []byte("snapshot"))
+	require.NoError(t, err)
+	err = d.Save(path)
+	require.NoError(t, err)
+
+	l, err := LoadMemDisk(path)
+	require.NoError(t, err)
+	require.Equal(t, 4, int(l.Size()))
+	require.Equal(t, path, l.Name)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = l.Read(2, buf)
+	require.NoError(t, err)
+	require.Equal(t, "snapshot", string(buf[:8]))
+
+	// saved images carry a header
+	img := &Disk{}
+	err = img.Open(path, 0)
+	require.NoError(t, err)
+	require.Equal(t, 4, int(img.Blocks))
+	require.Equal(t, l.Header.UUID, img.Header.UUID)
+	require.NoError(t, img.Close())
+
+	// a partial block can not be loaded
+	err = os.WriteFile(path, make([]byte, BLOCK_SIZE+1), 0600)
+	require.NoError(t, err)
+	_, err = LoadMemDisk(path)
+	require.Error(t, err)
+}
+
+func testMemLoadImage(t *testing.T) {
+	d := &Disk{}
+	err := d.Open("test_image10", 10)
+	require.NoError(t, err)
+	defer tearDown(d)
+	err = d.Write(7, []byte("from disk"))
+	require.NoError(t, err)
+
+	m, err := LoadMemDisk("test_image10")
+	require.NoError(t, err)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = m.Read(7, buf)
+	require.NoError(t, err)
+	require.Equal(t, "from disk", string(buf[:9]))
+}
+
+func testMemBlockSize(t *testing.T) {
+	_, err := NewMemDiskWithBlockSize(10, 256)
+	require.Error(t, err)
+	_, err = NewMemDiskWithBlockSize(10, 3000)
+	require.Error(t, err)
+	d, err := NewMemDiskWithBlockSize(10, 65536)
+	require.NoError(t, err)
+	require.Equal(t, 65536, d.BlockSize())
+	require.NoError(t, d.Write(9, make([]byte, 65536)))
+
+	d, err = NewMemDiskWithBlockSize(4, 1024)
+	require.NoError(t, err)
+	require.NoError(t, d.Write(3, []byte("kilobyte")))
+	path := filepath.Join(t.TempDir(), "image")
+	require.NoError(t, d.Save(path))
+	img, err := LoadMemDisk(path)
+	require.NoError(t, err)
+	require.Equal(t, 1024, img.BlockSize())
+	require.Equal(t, 4, int(img.Size()))
+	rdata := make([]byte, 1024)
+	_, err = img.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "kilobyte", string(rdata[:8]))
+}
+
+func testMemTrim(t *testing.T) {
+	d := NewMemDisk(5)
+	require.NoError(t, d.Write(2, []byte("trimmed")))
+	require.NoError(t, d.Write(3, []byte("kept")))
+	require.NoError(t, d.Trim(1, 2))
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err := d.Read(2, rdata)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), rdata)
+	_, err = d.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "kept", string(rdata[:4]))
+	require.Equal(t, 1, int(d.Stats().Trims))
+	require.Error(t, d.Trim(4, 2))
+
+	// devices without trim support get zeros written
+	plain := struct{ BlockDevice }{NewMemDisk(5)}
+	require.NoError(t, Trim(plain, 0, 3))
+	require.Equal(t, Stats{Writes: 3}, plain.Stats())
+}
+
+func testMemBlocks(t *testing.T) {
+	d := NewMemDisk(8)
+	fillBlocks(t, d)
+	bufs := make([][]byte, 3)
+	for i := range bufs {
+		bufs[i] = make([]byte, BLOCK_SIZE)
+	}
+	require.NoError(t, d.ReadBlocks(5, bufs))
+	require.Equal(t, 3, int(d.Reads))
+	require.Equal(t, []byte{7, 0, 0xaa}, bufs[2][:3])
+	require.Error(t, d.ReadBlocks(6, bufs))
+	require.Error(t, d.WriteBlocks(0, [][]byte{{1}}))
+
+	bufs[0][0], bufs[1][0], bufs[2][0] = 0, 1, 2
+	require.NoError(t, d.WriteBlocks(0, bufs))
+	require.Equal(t, 8+3, int(d.Writes))
+	checkBlocks(t, d)
+
+	// devices without ranged transfers get a request per block
+	faulty := NewFaultyDisk(d)
+	require.NoError(t, ReadBlocks(faulty, 2, bufs))
+	require.Equal(t, []byte{4, 0, 0xaa}, bufs[2][:3])
+	require.Equal(t, 3+8+3, int(d.Reads))
+	require.NoError(t, WriteBlocks(faulty, 2, bufs))
+	require.Equal(t, 8+3+3, int(d.Writes))
+	require.Error(t, WriteBlocks(faulty, 0, [][]byte{{1}}))
+	checkBlocks(t, d)
+}
@@ -0,0 +1,475 @@
+package disk
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Mirrored block device (RAID-1)
+
+Every member holds a full copy of the device. Writes go to all members
+that have not failed, reads are spread round-robin over the healthy ones.
+A failed member is brought back by copying every block from a healthy
+member; writes reach it while it resyncs, reads do not.
+*/
+
+var (
+	ErrMirrorMismatch = errors.New("mirror members disagree")
+	ErrNoHealthy      = errors.New("no healthy mirror member left")
+	ErrResyncAborted  = errors.New("member failed while resyncing")
+)
+
+// MemberState tells whether a mirror member can serve I/O
+type MemberState int
+
+const (
+	MemberHealthy   MemberState = iota // Member serves reads and writes
+	MemberFailed                       // Member is left alone until resynced
+	MemberResyncing                    // Member receives writes and a copy of every block
+)
+
+func (s MemberState) String() string {
+	switch s {
+	case MemberFailed:
+		return "failed"
+	case MemberResyncing:
+		return "resyncing"
+	}
+	return "healthy"
+}
+
+// MemberStatus describes a member of a Mirror
+type MemberStatus struct {
+	State    MemberState // Whether member can serve I/O
+	Reads    uint32      // Number of reads served by member
+	Resynced uint32      // Number of blocks copied by the current or last resync
+	Err      error       // Error that failed member (nil if failed by hand)
+	copying  bool        // Whether a resync is still copying into member
+}
+
+var _ BlockDevice = (*Mirror)(nil)
+
+// Mirror keeps identical copies of every block on two or more devices
+type Mirror struct {
+	Counters
+	Members    []BlockDevice
+	Verify     bool   // Read every healthy member and compare the copies
+	Mismatches uint32 // Number of verified reads whose copies differed
+	mu         sync.RWMutex
+	status     []MemberStatus
+	next       uint32 // Member the next balanced read starts at
+}
+
+// Mirror blocks across members
+// members: Devices of the same size and block size
+func NewMirror(members ...BlockDevice) (*Mirror, error) {
+	if len(members) < 2 {
+		return nil, errors.New("Unable to create mirror: at least two members required")
+	}
+	for i, member := range members[1:] {
+		if member.Size() != members[0].Size() || member.BlockSize() != members[0].BlockSize() {
+			return nil, fmt.Errorf("Unable to create mirror: member %d has %d blocks of %d bytes, not %d blocks of %d bytes",
+				i+1, member.Size(), member.BlockSize(), members[0].Size(), members[0].BlockSize())
+		}
+	}
+	return &Mirror{Members: members, status: make([]MemberStatus, len(members))}, nil
+}
+
+// Return status of every member
+func (m *Mirror) Status() []MemberStatus {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	status := make([]MemberStatus, len(m.status))
+	for i := range m.status {
+		status[i] = MemberStatus{
+			State:    m.status[i].State,
+			Reads:    atomic.LoadUint32(&m.status[i].Reads),
+			Resynced: atomic.LoadUint32(&m.status[i].Resynced),
+			Err:      m.status[i].Err,
+		}
+	}
+	return status
+}
+
+// Return status lines of mirror and its members
+func (m *Mirror) Report() []string {
+	status := m.Status()
+	healthy := 0
+	for _, s := range status {
+		if s.State == MemberHealthy {
+			healthy++
+		}
+	}
+	policy := "balanced"
+	if m.Verify {
+		policy = "verified"
+	}
+	lines := []string{fmt.Sprintf("mirror: %d of %d members healthy, %s reads, %d mismatches",
+		healthy, len(status), policy, atomic.LoadUint32(&m.Mismatches))}
+	for i, s := range status {
+		line := fmt.Sprintf("member %d: %s, %d reads", i, s.State, s.Reads)
+		switch {
+		case s.State == MemberResyncing:
+			line += fmt.Sprintf(", resynced %d of %d blocks", s.Resynced, m.Size())
+		case s.Err != nil:
+			line += fmt.Sprintf(" (%s)", s.Err.Error())
+		}
+		lines = append(lines, "    "+line)
+		for _, l := range Report(m.Members[i]) {
+			lines = append(lines, "        "+l)
+		}
+	}
+	return lines
+}
+
+// Return size of mirror (in terms of blocks)
+func (m *Mirror) Size() uint32 {
+	return m.Members[0].Size()
+}
+
+// Return size of a single block (in bytes)
+func (m *Mirror) BlockSize() int {
+	return m.Members[0].BlockSize()
+}
+
+// Mark member as failed, it receives no I/O until resynced
+// member: Index of member
+func (m *Mirror) Fail(member int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.fail(member, nil)
+}
+
+// mark member as failed because of err, refusing to fail the last
+// healthy member (must hold m.mu)
+func (m *Mirror) fail(member int, err error) error {
+	if member < 0 || member >= len(m.Members) {
+		return fmt.Errorf("Unable to fail member %d: mirror has %d members", member, len(m.Members))
+	}
+	if m.status[member].State == MemberHealthy && m.healthy() == 1 {
+		return fmt.Errorf("Unable to fail member %d: %w", member, ErrNoHealthy)
+	}
+	m.status[member].State = MemberFailed
+	m.status[member].Err = err
+	return nil
+}
+
+// return number of healthy members (must hold m.mu)
+func (m *Mirror) healthy() int {
+	n := 0
+	for _, s := range m.status {
+		if s.State == MemberHealthy {
+			n++
+		}
+	}
+	return n
+}
+
+// Copy every block from a healthy member into member and mark it healthy
+// again
+// member: Index of a failed member
+func (m *Mirror) Resync(member int) error {
+	done, err := m.StartResync(member)
+	if err != nil {
+		return err
+	}
+	return <-done
+}
+
+// Start copying every block from a healthy member into member in the
+// background. The mirror stays usable while the copy is in progress, the
+// returned channel receives the outcome once it is done.
+// member: Index of a failed member
+func (m *Mirror) StartResync(member int) (<-chan error, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if member < 0 || member >= len(m.Members) {
+		return nil, fmt.Errorf("Unable to resync member %d: mirror has %d members", member, len(m.Members))
+	}
+	if m.status[member].State != MemberFailed {
+		return nil, fmt.Errorf("Unable to resync member %d: member is %s", member, m.status[member].State)
+	}
+	// a member failed while resyncing waits for the copy to notice
+	if m.status[member].copying {
+		return nil, fmt.Errorf("Unable to resync member %d: previous resync is still stopping", member)
+	}
+	m.status[member].State = MemberResyncing
+	m.status[member].Err = nil
+	m.status[member].copying = true
+	atomic.StoreUint32(&m.status[member].Resynced, 0)
+	done := make(chan error, 1)
+	go func() {
+		done <- m.resync(member)
+	}()
+	return done, nil
+}
+
+// copy every block into a resyncing member, stopping as soon as the
+// member is failed again
+func (m *Mirror) resync(member int) error {
+	defer func() {
+		m.mu.Lock()
+		m.status[member].copying = false
+		m.mu.Unlock()
+	}()
+	buf := make([]byte, m.BlockSize())
+	for blocknum := 0; blocknum < int(m.Size()); blocknum++ {
+		// writes are held off while a block is copied, so the copy is never stale
+		m.mu.Lock()
+		if m.status[member].State != MemberResyncing {
+			m.mu.Unlock()
+			return fmt.Errorf("Unable to resync member %d: %w", member, ErrResyncAborted)
+		}
+		err := m.copyBlock(member, blocknum, buf)
+		if err != nil {
+			m.status[member].State = MemberFailed
+			m.status[member].Err = err
+			m.mu.Unlock()
+			return fmt.Errorf("Unable to resync member %d: %s", member, err.Error())
+		}
+		atomic.AddUint32(&m.status[member].Resynced, 1)
+		m.mu.Unlock()
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.status[member].State != MemberResyncing {
+		return fmt.Errorf("Unable to resync member %d: %w", member, ErrResyncAborted)
+	}
+	if err := Sync(m.Members[member]); err != nil {
+		m.status[member].State = MemberFailed
+		m.status[member].Err = err
+		return fmt.Errorf("Unable to resync member %d: %s", member, err.Error())
+	}
+	m.status[member].State = MemberHealthy
+	return nil
+}
+
+// copy block from a healthy member into member (must hold m.mu)
+func (m *Mirror) copyBlock(member int, blocknum int, buf []byte) error {
+	for i, source := range m.Members {
+		if m.status[i].State != MemberHealthy {
+			continue
+		}
+		if _, err := source.Read(blocknum, buf); err != nil {
+			if m.fail(i, err) == nil {
+				continue
+			}
+			return err
+		}
+		// holes stay holes on members that can punch them
+		if bytes.Count(buf, []byte{0}) == len(buf) {
+			return Trim(m.Members[member], blocknum, 1)
+		}
+		return m.Members[member].Write(blocknum, buf)
+	}
+	return ErrNoHealthy
+}
+
+// Read block from a healthy member, or from all of them if reads are
+// verified
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (m *Mirror) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, m.Size()); err != nil {
+		return -1, err
+	}
+	bs := m.BlockSize()
+	if len(data) < bs {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, bs)
+	}
+	var err error
+	if m.Verify {
+		err = m.readVerified(blocknum, data[:bs])
+	} else {
+		err = m.readBalanced(blocknum, data[:bs])
+	}
+	if err != nil {
+		return -1, fmt.Errorf("Unable to read %d: %w", blocknum, err)
+	}
+	atomic.AddUint32(&m.Reads, 1)
+	return bs, nil
+}
+
+// read block from the next healthy member, failing over to the others
+func (m *Mirror) readBalanced(blocknum int, data []byte) error {
+	m.mu.RLock()
+	start := int(atomic.AddUint32(&m.next, 1))
+	for i := 0; i < len(m.Members); i++ {
+		member := (start + i) % len(m.Members)
+		if m.status[member].State != MemberHealthy {
+			continue
+		}
+		_, err := m.Members[member].Read(blocknum, data)
+		if err == nil {
+			atomic.AddUint32(&m.status[member].Reads, 1)
+			m.mu.RUnlock()
+			return nil
+		}
+		m.mu.RUnlock()
+		m.mu.Lock()
+		failErr := m.fail(member, err)
+		m.mu.Unlock()
+		if failErr != nil {
+			return err
+		}
+		m.mu.RLock()
+	}
+	m.mu.RUnlock()
+	return ErrNoHealthy
+}
+
+// read block from every healthy member and compare the copies. Members
+// outvoted by the majority are repaired, without a majority the read fails.
+func (m *Mirror) readVerified(blocknum int, data []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	bs := m.BlockSize()
+	copies := make(map[int][]byte)
+	var lastErr error
+	for member := range m.Members {
+		if m.status[member].State != MemberHealthy {
+			continue
+		}
+		buf := make([]byte, bs)
+		if _, err := m.Members[member].Read(blocknum, buf); err != nil {
+			if m.fail(member, err) != nil {
+				return err
+			}
+			lastErr = err
+			continue
+		}
+		atomic.AddUint32(&m.status[member].Reads, 1)
+		copies[member] = buf
+	}
+	if len(copies) == 0 {
+		if lastErr != nil {
+			return lastErr
+		}
+		return ErrNoHealthy
+	}
+
+	var best []byte
+	votes := 0
+	for _, c := range copies {
+		n := 0
+		for _, other := range copies {
+			if bytes.Equal(c, other) {
+				n++
+			}
+		}
+		if n > votes {
+			best, votes = c, n
+		}
+	}
+	if votes == len(copies) {
+		copy(data, best)
+		return nil
+	}
+	atomic.AddUint32(&m.Mismatches, 1)
+	if 2*votes <= len(copies) {
+		return fmt.Errorf("%w on block %d", ErrMirrorMismatch, blocknum)
+	}
+	for member, c := range copies {
+		if bytes.Equal(c, best) {
+			continue
+		}
+		if err := m.Members[member].Write(blocknum, best); err != nil {
+			m.fail(member, err)
+		}
+	}
+	copy(data, best)
+	return nil
+}
+
+// Write block to every member that has not failed
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (m *Mirror) Write(blocknum int, data []byte) error {
+	bs := m.BlockSize()
+	if bs < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, bs)
+	}
+	if err := checkBlock(blocknum, m.Size()); err != nil {
+		return err
+	}
+	err := m.each(func(member BlockDevice) error {
+		return member.Write(blocknum, data)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, err)
+	}
+	atomic.AddUint32(&m.Writes, 1)
+	return nil
+}
+
+// Release blocks on every member that has not failed
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (m *Mirror) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, m.Size()); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, m.Size()); err != nil {
+		return err
+	}
+	err := m.each(func(member BlockDevice) error {
+		return Trim(member, blocknum, count)
+	})
+	if err != nil {
+		return fmt.Errorf("Unable to trim block (%d): %w", blocknum, err)
+	}
+	atomic.AddUint32(&m.Trims, 1)
+	return nil
+}
+
+// Flush buffered writes of every member that has not failed
+func (m *Mirror) Sync() error {
+	err := m.each(Sync)
+	if err != nil {
+		return fmt.Errorf("Unable to sync mirror: %w", err)
+	}
+	return nil
+}
+
+// apply op to every member that has not failed. Members op fails on are
+// failed, op only fails if it fails on the last healthy member.
+func (m *Mirror) each(op func(BlockDevice) error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for member := range m.Members {
+		if m.status[member].State == MemberFailed {
+			continue
+		}
+		if err := op(m.Members[member]); err != nil {
+			if m.fail(member, err) != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Close every member
+func (m *Mirror) Close() error {
+	var first error
+	for _, member := range m.Members {
+		if err := member.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
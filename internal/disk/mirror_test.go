@@ -0,0 +1,227 @@
+package disk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMirror(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"geometry":        testMirrorGeometry,
+		"balanced reads":  testMirrorBalanced,
+		"verified reads":  testMirrorVerified,
+		"read failover":   testMirrorFailover,
+		"fail and resync": testMirrorResync,
+		"resync online":   testMirrorResyncOnline,
+		"fail resyncing":  testMirrorFailResyncing,
+		"last member":     testMirrorLastMember,
+		"trim":            testMirrorTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testMirrorGeometry(t *testing.T) {
+	_, err := NewMirror(NewMemDisk(10))
+	require.Error(t, err)
+	_, err = NewMirror(NewMemDisk(10), NewMemDisk(11))
+	require.Error(t, err)
+	small, err := NewMemDiskWithBlockSize(10, 512)
+	require.NoError(t, err)
+	_, err = NewMirror(NewMemDisk(10), small)
+	require.Error(t, err)
+	m, err := NewMirror(NewMemDisk(10), NewMemDisk(10))
+	require.NoError(t, err)
+	require.Equal(t, 10, int(m.Size()))
+	require.Equal(t, BLOCK_SIZE, m.BlockSize())
+}
+
+func testMirrorBalanced(t *testing.T) {
+	a, b := NewMemDisk(10), NewMemDisk(10)
+	m, err := NewMirror(a, b)
+	require.NoError(t, err)
+	require.NoError(t, m.Write(3, []byte("mirrored")))
+	require.Equal(t, 1, int(a.Writes))
+	require.Equal(t, 1, int(b.Writes))
+
+	rdata := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 10; i++ {
+		_, err := m.Read(3, rdata)
+		require.NoError(t, err)
+		require.Equal(t, "mirrored", string(rdata[:8]))
+	}
+	require.Equal(t, 5, int(a.Reads))
+	require.Equal(t, 5, int(b.Reads))
+	require.Equal(t, Stats{Reads: 10, Writes: 1}, m.Stats())
+	status := m.Status()
+	require.Equal(t, 5, int(status[0].Reads))
+	require.Equal(t, 5, int(status[1].Reads))
+}
+
+func testMirrorVerified(t *testing.T) {
+	a, b, c := NewMemDisk(10), NewMemDisk(10), NewMemDisk(10)
+	m, err := NewMirror(a, b, c)
+	require.NoError(t, err)
+	m.Verify = true
+	require.NoError(t, m.Write(1, []byte("good")))
+
+	// the odd copy out is outvoted and repaired
+	require.NoError(t, b.Write(1, []byte("rot!")))
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = m.Read(1, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "good", string(rdata[:4]))
+	_, err = b.Read(1, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "good", string(rdata[:4]))
+	require.Equal(t, 1, int(m.Mismatches))
+
+	// two copies can not outvote each other
+	m, err = NewMirror(a, b)
+	require.NoError(t, err)
+	m.Verify = true
+	require.NoError(t, b.Write(1, []byte("rot!")))
+	_, err = m.Read(1, rdata)
+	require.True(t, errors.Is(err, ErrMirrorMismatch))
+	require.Contains(t, m.Report()[0], "verified reads, 1 mismatches")
+}
+
+func testMirrorFailover(t *testing.T) {
+	a := NewMemDisk(10)
+	b := NewFaultyDisk(NewMemDisk(10))
+	m, err := NewMirror(a, b)
+	require.NoError(t, err)
+	require.NoError(t, m.Write(2, []byte("two")))
+
+	b.Inject(Fault{Op: OpRead, Nth: 1})
+	rdata := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 4; i++ {
+		_, err = m.Read(2, rdata)
+		require.NoError(t, err)
+		require.Equal(t, "two", string(rdata[:3]))
+	}
+	status := m.Status()
+	require.Equal(t, MemberHealthy, status[0].State)
+	require.Equal(t, MemberFailed, status[1].State)
+	require.True(t, errors.Is(status[1].Err, ErrInjected))
+	require.Equal(t, 4, int(a.Reads))
+
+	// failed members miss writes
+	require.NoError(t, m.Write(2, []byte("TWO")))
+	require.Equal(t, 1, int(b.Stats().Writes))
+}
+
+func testMirrorResync(t *testing.T) {
+	a, b := NewMemDisk(10), NewMemDisk(10)
+	m, err := NewMirror(a, b)
+	require.NoError(t, err)
+	require.NoError(t, m.Write(0, []byte("zero")))
+	require.NoError(t, m.Fail(1))
+	require.NoError(t, m.Write(4, []byte("four")))
+	require.NoError(t, m.Write(9, []byte("nine")))
+	require.Equal(t, 1, int(b.Writes))
+
+	rdata := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 4; i++ {
+		_, err = m.Read(4, rdata)
+		require.NoError(t, err)
+	}
+	require.Equal(t, 0, int(b.Reads))
+	require.Contains(t, m.Report()[0], "1 of 2 members healthy")
+	require.Contains(t, m.Report()[2], "member 1: failed")
+
+	require.Error(t, m.Resync(0))
+	require.NoError(t, m.Resync(1))
+	status := m.Status()
+	require.Equal(t, MemberHealthy, status[1].State)
+	require.Equal(t, 10, int(status[1].Resynced))
+	require.Equal(t, a.data, b.data)
+}
+
+func testMirrorResyncOnline(t *testing.T) {
+	a, b := NewMemDisk(200), NewMemDisk(200)
+	m, err := NewMirror(a, b)
+	require.NoError(t, err)
+	require.NoError(t, m.Fail(1))
+	done, err := m.StartResync(1)
+	require.NoError(t, err)
+	_, err = m.StartResync(1)
+	require.Error(t, err)
+	// writes during the resync reach both members
+	for i := 199; i >= 0; i-- {
+		require.NoError(t, m.Write(i, []byte{byte(i), 1}))
+	}
+	require.NoError(t, <-done)
+	require.Equal(t, MemberHealthy, m.Status()[1].State)
+	require.Equal(t, a.data, b.data)
+}
+
+// trimHook is an in-memory disk calling hook before every trim
+type trimHook struct {
+	*MemDisk
+	hook func(blocknum int)
+}
+
+func (h *trimHook) Trim(blocknum int, count int) error {
+	h.hook(blocknum)
+	return h.MemDisk.Trim(blocknum, count)
+}
+
+func testMirrorFailResyncing(t *testing.T) {
+	a := NewMemDisk(20)
+	b := &trimHook{MemDisk: NewMemDisk(20), hook: func(int) {}}
+	m, err := NewMirror(a, b)
+	require.NoError(t, err)
+	require.NoError(t, m.Fail(1))
+	require.NoError(t, m.Write(15, []byte("fifteen")))
+
+	// fail the member while block 5 is copied into it, the copy holds m.mu
+	var failErr, restartErr error
+	b.hook = func(blocknum int) {
+		if blocknum == 5 {
+			m.mu.Unlock()
+			failErr = m.Fail(1)
+			_, restartErr = m.StartResync(1)
+			m.mu.Lock()
+		}
+	}
+	done, err := m.StartResync(1)
+	require.NoError(t, err)
+	require.ErrorIs(t, <-done, ErrResyncAborted)
+	require.NoError(t, failErr)
+	require.Error(t, restartErr)
+	status := m.Status()[1]
+	require.Equal(t, MemberFailed, status.State)
+	require.Equal(t, 6, int(status.Resynced))
+	require.NotEqual(t, a.data, b.data)
+
+	b.hook = func(int) {}
+	require.NoError(t, m.Resync(1))
+	require.Equal(t, MemberHealthy, m.Status()[1].State)
+	require.Equal(t, a.data, b.data)
+}
+
+func testMirrorLastMember(t *testing.T) {
+	m, err := NewMirror(NewMemDisk(10), NewFaultyDisk(NewMemDisk(10), Fault{Op: OpWrite, Nth: 1}))
+	require.NoError(t, err)
+	require.NoError(t, m.Write(0, []byte("survives")))
+	require.Equal(t, MemberFailed, m.Status()[1].State)
+	err = m.Fail(0)
+	require.True(t, errors.Is(err, ErrNoHealthy))
+	require.Error(t, m.Fail(2))
+	require.Error(t, m.Resync(0))
+}
+
+func testMirrorTrim(t *testing.T) {
+	a, b := NewMemDisk(10), NewMemDisk(10)
+	m, err := NewMirror(a, b)
+	require.NoError(t, err)
+	require.NoError(t, m.Write(5, []byte("five")))
+	require.NoError(t, Trim(m, 4, 3))
+	require.Equal(t, 1, int(a.Trims))
+	require.Equal(t, 1, int(b.Trims))
+	require.Equal(t, 1, int(m.Stats().Trims))
+	require.Error(t, m.Trim(8, 3))
+}
@@ -0,0 +1,506 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Object-backed block device
+
+An ObjectDisk keeps its blocks in an ObjectStore, GroupBlocks consecutive
+blocks per object: "<name>/meta" holds an objectHeader, "<name>/blocks/%08x"
+the blocks of group n. Objects that do not exist read as zeros, groups
+that become all zeros are deleted again.
+
+Objects are kept in a cache. Changed objects are put in batches of Batch
+objects (or on Sync), and a read that misses the cache fetches the
+ReadAhead objects following the one it needs along with it.
+*/
+
+const (
+	OBJECT_MAGIC   = "SFSOBJCT"
+	OBJECT_VERSION = 1
+)
+
+// objectHeader describes the geometry of an ObjectDisk
+type objectHeader struct {
+	Magic       [8]byte // Object disk magic (OBJECT_MAGIC)
+	Version     uint32  // Object disk format version
+	BlockSize   uint32  // Size of a block (in bytes)
+	Blocks      uint32  // Number of blocks in disk
+	GroupBlocks uint32  // Number of blocks per object
+}
+
+// ObjectConfig describes how an ObjectDisk uses its store
+type ObjectConfig struct {
+	GroupBlocks int // Number of blocks per object of a new disk
+	Cache       int // Number of objects kept in memory
+	Batch       int // Number of changed objects buffered before they are put together
+	ReadAhead   int // Number of objects fetched along with one a read misses
+}
+
+var DefaultObjectConfig = ObjectConfig{
+	GroupBlocks: 16,
+	Cache:       64,
+	Batch:       8,
+	ReadAhead:   2,
+}
+
+// ObjectStats holds the counters of the requests an ObjectDisk sends to
+// its store
+type ObjectStats struct {
+	Gets          uint32 // Number of objects fetched
+	Puts          uint32 // Number of objects stored
+	Deletes       uint32 // Number of objects deleted
+	Batches       uint32 // Number of batches of changed objects put
+	ReadAhead     uint32 // Number of objects fetched ahead of a read
+	ReadAheadHits uint32 // Number of objects fetched ahead that were used
+}
+
+// objectGroup is a cached object
+type objectGroup struct {
+	data  []byte // Blocks of group
+	dirty bool   // Whether or not the object changed since it was fetched
+	ahead bool   // Whether or not the object was fetched ahead and not used yet
+}
+
+var _ BlockDevice = (*ObjectDisk)(nil)
+
+// ObjectDisk keeps its blocks as objects of an ObjectStore
+type ObjectDisk struct {
+	Counters
+	Name      string       // Prefix of the keys of all objects of disk
+	Store     ObjectStore  // Store holding the objects
+	Config    ObjectConfig // Use of store (GroupBlocks as recorded by disk)
+	blocks    uint32
+	blockSize int
+	mu        sync.Mutex
+	cache     map[int]*objectGroup // Cached objects by group
+	order     []int                // Cached groups, least recently used first
+	dirty     int                  // Number of changed objects in cache
+	stats     ObjectStats
+}
+
+// Open the disk kept as objects name/... of store, creating it if it does
+// not exist yet. Existing disks keep their size unless nblocks asks for a
+// larger one; they are never shrunk.
+// store: Store holding the objects
+// name: Prefix of the keys of all objects of disk
+// nblocks: Number of blocks in disk (0 to use size of existing disk)
+// blockSize: Size of a block of a new disk (0 for BLOCK_SIZE or the size of an existing disk)
+// cfg: Use of store
+func OpenObjectDisk(store ObjectStore, name string, nblocks int, blockSize int, cfg ObjectConfig) (*ObjectDisk, error) {
+	if name == "" || strings.HasPrefix(name, "/") || strings.HasSuffix(name, "/") {
+		return nil, fmt.Errorf("Unable to open object disk %q: invalid name", name)
+	}
+	if blockSize != 0 {
+		if err := ValidBlockSize(blockSize); err != nil {
+			return nil, fmt.Errorf("Unable to open object disk %s: %s", name, err.Error())
+		}
+	}
+	if cfg.GroupBlocks <= 0 {
+		cfg.GroupBlocks = DefaultObjectConfig.GroupBlocks
+	}
+	if cfg.Batch < 1 {
+		cfg.Batch = 1
+	}
+	if cfg.ReadAhead < 0 {
+		cfg.ReadAhead = 0
+	}
+	if cfg.Cache < cfg.ReadAhead+1 {
+		cfg.Cache = cfg.ReadAhead + 1
+	}
+	o := &ObjectDisk{Name: name, Store: store, Config: cfg, cache: map[int]*objectGroup{}}
+	if err := o.load(nblocks, blockSize); err != nil {
+		return nil, fmt.Errorf("Unable to open object disk %s: %s", name, err.Error())
+	}
+	return o, nil
+}
+
+// read geometry from meta object, creating or growing the disk to nblocks
+// blocks
+func (o *ObjectDisk) load(nblocks int, blockSize int) error {
+	var header objectHeader
+	meta, err := o.Store.Get(o.Name + "/meta")
+	if errors.Is(err, ErrNoObject) {
+		if nblocks <= 0 {
+			return errors.New("disk does not exist")
+		}
+		if blockSize == 0 {
+			blockSize = BLOCK_SIZE
+		}
+		copy(header.Magic[:], OBJECT_MAGIC)
+		header.Version = OBJECT_VERSION
+		header.BlockSize = uint32(blockSize)
+		header.GroupBlocks = uint32(o.Config.GroupBlocks)
+	} else if err != nil {
+		return err
+	} else {
+		if err := binary.Read(bytes.NewReader(meta), binary.LittleEndian, &header); err != nil {
+			return fmt.Errorf("unable to read meta object: %s", err.Error())
+		}
+		if string(header.Magic[:]) != OBJECT_MAGIC {
+			return errors.New("not an object disk")
+		}
+		if header.Version != OBJECT_VERSION {
+			return fmt.Errorf("unsupported object disk version %d", header.Version)
+		}
+		if err := ValidBlockSize(int(header.BlockSize)); err != nil {
+			return err
+		}
+		if header.GroupBlocks == 0 {
+			return errors.New("meta object is corrupt")
+		}
+		if blockSize != 0 && blockSize != int(header.BlockSize) {
+			return fmt.Errorf("disk has a block size of %d bytes, not %d", header.BlockSize, blockSize)
+		}
+		if nblocks != 0 && nblocks < int(header.Blocks) {
+			return fmt.Errorf("disk has %d blocks, refusing to shrink it to %d", header.Blocks, nblocks)
+		}
+	}
+	o.blockSize = int(header.BlockSize)
+	o.Config.GroupBlocks = int(header.GroupBlocks)
+	if nblocks > int(header.Blocks) {
+		// grown blocks belong to objects that do not exist yet
+		header.Blocks = uint32(nblocks)
+		if err := o.Store.Put(o.Name+"/meta", encode(header)); err != nil {
+			return err
+		}
+		o.stats.Puts++
+	}
+	o.blocks = header.Blocks
+	return nil
+}
+
+// return key of object holding group
+func (o *ObjectDisk) key(group int) string {
+	return fmt.Sprintf("%s/blocks/%08x", o.Name, group)
+}
+
+// return number of groups of disk
+func (o *ObjectDisk) groups() int {
+	return (int(o.blocks) + o.Config.GroupBlocks - 1) / o.Config.GroupBlocks
+}
+
+// fetch blocks of group from store
+func (o *ObjectDisk) fetch(group int) ([]byte, error) {
+	size := o.Config.GroupBlocks * o.blockSize
+	data, err := o.Store.Get(o.key(group))
+	if errors.Is(err, ErrNoObject) {
+		return make([]byte, size), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) != size {
+		return nil, fmt.Errorf("object %s has %d bytes instead of %d", o.key(group), len(data), size)
+	}
+	return data, nil
+}
+
+// return cached group, fetching it (and the groups following it if
+// readAhead is set) on a miss
+func (o *ObjectDisk) group(group int, readAhead bool) (*objectGroup, error) {
+	if g, ok := o.cache[group]; ok {
+		if g.ahead {
+			g.ahead = false
+			o.stats.ReadAheadHits++
+		}
+		o.touch(group)
+		return g, nil
+	}
+	missing := []int{group}
+	if readAhead {
+		for next := group + 1; next <= group+o.Config.ReadAhead && next < o.groups(); next++ {
+			if _, ok := o.cache[next]; !ok {
+				missing = append(missing, next)
+			}
+		}
+	}
+	// objects are fetched concurrently, failing read-ahead is not an error
+	fetched := make([][]byte, len(missing))
+	errs := make([]error, len(missing))
+	var wg sync.WaitGroup
+	for i := range missing {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			fetched[i], errs[i] = o.fetch(missing[i])
+		}(i)
+	}
+	wg.Wait()
+	if errs[0] != nil {
+		return nil, errs[0]
+	}
+	for i := len(missing) - 1; i >= 0; i-- {
+		o.stats.Gets++
+		if errs[i] != nil {
+			continue
+		}
+		o.cache[missing[i]] = &objectGroup{data: fetched[i], ahead: i > 0}
+		o.order = append(o.order, missing[i])
+		if i > 0 {
+			o.stats.ReadAhead++
+		}
+	}
+	o.evict()
+	return o.cache[group], nil
+}
+
+// mark group as most recently used
+func (o *ObjectDisk) touch(group int) {
+	for i, g := range o.order {
+		if g == group {
+			o.order = append(append(o.order[:i:i], o.order[i+1:]...), group)
+			return
+		}
+	}
+}
+
+// drop least recently used unchanged objects beyond the cache size, but
+// never the object used last
+func (o *ObjectDisk) evict() {
+	for i := 0; len(o.cache) > o.Config.Cache && i < len(o.order)-1; {
+		group := o.order[i]
+		if o.cache[group].dirty {
+			i++
+			continue
+		}
+		delete(o.cache, group)
+		o.order = append(o.order[:i], o.order[i+1:]...)
+	}
+}
+
+// mark cached group as changed, putting the batch of changed objects
+// first if it is full
+func (o *ObjectDisk) changed(g *objectGroup) error {
+	if g.dirty {
+		return nil
+	}
+	if o.dirty >= o.Config.Batch {
+		if err := o.flush(); err != nil {
+			return err
+		}
+	}
+	g.dirty = true
+	o.dirty++
+	return nil
+}
+
+// put every changed object, deleting objects that hold only zeros
+func (o *ObjectDisk) flush() error {
+	if o.dirty == 0 {
+		return nil
+	}
+	groups := make([]int, 0, o.dirty)
+	for group, g := range o.cache {
+		if g.dirty {
+			groups = append(groups, group)
+		}
+	}
+	sort.Ints(groups)
+	errs := make([]error, len(groups))
+	deleted := make([]bool, len(groups))
+	var wg sync.WaitGroup
+	for i, group := range groups {
+		wg.Add(1)
+		go func(i int, group int) {
+			defer wg.Done()
+			if data := o.cache[group].data; isZero(data) {
+				deleted[i] = true
+				errs[i] = o.Store.Delete(o.key(group))
+			} else {
+				errs[i] = o.Store.Put(o.key(group), data)
+			}
+		}(i, group)
+	}
+	wg.Wait()
+	var err error
+	for i, group := range groups {
+		if errs[i] != nil {
+			if err == nil {
+				err = errs[i]
+			}
+			continue
+		}
+		if deleted[i] {
+			o.stats.Deletes++
+		} else {
+			o.stats.Puts++
+		}
+		o.cache[group].dirty = false
+		o.dirty--
+	}
+	o.stats.Batches++
+	o.evict()
+	return err
+}
+
+// Return counters of the requests sent to the store
+func (o *ObjectDisk) ObjectStats() ObjectStats {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.stats
+}
+
+// Return status lines of disk
+func (o *ObjectDisk) Report() []string {
+	lines := []string{fmt.Sprintf("objects %s: %d blocks of %d bytes, %d blocks per object", o.Name, o.blocks, o.blockSize, o.Config.GroupBlocks)}
+	if keys, err := o.Store.List(o.Name + "/blocks/"); err == nil {
+		lines[0] += fmt.Sprintf(", %d of %d objects stored", len(keys), o.groups())
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return append(lines,
+		fmt.Sprintf("    %d gets (%d read ahead, %d of them used), %d puts in %d batches, %d deletes",
+			o.stats.Gets, o.stats.ReadAhead, o.stats.ReadAheadHits, o.stats.Puts, o.stats.Batches, o.stats.Deletes),
+		fmt.Sprintf("    %d objects cached, %d changed", len(o.cache), o.dirty))
+}
+
+// Return size of disk (in terms of blocks)
+func (o *ObjectDisk) Size() uint32 {
+	return o.blocks
+}
+
+// Return size of a single block (in bytes)
+func (o *ObjectDisk) BlockSize() int {
+	return o.blockSize
+}
+
+// Read block from the object holding it
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (o *ObjectDisk) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, o.blocks); err != nil {
+		return -1, err
+	}
+	bs := o.blockSize
+	if len(data) < bs {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, bs)
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	g, err := o.group(blocknum/o.Config.GroupBlocks, true)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to read %d: %s", blocknum, err.Error())
+	}
+	offset := blocknum % o.Config.GroupBlocks * bs
+	copy(data, g.data[offset:offset+bs])
+	atomic.AddUint32(&o.Reads, 1)
+	return bs, nil
+}
+
+// Write block into the cached object holding it
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (o *ObjectDisk) Write(blocknum int, data []byte) error {
+	bs := o.blockSize
+	if bs < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, bs)
+	}
+	if err := checkBlock(blocknum, o.blocks); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	g, err := o.group(blocknum/o.Config.GroupBlocks, false)
+	if err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+	}
+	copy(g.data[blocknum%o.Config.GroupBlocks*bs:], data)
+	if err := o.changed(g); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+	}
+	atomic.AddUint32(&o.Writes, 1)
+	return nil
+}
+
+// Release blocks, deleting the objects they cover entirely
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (o *ObjectDisk) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, o.blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, o.blocks); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	gb, bs := o.Config.GroupBlocks, o.blockSize
+	for start := blocknum; start < blocknum+count; {
+		group := start / gb
+		end := (group + 1) * gb
+		if end > blocknum+count {
+			end = blocknum + count
+		}
+		if start == group*gb && (end == (group+1)*gb || end == int(o.blocks)) {
+			// the blocks of a deleted object read as zeros
+			if err := o.Store.Delete(o.key(group)); err != nil {
+				return fmt.Errorf("Unable to trim blocks (%d-%d): %s", blocknum, blocknum+count-1, err.Error())
+			}
+			o.stats.Deletes++
+			if g, ok := o.cache[group]; ok {
+				for i := range g.data {
+					g.data[i] = 0
+				}
+				if g.dirty {
+					g.dirty = false
+					o.dirty--
+				}
+			}
+		} else {
+			g, err := o.group(group, false)
+			if err != nil {
+				return fmt.Errorf("Unable to trim blocks (%d-%d): %s", blocknum, blocknum+count-1, err.Error())
+			}
+			for i := (start - group*gb) * bs; i < (end-group*gb)*bs; i++ {
+				g.data[i] = 0
+			}
+			if err := o.changed(g); err != nil {
+				return fmt.Errorf("Unable to trim blocks (%d-%d): %s", blocknum, blocknum+count-1, err.Error())
+			}
+		}
+		start = end
+	}
+	atomic.AddUint32(&o.Trims, 1)
+	return nil
+}
+
+// Put every changed object into the store
+func (o *ObjectDisk) Sync() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.flush(); err != nil {
+		return fmt.Errorf("Unable to sync object disk %s: %s", o.Name, err.Error())
+	}
+	return nil
+}
+
+// Put every changed object into the store and drop the cache
+func (o *ObjectDisk) Close() error {
+	if err := o.Sync(); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.cache = map[int]*objectGroup{}
+	o.order = nil
+	return nil
+}
@@ -0,0 +1,189 @@
+package disk
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestObjectStore(t *testing.T) {
+	s := NewDirStore(filepath.Join(t.TempDir(), "objects"))
+	keys, err := s.List("")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	_, err = s.Get("a/b")
+	require.ErrorIs(t, err, ErrNoObject)
+
+	require.NoError(t, s.Put("a/b", []byte("first")))
+	require.NoError(t, s.Put("a/c", []byte("second")))
+	require.NoError(t, s.Put("b", []byte("third")))
+	require.NoError(t, s.Put("a/b", []byte("replaced")))
+	data, err := s.Get("a/b")
+	require.NoError(t, err)
+	require.Equal(t, "replaced", string(data))
+	keys, err = s.List("a/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b", "a/c"}, keys)
+	keys, err = s.List("")
+	require.NoError(t, err)
+	require.Equal(t, []string{"a/b", "a/c", "b"}, keys)
+
+	require.NoError(t, s.Delete("a/b"))
+	require.NoError(t, s.Delete("a/b"))
+	_, err = s.Get("a/b")
+	require.ErrorIs(t, err, ErrNoObject)
+	for _, key := range []string{"", "/a", "a/", "a//b", "../a", "a/./b"} {
+		require.Error(t, s.Put(key, nil), key)
+	}
+}
+
+func TestObjectDisk(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"blocks":     testObjectBlocks,
+		"reopen":     testObjectReopen,
+		"batching":   testObjectBatching,
+		"read-ahead": testObjectReadAhead,
+		"trim":       testObjectTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// return object disk of nblocks blocks in a new directory store
+func tempObjectDisk(t *testing.T, nblocks int, cfg ObjectConfig) *ObjectDisk {
+	o, err := OpenObjectDisk(NewDirStore(t.TempDir()), "disk", nblocks, 0, cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { o.Close() })
+	return o
+}
+
+func testObjectBlocks(t *testing.T) {
+	o := tempObjectDisk(t, 20, ObjectConfig{GroupBlocks: 8, Cache: 1, Batch: 1})
+	require.Equal(t, 20, int(o.Size()))
+	fillBlocks(t, o)
+	checkBlocks(t, o)
+	require.Equal(t, Stats{Reads: 20, Writes: 20}, o.Stats())
+
+	// the last object is padded to whole groups
+	require.NoError(t, o.Sync())
+	keys, err := o.Store.List("disk/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"disk/blocks/00000000", "disk/blocks/00000001", "disk/blocks/00000002", "disk/meta"}, keys)
+	data, err := o.Store.Get("disk/blocks/00000002")
+	require.NoError(t, err)
+	require.Equal(t, 8*BLOCK_SIZE, len(data))
+
+	_, err = o.Read(20, make([]byte, BLOCK_SIZE))
+	require.Error(t, err)
+	require.Error(t, o.Write(0, make([]byte, BLOCK_SIZE+1)))
+	require.Contains(t, o.Report()[0], "20 blocks of 4096 bytes, 8 blocks per object, 3 of 3 objects stored")
+	_, err = OpenObjectDisk(o.Store, "", 8, 0, DefaultObjectConfig)
+	require.Error(t, err)
+}
+
+func testObjectReopen(t *testing.T) {
+	store := NewDirStore(t.TempDir())
+	o, err := OpenObjectDisk(store, "disk", 20, 512, ObjectConfig{GroupBlocks: 4})
+	require.NoError(t, err)
+	fillBlocks(t, o)
+	require.NoError(t, o.Close())
+
+	// the geometry is kept by the disk
+	o, err = OpenObjectDisk(store, "disk", 0, 0, DefaultObjectConfig)
+	require.NoError(t, err)
+	require.Equal(t, 512, o.BlockSize())
+	require.Equal(t, 4, o.Config.GroupBlocks)
+	checkBlocks(t, o)
+	_, err = OpenObjectDisk(store, "disk", 10, 0, DefaultObjectConfig)
+	require.Error(t, err)
+	_, err = OpenObjectDisk(store, "disk", 0, 4096, DefaultObjectConfig)
+	require.Error(t, err)
+	_, err = OpenObjectDisk(store, "other", 0, 0, DefaultObjectConfig)
+	require.Error(t, err)
+	o, err = OpenObjectDisk(store, "disk", 30, 0, DefaultObjectConfig)
+	require.NoError(t, err)
+	require.Equal(t, 30, int(o.Size()))
+	require.NoError(t, o.Write(29, []byte("grown")))
+	require.NoError(t, o.Close())
+}
+
+func testObjectBatching(t *testing.T) {
+	o := tempObjectDisk(t, 64, ObjectConfig{GroupBlocks: 4, Cache: 16, Batch: 4})
+
+	// writes to the same objects are put together, four objects at a time
+	fillBlocks(t, o)
+	require.Equal(t, ObjectStats{Gets: 16, Puts: 1 + 12, Batches: 3}, o.ObjectStats())
+	for i := 0; i < 3; i++ {
+		require.NoError(t, o.Write(i, []byte("again")))
+	}
+	require.Equal(t, 17, int(o.ObjectStats().Puts))
+	require.Contains(t, o.Report()[2], "1 changed")
+	require.NoError(t, o.Sync())
+	require.Equal(t, 18, int(o.ObjectStats().Puts))
+	require.Equal(t, 5, int(o.ObjectStats().Batches))
+
+	// changed objects are put before they leave the cache
+	o = tempObjectDisk(t, 64, ObjectConfig{GroupBlocks: 1, Cache: 2, Batch: 8})
+	fillBlocks(t, o)
+	checkBlocks(t, o)
+}
+
+func testObjectReadAhead(t *testing.T) {
+	store := NewDirStore(t.TempDir())
+	cfg := ObjectConfig{GroupBlocks: 2, Cache: 8, Batch: 1, ReadAhead: 3}
+	o, err := OpenObjectDisk(store, "disk", 32, 0, cfg)
+	require.NoError(t, err)
+	fillBlocks(t, o)
+	require.NoError(t, o.Close())
+
+	// sequential reads fetch four objects at a time
+	o, err = OpenObjectDisk(store, "disk", 0, 0, cfg)
+	require.NoError(t, err)
+	defer o.Close()
+	checkBlocks(t, o)
+	stats := o.ObjectStats()
+	require.Equal(t, 16, int(stats.Gets))
+	require.Equal(t, 12, int(stats.ReadAhead))
+	require.Equal(t, 12, int(stats.ReadAheadHits))
+	require.Contains(t, o.Report()[1], "16 gets (12 read ahead, 12 of them used)")
+
+	// objects fetched ahead that fail to load are fetched again
+	require.NoError(t, o.Close())
+	require.NoError(t, os.WriteFile(filepath.Join(store.Dir, "disk", "blocks", "00000001"), []byte("short"), 0600))
+	_, err = o.Read(0, make([]byte, BLOCK_SIZE))
+	require.NoError(t, err)
+	_, err = o.Read(2, make([]byte, BLOCK_SIZE))
+	require.Error(t, err)
+}
+
+func testObjectTrim(t *testing.T) {
+	o := tempObjectDisk(t, 20, ObjectConfig{GroupBlocks: 8, Cache: 4, Batch: 1})
+	fillBlocks(t, o)
+
+	// objects covered entirely are deleted, others zeroed in part
+	require.NoError(t, Trim(o, 6, 14))
+	require.Equal(t, 1, int(o.Stats().Trims))
+	keys, err := o.Store.List("disk/blocks/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"disk/blocks/00000000"}, keys)
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 20; i++ {
+		_, err := o.Read(i, buf)
+		require.NoError(t, err)
+		if i < 6 {
+			require.Equal(t, []byte{byte(i), 0, 0xaa}, buf[:3], "block %d", i)
+		} else {
+			require.Equal(t, make([]byte, BLOCK_SIZE), buf, "block %d", i)
+		}
+	}
+
+	// objects left with zeros only are deleted as well
+	require.NoError(t, o.Trim(0, 6))
+	require.NoError(t, o.Sync())
+	keys, err = o.Store.List("disk/blocks/")
+	require.NoError(t, err)
+	require.Empty(t, keys)
+	require.Error(t, o.Trim(19, 2))
+}
@@ -0,0 +1,152 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+/*
+Object store abstraction
+
+ObjectStore is the small subset of an object storage service ObjectDisk
+needs: whole objects are put, fetched, deleted and listed by key. Keys are
+slash separated paths. DirStore keeps every object as a file below a
+directory, standing in for a real service.
+*/
+
+var ErrNoObject = errors.New("object does not exist")
+
+// ObjectStore keeps objects under keys
+type ObjectStore interface {
+	// Return contents of object key, or ErrNoObject if there is none
+	Get(key string) ([]byte, error)
+	// Store data as object key, replacing any previous contents
+	Put(key string, data []byte) error
+	// Remove object key; removing a missing object is not an error
+	Delete(key string) error
+	// Return keys of all objects starting with prefix in ascending order
+	List(prefix string) ([]string, error)
+}
+
+var _ ObjectStore = (*DirStore)(nil)
+
+// DirStore keeps every object as a file below a directory
+type DirStore struct {
+	Dir string // Directory holding the objects
+}
+
+// Create an object store in directory dir
+// dir: Directory holding the objects (created when first needed)
+func NewDirStore(dir string) *DirStore {
+	return &DirStore{Dir: dir}
+}
+
+// return path of the file holding object key
+func (s *DirStore) path(key string) (string, error) {
+	if key == "" || strings.HasPrefix(key, "/") || strings.HasSuffix(key, "/") {
+		return "", fmt.Errorf("invalid object key %q", key)
+	}
+	for _, part := range strings.Split(key, "/") {
+		if part == "" || part == "." || part == ".." || strings.HasPrefix(part, ".tmp-") {
+			return "", fmt.Errorf("invalid object key %q", key)
+		}
+	}
+	return filepath.Join(s.Dir, filepath.FromSlash(key)), nil
+}
+
+// Return contents of object key
+//
+// key: Key of object
+func (s *DirStore) Get(key string) ([]byte, error) {
+	path, err := s.path(key)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get object: %s", err.Error())
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("Unable to get object %s: %w", key, ErrNoObject)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to get object %s: %s", key, err.Error())
+	}
+	return data, nil
+}
+
+// Store data as object key. The object is replaced at once, readers see
+// either the old or the new contents.
+//
+// key: Key of object
+//
+// data: Contents of object
+func (s *DirStore) Put(key string, data []byte) error {
+	path, err := s.path(key)
+	if err != nil {
+		return fmt.Errorf("Unable to put object: %s", err.Error())
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return fmt.Errorf("Unable to put object %s: %s", key, err.Error())
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-")
+	if err != nil {
+		return fmt.Errorf("Unable to put object %s: %s", key, err.Error())
+	}
+	_, err = tmp.Write(data)
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("Unable to put object %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+// Remove object key
+//
+// key: Key of object
+func (s *DirStore) Delete(key string) error {
+	path, err := s.path(key)
+	if err != nil {
+		return fmt.Errorf("Unable to delete object: %s", err.Error())
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return fmt.Errorf("Unable to delete object %s: %s", key, err.Error())
+	}
+	return nil
+}
+
+// Return keys of all objects starting with prefix
+//
+// prefix: Start of keys to return ("" for all objects)
+func (s *DirStore) List(prefix string) ([]string, error) {
+	keys := []string{}
+	err := filepath.WalkDir(s.Dir, func(path string, entry fs.DirEntry, err error) error {
+		if errors.Is(err, fs.ErrNotExist) && path == s.Dir {
+			return filepath.SkipDir
+		}
+		if err != nil || entry.IsDir() || strings.HasPrefix(entry.Name(), ".tmp-") {
+			return err
+		}
+		rel, err := filepath.Rel(s.Dir, path)
+		if err != nil {
+			return err
+		}
+		if key := filepath.ToSlash(rel); strings.HasPrefix(key, prefix) {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list objects: %s", err.Error())
+	}
+	sort.Strings(keys)
+	return keys, nil
+}
@@ -0,0 +1,399 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Copy-on-write overlay device
+
+Reads fall through to a base device that is never written to, writes land
+in a delta file. The delta file starts with a DeltaHeader of
+DELTA_HEADER_SIZE bytes, followed by the block map (one little-endian
+uint32 per block of the base, 0 if the block is not in the delta,
+DELTA_ZERO if it was trimmed, its 1-based slot otherwise) padded to a
+whole block, followed by the slots.
+*/
+
+const (
+	DELTA_MAGIC       = "SFSDELTA"
+	DELTA_VERSION     = 1
+	DELTA_HEADER_SIZE = 4096
+	DELTA_ZERO        = 0xffffffff // Block map entry of trimmed blocks, they read as zeros
+)
+
+// DeltaHeader describes the base a delta file belongs to
+type DeltaHeader struct {
+	Magic     [8]byte  // Delta magic (DELTA_MAGIC)
+	Version   uint32   // Delta format version
+	BlockSize uint32   // Size of a block (in bytes)
+	Blocks    uint32   // Number of blocks of the base
+	BaseUUID  [16]byte // UUID of the base image (zero if base has no header)
+}
+
+var _ BlockDevice = (*Overlay)(nil)
+
+// Overlay redirects all writes to a base device into a delta file
+type Overlay struct {
+	Counters
+	Name   string // File name of delta file
+	Header DeltaHeader
+	base   BlockDevice // Device unmodified blocks are read from
+	mu     sync.RWMutex
+	file   *os.File
+	slots  []uint32 // Slot of every block in the delta file (0 if not in delta)
+	used   uint32   // Number of slots in delta file
+	free   []uint32 // Slots of trimmed blocks, handed out before new ones
+}
+
+// Stack a delta file on top of base, creating the delta file if it does
+// not exist yet
+// base: Device to read unmodified blocks from
+// path: Path to delta file
+func NewOverlay(base BlockDevice, path string) (*Overlay, error) {
+	file, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open overlay %s: %s", path, err.Error())
+	}
+	o := &Overlay{base: base, Name: path, file: file, slots: make([]uint32, base.Size())}
+	if err := o.load(); err != nil {
+		file.Close()
+		return nil, fmt.Errorf("Unable to open overlay %s: %s", path, err.Error())
+	}
+	return o, nil
+}
+
+// read header and block map of delta file, initializing an empty file
+func (o *Overlay) load() error {
+	expected := DeltaHeader{
+		Version:   DELTA_VERSION,
+		BlockSize: uint32(o.BlockSize()),
+		Blocks:    o.base.Size(),
+	}
+	copy(expected.Magic[:], DELTA_MAGIC)
+	if header := baseHeader(o.base); header != nil {
+		expected.BaseUUID = header.UUID
+	}
+
+	info, err := o.file.Stat()
+	if err != nil {
+		return err
+	}
+	if info.Size() == 0 {
+		o.Header = expected
+		return o.reset()
+	}
+
+	buf := make([]byte, DELTA_HEADER_SIZE)
+	if _, err := o.file.ReadAt(buf, 0); err != nil {
+		return fmt.Errorf("unable to read delta header: %s", err.Error())
+	}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, &o.Header); err != nil {
+		return fmt.Errorf("unable to read delta header: %s", err.Error())
+	}
+	if string(o.Header.Magic[:]) != DELTA_MAGIC {
+		return errors.New("not a delta file")
+	}
+	if o.Header.Version != DELTA_VERSION {
+		return fmt.Errorf("unsupported delta version %d", o.Header.Version)
+	}
+	if o.Header.BlockSize != expected.BlockSize || o.Header.Blocks != expected.Blocks || o.Header.BaseUUID != expected.BaseUUID {
+		return errors.New("delta file belongs to a different base image")
+	}
+
+	blockMap := make([]byte, 4*len(o.slots))
+	if _, err := o.file.ReadAt(blockMap, DELTA_HEADER_SIZE); err != nil {
+		return fmt.Errorf("unable to read block map: %s", err.Error())
+	}
+	for i := range o.slots {
+		o.slots[i] = binary.LittleEndian.Uint32(blockMap[4*i:])
+		if o.slots[i] != DELTA_ZERO && o.slots[i] > o.used {
+			o.used = o.slots[i]
+		}
+	}
+	// slots no block refers to any more are reused
+	taken := make([]bool, o.used+1)
+	for _, slot := range o.slots {
+		if slot != DELTA_ZERO {
+			taken[slot] = true
+		}
+	}
+	for slot := o.used; slot > 0; slot-- {
+		if !taken[slot] {
+			o.free = append(o.free, slot)
+		}
+	}
+	return nil
+}
+
+// write header and an empty block map, dropping all slots
+func (o *Overlay) reset() error {
+	bs := int64(o.BlockSize())
+	mapSize := (int64(4*len(o.slots)) + bs - 1) / bs * bs
+	if err := o.file.Truncate(0); err != nil {
+		return err
+	}
+	if err := o.file.Truncate(DELTA_HEADER_SIZE + mapSize); err != nil {
+		return err
+	}
+	if _, err := o.file.WriteAt(encode(&o.Header), 0); err != nil {
+		return err
+	}
+	for i := range o.slots {
+		o.slots[i] = 0
+	}
+	o.used = 0
+	o.free = nil
+	return nil
+}
+
+// return header of the image at the bottom of dev (if any)
+func baseHeader(dev BlockDevice) *ImageHeader {
+	for dev != nil {
+		switch d := dev.(type) {
+		case *Disk:
+			return d.Header
+		case *MemDisk:
+			return d.Header
+		case *CompactDisk:
+			return d.Header
+		}
+		w, ok := dev.(Wrapper)
+		if !ok {
+			return nil
+		}
+		dev = w.Unwrap()
+	}
+	return nil
+}
+
+// return offset of slot in delta file
+func (o *Overlay) slotOffset(slot uint32) int64 {
+	bs := int64(o.BlockSize())
+	mapSize := (int64(4*len(o.slots)) + bs - 1) / bs * bs
+	return DELTA_HEADER_SIZE + mapSize + int64(slot-1)*bs
+}
+
+// Return base device
+func (o *Overlay) Unwrap() BlockDevice {
+	return o.base
+}
+
+// Return size of overlay (in terms of blocks)
+func (o *Overlay) Size() uint32 {
+	return o.base.Size()
+}
+
+// Return size of a single block (in bytes)
+func (o *Overlay) BlockSize() int {
+	return o.base.BlockSize()
+}
+
+// Return number of blocks written or trimmed in the delta file
+func (o *Overlay) Dirty() int {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	dirty := 0
+	for _, slot := range o.slots {
+		if slot != 0 {
+			dirty++
+		}
+	}
+	return dirty
+}
+
+// Return status lines of overlay and base device
+func (o *Overlay) Report() []string {
+	lines := []string{fmt.Sprintf("overlay %s: %d of %d blocks changed", o.Name, o.Dirty(), len(o.slots))}
+	return append(lines, Report(o.base)...)
+}
+
+// Read block from delta file or base
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (o *Overlay) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, o.Size()); err != nil {
+		return -1, err
+	}
+	bs := o.BlockSize()
+	if len(data) < bs {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, bs)
+	}
+	// a concurrent commit or discard must not reuse the slot under us
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	switch slot := o.slots[blocknum]; slot {
+	case 0:
+		n, err := o.base.Read(blocknum, data)
+		if err == nil {
+			atomic.AddUint32(&o.Reads, 1)
+		}
+		return n, err
+	case DELTA_ZERO:
+		copy(data[:bs], make([]byte, bs))
+	default:
+		if _, err := o.file.ReadAt(data[:bs], o.slotOffset(slot)); err != nil {
+			return -1, fmt.Errorf("Unable to read %d: %s", blocknum, err.Error())
+		}
+	}
+	atomic.AddUint32(&o.Reads, 1)
+	return bs, nil
+}
+
+// Write block to delta file
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (o *Overlay) Write(blocknum int, data []byte) error {
+	bs := o.BlockSize()
+	if bs < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, bs)
+	}
+	if err := checkBlock(blocknum, o.Size()); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	slot := o.slots[blocknum]
+	if slot == 0 || slot == DELTA_ZERO {
+		// copy the block up from the base, short writes keep the rest of it
+		buf := make([]byte, bs)
+		if len(data) < bs && slot == 0 {
+			if _, err := o.base.Read(blocknum, buf); err != nil {
+				return err
+			}
+		}
+		copy(buf, data)
+		slot = o.used + 1
+		if len(o.free) > 0 {
+			slot = o.free[len(o.free)-1]
+		}
+		if _, err := o.file.WriteAt(buf, o.slotOffset(slot)); err != nil {
+			return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+		}
+		// the map entry is written last, a torn write leaves an unused slot
+		var entry [4]byte
+		binary.LittleEndian.PutUint32(entry[:], slot)
+		if _, err := o.file.WriteAt(entry[:], DELTA_HEADER_SIZE+4*int64(blocknum)); err != nil {
+			return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+		}
+		o.slots[blocknum] = slot
+		if slot > o.used {
+			o.used = slot
+		} else {
+			o.free = o.free[:len(o.free)-1]
+		}
+	} else if _, err := o.file.WriteAt(data, o.slotOffset(slot)); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %s", blocknum, err.Error())
+	}
+	atomic.AddUint32(&o.Writes, 1)
+	return nil
+}
+
+// Trim blocks in the delta file: their slots are freed for later writes
+// and the blocks read as zeros, the base is left untouched until a commit
+//
+// blocknum: First block to trim
+//
+// count: Number of blocks to trim
+func (o *Overlay) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, o.Size()); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, o.Size()); err != nil {
+		return err
+	}
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	entries := make([]byte, 4*count)
+	for i := 0; i < count; i++ {
+		binary.LittleEndian.PutUint32(entries[4*i:], DELTA_ZERO)
+	}
+	if _, err := o.file.WriteAt(entries, DELTA_HEADER_SIZE+4*int64(blocknum)); err != nil {
+		return fmt.Errorf("Unable to trim block (%d): %s", blocknum, err.Error())
+	}
+	for i := blocknum; i < blocknum+count; i++ {
+		if slot := o.slots[i]; slot != 0 && slot != DELTA_ZERO {
+			o.free = append(o.free, slot)
+		}
+		o.slots[i] = DELTA_ZERO
+	}
+	atomic.AddUint32(&o.Trims, 1)
+	return nil
+}
+
+// Write every block of the delta file into the base, then empty the
+// delta file
+func (o *Overlay) Commit() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	buf := make([]byte, o.BlockSize())
+	for blocknum, slot := range o.slots {
+		if slot == 0 {
+			continue
+		}
+		if slot == DELTA_ZERO {
+			if err := Trim(o.base, blocknum, 1); err != nil {
+				return fmt.Errorf("Unable to commit overlay: %s", err.Error())
+			}
+			continue
+		}
+		if _, err := o.file.ReadAt(buf, o.slotOffset(slot)); err != nil {
+			return fmt.Errorf("Unable to commit overlay: %s", err.Error())
+		}
+		if err := o.base.Write(blocknum, buf); err != nil {
+			return fmt.Errorf("Unable to commit overlay: %s", err.Error())
+		}
+	}
+	if err := Sync(o.base); err != nil {
+		return fmt.Errorf("Unable to commit overlay: %s", err.Error())
+	}
+	if err := o.reset(); err != nil {
+		return fmt.Errorf("Unable to commit overlay: %s", err.Error())
+	}
+	return nil
+}
+
+// Drop every change held by the delta file
+func (o *Overlay) Discard() error {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if err := o.reset(); err != nil {
+		return fmt.Errorf("Unable to discard overlay: %s", err.Error())
+	}
+	return nil
+}
+
+// Flush delta file to stable storage
+func (o *Overlay) Sync() error {
+	if err := o.file.Sync(); err != nil {
+		return fmt.Errorf("Unable to sync overlay: %s", err.Error())
+	}
+	return nil
+}
+
+// Return bad blocks of the base
+func (o *Overlay) BadBlocks() []int {
+	return BadBlocks(o.base)
+}
+
+// Close delta file and base
+func (o *Overlay) Close() error {
+	if err := o.file.Close(); err != nil {
+		o.base.Close()
+		return fmt.Errorf("Unable to close overlay: %s", err.Error())
+	}
+	return o.base.Close()
+}
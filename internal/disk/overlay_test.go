@@ -0,0 +1,230 @@
+package disk
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestOverlay(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"copy on write":  testOverlayCopyOnWrite,
+		"reopen delta":   testOverlayReopen,
+		"commit":         testOverlayCommit,
+		"discard":        testOverlayDiscard,
+		"other base":     testOverlayOtherBase,
+		"read-only base": testOverlayReadOnlyBase,
+		"trim":           testOverlayTrim,
+		"reuse slots":    testOverlayReuse,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testOverlayCopyOnWrite(t *testing.T) {
+	base := NewMemDisk(10)
+	require.NoError(t, base.Write(2, []byte("base block")))
+	o, err := NewOverlay(base, filepath.Join(t.TempDir(), "delta"))
+	require.NoError(t, err)
+	defer o.Close()
+	require.Equal(t, 10, int(o.Size()))
+
+	require.NoError(t, o.Write(2, []byte("BASE")))
+	require.NoError(t, o.Write(7, []byte("new block")))
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = o.Read(2, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "BASE block", string(rdata[:10]))
+	_, err = o.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), rdata)
+	require.Equal(t, 2, o.Dirty())
+	require.Equal(t, Stats{Reads: 2, Writes: 2}, o.Stats())
+
+	// the base is left untouched
+	_, err = base.Read(2, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "base block", string(rdata[:10]))
+	require.Equal(t, 1, int(base.Writes))
+	require.Error(t, o.Write(10, rdata))
+}
+
+func testOverlayReopen(t *testing.T) {
+	base := NewMemDisk(10)
+	path := filepath.Join(t.TempDir(), "delta")
+	o, err := NewOverlay(base, path)
+	require.NoError(t, err)
+	require.NoError(t, o.Write(4, []byte("four")))
+	require.NoError(t, o.Write(1, []byte("one")))
+	require.NoError(t, o.Close())
+
+	o, err = NewOverlay(base, path)
+	require.NoError(t, err)
+	defer o.Close()
+	require.Equal(t, 2, o.Dirty())
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = o.Read(4, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "four", string(rdata[:4]))
+	_, err = o.Read(1, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "one", string(rdata[:3]))
+}
+
+func testOverlayCommit(t *testing.T) {
+	base := NewMemDisk(10)
+	o, err := NewOverlay(base, filepath.Join(t.TempDir(), "delta"))
+	require.NoError(t, err)
+	defer o.Close()
+	require.NoError(t, o.Write(5, []byte("committed")))
+	require.NoError(t, o.Commit())
+	require.Equal(t, 0, o.Dirty())
+
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = base.Read(5, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "committed", string(rdata[:9]))
+	_, err = o.Read(5, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "committed", string(rdata[:9]))
+}
+
+func testOverlayDiscard(t *testing.T) {
+	base := NewMemDisk(10)
+	path := filepath.Join(t.TempDir(), "delta")
+	o, err := NewOverlay(base, path)
+	require.NoError(t, err)
+	defer o.Close()
+	require.NoError(t, o.Write(5, []byte("discarded")))
+	require.NoError(t, o.Discard())
+	require.Equal(t, 0, o.Dirty())
+	rdata := make([]byte, BLOCK_SIZE)
+	_, err = o.Read(5, rdata)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), rdata)
+	require.Equal(t, 0, int(base.Writes))
+
+	// slots are reused after a discard
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	require.NoError(t, o.Write(6, []byte("again")))
+	after, err := os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, info.Size()+BLOCK_SIZE, after.Size())
+}
+
+func testOverlayOtherBase(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "delta")
+	o, err := NewOverlay(NewMemDisk(10), path)
+	require.NoError(t, err)
+	require.NoError(t, o.Close())
+	_, err = NewOverlay(NewMemDisk(20), path)
+	require.Error(t, err)
+
+	require.NoError(t, os.WriteFile(path, make([]byte, 2*BLOCK_SIZE), 0600))
+	_, err = NewOverlay(NewMemDisk(10), path)
+	require.Error(t, err)
+}
+
+func testOverlayReadOnlyBase(t *testing.T) {
+	base := &Disk{}
+	require.NoError(t, base.OpenReadOnly("../../data/image.5"))
+	err := base.Write(0, []byte("golden"))
+	require.True(t, errors.Is(err, ErrReadOnly))
+
+	golden, err := os.ReadFile("../../data/image.5")
+	require.NoError(t, err)
+	o, err := NewOverlay(base, filepath.Join(t.TempDir(), "delta"))
+	require.NoError(t, err)
+	require.NoError(t, o.Write(0, []byte("golden")))
+	require.Error(t, o.Commit())
+	require.NoError(t, o.Close())
+	after, err := os.ReadFile("../../data/image.5")
+	require.NoError(t, err)
+	require.Equal(t, golden, after)
+}
+
+func testOverlayTrim(t *testing.T) {
+	base := NewMemDisk(10)
+	require.NoError(t, base.Write(2, []byte("two")))
+	require.NoError(t, base.Write(3, []byte("three")))
+	path := filepath.Join(t.TempDir(), "delta")
+	o, err := NewOverlay(base, path)
+	require.NoError(t, err)
+	require.NoError(t, o.Write(3, []byte("THREE")))
+	require.NoError(t, o.Trim(2, 2))
+	require.Error(t, o.Trim(9, 2))
+	require.Equal(t, Stats{Writes: 1, Trims: 1}, o.Stats())
+	require.Equal(t, 2, o.Dirty())
+	require.NoError(t, o.Close())
+
+	// trimmed blocks read as zeros, also after reopening the delta file
+	o, err = NewOverlay(base, path)
+	require.NoError(t, err)
+	defer o.Close()
+	rdata := make([]byte, BLOCK_SIZE)
+	for _, blocknum := range []int{2, 3} {
+		_, err = o.Read(blocknum, rdata)
+		require.NoError(t, err)
+		require.Equal(t, make([]byte, BLOCK_SIZE), rdata, "block %d", blocknum)
+	}
+	_, err = base.Read(2, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "two", string(rdata[:3]))
+
+	// short writes to a trimmed block do not bring the base back
+	require.NoError(t, o.Write(2, []byte("2")))
+	_, err = o.Read(2, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "2\x00\x00", string(rdata[:3]))
+
+	require.NoError(t, o.Commit())
+	_, err = base.Read(2, rdata)
+	require.NoError(t, err)
+	require.Equal(t, "2\x00\x00", string(rdata[:3]))
+	_, err = base.Read(3, rdata)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), rdata)
+}
+
+func testOverlayReuse(t *testing.T) {
+	base := NewMemDisk(10)
+	path := filepath.Join(t.TempDir(), "delta")
+	o, err := NewOverlay(base, path)
+	require.NoError(t, err)
+	require.NoError(t, o.Write(1, []byte("one")))
+	require.NoError(t, o.Write(2, []byte("two")))
+	info, err := os.Stat(path)
+	require.NoError(t, err)
+	size := info.Size()
+
+	// blocks written again after a trim take over freed slots
+	for i := 0; i < 3; i++ {
+		require.NoError(t, o.Trim(1, 2))
+		require.NoError(t, o.Write(2, []byte("TWO")))
+		require.NoError(t, o.Write(1, []byte("ONE")))
+	}
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, size, info.Size())
+
+	// also once the delta file is reopened
+	require.NoError(t, o.Trim(2, 1))
+	require.NoError(t, o.Close())
+	o, err = NewOverlay(base, path)
+	require.NoError(t, err)
+	defer o.Close()
+	require.NoError(t, o.Write(3, []byte("three")))
+	info, err = os.Stat(path)
+	require.NoError(t, err)
+	require.Equal(t, size, info.Size())
+	rdata := make([]byte, BLOCK_SIZE)
+	for blocknum, data := range map[int]string{1: "ONE", 2: "\x00\x00\x00", 3: "three"} {
+		_, err = o.Read(blocknum, rdata)
+		require.NoError(t, err)
+		require.Equal(t, data, string(rdata[:len(data)]), "block %d", blocknum)
+	}
+}
@@ -0,0 +1,275 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync/atomic"
+)
+
+/*
+Partitions
+
+Block 0 of a partitioned device holds a PartitionTable listing up to
+MAX_PARTITIONS ranges of blocks, each of which is exposed as a device of
+its own by a Partition.
+*/
+
+const (
+	PART_MAGIC     = "SFSPARTS"
+	PART_VERSION   = 1
+	MAX_PARTITIONS = 16
+)
+
+var ErrNoPartitionTable = errors.New("device has no partition table")
+
+// PartitionEntry locates a partition on its device
+type PartitionEntry struct {
+	Start  uint32 // First block of partition
+	Blocks uint32 // Number of blocks in partition
+}
+
+// PartitionTable describes the partitions of a device
+type PartitionTable struct {
+	Magic   [8]byte // Partition table magic (PART_MAGIC)
+	Version uint32  // Partition table format version
+	Count   uint32  // Number of partitions
+	Entries [MAX_PARTITIONS]PartitionEntry
+}
+
+// Return partitions listed in table
+func (t *PartitionTable) Partitions() []PartitionEntry {
+	return t.Entries[:t.Count]
+}
+
+// Write a partition table into block 0 of dev, laying out partitions of
+// the given sizes one after the other
+// dev: Device to partition
+// sizes: Number of blocks of every partition
+func CreatePartitions(dev BlockDevice, sizes ...int) (*PartitionTable, error) {
+	if len(sizes) == 0 || len(sizes) > MAX_PARTITIONS {
+		return nil, fmt.Errorf("Unable to partition device: %d partitions requested, 1 to %d supported", len(sizes), MAX_PARTITIONS)
+	}
+	t := &PartitionTable{Version: PART_VERSION, Count: uint32(len(sizes))}
+	copy(t.Magic[:], PART_MAGIC)
+	start := 1
+	for i, size := range sizes {
+		if size <= 0 {
+			return nil, fmt.Errorf("Unable to partition device: partition %d has %d blocks", i, size)
+		}
+		t.Entries[i] = PartitionEntry{Start: uint32(start), Blocks: uint32(size)}
+		start += size
+	}
+	if start > int(dev.Size()) {
+		return nil, fmt.Errorf("Unable to partition device: partitions need %d blocks, device has %d", start, dev.Size())
+	}
+	if err := dev.Write(0, encode(t)); err != nil {
+		return nil, fmt.Errorf("Unable to partition device: %s", err.Error())
+	}
+	return t, nil
+}
+
+// Read partition table from block 0 of dev (nil if dev is not partitioned)
+func ReadPartitionTable(dev BlockDevice) (*PartitionTable, error) {
+	if dev.Size() == 0 {
+		return nil, nil
+	}
+	buf := make([]byte, dev.BlockSize())
+	if _, err := dev.Read(0, buf); err != nil {
+		return nil, fmt.Errorf("Unable to read partition table: %s", err.Error())
+	}
+	if string(buf[:len(PART_MAGIC)]) != PART_MAGIC {
+		return nil, nil
+	}
+	t := &PartitionTable{}
+	if err := binary.Read(bytes.NewReader(buf), binary.LittleEndian, t); err != nil {
+		return nil, fmt.Errorf("Unable to read partition table: %s", err.Error())
+	}
+	if t.Version != PART_VERSION {
+		return nil, fmt.Errorf("Unable to read partition table: unsupported version %d", t.Version)
+	}
+	if t.Count > MAX_PARTITIONS {
+		return nil, fmt.Errorf("Unable to read partition table: %d partitions", t.Count)
+	}
+	end := uint32(1)
+	for i, entry := range t.Partitions() {
+		if entry.Start < end || entry.Blocks == 0 || uint64(entry.Start)+uint64(entry.Blocks) > uint64(dev.Size()) {
+			return nil, fmt.Errorf("Unable to read partition table: partition %d (blocks %d+%d) overlaps or is out of bounds", i, entry.Start, entry.Blocks)
+		}
+		end = entry.Start + entry.Blocks
+	}
+	return t, nil
+}
+
+var _ BlockDevice = (*Partition)(nil)
+
+// Partition exposes a range of blocks of a partitioned device
+type Partition struct {
+	Counters
+	Index  int         // Index of partition in partition table
+	Start  int         // First block of partition on the device
+	Blocks uint32      // Number of blocks in partition
+	dev    BlockDevice // Partitioned device
+}
+
+// Open partition listed in the partition table of dev
+// dev: Partitioned device
+// index: Index of partition in partition table
+func OpenPartition(dev BlockDevice, index int) (*Partition, error) {
+	t, err := ReadPartitionTable(dev)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to open partition %d: %s", index, err.Error())
+	}
+	if t == nil {
+		return nil, fmt.Errorf("Unable to open partition %d: %w", index, ErrNoPartitionTable)
+	}
+	if index < 0 || index >= int(t.Count) {
+		return nil, fmt.Errorf("Unable to open partition %d: device has %d partitions", index, t.Count)
+	}
+	entry := t.Entries[index]
+	return &Partition{dev: dev, Index: index, Start: int(entry.Start), Blocks: entry.Blocks}, nil
+}
+
+// Return partitioned device
+func (p *Partition) Unwrap() BlockDevice {
+	return p.dev
+}
+
+// Return status lines of partition and the device it lives on
+func (p *Partition) Report() []string {
+	lines := []string{fmt.Sprintf("partition %d: blocks %d-%d", p.Index, p.Start, p.Start+int(p.Blocks)-1)}
+	return append(lines, Report(p.dev)...)
+}
+
+// Return size of partition (in terms of blocks)
+func (p *Partition) Size() uint32 {
+	return p.Blocks
+}
+
+// Return size of a single block (in bytes)
+func (p *Partition) BlockSize() int {
+	return p.dev.BlockSize()
+}
+
+// Read block from partition
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (p *Partition) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, p.Blocks); err != nil {
+		return -1, err
+	}
+	n, err := p.dev.Read(p.Start+blocknum, data)
+	if err != nil {
+		return -1, err
+	}
+	atomic.AddUint32(&p.Reads, 1)
+	return n, nil
+}
+
+// Write block to partition
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (p *Partition) Write(blocknum int, data []byte) error {
+	if err := checkBlock(blocknum, p.Blocks); err != nil {
+		return err
+	}
+	if err := p.dev.Write(p.Start+blocknum, data); err != nil {
+		return err
+	}
+	atomic.AddUint32(&p.Writes, 1)
+	return nil
+}
+
+// Read consecutive blocks from partition
+//
+// blocknum: First block to read from
+//
+// bufs: Buffers to read into, one per block
+func (p *Partition) ReadBlocks(blocknum int, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, p.Blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+len(bufs)-1, p.Blocks); err != nil {
+		return err
+	}
+	if err := ReadBlocks(p.dev, p.Start+blocknum, bufs); err != nil {
+		return err
+	}
+	atomic.AddUint32(&p.Reads, uint32(len(bufs)))
+	return nil
+}
+
+// Write consecutive blocks to partition
+//
+// blocknum: First block to write to
+//
+// bufs: Buffers to write from, each holding a whole block
+func (p *Partition) WriteBlocks(blocknum int, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, p.Blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+len(bufs)-1, p.Blocks); err != nil {
+		return err
+	}
+	if err := WriteBlocks(p.dev, p.Start+blocknum, bufs); err != nil {
+		return err
+	}
+	atomic.AddUint32(&p.Writes, uint32(len(bufs)))
+	return nil
+}
+
+// Release blocks of partition
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (p *Partition) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, p.Blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, p.Blocks); err != nil {
+		return err
+	}
+	if err := Trim(p.dev, p.Start+blocknum, count); err != nil {
+		return err
+	}
+	atomic.AddUint32(&p.Trims, 1)
+	return nil
+}
+
+// Flush buffered writes of the device the partition lives on
+func (p *Partition) Sync() error {
+	return Sync(p.dev)
+}
+
+// Return bad blocks of the device the partition lives on that fall into the
+// partition, numbered from its start
+func (p *Partition) BadBlocks() []int {
+	var bad []int
+	for _, blocknum := range BadBlocks(p.dev) {
+		if blocknum >= p.Start && blocknum < p.Start+int(p.Blocks) {
+			bad = append(bad, blocknum-p.Start)
+		}
+	}
+	return bad
+}
+
+// Flush buffered writes; the device the partition lives on stays open as
+// other partitions may still use it
+func (p *Partition) Close() error {
+	return p.Sync()
+}
@@ -0,0 +1,163 @@
+package disk
+
+import (
+	"errors"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPartition(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"create table":   testPartitionCreate,
+		"no table":       testPartitionNoTable,
+		"bad table":      testPartitionBadTable,
+		"isolated":       testPartitionIsolated,
+		"trim and stats": testPartitionTrim,
+		"vectored I/O":   testPartitionBlocks,
+		"bad blocks":     testPartitionBadBlocks,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testPartitionCreate(t *testing.T) {
+	mem := NewMemDisk(20)
+	_, err := CreatePartitions(mem)
+	require.Error(t, err)
+	_, err = CreatePartitions(mem, 10, 10)
+	require.Error(t, err)
+	_, err = CreatePartitions(mem, 10, 0)
+	require.Error(t, err)
+
+	_, err = CreatePartitions(mem, 5, 14)
+	require.NoError(t, err)
+	table, err := ReadPartitionTable(mem)
+	require.NoError(t, err)
+	require.Equal(t, []PartitionEntry{{Start: 1, Blocks: 5}, {Start: 6, Blocks: 14}}, table.Partitions())
+
+	p, err := OpenPartition(mem, 1)
+	require.NoError(t, err)
+	require.Equal(t, 14, int(p.Size()))
+	require.Equal(t, BLOCK_SIZE, p.BlockSize())
+	require.Equal(t, "partition 1: blocks 6-19", p.Report()[0])
+	_, err = OpenPartition(mem, 2)
+	require.Error(t, err)
+}
+
+func testPartitionNoTable(t *testing.T) {
+	mem := NewMemDisk(20)
+	table, err := ReadPartitionTable(mem)
+	require.NoError(t, err)
+	require.Nil(t, table)
+	_, err = OpenPartition(mem, 0)
+	require.True(t, errors.Is(err, ErrNoPartitionTable))
+}
+
+func testPartitionBadTable(t *testing.T) {
+	mem := NewMemDisk(20)
+	table, err := CreatePartitions(mem, 5, 5)
+	require.NoError(t, err)
+	// the device shrank below its partitions
+	small := NewMemDisk(8)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = mem.Read(0, buf)
+	require.NoError(t, err)
+	require.NoError(t, small.Write(0, buf))
+	_, err = ReadPartitionTable(small)
+	require.Error(t, err)
+	require.Equal(t, 2, int(table.Count))
+
+	// the end of a partition must not wrap around
+	table.Entries[1].Blocks = math.MaxUint32 - 2
+	require.NoError(t, mem.Write(0, encode(table)))
+	_, err = ReadPartitionTable(mem)
+	require.Error(t, err)
+}
+
+func testPartitionIsolated(t *testing.T) {
+	mem := NewMemDisk(10)
+	_, err := CreatePartitions(mem, 4, 5)
+	require.NoError(t, err)
+	first, err := OpenPartition(mem, 0)
+	require.NoError(t, err)
+	second, err := OpenPartition(mem, 1)
+	require.NoError(t, err)
+	fillBlocks(t, first)
+	fillBlocks(t, second)
+	checkBlocks(t, first)
+	checkBlocks(t, second)
+	require.Error(t, first.Write(4, []byte("spill")))
+	require.Error(t, second.Write(5, []byte("spill")))
+
+	// partitions sit behind the table
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = mem.Read(5, buf)
+	require.NoError(t, err)
+	require.Equal(t, 0, int(buf[0]))
+	table, err := ReadPartitionTable(mem)
+	require.NoError(t, err)
+	require.Equal(t, 2, int(table.Count))
+}
+
+func testPartitionTrim(t *testing.T) {
+	mem := NewMemDisk(10)
+	_, err := CreatePartitions(mem, 4, 5)
+	require.NoError(t, err)
+	p, err := OpenPartition(mem, 1)
+	require.NoError(t, err)
+	fillBlocks(t, p)
+	require.NoError(t, Trim(p, 1, 4))
+	require.Error(t, p.Trim(4, 2))
+	require.Equal(t, Stats{Writes: 5, Trims: 1}, p.Stats())
+	require.Equal(t, 1, int(mem.Trims))
+	p.Mount()
+	require.Equal(t, 1, int(p.Stats().Mounts))
+	require.Equal(t, 0, int(mem.Stats().Mounts))
+	require.NoError(t, p.Close())
+}
+
+func testPartitionBlocks(t *testing.T) {
+	mem := NewMemDisk(10)
+	_, err := CreatePartitions(mem, 4, 5)
+	require.NoError(t, err)
+	p, err := OpenPartition(mem, 1)
+	require.NoError(t, err)
+	bufs := make([][]byte, 5)
+	for i := range bufs {
+		bufs[i] = []byte{byte(i), 0, 0xaa}
+		bufs[i] = append(bufs[i], make([]byte, BLOCK_SIZE-3)...)
+	}
+	require.NoError(t, p.WriteBlocks(0, bufs))
+	require.Error(t, p.WriteBlocks(1, bufs))
+	checkBlocks(t, p)
+	require.NoError(t, p.ReadBlocks(2, bufs[:3]))
+	require.Equal(t, []byte{4, 0, 0xaa}, bufs[2][:3])
+	require.Error(t, p.ReadBlocks(3, bufs[:3]))
+	require.Equal(t, Stats{Reads: 5 + 3, Writes: 5}, p.Stats())
+	// one write of the partition table, then the partition blocks
+	require.Equal(t, 1+5, int(mem.Writes))
+}
+
+// badBlockDisk is an in-memory disk reporting a fixed list of bad blocks
+type badBlockDisk struct {
+	*MemDisk
+	bad []int
+}
+
+func (b *badBlockDisk) BadBlocks() []int {
+	return b.bad
+}
+
+func testPartitionBadBlocks(t *testing.T) {
+	mem := &badBlockDisk{MemDisk: NewMemDisk(10), bad: []int{0, 2, 5, 9}}
+	_, err := CreatePartitions(mem, 4, 5)
+	require.NoError(t, err)
+	first, err := OpenPartition(mem, 0)
+	require.NoError(t, err)
+	second, err := OpenPartition(mem, 1)
+	require.NoError(t, err)
+	require.Equal(t, []int{1}, BadBlocks(first))
+	require.Equal(t, []int{0, 4}, BadBlocks(second))
+}
@@ -0,0 +1,17 @@
+//go:build !linux
+
+package disk
+
+import "os"
+
+// Release length bytes of file starting at offset, which read as zeros
+// afterwards. Hole punching is only supported on Linux, elsewhere zeros
+// are written.
+func punchHole(file *os.File, offset int64, length int64) error {
+	return zeroRange(file, offset, length)
+}
+
+// Return number of bytes of storage allocated to file
+func allocatedSize(info os.FileInfo) int64 {
+	return info.Size()
+}
@@ -0,0 +1,585 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+Asynchronous I/O queue
+
+A Queue accepts requests without waiting for them: Submit hands a request
+to the scheduler of the queue and returns, while a worker dispatches the
+queued requests to the wrapped device one at a time, in the order the
+scheduler picks, and sends every completed request to the channel given
+on submission. While the queue is plugged requests only collect, so a
+batch submitted between Plug and Unplug is ordered as a whole.
+
+Statistics are kept for every scheduler the queue used, so that schedulers
+can be switched and compared on the same workload.
+*/
+
+var ErrQueueClosed = errors.New("queue is closed")
+
+// Request is a block transfer submitted to a Queue
+type Request struct {
+	Op        Op        // Kind of operation
+	Block     int       // First block of the request
+	Bufs      [][]byte  // Buffers to read into or write from, one per block (nil for trims)
+	Count     int       // Number of blocks released by a trim
+	Err       error     // Result of the request, set on completion
+	Submitted time.Time // Time the request was queued
+	Completed time.Time // Time the request completed
+	seq       uint64
+	done      chan<- *Request
+}
+
+// Return number of blocks covered by the request
+func (r *Request) Blocks() int {
+	if r.Op == OpTrim {
+		return r.Count
+	}
+	return len(r.Bufs)
+}
+
+// transfer req on dev
+func execute(dev BlockDevice, req *Request) error {
+	switch req.Op {
+	case OpRead:
+		if len(req.Bufs) == 1 {
+			_, err := dev.Read(req.Block, req.Bufs[0])
+			return err
+		}
+		return ReadBlocks(dev, req.Block, req.Bufs)
+	case OpWrite:
+		if len(req.Bufs) == 1 {
+			return dev.Write(req.Block, req.Bufs[0])
+		}
+		return WriteBlocks(dev, req.Block, req.Bufs)
+	case OpTrim:
+		return Trim(dev, req.Block, req.Count)
+	}
+	return fmt.Errorf("Unable to execute request: unknown operation %d", int(req.Op))
+}
+
+// Scheduler decides the order queued requests are dispatched in
+type Scheduler interface {
+	// Return name of the scheduling policy
+	Name() string
+	// Queue request
+	Add(req *Request)
+	// Remove and return the request to dispatch next, the last request
+	// having ended at block head (nil if no request is queued)
+	Next(head int, now time.Time) *Request
+	// Return number of queued requests
+	Len() int
+}
+
+// Names of the schedulers NewScheduler knows
+var Schedulers = []string{"fifo", "scan", "deadline"}
+
+// Create scheduler by name, with default settings
+// name: fifo, scan (or elevator) or deadline
+func NewScheduler(name string) (Scheduler, error) {
+	switch name {
+	case "fifo":
+		return NewFIFO(), nil
+	case "scan", "elevator":
+		return NewElevator(), nil
+	case "deadline":
+		return NewDeadline(DefaultReadExpire, DefaultWriteExpire), nil
+	}
+	return nil, fmt.Errorf("unknown scheduler %q (use one of %s)", name, strings.Join(Schedulers, ", "))
+}
+
+// return reqs without req, keeping the order of the others
+func removeRequest(reqs []*Request, req *Request) []*Request {
+	for i, r := range reqs {
+		if r == req {
+			return append(reqs[:i], reqs[i+1:]...)
+		}
+	}
+	return reqs
+}
+
+// insert req into reqs sorted by block, after requests for the same block
+func insertByBlock(reqs []*Request, req *Request) []*Request {
+	i := sort.Search(len(reqs), func(i int) bool { return reqs[i].Block > req.Block })
+	reqs = append(reqs, nil)
+	copy(reqs[i+1:], reqs[i:])
+	reqs[i] = req
+	return reqs
+}
+
+var _ Scheduler = (*FIFO)(nil)
+
+// FIFO dispatches requests in the order they were submitted
+type FIFO struct {
+	reqs []*Request
+}
+
+// Create first in, first out scheduler
+func NewFIFO() *FIFO {
+	return &FIFO{}
+}
+
+func (f *FIFO) Name() string {
+	return "fifo"
+}
+
+func (f *FIFO) Add(req *Request) {
+	f.reqs = append(f.reqs, req)
+}
+
+func (f *FIFO) Next(head int, now time.Time) *Request {
+	if len(f.reqs) == 0 {
+		return nil
+	}
+	req := f.reqs[0]
+	f.reqs = f.reqs[1:]
+	return req
+}
+
+func (f *FIFO) Len() int {
+	return len(f.reqs)
+}
+
+var _ Scheduler = (*Elevator)(nil)
+
+// Elevator sweeps the head across the disk, serving requests in block
+// order until none is left in the direction it moves and then turning
+// around (SCAN)
+type Elevator struct {
+	reqs []*Request // Queued requests sorted by block
+	down bool       // Head moves towards block 0
+}
+
+// Create elevator scheduler, starting upwards
+func NewElevator() *Elevator {
+	return &Elevator{}
+}
+
+func (e *Elevator) Name() string {
+	return "scan"
+}
+
+func (e *Elevator) Add(req *Request) {
+	e.reqs = insertByBlock(e.reqs, req)
+}
+
+func (e *Elevator) Next(head int, now time.Time) *Request {
+	if len(e.reqs) == 0 {
+		return nil
+	}
+	for {
+		var i int
+		if e.down {
+			// closest block at or below head, earliest submitted first
+			i = sort.Search(len(e.reqs), func(i int) bool { return e.reqs[i].Block > head }) - 1
+			if i >= 0 {
+				i = sort.Search(i, func(j int) bool { return e.reqs[j].Block == e.reqs[i].Block })
+			}
+		} else {
+			i = sort.Search(len(e.reqs), func(i int) bool { return e.reqs[i].Block >= head })
+			if i == len(e.reqs) {
+				i = -1
+			}
+		}
+		if i >= 0 {
+			req := e.reqs[i]
+			e.reqs = append(e.reqs[:i], e.reqs[i+1:]...)
+			return req
+		}
+		e.down = !e.down
+	}
+}
+
+func (e *Elevator) Len() int {
+	return len(e.reqs)
+}
+
+// Expiry times of the deadline scheduler Linux uses
+const (
+	DefaultReadExpire  = 500 * time.Millisecond
+	DefaultWriteExpire = 5 * time.Second
+)
+
+var _ Scheduler = (*Deadline)(nil)
+
+// Deadline serves requests in ascending block order, wrapping around to
+// the lowest block at the end (C-LOOK), unless the oldest read or the
+// oldest write has waited longer than its expiry time. Reads expire
+// first as callers usually wait for them.
+type Deadline struct {
+	ReadExpire  time.Duration // Time a read may wait before it is served out of order
+	WriteExpire time.Duration // Time a write or trim may wait before it is served out of order
+	sorted      []*Request    // Queued requests sorted by block
+	reads       []*Request    // Queued reads in submission order
+	writes      []*Request    // Queued writes and trims in submission order
+}
+
+// Create deadline scheduler
+// readExpire: Time a read may wait before it is served out of order
+// writeExpire: Time a write or trim may wait before it is served out of order
+func NewDeadline(readExpire time.Duration, writeExpire time.Duration) *Deadline {
+	return &Deadline{ReadExpire: readExpire, WriteExpire: writeExpire}
+}
+
+func (d *Deadline) Name() string {
+	return "deadline"
+}
+
+func (d *Deadline) Add(req *Request) {
+	d.sorted = insertByBlock(d.sorted, req)
+	if req.Op == OpRead {
+		d.reads = append(d.reads, req)
+	} else {
+		d.writes = append(d.writes, req)
+	}
+}
+
+func (d *Deadline) Next(head int, now time.Time) *Request {
+	if len(d.sorted) == 0 {
+		return nil
+	}
+	var req *Request
+	if len(d.reads) > 0 && now.Sub(d.reads[0].Submitted) >= d.ReadExpire {
+		req = d.reads[0]
+	} else if len(d.writes) > 0 && now.Sub(d.writes[0].Submitted) >= d.WriteExpire {
+		req = d.writes[0]
+	}
+	if req == nil {
+		i := sort.Search(len(d.sorted), func(i int) bool { return d.sorted[i].Block >= head })
+		if i == len(d.sorted) {
+			i = 0
+		}
+		req = d.sorted[i]
+	}
+	d.sorted = removeRequest(d.sorted, req)
+	if req.Op == OpRead {
+		d.reads = removeRequest(d.reads, req)
+	} else {
+		d.writes = removeRequest(d.writes, req)
+	}
+	return req
+}
+
+func (d *Deadline) Len() int {
+	return len(d.sorted)
+}
+
+// QueueStats holds the counters a Queue keeps for one scheduler
+type QueueStats struct {
+	Requests  uint32        // Number of requests dispatched
+	Reordered uint32        // Number of requests dispatched ahead of an earlier one
+	Distance  uint64        // Blocks the head moved between requests
+	MaxDepth  int           // Most requests queued at once
+	Wait      time.Duration // Time requests spent queued
+	MaxWait   time.Duration // Longest time a request spent queued
+}
+
+var _ BlockDevice = (*Queue)(nil)
+var _ AsyncDevice = (*Queue)(nil)
+
+// Queue dispatches requests to the device it wraps in the background, in
+// the order picked by a scheduler
+type Queue struct {
+	BlockDevice
+	mu        sync.Mutex
+	cond      *sync.Cond // Signalled whenever the state of the queue changes
+	scheduler Scheduler
+	plugged   int      // Number of Plug calls not yet undone
+	busy      bool     // A request is being transferred
+	closed    bool     // Close was called, no requests are accepted
+	head      int      // Last block of the last dispatched request
+	seq       uint64   // Sequence number of the last submitted request
+	queued    []uint64 // Sequence numbers of queued requests, ascending
+	stats     map[string]*QueueStats
+	used      []string         // Names of schedulers used, in order of first use
+	stopped   chan struct{}    // Closed when the worker returned
+	now       func() time.Time // Clock, replaced in tests
+}
+
+// Wrap dev in a request queue and start dispatching
+// dev: Device to wrap
+// scheduler: Decides the order queued requests are dispatched in
+func NewQueue(dev BlockDevice, scheduler Scheduler) *Queue {
+	q := &Queue{
+		BlockDevice: dev,
+		stats:       map[string]*QueueStats{},
+		stopped:     make(chan struct{}),
+		now:         time.Now,
+	}
+	q.cond = sync.NewCond(&q.mu)
+	q.scheduler = scheduler
+	q.schedulerStats()
+	go q.run()
+	return q
+}
+
+// return statistics of the current scheduler (lock must be held)
+func (q *Queue) schedulerStats() *QueueStats {
+	name := q.scheduler.Name()
+	stats, ok := q.stats[name]
+	if !ok {
+		stats = &QueueStats{}
+		q.stats[name] = stats
+		q.used = append(q.used, name)
+	}
+	return stats
+}
+
+// Return wrapped device
+func (q *Queue) Unwrap() BlockDevice {
+	return q.BlockDevice
+}
+
+// Return current scheduler
+func (q *Queue) Scheduler() Scheduler {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.scheduler
+}
+
+// Switch to scheduler, handing it the requests still queued
+// scheduler: Decides the order queued requests are dispatched in from now on
+func (q *Queue) SetScheduler(scheduler Scheduler) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var reqs []*Request
+	for q.scheduler.Len() > 0 {
+		reqs = append(reqs, q.scheduler.Next(q.head, q.now()))
+	}
+	sort.Slice(reqs, func(i, j int) bool { return reqs[i].seq < reqs[j].seq })
+	for _, req := range reqs {
+		scheduler.Add(req)
+	}
+	q.scheduler = scheduler
+	q.schedulerStats()
+}
+
+// Return statistics of every scheduler used, by scheduler name
+func (q *Queue) QueueStats() map[string]QueueStats {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	stats := map[string]QueueStats{}
+	for name, s := range q.stats {
+		stats[name] = *s
+	}
+	return stats
+}
+
+// Reset statistics of all schedulers
+func (q *Queue) ResetStats() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.stats = map[string]*QueueStats{}
+	q.used = nil
+	q.schedulerStats()
+}
+
+// Return status lines of queue and wrapped device
+func (q *Queue) Report() []string {
+	q.mu.Lock()
+	lines := []string{fmt.Sprintf("queue: %s scheduler, %d requests queued, head at block %d", q.scheduler.Name(), q.scheduler.Len(), q.head)}
+	for _, name := range q.used {
+		s := q.stats[name]
+		var avg time.Duration
+		if s.Requests > 0 {
+			avg = s.Wait / time.Duration(s.Requests)
+		}
+		lines = append(lines, fmt.Sprintf("    %s: %d requests (%d reordered), head moved %d blocks, waited %v on average and %v at most, up to %d queued",
+			name, s.Requests, s.Reordered, s.Distance, avg, s.MaxWait, s.MaxDepth))
+	}
+	q.mu.Unlock()
+	return append(lines, Report(q.BlockDevice)...)
+}
+
+// Queue req, sending it to done once it completed. Submit does not wait
+// for the request, so done needs room for every request in flight.
+//
+// req: Request to queue
+//
+// done: Channel receiving the completed request
+func (q *Queue) Submit(req *Request, done chan<- *Request) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.closed {
+		return fmt.Errorf("Unable to submit %v of block (%d): %w", req.Op, req.Block, ErrQueueClosed)
+	}
+	q.seq++
+	req.seq = q.seq
+	req.done = done
+	req.Err = nil
+	req.Submitted = q.now()
+	q.scheduler.Add(req)
+	q.queued = append(q.queued, req.seq)
+	if stats := q.schedulerStats(); q.scheduler.Len() > stats.MaxDepth {
+		stats.MaxDepth = q.scheduler.Len()
+	}
+	q.cond.Broadcast()
+	return nil
+}
+
+// Hold back dispatching until Unplug, letting requests collect
+func (q *Queue) Plug() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.plugged++
+}
+
+// Undo a Plug, dispatching again once every Plug was undone
+func (q *Queue) Unplug() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if q.plugged > 0 {
+		q.plugged--
+	}
+	q.cond.Broadcast()
+}
+
+// dispatch requests until the queue is closed and empty
+func (q *Queue) run() {
+	defer close(q.stopped)
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for q.scheduler.Len() == 0 || (q.plugged > 0 && !q.closed) {
+			if q.closed && q.scheduler.Len() == 0 {
+				return
+			}
+			q.cond.Wait()
+		}
+		now := q.now()
+		req := q.scheduler.Next(q.head, now)
+		q.account(req, now)
+		q.busy = true
+		q.mu.Unlock()
+
+		req.Err = execute(q.BlockDevice, req)
+		req.Completed = q.now()
+		req.done <- req
+
+		q.mu.Lock()
+		q.busy = false
+		q.cond.Broadcast()
+	}
+}
+
+// record dispatch of req in the statistics of the current scheduler
+func (q *Queue) account(req *Request, now time.Time) {
+	stats := q.schedulerStats()
+	stats.Requests++
+	if req.seq != q.queued[0] {
+		stats.Reordered++
+	}
+	i := sort.Search(len(q.queued), func(i int) bool { return q.queued[i] >= req.seq })
+	q.queued = append(q.queued[:i], q.queued[i+1:]...)
+
+	distance := req.Block - q.head
+	if distance < 0 {
+		distance = -distance
+	}
+	stats.Distance += uint64(distance)
+	q.head = req.Block
+	if req.Blocks() > 1 {
+		q.head += req.Blocks() - 1
+	}
+
+	wait := now.Sub(req.Submitted)
+	stats.Wait += wait
+	if wait > stats.MaxWait {
+		stats.MaxWait = wait
+	}
+}
+
+// submit req and wait for it
+func (q *Queue) transfer(req *Request) error {
+	done := make(chan *Request, 1)
+	if err := q.Submit(req, done); err != nil {
+		return err
+	}
+	return (<-done).Err
+}
+
+// Read block through the queue, waiting for it
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (q *Queue) Read(blocknum int, data []byte) (int, error) {
+	if err := q.transfer(&Request{Op: OpRead, Block: blocknum, Bufs: [][]byte{data}}); err != nil {
+		return -1, err
+	}
+	return q.BlockSize(), nil
+}
+
+// Write block through the queue, waiting for it
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (q *Queue) Write(blocknum int, data []byte) error {
+	return q.transfer(&Request{Op: OpWrite, Block: blocknum, Bufs: [][]byte{data}})
+}
+
+// Read consecutive blocks as a single request, waiting for it
+//
+// blocknum: First block to read from
+//
+// bufs: Buffers to read into, one per block
+func (q *Queue) ReadBlocks(blocknum int, bufs [][]byte) error {
+	return q.transfer(&Request{Op: OpRead, Block: blocknum, Bufs: bufs})
+}
+
+// Write consecutive blocks as a single request, waiting for it
+//
+// blocknum: First block to write to
+//
+// bufs: Buffers to write from, one per block
+func (q *Queue) WriteBlocks(blocknum int, bufs [][]byte) error {
+	return q.transfer(&Request{Op: OpWrite, Block: blocknum, Bufs: bufs})
+}
+
+// Release blocks through the queue, waiting for it
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (q *Queue) Trim(blocknum int, count int) error {
+	return q.transfer(&Request{Op: OpTrim, Block: blocknum, Count: count})
+}
+
+// wait until every queued request completed
+func (q *Queue) drain() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for q.scheduler.Len() > 0 || q.busy {
+		q.cond.Wait()
+	}
+}
+
+// Wait for queued requests and flush buffered writes of the device
+func (q *Queue) Sync() error {
+	q.drain()
+	return Sync(q.BlockDevice)
+}
+
+// Return bad blocks of the device
+func (q *Queue) BadBlocks() []int {
+	return BadBlocks(q.BlockDevice)
+}
+
+// Complete queued requests, stop dispatching and close the wrapped device
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	q.closed = true
+	q.cond.Broadcast()
+	q.mu.Unlock()
+	<-q.stopped
+	return q.BlockDevice.Close()
+}
@@ -0,0 +1,188 @@
+package disk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// queue dev with a simulated clock, closing it when the test ends
+func newTestQueue(t *testing.T, dev BlockDevice, scheduler Scheduler) (*Queue, *time.Time) {
+	q := NewQueue(dev, scheduler)
+	clock := time.Unix(0, 0)
+	q.now = func() time.Time { return clock }
+	t.Cleanup(func() { q.Close() })
+	return q, &clock
+}
+
+// submit a request per block while plugged, returning blocks in the
+// order the requests completed
+func submitBatch(t *testing.T, q *Queue, op Op, blocks ...int) []int {
+	done := make(chan *Request, len(blocks))
+	q.Plug()
+	for _, block := range blocks {
+		buf := make([]byte, q.BlockSize())
+		require.NoError(t, q.Submit(&Request{Op: op, Block: block, Bufs: [][]byte{buf}}, done))
+	}
+	q.Unplug()
+	order := []int{}
+	for range blocks {
+		req := <-done
+		require.NoError(t, req.Err)
+		order = append(order, req.Block)
+	}
+	return order
+}
+
+func TestQueue(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"schedulers":       testQueueSchedulers,
+		"deadline":         testQueueDeadline,
+		"switch scheduler": testQueueSwitchScheduler,
+		"sync":             testQueueSync,
+		"submit all":       testQueueSubmitAll,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testQueueSchedulers(t *testing.T) {
+	for _, tc := range []struct {
+		scheduler string
+		order     []int
+		distance  uint64
+		reordered uint32
+	}{
+		{"fifo", []int{50, 10, 70, 30, 90, 20}, 280, 0},
+		// sweeps up from the head, then down
+		{"scan", []int{70, 90, 50, 30, 20, 10}, 110, 4},
+		// sweeps up from the head, then starts over at the lowest block
+		{"deadline", []int{70, 90, 10, 20, 30, 50}, 150, 5},
+	} {
+		scheduler, err := NewScheduler(tc.scheduler)
+		require.NoError(t, err)
+		q, _ := newTestQueue(t, NewMemDisk(100), scheduler)
+		_, err = q.Read(60, make([]byte, BLOCK_SIZE))
+		require.NoError(t, err)
+		q.ResetStats()
+
+		require.Equal(t, tc.order, submitBatch(t, q, OpRead, 50, 10, 70, 30, 90, 20), tc.scheduler)
+		require.Equal(t, map[string]QueueStats{
+			tc.scheduler: {Requests: 6, Reordered: tc.reordered, Distance: tc.distance, MaxDepth: 6},
+		}, q.QueueStats(), tc.scheduler)
+		require.Equal(t, uint32(7), q.Stats().Reads)
+	}
+	_, err := NewScheduler("noop")
+	require.Error(t, err)
+}
+
+func testQueueDeadline(t *testing.T) {
+	q, clock := newTestQueue(t, NewMemDisk(100), NewDeadline(time.Second, 5*time.Second))
+
+	// a write that waited too long goes first
+	done := make(chan *Request, 3)
+	q.Plug()
+	require.NoError(t, q.Submit(&Request{Op: OpWrite, Block: 80, Bufs: [][]byte{{1}}}, done))
+	*clock = clock.Add(6 * time.Second)
+	require.NoError(t, q.Submit(&Request{Op: OpRead, Block: 10, Bufs: [][]byte{make([]byte, BLOCK_SIZE)}}, done))
+	require.NoError(t, q.Submit(&Request{Op: OpRead, Block: 20, Bufs: [][]byte{make([]byte, BLOCK_SIZE)}}, done))
+	q.Unplug()
+	order := []int{}
+	for i := 0; i < 3; i++ {
+		order = append(order, (<-done).Block)
+	}
+	require.Equal(t, []int{80, 10, 20}, order)
+	require.Equal(t, 6*time.Second, q.QueueStats()["deadline"].MaxWait)
+
+	// reads expire sooner than writes
+	q.Plug()
+	require.NoError(t, q.Submit(&Request{Op: OpWrite, Block: 30, Bufs: [][]byte{{2}}}, done))
+	require.NoError(t, q.Submit(&Request{Op: OpRead, Block: 5, Bufs: [][]byte{make([]byte, BLOCK_SIZE)}}, done))
+	*clock = clock.Add(2 * time.Second)
+	q.Unplug()
+	require.Equal(t, 5, (<-done).Block)
+	require.Equal(t, 30, (<-done).Block)
+
+	// without expired requests blocks are served in ascending order
+	require.Equal(t, []int{40, 60, 10}, submitBatch(t, q, OpWrite, 10, 60, 40))
+}
+
+func testQueueSwitchScheduler(t *testing.T) {
+	q, _ := newTestQueue(t, NewMemDisk(100), NewFIFO())
+	require.Equal(t, []int{30, 10, 20}, submitBatch(t, q, OpRead, 30, 10, 20))
+
+	// queued requests move to the new scheduler
+	done := make(chan *Request, 3)
+	q.Plug()
+	for _, block := range []int{90, 25, 50} {
+		require.NoError(t, q.Submit(&Request{Op: OpRead, Block: block, Bufs: [][]byte{make([]byte, BLOCK_SIZE)}}, done))
+	}
+	q.SetScheduler(NewElevator())
+	q.Unplug()
+	order := []int{}
+	for i := 0; i < 3; i++ {
+		order = append(order, (<-done).Block)
+	}
+	require.Equal(t, []int{25, 50, 90}, order)
+	require.Equal(t, "scan", q.Scheduler().Name())
+
+	stats := q.QueueStats()
+	require.Equal(t, uint32(3), stats["fifo"].Requests)
+	require.Equal(t, uint32(3), stats["scan"].Requests)
+	report := q.Report()
+	require.Contains(t, report[0], "scan scheduler, 0 requests queued, head at block 90")
+	require.Contains(t, report[1], "fifo: 3 requests (0 reordered), head moved 60 blocks")
+	require.Contains(t, report[2], "scan: 3 requests (2 reordered), head moved 70 blocks")
+}
+
+func testQueueSync(t *testing.T) {
+	q, _ := newTestQueue(t, NewMemDisk(16), NewElevator())
+	fillBlocks(t, q)
+	checkBlocks(t, q)
+	require.Equal(t, Stats{Reads: 16, Writes: 16}, q.Stats())
+
+	bufs := make([][]byte, 4)
+	for i := range bufs {
+		bufs[i] = make([]byte, BLOCK_SIZE)
+	}
+	require.NoError(t, q.ReadBlocks(4, bufs))
+	require.Equal(t, byte(7), bufs[3][0])
+	require.NoError(t, q.WriteBlocks(12, bufs))
+	require.NoError(t, q.Trim(0, 2))
+	_, err := q.Read(16, bufs[0])
+	require.Error(t, err)
+	require.NoError(t, q.Sync())
+	require.Equal(t, uint32(36), q.QueueStats()["scan"].Requests)
+
+	// closing completes queued requests and refuses new ones
+	done := make(chan *Request, 1)
+	q.Plug()
+	require.NoError(t, q.Submit(&Request{Op: OpRead, Block: 12, Bufs: [][]byte{make([]byte, BLOCK_SIZE)}}, done))
+	require.NoError(t, q.Close())
+	req := <-done
+	require.NoError(t, req.Err)
+	require.Equal(t, byte(4), req.Bufs[0][0])
+	require.ErrorIs(t, q.Write(0, []byte{1}), ErrQueueClosed)
+}
+
+func testQueueSubmitAll(t *testing.T) {
+	dev := NewMemDisk(16)
+	fillBlocks(t, dev)
+	q, _ := newTestQueue(t, dev, NewElevator())
+	for _, d := range []BlockDevice{dev, q} {
+		reqs := []*Request{
+			{Op: OpRead, Block: 9, Bufs: [][]byte{make([]byte, BLOCK_SIZE)}},
+			{Op: OpRead, Block: 2, Bufs: [][]byte{make([]byte, BLOCK_SIZE), make([]byte, BLOCK_SIZE)}},
+		}
+		require.NoError(t, SubmitAll(d, reqs))
+		require.Equal(t, byte(9), reqs[0].Bufs[0][0])
+		require.Equal(t, byte(3), reqs[1].Bufs[1][0])
+
+		reqs = append(reqs, &Request{Op: OpWrite, Block: 16, Bufs: [][]byte{{1}}})
+		require.Error(t, SubmitAll(d, reqs))
+		require.Error(t, reqs[2].Err)
+	}
+	// the queued batch went to the lower blocks first
+	require.Equal(t, uint32(2), q.QueueStats()["scan"].Reordered)
+}
@@ -0,0 +1,296 @@
+package disk
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Bad block remapping
+
+The last block of the wrapped device holds a remap table, the Spares blocks
+before it form the spare area. When a write fails with ErrMedia the block
+is moved to the next unused spare and the table is updated; from then on
+every access to the block goes to its spare. Reads of a bad block that was
+never rewritten still fail, as its data is lost.
+*/
+
+const (
+	REMAP_MAGIC   = "SFSREMAP"
+	REMAP_VERSION = 1
+)
+
+// RemapEntry redirects a bad block to a spare block
+type RemapEntry struct {
+	Block uint32 // Bad block
+	Spare uint32 // Spare block holding its data
+}
+
+// remapHeader starts the remap table, followed by Count entries
+type remapHeader struct {
+	Magic   [8]byte // Remap table magic (REMAP_MAGIC)
+	Version uint32  // Remap table format version
+	Spares  uint32  // Number of blocks in spare area
+	Used    uint32  // Number of spares handed out so far
+	Count   uint32  // Number of entries
+}
+
+var _ BlockDevice = (*Remap)(nil)
+
+// Remap hides bad blocks of its device behind blocks of a spare area
+type Remap struct {
+	Counters
+	Spares   uint32       // Number of blocks in spare area
+	Remapped uint32       // Number of blocks moved to a spare so far
+	dev      BlockDevice  // Device with bad blocks
+	mu       sync.RWMutex // Guards the fields below
+	used     uint32       // Number of spares handed out
+	table    map[int]int  // Spare of every remapped block
+	blocks   uint32       // Number of blocks exposed
+}
+
+// Return number of remap table entries fitting into a block of bs bytes
+func remapCapacity(bs int) int {
+	return (bs - binary.Size(remapHeader{})) / binary.Size(RemapEntry{})
+}
+
+// Wrap dev, reserving spare blocks and a remap table at its end. Devices
+// that already carry a remap table keep its spare area.
+// dev: Device to wrap
+// spares: Number of spare blocks of a new remap table
+func NewRemap(dev BlockDevice, spares int) (*Remap, error) {
+	if dev.Size() == 0 {
+		return nil, errors.New("Unable to remap device: device has no blocks")
+	}
+	r := &Remap{dev: dev, table: map[int]int{}}
+	tableBlock := int(dev.Size()) - 1
+	buf := make([]byte, dev.BlockSize())
+	if _, err := dev.Read(tableBlock, buf); err != nil {
+		return nil, fmt.Errorf("Unable to read remap table: %s", err.Error())
+	}
+	if string(buf[:len(REMAP_MAGIC)]) != REMAP_MAGIC {
+		if spares <= 0 || spares > remapCapacity(dev.BlockSize()) {
+			return nil, fmt.Errorf("Unable to remap device: %d spares requested, 1 to %d supported", spares, remapCapacity(dev.BlockSize()))
+		}
+		if spares >= tableBlock {
+			return nil, fmt.Errorf("Unable to remap device: %d spares leave no blocks on a device of %d blocks", spares, dev.Size())
+		}
+		// the table must not overwrite data of a device already in use
+		if !isZero(buf) {
+			return nil, fmt.Errorf("Unable to remap device: block %d is in use", tableBlock)
+		}
+		r.Spares = uint32(spares)
+		r.blocks = uint32(tableBlock - spares)
+		if err := r.writeTable(); err != nil {
+			return nil, err
+		}
+		return r, nil
+	}
+
+	reader := bytes.NewReader(buf)
+	var header remapHeader
+	if err := binary.Read(reader, binary.LittleEndian, &header); err != nil {
+		return nil, fmt.Errorf("Unable to read remap table: %s", err.Error())
+	}
+	if header.Version != REMAP_VERSION {
+		return nil, fmt.Errorf("Unable to read remap table: unsupported version %d", header.Version)
+	}
+	if int(header.Spares) >= tableBlock || int(header.Spares) > remapCapacity(dev.BlockSize()) ||
+		header.Used > header.Spares || header.Count > header.Used {
+		return nil, errors.New("Unable to read remap table: table is corrupt")
+	}
+	r.Spares = header.Spares
+	r.used = header.Used
+	r.blocks = uint32(tableBlock) - header.Spares
+	entries := make([]RemapEntry, header.Count)
+	if err := binary.Read(reader, binary.LittleEndian, entries); err != nil {
+		return nil, fmt.Errorf("Unable to read remap table: %s", err.Error())
+	}
+	for _, entry := range entries {
+		if entry.Block >= r.blocks || entry.Spare < r.blocks || entry.Spare >= r.blocks+r.used {
+			return nil, fmt.Errorf("Unable to read remap table: entry %d -> %d out of bounds", entry.Block, entry.Spare)
+		}
+		r.table[int(entry.Block)] = int(entry.Spare)
+	}
+	r.Remapped = uint32(len(r.table))
+	return r, nil
+}
+
+// write remap table into the last block of the device
+func (r *Remap) writeTable() error {
+	header := remapHeader{Version: REMAP_VERSION, Spares: r.Spares, Used: r.used, Count: uint32(len(r.table))}
+	copy(header.Magic[:], REMAP_MAGIC)
+	buf := append(encode(header), encode(r.Table())...)
+	if err := r.dev.Write(int(r.dev.Size())-1, buf); err != nil {
+		return fmt.Errorf("Unable to write remap table: %s", err.Error())
+	}
+	return nil
+}
+
+// Return wrapped device
+func (r *Remap) Unwrap() BlockDevice {
+	return r.dev
+}
+
+// Return remapped blocks in ascending order
+func (r *Remap) Table() []RemapEntry {
+	entries := make([]RemapEntry, 0, len(r.table))
+	for block := 0; len(entries) < len(r.table); block++ {
+		if spare, ok := r.table[block]; ok {
+			entries = append(entries, RemapEntry{uint32(block), uint32(spare)})
+		}
+	}
+	return entries
+}
+
+// Return status lines of remapping and the device it wraps
+func (r *Remap) Report() []string {
+	r.mu.RLock()
+	lines := []string{fmt.Sprintf("remap: %d of %d spare blocks used, %d blocks remapped", r.used, r.Spares, len(r.table))}
+	for _, entry := range r.Table() {
+		lines = append(lines, fmt.Sprintf("    block %d -> spare %d", entry.Block, entry.Spare))
+	}
+	r.mu.RUnlock()
+	return append(lines, Report(r.dev)...)
+}
+
+// Return size of device (in terms of blocks)
+func (r *Remap) Size() uint32 {
+	return r.blocks
+}
+
+// Return size of a single block (in bytes)
+func (r *Remap) BlockSize() int {
+	return r.dev.BlockSize()
+}
+
+// return block of the wrapped device holding blocknum
+func (r *Remap) locate(blocknum int) int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if spare, ok := r.table[blocknum]; ok {
+		return spare
+	}
+	return blocknum
+}
+
+// Read block from the device, or from its spare if it was remapped
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (r *Remap) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, r.blocks); err != nil {
+		return -1, err
+	}
+	n, err := r.dev.Read(r.locate(blocknum), data)
+	if err != nil {
+		return -1, err
+	}
+	atomic.AddUint32(&r.Reads, 1)
+	return n, nil
+}
+
+// Write block to the device, moving it to a spare if the write fails
+// with a media error
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (r *Remap) Write(blocknum int, data []byte) error {
+	if err := checkBlock(blocknum, r.blocks); err != nil {
+		return err
+	}
+	err := r.dev.Write(r.locate(blocknum), data)
+	if errors.Is(err, ErrMedia) {
+		err = r.remap(blocknum, data)
+	}
+	if err != nil {
+		return err
+	}
+	atomic.AddUint32(&r.Writes, 1)
+	return nil
+}
+
+// move blocknum to the next spare that takes data
+func (r *Remap) remap(blocknum int, data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for r.used < r.Spares {
+		spare := int(r.blocks + r.used)
+		r.used++
+		err := r.dev.Write(spare, data)
+		if errors.Is(err, ErrMedia) {
+			// bad spares are skipped for good
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if _, ok := r.table[blocknum]; !ok {
+			atomic.AddUint32(&r.Remapped, 1)
+		}
+		r.table[blocknum] = spare
+		return r.writeTable()
+	}
+	if err := r.writeTable(); err != nil {
+		return err
+	}
+	// with no spares left the block stays bad
+	return fmt.Errorf("Unable to write to block (%d), no spare blocks left: %w", blocknum, ErrMedia)
+}
+
+// Release blocks (or their spares) on the device
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (r *Remap) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, r.blocks); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, r.blocks); err != nil {
+		return err
+	}
+	// runs of blocks that stayed in place are released at once
+	start := blocknum
+	for i := blocknum; i <= blocknum+count; i++ {
+		physical := i
+		if i < blocknum+count {
+			physical = r.locate(i)
+			if physical == i {
+				continue
+			}
+		}
+		if i > start {
+			if err := Trim(r.dev, start, i-start); err != nil {
+				return err
+			}
+		}
+		if i < blocknum+count {
+			if err := Trim(r.dev, physical, 1); err != nil {
+				return err
+			}
+		}
+		start = i + 1
+	}
+	atomic.AddUint32(&r.Trims, 1)
+	return nil
+}
+
+// Flush buffered writes of the device
+func (r *Remap) Sync() error {
+	return Sync(r.dev)
+}
+
+// Close wrapped device
+func (r *Remap) Close() error {
+	return r.dev.Close()
+}
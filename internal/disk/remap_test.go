@@ -0,0 +1,125 @@
+package disk
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRemap(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"geometry": testRemapGeometry,
+		"remap":    testRemapBadBlocks,
+		"spares":   testRemapSpares,
+		"trim":     testRemapTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// open a disk image of nblocks blocks, closed at the end of the test
+func tempImage(t *testing.T, nblocks int) *Disk {
+	d := &Disk{}
+	require.NoError(t, d.Open(filepath.Join(t.TempDir(), "disk.img"), nblocks))
+	t.Cleanup(func() { d.Close() })
+	return d
+}
+
+func testRemapGeometry(t *testing.T) {
+	_, err := NewRemap(NewMemDisk(10), 0)
+	require.Error(t, err)
+	_, err = NewRemap(NewMemDisk(10), 9)
+	require.Error(t, err)
+	_, err = NewRemap(NewMemDisk(10), remapCapacity(BLOCK_SIZE)+1)
+	require.Error(t, err)
+	// the table is never written over data
+	used := NewMemDisk(10)
+	require.NoError(t, used.Write(9, []byte("data")))
+	_, err = NewRemap(used, 3)
+	require.Error(t, err)
+	require.Equal(t, 1, int(used.Writes))
+
+	mem := NewMemDisk(10)
+	r, err := NewRemap(mem, 3)
+	require.NoError(t, err)
+	require.Equal(t, 6, int(r.Size()))
+	require.Equal(t, 3, int(r.Spares))
+	fillBlocks(t, r)
+	checkBlocks(t, r)
+	_, err = r.Read(6, make([]byte, BLOCK_SIZE))
+	require.Error(t, err)
+	require.Contains(t, r.Report()[0], "remap: 0 of 3 spare blocks used")
+
+	// an existing table keeps its spare area
+	r, err = NewRemap(mem, 5)
+	require.NoError(t, err)
+	require.Equal(t, 6, int(r.Size()))
+	checkBlocks(t, r)
+}
+
+func testRemapBadBlocks(t *testing.T) {
+	d := tempImage(t, 10)
+	r, err := NewRemap(d, 2)
+	require.NoError(t, err)
+	fillBlocks(t, r)
+	require.NoError(t, d.MarkBad(4))
+
+	// the data of a bad block is lost until it is written again
+	_, err = r.Read(4, make([]byte, BLOCK_SIZE))
+	require.ErrorIs(t, err, ErrMedia)
+	fillBlocks(t, r)
+	checkBlocks(t, r)
+	require.Equal(t, []RemapEntry{{4, 7}}, r.Table())
+	require.Equal(t, 1, int(r.Remapped))
+	require.Contains(t, r.Report()[1], "block 4 -> spare 7")
+
+	// the table survives reopening the image
+	require.NoError(t, d.Open(d.Name, 0))
+	r, err = NewRemap(d, 2)
+	require.NoError(t, err)
+	require.Equal(t, []RemapEntry{{4, 7}}, r.Table())
+	checkBlocks(t, r)
+}
+
+func testRemapSpares(t *testing.T) {
+	d := tempImage(t, 10)
+	r, err := NewRemap(d, 2)
+	require.NoError(t, err)
+	fillBlocks(t, r)
+
+	// bad spares are skipped, and blocks stay bad once spares run out
+	require.NoError(t, d.MarkBad(7))
+	require.NoError(t, d.MarkBad(1))
+	require.NoError(t, d.MarkBad(2))
+	require.NoError(t, r.Write(1, []byte{1, 0, 0xaa}))
+	require.Equal(t, []RemapEntry{{1, 8}}, r.Table())
+	require.ErrorIs(t, r.Write(2, make([]byte, BLOCK_SIZE)), ErrMedia)
+	require.Contains(t, r.Report()[0], "2 of 2 spare blocks used, 1 blocks remapped")
+
+	// spares going bad move their block on
+	require.NoError(t, d.MarkBad(8))
+	require.ErrorIs(t, r.Write(1, make([]byte, BLOCK_SIZE)), ErrMedia)
+}
+
+func testRemapTrim(t *testing.T) {
+	mem := NewMemDisk(12)
+	r, err := NewRemap(mem, 2)
+	require.NoError(t, err)
+	r.table[3] = 9
+	r.used = 1
+	fillBlocks(t, r)
+	require.NoError(t, r.Trim(2, 4))
+	require.Equal(t, 1, int(r.Stats().Trims))
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < int(mem.Size()); i++ {
+		_, err := mem.Read(i, buf)
+		require.NoError(t, err)
+		if i == 2 || (i >= 4 && i < 6) || i == 9 {
+			require.Equal(t, make([]byte, BLOCK_SIZE), buf, "block %d", i)
+		} else if i != 3 && i < 9 {
+			require.Equal(t, []byte{byte(i), 0, 0xaa}, buf[:3], "block %d", i)
+		}
+	}
+	require.Error(t, r.Trim(7, 3))
+}
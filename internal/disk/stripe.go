@@ -0,0 +1,560 @@
+package disk
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+Striped block devices (RAID-0 and RAID-5)
+
+The blocks of a striped device are cut into stripe units of Unit blocks,
+which are laid out round-robin over the members. A row holds one unit of
+every member. A Parity device gives one unit of every row to the XOR of
+the other units of the row, so the blocks of any single member can be
+rebuilt from the others. The parity unit rotates from the last member
+backwards, one member per row.
+*/
+
+var ErrDegraded = errors.New("more than one member failed")
+
+// check that members can be striped in units of unit blocks and return
+// number of blocks every member contributes
+func stripeGeometry(unit int, members []BlockDevice) (blocks int, err error) {
+	if unit < 1 {
+		return 0, fmt.Errorf("stripe unit of %d blocks", unit)
+	}
+	var first BlockDevice
+	for i, member := range members {
+		if member == nil {
+			continue
+		}
+		if first == nil {
+			first = member
+			continue
+		}
+		if member.Size() != first.Size() || member.BlockSize() != first.BlockSize() {
+			return 0, fmt.Errorf("member %d has %d blocks of %d bytes, not %d blocks of %d bytes",
+				i, member.Size(), member.BlockSize(), first.Size(), first.BlockSize())
+		}
+	}
+	if first == nil {
+		return 0, errors.New("no members")
+	}
+	blocks = int(first.Size()) / unit * unit
+	if blocks == 0 {
+		return 0, fmt.Errorf("members are smaller than a stripe unit of %d blocks", unit)
+	}
+	return blocks, nil
+}
+
+// return status lines of members, indented below the line of a striped device
+func reportMembers(members []BlockDevice, state func(int) string) []string {
+	var lines []string
+	for i, member := range members {
+		lines = append(lines, fmt.Sprintf("    member %d: %s", i, state(i)))
+		if member == nil {
+			continue
+		}
+		for _, l := range Report(member) {
+			lines = append(lines, "        "+l)
+		}
+	}
+	return lines
+}
+
+// Close every member that is present
+func closeMembers(members []BlockDevice) error {
+	var first error
+	for _, member := range members {
+		if member == nil {
+			continue
+		}
+		if err := member.Close(); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+var _ BlockDevice = (*Stripe)(nil)
+
+// Stripe spreads blocks over its members without redundancy (RAID-0)
+type Stripe struct {
+	Counters
+	Members []BlockDevice
+	Unit    int // Number of blocks per stripe unit
+	blocks  int // Number of blocks every member contributes
+}
+
+// Stripe blocks across members
+// unit: Number of consecutive blocks kept on the same member
+// members: Devices of the same size and block size
+func NewStripe(unit int, members ...BlockDevice) (*Stripe, error) {
+	if len(members) < 2 {
+		return nil, errors.New("Unable to create stripe: at least two members required")
+	}
+	for i, member := range members {
+		if member == nil {
+			return nil, fmt.Errorf("Unable to create stripe: member %d is missing", i)
+		}
+	}
+	blocks, err := stripeGeometry(unit, members)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create stripe: %s", err.Error())
+	}
+	return &Stripe{Members: members, Unit: unit, blocks: blocks}, nil
+}
+
+// return member holding blocknum and the block number on that member
+func (s *Stripe) locate(blocknum int) (member int, physical int) {
+	unit := blocknum / s.Unit
+	row := unit / len(s.Members)
+	return unit % len(s.Members), row*s.Unit + blocknum%s.Unit
+}
+
+// Return status lines of stripe and its members
+func (s *Stripe) Report() []string {
+	lines := []string{fmt.Sprintf("raid0: %d members, stripe unit %d blocks", len(s.Members), s.Unit)}
+	return append(lines, reportMembers(s.Members, func(int) string { return "healthy" })...)
+}
+
+// Return size of stripe (in terms of blocks)
+func (s *Stripe) Size() uint32 {
+	return uint32(len(s.Members) * s.blocks)
+}
+
+// Return size of a single block (in bytes)
+func (s *Stripe) BlockSize() int {
+	return s.Members[0].BlockSize()
+}
+
+// Read block from the member holding it
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (s *Stripe) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, s.Size()); err != nil {
+		return -1, err
+	}
+	member, physical := s.locate(blocknum)
+	n, err := s.Members[member].Read(physical, data)
+	if err != nil {
+		return -1, fmt.Errorf("Unable to read %d: member %d: %w", blocknum, member, err)
+	}
+	atomic.AddUint32(&s.Reads, 1)
+	return n, nil
+}
+
+// Write block to the member holding it
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (s *Stripe) Write(blocknum int, data []byte) error {
+	if err := checkBlock(blocknum, s.Size()); err != nil {
+		return err
+	}
+	member, physical := s.locate(blocknum)
+	if err := s.Members[member].Write(physical, data); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): member %d: %w", blocknum, member, err)
+	}
+	atomic.AddUint32(&s.Writes, 1)
+	return nil
+}
+
+// Release blocks, trimming every run of blocks that is contiguous on a
+// member at once
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (s *Stripe) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, s.Size()); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, s.Size()); err != nil {
+		return err
+	}
+	for i := blocknum; i < blocknum+count; {
+		member, physical := s.locate(i)
+		// the rest of the stripe unit is contiguous on the member
+		run := s.Unit - i%s.Unit
+		if run > blocknum+count-i {
+			run = blocknum + count - i
+		}
+		if err := Trim(s.Members[member], physical, run); err != nil {
+			return fmt.Errorf("Unable to trim block (%d): member %d: %w", i, member, err)
+		}
+		i += run
+	}
+	atomic.AddUint32(&s.Trims, 1)
+	return nil
+}
+
+// Flush buffered writes of every member
+func (s *Stripe) Sync() error {
+	for i, member := range s.Members {
+		if err := Sync(member); err != nil {
+			return fmt.Errorf("Unable to sync member %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Close every member
+func (s *Stripe) Close() error {
+	return closeMembers(s.Members)
+}
+
+var _ BlockDevice = (*Parity)(nil)
+
+// Parity spreads blocks over its members with rotating parity (RAID-5).
+// It keeps working with one member missing or failed.
+type Parity struct {
+	Counters
+	Members       []BlockDevice // Members (nil for a missing member)
+	Unit          int           // Number of blocks per stripe unit
+	Reconstructed uint32        // Number of reads rebuilt from the other members
+	mu            sync.RWMutex
+	blocks        int   // Number of blocks every member contributes
+	bs            int   // Size of a block (in bytes)
+	failed        int   // Member that is missing or failed (-1 if none)
+	failErr       error // Error that failed member (nil if missing or failed by hand)
+}
+
+// Stripe blocks with rotating parity across members
+// unit: Number of consecutive blocks kept on the same member
+// members: Devices of the same size and block size, at most one of them
+// may be nil for a missing member
+func NewParity(unit int, members ...BlockDevice) (*Parity, error) {
+	if len(members) < 3 {
+		return nil, errors.New("Unable to create parity stripe: at least three members required")
+	}
+	p := &Parity{Members: members, Unit: unit, failed: -1}
+	for i, member := range members {
+		if member == nil {
+			if p.failed >= 0 {
+				return nil, fmt.Errorf("Unable to create parity stripe: %w", ErrDegraded)
+			}
+			p.failed = i
+		}
+	}
+	blocks, err := stripeGeometry(unit, members)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to create parity stripe: %s", err.Error())
+	}
+	p.blocks = blocks
+	for _, member := range members {
+		if member != nil {
+			p.bs = member.BlockSize()
+			break
+		}
+	}
+	return p, nil
+}
+
+// return member holding blocknum, member holding the parity of its row and
+// the block number on both members
+func (p *Parity) locate(blocknum int) (member int, parity int, physical int) {
+	n := len(p.Members)
+	unit := blocknum / p.Unit
+	row := unit / (n - 1)
+	parity = n - 1 - row%n
+	member = unit % (n - 1)
+	if member >= parity {
+		member++
+	}
+	return member, parity, row*p.Unit + blocknum%p.Unit
+}
+
+// Return member that is missing or failed (-1 if all members are healthy)
+func (p *Parity) Failed() int {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.failed
+}
+
+// Mark member as failed, its blocks are rebuilt from the other members
+// member: Index of member
+func (p *Parity) Fail(member int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if member < 0 || member >= len(p.Members) {
+		return fmt.Errorf("Unable to fail member %d: device has %d members", member, len(p.Members))
+	}
+	return p.fail(member, nil)
+}
+
+// mark member as failed because of err (must hold p.mu for writing)
+func (p *Parity) fail(member int, err error) error {
+	if p.failed >= 0 && p.failed != member {
+		return fmt.Errorf("Unable to fail member %d: %w", member, ErrDegraded)
+	}
+	p.failed = member
+	p.failErr = err
+	return nil
+}
+
+// Replace a missing or failed member with dev and rebuild its blocks from
+// the other members
+// member: Index of the missing or failed member
+// dev: Device of the same size and block size as the other members
+func (p *Parity) Rebuild(member int, dev BlockDevice) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if member != p.failed || member < 0 {
+		return fmt.Errorf("Unable to rebuild member %d: member has not failed", member)
+	}
+	if int(dev.Size())/p.Unit*p.Unit != p.blocks || dev.BlockSize() != p.bs {
+		return fmt.Errorf("Unable to rebuild member %d: device has %d blocks of %d bytes, not %d blocks of %d bytes",
+			member, dev.Size(), dev.BlockSize(), p.blocks, p.bs)
+	}
+	buf := make([]byte, p.bs)
+	for physical := 0; physical < p.blocks; physical++ {
+		if err := p.reconstruct(member, physical, buf); err != nil {
+			return fmt.Errorf("Unable to rebuild member %d: %s", member, err.Error())
+		}
+		if err := dev.Write(physical, buf); err != nil {
+			return fmt.Errorf("Unable to rebuild member %d: %s", member, err.Error())
+		}
+	}
+	if err := Sync(dev); err != nil {
+		return fmt.Errorf("Unable to rebuild member %d: %s", member, err.Error())
+	}
+	if old := p.Members[member]; old != nil && old != dev {
+		old.Close()
+	}
+	p.Members[member] = dev
+	p.failed = -1
+	p.failErr = nil
+	return nil
+}
+
+// Return status lines of device and its members
+func (p *Parity) Report() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	lines := []string{fmt.Sprintf("raid5: %d members, stripe unit %d blocks, %d reads reconstructed",
+		len(p.Members), p.Unit, atomic.LoadUint32(&p.Reconstructed))}
+	return append(lines, reportMembers(p.Members, func(i int) string {
+		switch {
+		case i != p.failed:
+			return "healthy"
+		case p.Members[i] == nil:
+			return "missing"
+		case p.failErr != nil:
+			return fmt.Sprintf("failed (%s)", p.failErr.Error())
+		}
+		return "failed"
+	})...)
+}
+
+// Return size of device (in terms of blocks)
+func (p *Parity) Size() uint32 {
+	return uint32((len(p.Members) - 1) * p.blocks)
+}
+
+// Return size of a single block (in bytes)
+func (p *Parity) BlockSize() int {
+	return p.bs
+}
+
+// rebuild block physical of member from the other members (must hold p.mu)
+func (p *Parity) reconstruct(member int, physical int, data []byte) error {
+	for i := range data {
+		data[i] = 0
+	}
+	buf := make([]byte, p.bs)
+	for i, other := range p.Members {
+		if i == member {
+			continue
+		}
+		if i == p.failed {
+			return fmt.Errorf("member %d: %w", i, ErrDegraded)
+		}
+		if _, err := other.Read(physical, buf); err != nil {
+			return fmt.Errorf("member %d: %w", i, err)
+		}
+		xorInto(data, buf)
+	}
+	return nil
+}
+
+// read block physical of member, rebuilding it if member has failed or
+// fails the read (must hold p.mu for writing)
+func (p *Parity) readMember(member int, physical int, data []byte) error {
+	if member != p.failed {
+		_, err := p.Members[member].Read(physical, data)
+		if err == nil {
+			return nil
+		}
+		if p.fail(member, err) != nil {
+			return fmt.Errorf("member %d: %w", member, err)
+		}
+	}
+	atomic.AddUint32(&p.Reconstructed, 1)
+	return p.reconstruct(member, physical, data)
+}
+
+// Read block from the member holding it, or rebuild it from the other
+// members if that member is missing or fails the read
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (p *Parity) Read(blocknum int, data []byte) (int, error) {
+	if err := checkBlock(blocknum, p.Size()); err != nil {
+		return -1, err
+	}
+	if len(data) < p.bs {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, p.bs)
+	}
+	member, _, physical := p.locate(blocknum)
+	p.mu.RLock()
+	var err error
+	if member != p.failed {
+		_, err = p.Members[member].Read(physical, data)
+		if err == nil {
+			p.mu.RUnlock()
+			atomic.AddUint32(&p.Reads, 1)
+			return p.bs, nil
+		}
+	}
+	p.mu.RUnlock()
+
+	// rebuild the block from the other members, failing the member if it
+	// failed the read
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err != nil {
+		if p.fail(member, err) != nil {
+			return -1, fmt.Errorf("Unable to read %d: member %d: %w", blocknum, member, err)
+		}
+	}
+	atomic.AddUint32(&p.Reconstructed, 1)
+	if err := p.reconstruct(member, physical, data[:p.bs]); err != nil {
+		return -1, fmt.Errorf("Unable to read %d: %w", blocknum, err)
+	}
+	atomic.AddUint32(&p.Reads, 1)
+	return p.bs, nil
+}
+
+// Write block and update the parity of its row
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (p *Parity) Write(blocknum int, data []byte) error {
+	if p.bs < len(data) {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, p.bs)
+	}
+	if err := checkBlock(blocknum, p.Size()); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if err := p.write(blocknum, data); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, err)
+	}
+	atomic.AddUint32(&p.Writes, 1)
+	return nil
+}
+
+// write block and parity of its row (must hold p.mu for writing)
+func (p *Parity) write(blocknum int, data []byte) error {
+	member, parity, physical := p.locate(blocknum)
+	old := make([]byte, p.bs)
+	if err := p.readMember(member, physical, old); err != nil {
+		return err
+	}
+	block := make([]byte, p.bs)
+	copy(block, old)
+	copy(block, data)
+
+	// new parity = old parity ^ old data ^ new data
+	sum := make([]byte, p.bs)
+	if parity != p.failed {
+		if err := p.readMember(parity, physical, sum); err != nil {
+			return err
+		}
+	}
+	if parity != p.failed {
+		xorInto(sum, old)
+		xorInto(sum, block)
+		if err := p.Members[parity].Write(physical, sum); err != nil {
+			if p.fail(parity, err) != nil {
+				return fmt.Errorf("member %d: %w", parity, err)
+			}
+		}
+	}
+	if member != p.failed {
+		if err := p.Members[member].Write(physical, block); err != nil {
+			// the parity already covers the new data
+			if p.fail(member, err) != nil {
+				return fmt.Errorf("member %d: %w", member, err)
+			}
+		}
+	}
+	return nil
+}
+
+// Release blocks by writing zeros over them (parity is kept up to date)
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (p *Parity) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := checkBlock(blocknum, p.Size()); err != nil {
+		return err
+	}
+	if err := checkBlock(blocknum+count-1, p.Size()); err != nil {
+		return err
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	zero := make([]byte, p.bs)
+	for i := blocknum; i < blocknum+count; i++ {
+		if err := p.write(i, zero); err != nil {
+			return fmt.Errorf("Unable to trim block (%d): %w", i, err)
+		}
+	}
+	atomic.AddUint32(&p.Trims, 1)
+	return nil
+}
+
+// Flush buffered writes of every member that is present
+func (p *Parity) Sync() error {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	for i, member := range p.Members {
+		if i == p.failed {
+			continue
+		}
+		if err := Sync(member); err != nil {
+			return fmt.Errorf("Unable to sync member %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// Close every member that is present
+func (p *Parity) Close() error {
+	return closeMembers(p.Members)
+}
+
+// xor src into dst
+func xorInto(dst []byte, src []byte) {
+	for i := range dst {
+		dst[i] ^= src[i]
+	}
+}
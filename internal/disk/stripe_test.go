@@ -0,0 +1,227 @@
+package disk
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestStripe(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"geometry": testStripeGeometry,
+		"layout":   testStripeLayout,
+		"trim":     testStripeTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// return n in-memory members of nblocks blocks
+func memMembers(n int, nblocks int) []BlockDevice {
+	members := make([]BlockDevice, n)
+	for i := range members {
+		members[i] = NewMemDisk(nblocks)
+	}
+	return members
+}
+
+// write a block naming itself into every block of dev
+func fillBlocks(t *testing.T, dev BlockDevice) {
+	for i := 0; i < int(dev.Size()); i++ {
+		require.NoError(t, dev.Write(i, []byte{byte(i), byte(i >> 8), 0xaa}))
+	}
+}
+
+// check that every block of dev still names itself
+func checkBlocks(t *testing.T, dev BlockDevice) {
+	buf := make([]byte, dev.BlockSize())
+	for i := 0; i < int(dev.Size()); i++ {
+		_, err := dev.Read(i, buf)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i), byte(i >> 8), 0xaa}, buf[:3], "block %d", i)
+	}
+}
+
+func testStripeGeometry(t *testing.T) {
+	_, err := NewStripe(2, NewMemDisk(10))
+	require.Error(t, err)
+	_, err = NewStripe(0, memMembers(2, 10)...)
+	require.Error(t, err)
+	_, err = NewStripe(2, NewMemDisk(10), NewMemDisk(12))
+	require.Error(t, err)
+	_, err = NewStripe(2, NewMemDisk(10), nil)
+	require.Error(t, err)
+	// partial stripe units at the end of the members are left unused
+	s, err := NewStripe(4, memMembers(3, 10)...)
+	require.NoError(t, err)
+	require.Equal(t, 24, int(s.Size()))
+}
+
+func testStripeLayout(t *testing.T) {
+	members := memMembers(3, 8)
+	s, err := NewStripe(2, members...)
+	require.NoError(t, err)
+	fillBlocks(t, s)
+	checkBlocks(t, s)
+
+	// blocks 0-1 on member 0, 2-3 on member 1, 4-5 on member 2, 6-7 on member 0
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = members[0].Read(2, buf)
+	require.NoError(t, err)
+	require.Equal(t, 6, int(buf[0]))
+	_, err = members[2].Read(1, buf)
+	require.NoError(t, err)
+	require.Equal(t, 5, int(buf[0]))
+	for _, member := range members {
+		require.Equal(t, 8, int(member.Stats().Writes))
+	}
+	require.Equal(t, Stats{Reads: 24, Writes: 24}, s.Stats())
+	require.Error(t, s.Write(24, buf))
+}
+
+func testStripeTrim(t *testing.T) {
+	members := memMembers(2, 8)
+	s, err := NewStripe(4, members...)
+	require.NoError(t, err)
+	fillBlocks(t, s)
+	// blocks 2-3 and 8-9 on member 0, blocks 4-7 on member 1
+	require.NoError(t, s.Trim(2, 8))
+	require.Equal(t, 2, int(members[0].Stats().Trims))
+	require.Equal(t, 1, int(members[1].Stats().Trims))
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < 16; i++ {
+		_, err := s.Read(i, buf)
+		require.NoError(t, err)
+		require.Equal(t, i < 2 || i >= 10, buf[2] == 0xaa, "block %d", i)
+	}
+}
+
+func TestParity(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"geometry":       testParityGeometry,
+		"parity":         testParityLayout,
+		"failed member":  testParityFailedMember,
+		"missing member": testParityMissingMember,
+		"read errors":    testParityReadErrors,
+		"rebuild":        testParityRebuild,
+		"trim":           testParityTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testParityGeometry(t *testing.T) {
+	_, err := NewParity(1, memMembers(2, 10)...)
+	require.Error(t, err)
+	_, err = NewParity(1, NewMemDisk(10), nil, nil)
+	require.True(t, errors.Is(err, ErrDegraded))
+	p, err := NewParity(4, memMembers(4, 10)...)
+	require.NoError(t, err)
+	require.Equal(t, 24, int(p.Size()))
+	require.Equal(t, -1, p.Failed())
+}
+
+func testParityLayout(t *testing.T) {
+	members := memMembers(3, 6)
+	p, err := NewParity(2, members...)
+	require.NoError(t, err)
+	fillBlocks(t, p)
+	checkBlocks(t, p)
+
+	// the parity unit moves from the last member backwards
+	rows := [][]int{{0, 1, 2}, {0, 2, 1}, {1, 2, 0}}
+	buf := make([]byte, BLOCK_SIZE)
+	for row, layout := range rows {
+		for i, member := range layout[:2] {
+			_, err := members[member].Read(row*2, buf)
+			require.NoError(t, err)
+			require.Equal(t, row*4+i*2, int(buf[0]), "row %d", row)
+		}
+		// the parity of two blocks naming themselves cancels the marker
+		_, err := members[layout[2]].Read(row*2, buf)
+		require.NoError(t, err)
+		require.Equal(t, byte(0), buf[2], "row %d", row)
+		require.Equal(t, byte(row*4)^byte(row*4+2), buf[0], "row %d", row)
+	}
+}
+
+func testParityFailedMember(t *testing.T) {
+	for failed := 0; failed < 3; failed++ {
+		members := memMembers(3, 8)
+		p, err := NewParity(2, members...)
+		require.NoError(t, err)
+		fillBlocks(t, p)
+		require.NoError(t, p.Fail(failed))
+		require.True(t, errors.Is(p.Fail((failed+1)%3), ErrDegraded))
+		checkBlocks(t, p)
+		// writes while degraded are still readable
+		fillBlocks(t, p)
+		checkBlocks(t, p)
+		require.Greater(t, int(p.Reconstructed), 0)
+	}
+}
+
+func testParityMissingMember(t *testing.T) {
+	members := memMembers(3, 8)
+	p, err := NewParity(2, members...)
+	require.NoError(t, err)
+	fillBlocks(t, p)
+
+	p, err = NewParity(2, members[0], nil, members[2])
+	require.NoError(t, err)
+	require.Equal(t, 1, p.Failed())
+	checkBlocks(t, p)
+	require.Contains(t, p.Report()[2], "member 1: missing")
+}
+
+func testParityReadErrors(t *testing.T) {
+	members := memMembers(3, 8)
+	faulty := NewFaultyDisk(members[1])
+	members[1] = faulty
+	p, err := NewParity(2, members...)
+	require.NoError(t, err)
+	fillBlocks(t, p)
+
+	faulty.Inject(Fault{Op: OpRead, Nth: faulty.reads + 1})
+	checkBlocks(t, p)
+	require.Equal(t, 1, p.Failed())
+	require.Contains(t, p.Report()[2], "member 1: failed (Unable to read 0: injected fault)")
+}
+
+func testParityRebuild(t *testing.T) {
+	members := memMembers(3, 8)
+	p, err := NewParity(2, members...)
+	require.NoError(t, err)
+	fillBlocks(t, p)
+	want := append([]byte(nil), members[2].(*MemDisk).data...)
+
+	p, err = NewParity(2, members[0], members[1], nil)
+	require.NoError(t, err)
+	require.Error(t, p.Rebuild(0, NewMemDisk(8)))
+	require.Error(t, p.Rebuild(2, NewMemDisk(6)))
+	replacement := NewMemDisk(8)
+	require.NoError(t, p.Rebuild(2, replacement))
+	require.Equal(t, -1, p.Failed())
+	require.Equal(t, want, replacement.data)
+	checkBlocks(t, p)
+	require.Equal(t, 0, int(p.Reconstructed))
+}
+
+func testParityTrim(t *testing.T) {
+	members := memMembers(3, 8)
+	p, err := NewParity(2, members...)
+	require.NoError(t, err)
+	fillBlocks(t, p)
+	require.NoError(t, Trim(p, 3, 4))
+	require.Equal(t, 1, int(p.Stats().Trims))
+
+	// the parity still rebuilds the blocks of a failed member
+	require.NoError(t, p.Fail(0))
+	buf := make([]byte, BLOCK_SIZE)
+	for i := 0; i < int(p.Size()); i++ {
+		_, err := p.Read(i, buf)
+		require.NoError(t, err)
+		require.Equal(t, i < 3 || i >= 7, buf[2] == 0xaa, "block %d", i)
+	}
+}
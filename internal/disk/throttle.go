@@ -0,0 +1,230 @@
+package disk
+
+import (
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+I/O throttling
+
+A Throttle delays the operations of the device it wraps to keep them
+within limits on operations and bytes per second. Each limit is a token
+bucket holding up to Burst operations worth of tokens; an operation takes
+its tokens and, when a bucket runs dry, sleeps until the bucket has
+refilled. Tokens are taken ahead of time, so operations issued
+concurrently queue up behind each other instead of all waking at once.
+*/
+
+// ThrottleConfig describes the limits of a Throttle
+type ThrottleConfig struct {
+	IOPS      float64       // Operations per second (0 for no limit)
+	Bandwidth float64       // Bytes per second (0 for no limit)
+	Burst     int           // Operations issued back to back before limits apply (0 for 1)
+	Jitter    time.Duration // Upper bound of a random delay added to every operation
+}
+
+// Return human readable description of limits
+func (c ThrottleConfig) String() string {
+	limits := []string{}
+	if c.IOPS > 0 {
+		limits = append(limits, fmt.Sprintf("%g IOPS", c.IOPS))
+	}
+	if c.Bandwidth > 0 {
+		limits = append(limits, fmt.Sprintf("%.0f bytes/s", c.Bandwidth))
+	}
+	if c.Jitter > 0 {
+		limits = append(limits, fmt.Sprintf("jitter up to %v", c.Jitter))
+	}
+	if len(limits) == 0 {
+		return "no limits"
+	}
+	return strings.Join(limits, ", ")
+}
+
+// ThrottleStats holds the time a Throttle delayed operations
+type ThrottleStats struct {
+	Operations uint32        // Number of operations passed through
+	Delayed    uint32        // Number of operations delayed
+	Throttled  time.Duration // Time spent waiting for tokens
+	Jitter     time.Duration // Time spent in random delays
+}
+
+// tokenBucket refills at rate tokens per second up to capacity
+type tokenBucket struct {
+	rate     float64   // Tokens added per second (0 for no limit)
+	capacity float64   // Tokens held by a full bucket
+	tokens   float64   // Tokens available (negative when taken ahead of time)
+	last     time.Time // Time tokens were last added
+}
+
+// take n tokens, returning how long to wait until they are available
+func (b *tokenBucket) take(n float64, now time.Time) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	if b.last.IsZero() {
+		b.tokens = b.capacity
+	} else if elapsed := now.Sub(b.last).Seconds(); elapsed > 0 {
+		b.tokens += elapsed * b.rate
+		if b.tokens > b.capacity {
+			b.tokens = b.capacity
+		}
+	}
+	b.last = now
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+var _ BlockDevice = (*Throttle)(nil)
+
+// Throttle limits the rate of operations on the device it wraps
+type Throttle struct {
+	BlockDevice
+	Config ThrottleConfig
+	mu     sync.Mutex
+	ops    tokenBucket
+	bytes  tokenBucket
+	rand   *rand.Rand
+	stats  ThrottleStats
+	now    func() time.Time    // Clock, replaced in tests
+	sleep  func(time.Duration) // Waits for a duration, replaced in tests
+}
+
+// Wrap dev in a throttle
+// dev: Device to wrap
+// cfg: Limits of operations on dev
+func NewThrottle(dev BlockDevice, cfg ThrottleConfig) *Throttle {
+	burst := float64(cfg.Burst)
+	if burst < 1 {
+		burst = 1
+	}
+	return &Throttle{
+		BlockDevice: dev,
+		Config:      cfg,
+		ops:         tokenBucket{rate: cfg.IOPS, capacity: burst},
+		bytes:       tokenBucket{rate: cfg.Bandwidth, capacity: burst * float64(dev.BlockSize())},
+		rand:        rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:         time.Now,
+		sleep:       time.Sleep,
+	}
+}
+
+// Return wrapped device
+func (t *Throttle) Unwrap() BlockDevice {
+	return t.BlockDevice
+}
+
+// Return time spent throttled
+func (t *Throttle) ThrottleStats() ThrottleStats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.stats
+}
+
+// Reset throttling statistics (tokens are kept)
+func (t *Throttle) ResetStats() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.stats = ThrottleStats{}
+}
+
+// Return status lines of throttle and wrapped device
+func (t *Throttle) Report() []string {
+	stats := t.ThrottleStats()
+	lines := []string{
+		fmt.Sprintf("throttle: %s", t.Config),
+		fmt.Sprintf("    %d of %d operations delayed, %v throttled, %v jitter", stats.Delayed, stats.Operations, stats.Throttled, stats.Jitter),
+	}
+	return append(lines, Report(t.BlockDevice)...)
+}
+
+// wait until an operation transferring n bytes may be issued
+func (t *Throttle) wait(n int) {
+	t.mu.Lock()
+	now := t.now()
+	delay := t.ops.take(1, now)
+	if wait := t.bytes.take(float64(n), now); wait > delay {
+		delay = wait
+	}
+	var jitter time.Duration
+	if t.Config.Jitter > 0 {
+		jitter = time.Duration(t.rand.Int63n(int64(t.Config.Jitter)))
+	}
+	t.stats.Operations++
+	if delay+jitter > 0 {
+		t.stats.Delayed++
+	}
+	t.stats.Throttled += delay
+	t.stats.Jitter += jitter
+	t.mu.Unlock()
+	if delay+jitter > 0 {
+		t.sleep(delay + jitter)
+	}
+}
+
+// Read block once the limits allow it
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (t *Throttle) Read(blocknum int, data []byte) (int, error) {
+	t.wait(t.BlockSize())
+	return t.BlockDevice.Read(blocknum, data)
+}
+
+// Write block once the limits allow it
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (t *Throttle) Write(blocknum int, data []byte) error {
+	t.wait(t.BlockSize())
+	return t.BlockDevice.Write(blocknum, data)
+}
+
+// Read consecutive blocks as a single operation once the limits allow it
+//
+// blocknum: First block to read from
+//
+// bufs: Buffers to read into, one per block
+func (t *Throttle) ReadBlocks(blocknum int, bufs [][]byte) error {
+	t.wait(len(bufs) * t.BlockSize())
+	return ReadBlocks(t.BlockDevice, blocknum, bufs)
+}
+
+// Write consecutive blocks as a single operation once the limits allow it
+//
+// blocknum: First block to write to
+//
+// bufs: Buffers to write from, one per block
+func (t *Throttle) WriteBlocks(blocknum int, bufs [][]byte) error {
+	t.wait(len(bufs) * t.BlockSize())
+	return WriteBlocks(t.BlockDevice, blocknum, bufs)
+}
+
+// Release blocks once the limits allow it (trims transfer no data)
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (t *Throttle) Trim(blocknum int, count int) error {
+	t.wait(0)
+	return Trim(t.BlockDevice, blocknum, count)
+}
+
+// Flush buffered writes of the device
+func (t *Throttle) Sync() error {
+	return Sync(t.BlockDevice)
+}
+
+// Return bad blocks of the device
+func (t *Throttle) BadBlocks() []int {
+	return BadBlocks(t.BlockDevice)
+}
@@ -0,0 +1,95 @@
+package disk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// throttle dev with a simulated clock that sleeping advances
+func newTestThrottle(dev BlockDevice, cfg ThrottleConfig) (*Throttle, *time.Time) {
+	t := NewThrottle(dev, cfg)
+	clock := time.Unix(0, 0)
+	t.now = func() time.Time { return clock }
+	t.sleep = func(d time.Duration) { clock = clock.Add(d) }
+	return t, &clock
+}
+
+func TestThrottle(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"iops":      testThrottleIOPS,
+		"bandwidth": testThrottleBandwidth,
+		"burst":     testThrottleBurst,
+		"jitter":    testThrottleJitter,
+		"no limits": testThrottleNoLimits,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+func testThrottleIOPS(t *testing.T) {
+	th, clock := newTestThrottle(NewMemDisk(16), ThrottleConfig{IOPS: 100})
+	start := *clock
+	fillBlocks(t, th)
+	checkBlocks(t, th)
+
+	// the first operation finds a full bucket
+	require.Equal(t, 310*time.Millisecond, clock.Sub(start))
+	require.Equal(t, ThrottleStats{Operations: 32, Delayed: 31, Throttled: 310 * time.Millisecond}, th.ThrottleStats())
+	require.Equal(t, Stats{Reads: 16, Writes: 16}, th.Stats())
+
+	// idle time refills the bucket, but no more than it holds
+	*clock = clock.Add(time.Second)
+	th.ResetStats()
+	require.NoError(t, th.Trim(0, 4))
+	require.NoError(t, th.Write(0, []byte{1}))
+	require.Equal(t, ThrottleStats{Operations: 2, Delayed: 1, Throttled: 10 * time.Millisecond}, th.ThrottleStats())
+	require.Contains(t, th.Report()[0], "throttle: 100 IOPS")
+}
+
+func testThrottleBandwidth(t *testing.T) {
+	th, clock := newTestThrottle(NewMemDisk(16), ThrottleConfig{Bandwidth: 10 * BLOCK_SIZE})
+	start := *clock
+	fillBlocks(t, th)
+	require.Equal(t, 1500*time.Millisecond, clock.Sub(start))
+
+	// vectored I/O counts the bytes of every block, trims none
+	th.ResetStats()
+	bufs := make([][]byte, 5)
+	for i := range bufs {
+		bufs[i] = make([]byte, BLOCK_SIZE)
+	}
+	require.NoError(t, ReadBlocks(th, 0, bufs))
+	require.Equal(t, 500*time.Millisecond, th.ThrottleStats().Throttled)
+	require.NoError(t, th.Trim(0, 16))
+	require.Equal(t, 500*time.Millisecond, th.ThrottleStats().Throttled)
+	require.Equal(t, 2, int(th.ThrottleStats().Operations))
+}
+
+func testThrottleBurst(t *testing.T) {
+	th, clock := newTestThrottle(NewMemDisk(16), ThrottleConfig{IOPS: 10, Burst: 4})
+	start := *clock
+	fillBlocks(t, th)
+	require.Equal(t, 1200*time.Millisecond, clock.Sub(start))
+	require.Equal(t, 12, int(th.ThrottleStats().Delayed))
+}
+
+func testThrottleJitter(t *testing.T) {
+	th, _ := newTestThrottle(NewMemDisk(16), ThrottleConfig{Jitter: 5 * time.Millisecond})
+	fillBlocks(t, th)
+	stats := th.ThrottleStats()
+	require.Zero(t, stats.Throttled)
+	require.Greater(t, stats.Jitter, time.Duration(0))
+	require.Less(t, stats.Jitter, 16*5*time.Millisecond)
+	require.Contains(t, th.Report()[0], "jitter up to 5ms")
+}
+
+func testThrottleNoLimits(t *testing.T) {
+	th := NewThrottle(NewMemDisk(16), ThrottleConfig{})
+	fillBlocks(t, th)
+	checkBlocks(t, th)
+	require.Equal(t, ThrottleStats{Operations: 32}, th.ThrottleStats())
+	require.Contains(t, th.Report()[0], "no limits")
+	require.Error(t, th.Write(16, []byte{1}))
+}
@@ -0,0 +1,267 @@
+package disk
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+/*
+Block I/O tracing and replay
+*/
+
+// TraceRecord describes a single traced block operation. Traces are
+// stored as one JSON encoded record per line.
+type TraceRecord struct {
+	Time  int64  `json:"us"`              // Microseconds since tracing started
+	Op    string `json:"op"`              // Operation ("read", "write" or "trim")
+	Block int    `json:"block"`           // Block operated on
+	Count int    `json:"count,omitempty"` // Number of blocks trimmed (trims only)
+	Hash  string `json:"hash"`            // Hash of the data transferred
+	Cause string `json:"cause,omitempty"` // Filesystem operation causing the I/O
+	Data  []byte `json:"data,omitempty"`  // Data written (writes only)
+	Err   string `json:"err,omitempty"`   // Error returned by the device (if any)
+}
+
+var _ BlockDevice = (*Tracer)(nil)
+
+// Tracer wraps a device and records every operation it performs
+type Tracer struct {
+	BlockDevice
+	mu      sync.Mutex
+	w       io.Writer
+	buf     *bufio.Writer
+	enc     *json.Encoder
+	start   time.Time
+	cause   string // Operation responsible for the following I/O
+	records uint32 // Number of records written
+}
+
+// Wrap dev in a tracer writing to w
+// dev: Device to trace
+// w: Destination of the trace (closed by Close if it is an io.Closer)
+func NewTracer(dev BlockDevice, w io.Writer) *Tracer {
+	buf := bufio.NewWriter(w)
+	return &Tracer{
+		BlockDevice: dev,
+		w:           w,
+		buf:         buf,
+		enc:         json.NewEncoder(buf),
+		start:       time.Now(),
+	}
+}
+
+// Return wrapped device
+func (t *Tracer) Unwrap() BlockDevice {
+	return t.BlockDevice
+}
+
+// Set the operation responsible for the following I/O
+func (t *Tracer) Annotate(cause string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.cause = cause
+}
+
+// Return status lines of tracer and wrapped device
+func (t *Tracer) Report() []string {
+	t.mu.Lock()
+	lines := []string{fmt.Sprintf("trace: %d records", t.records)}
+	t.mu.Unlock()
+	return append(lines, Report(t.BlockDevice)...)
+}
+
+// Read block from disk and record it
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (t *Tracer) Read(blocknum int, data []byte) (int, error) {
+	n, err := t.BlockDevice.Read(blocknum, data)
+	record := TraceRecord{Op: OpRead.String(), Block: blocknum}
+	if err != nil {
+		record.Err = err.Error()
+	} else {
+		record.Hash = hashBlock(data[:n])
+	}
+	t.record(record)
+	return n, err
+}
+
+// Write block to disk and record it
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (t *Tracer) Write(blocknum int, data []byte) error {
+	err := t.BlockDevice.Write(blocknum, data)
+	record := TraceRecord{Op: OpWrite.String(), Block: blocknum, Hash: hashBlock(data), Data: data}
+	if err != nil {
+		record.Err = err.Error()
+	}
+	t.record(record)
+	return err
+}
+
+// Release blocks of disk and record it
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (t *Tracer) Trim(blocknum int, count int) error {
+	err := Trim(t.BlockDevice, blocknum, count)
+	record := TraceRecord{Op: OpTrim.String(), Block: blocknum, Count: count}
+	if err != nil {
+		record.Err = err.Error()
+	}
+	t.record(record)
+	return err
+}
+
+// Flush the trace and the wrapped device
+func (t *Tracer) Sync() error {
+	t.mu.Lock()
+	err := t.buf.Flush()
+	t.mu.Unlock()
+	if err != nil {
+		return fmt.Errorf("Unable to flush trace: %s", err.Error())
+	}
+	return Sync(t.BlockDevice)
+}
+
+// Return bad blocks of the traced device
+func (t *Tracer) BadBlocks() []int {
+	return BadBlocks(t.BlockDevice)
+}
+
+// Flush and close the trace, then close the wrapped device
+func (t *Tracer) Close() error {
+	t.mu.Lock()
+	err := t.buf.Flush()
+	if c, ok := t.w.(io.Closer); ok && err == nil {
+		err = c.Close()
+	}
+	t.mu.Unlock()
+	if err != nil {
+		t.BlockDevice.Close()
+		return fmt.Errorf("Unable to close trace: %s", err.Error())
+	}
+	return t.BlockDevice.Close()
+}
+
+// write record to the trace
+func (t *Tracer) record(record TraceRecord) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	record.Time = time.Since(t.start).Microseconds()
+	record.Cause = t.cause
+	// tracing must never fail the traced operation
+	if t.enc.Encode(&record) == nil {
+		t.records++
+	}
+}
+
+// Return hex encoded hash of data
+func hashBlock(data []byte) string {
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:8])
+}
+
+// Read all records of a trace
+func ReadTrace(r io.Reader) ([]TraceRecord, error) {
+	var records []TraceRecord
+	dec := json.NewDecoder(r)
+	for {
+		var record TraceRecord
+		err := dec.Decode(&record)
+		if errors.Is(err, io.EOF) {
+			return records, nil
+		}
+		if err != nil {
+			return records, fmt.Errorf("Unable to read trace record %d: %s", len(records)+1, err.Error())
+		}
+		records = append(records, record)
+	}
+}
+
+// ReplayResult summarizes a replayed trace. Records are numbered from 1 in
+// the order they appear in the trace, both here and in replay errors
+type ReplayResult struct {
+	Reads      int   // Number of reads replayed
+	Writes     int   // Number of writes replayed
+	Trims      int   // Number of trims replayed
+	Skipped    int   // Number of records skipped because they failed when traced
+	Mismatches []int // Number of every read record returning different data than traced
+}
+
+// Replay the operations of a trace against dev, checking that every read
+// returns the data that was traced
+// r: Trace to replay
+// dev: Device to replay trace on
+func Replay(r io.Reader, dev BlockDevice) (ReplayResult, error) {
+	var result ReplayResult
+	records, err := ReadTrace(r)
+	if err != nil {
+		return result, err
+	}
+	buf := make([]byte, dev.BlockSize())
+	for i, record := range records {
+		if record.Err != "" {
+			result.Skipped++
+			continue
+		}
+		Annotate(dev, record.Cause)
+		switch record.Op {
+		case OpRead.String():
+			n, err := dev.Read(record.Block, buf)
+			if err != nil {
+				return result, fmt.Errorf("Unable to replay record %d: %s", i+1, err.Error())
+			}
+			if hashBlock(buf[:n]) != record.Hash {
+				result.Mismatches = append(result.Mismatches, i+1)
+			}
+			result.Reads++
+		case OpWrite.String():
+			if hashBlock(record.Data) != record.Hash {
+				return result, fmt.Errorf("Unable to replay record %d: data does not match hash", i+1)
+			}
+			if err := dev.Write(record.Block, record.Data); err != nil {
+				return result, fmt.Errorf("Unable to replay record %d: %s", i+1, err.Error())
+			}
+			result.Writes++
+		case OpTrim.String():
+			if err := Trim(dev, record.Block, record.Count); err != nil {
+				return result, fmt.Errorf("Unable to replay record %d: %s", i+1, err.Error())
+			}
+			result.Trims++
+		default:
+			return result, fmt.Errorf("Unable to replay record %d: unknown operation %q", i+1, record.Op)
+		}
+	}
+	return result, nil
+}
+
+// Return index of the first record where two traces perform a different
+// operation (ignoring timing), or -1 if they perform the same operations
+func DiffTraces(a, b []TraceRecord) int {
+	for i := range a {
+		if i == len(b) {
+			return i
+		}
+		if a[i].Op != b[i].Op || a[i].Block != b[i].Block || a[i].Count != b[i].Count || a[i].Hash != b[i].Hash ||
+			a[i].Cause != b[i].Cause || !bytes.Equal(a[i].Data, b[i].Data) || a[i].Err != b[i].Err {
+			return i
+		}
+	}
+	if len(a) != len(b) {
+		return len(a)
+	}
+	return -1
+}
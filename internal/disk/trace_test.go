@@ -0,0 +1,126 @@
+package disk
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrace(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"record":         testTraceRecord,
+		"replay":         testTraceReplay,
+		"diff":           testTraceDiff,
+		"annotate stack": testTraceAnnotateStack,
+		"trim":           testTraceTrim,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// return trace of a small workload on a fresh disk
+func traceWorkload(t *testing.T) []byte {
+	var out bytes.Buffer
+	tr := NewTracer(NewMemDisk(4), &out)
+	buf := make([]byte, BLOCK_SIZE)
+	tr.Annotate("setup")
+	require.NoError(t, tr.Write(1, []byte("hello")))
+	require.NoError(t, tr.Write(2, []byte("world")))
+	tr.Annotate("check")
+	_, err := tr.Read(1, buf)
+	require.NoError(t, err)
+	_, err = tr.Read(4, buf)
+	require.Error(t, err)
+	require.NoError(t, tr.Close())
+	return out.Bytes()
+}
+
+func testTraceRecord(t *testing.T) {
+	records, err := ReadTrace(bytes.NewReader(traceWorkload(t)))
+	require.NoError(t, err)
+	require.Len(t, records, 4)
+	require.Equal(t, "write", records[0].Op)
+	require.Equal(t, 1, records[0].Block)
+	require.Equal(t, "setup", records[0].Cause)
+	require.Equal(t, "hello", string(records[0].Data))
+	require.Equal(t, "read", records[2].Op)
+	require.Equal(t, "check", records[2].Cause)
+	require.Empty(t, records[2].Data)
+	require.NotEmpty(t, records[2].Hash)
+	require.NotEmpty(t, records[3].Err)
+	require.LessOrEqual(t, records[0].Time, records[3].Time)
+}
+
+func testTraceReplay(t *testing.T) {
+	trace := traceWorkload(t)
+	m := NewMemDisk(4)
+	result, err := Replay(bytes.NewReader(trace), m)
+	require.NoError(t, err)
+	require.Equal(t, ReplayResult{Reads: 1, Writes: 2, Skipped: 1}, result)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = m.Read(2, buf)
+	require.NoError(t, err)
+	require.Equal(t, "world", string(buf[:5]))
+
+	// corrupt the first write as it lands
+	f := NewFaultyDisk(NewMemDisk(4), Fault{Op: OpWrite, Nth: 1, Kind: FlipBit})
+	result, err = Replay(bytes.NewReader(trace), f)
+	require.NoError(t, err)
+	// the read is the third record
+	require.Equal(t, []int{3}, result.Mismatches)
+
+	// replayed devices must be large enough
+	_, err = Replay(bytes.NewReader(trace), NewMemDisk(2))
+	require.Error(t, err)
+	_, err = Replay(bytes.NewReader([]byte("{")), NewMemDisk(4))
+	require.Error(t, err)
+}
+
+func testTraceDiff(t *testing.T) {
+	a, err := ReadTrace(bytes.NewReader(traceWorkload(t)))
+	require.NoError(t, err)
+	b, err := ReadTrace(bytes.NewReader(traceWorkload(t)))
+	require.NoError(t, err)
+	require.Equal(t, -1, DiffTraces(a, b))
+	require.Equal(t, 3, DiffTraces(a, b[:3]))
+	b[1].Block = 3
+	require.Equal(t, 1, DiffTraces(a, b))
+}
+
+func testTraceAnnotateStack(t *testing.T) {
+	var out bytes.Buffer
+	tr := NewTracer(NewMemDisk(4), &out)
+	dev := NewCache(NewFaultyDisk(tr), 2, WriteThrough)
+	Annotate(dev, "through the stack")
+	require.NoError(t, dev.Write(0, []byte("x")))
+	require.NoError(t, tr.Sync())
+	records, err := ReadTrace(&out)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	require.Equal(t, "through the stack", records[0].Cause)
+	require.Equal(t, []string{"trace: 1 records"}, Report(tr))
+}
+
+func testTraceTrim(t *testing.T) {
+	var out bytes.Buffer
+	tr := NewTracer(NewMemDisk(4), &out)
+	require.NoError(t, tr.Write(1, []byte("hello")))
+	require.NoError(t, Trim(tr, 0, 3))
+	require.NoError(t, tr.Sync())
+	records, err := ReadTrace(bytes.NewReader(out.Bytes()))
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	require.Equal(t, "trim", records[1].Op)
+	require.Equal(t, 3, records[1].Count)
+
+	m := NewMemDisk(4)
+	require.NoError(t, m.Write(2, []byte("stale")))
+	result, err := Replay(bytes.NewReader(out.Bytes()), m)
+	require.NoError(t, err)
+	require.Equal(t, ReplayResult{Writes: 1, Trims: 1}, result)
+	buf := make([]byte, BLOCK_SIZE)
+	_, err = m.Read(2, buf)
+	require.NoError(t, err)
+	require.Equal(t, make([]byte, BLOCK_SIZE), buf)
+}
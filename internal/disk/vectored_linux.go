@@ -0,0 +1,62 @@
+package disk
+
+import (
+	"errors"
+	"io"
+	"os"
+
+	"golang.org/x/sys/unix"
+)
+
+// Most buffers a single preadv or pwritev call accepts (IOV_MAX)
+const iovMax = 1024
+
+// return the buffers of iovs the next call may pass
+func iovChunk(iovs [][]byte) [][]byte {
+	if len(iovs) > iovMax {
+		return iovs[:iovMax]
+	}
+	return iovs
+}
+
+// Read into bufs from file starting at offset, filling them in order with
+// one preadv call per IOV_MAX buffers unless a call comes up short. Returns
+// the number of bytes read and io.EOF if the file ends before bufs are full.
+func readv(file *os.File, bufs [][]byte, offset int64) (int, error) {
+	iovs := append([][]byte(nil), bufs...)
+	total := 0
+	for len(iovs) > 0 {
+		n, err := unix.Preadv(int(file.Fd()), iovChunk(iovs), offset)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return total, err
+		}
+		if n == 0 {
+			return total, io.EOF
+		}
+		total += n
+		offset += int64(n)
+		iovs = advance(iovs, n)
+	}
+	return total, nil
+}
+
+// Write bufs in order into file starting at offset with one pwritev call
+// per IOV_MAX buffers unless a call comes up short
+func writev(file *os.File, bufs [][]byte, offset int64) error {
+	iovs := append([][]byte(nil), bufs...)
+	for len(iovs) > 0 {
+		n, err := unix.Pwritev(int(file.Fd()), iovChunk(iovs), offset)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		offset += int64(n)
+		iovs = advance(iovs, n)
+	}
+	return nil
+}
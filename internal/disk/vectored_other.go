@@ -0,0 +1,34 @@
+//go:build !linux
+
+package disk
+
+import "os"
+
+// Read into bufs from file starting at offset, filling them in order. The
+// range is read with a single call into a staging buffer, as vectored
+// reads are only used on Linux. Returns the number of bytes read and
+// io.EOF if the file ends before bufs are full.
+func readv(file *os.File, bufs [][]byte, offset int64) (int, error) {
+	size := 0
+	for _, buf := range bufs {
+		size += len(buf)
+	}
+	staging := make([]byte, size)
+	n, err := file.ReadAt(staging, offset)
+	staging = staging[:n]
+	for _, buf := range bufs {
+		staging = staging[copy(buf, staging):]
+	}
+	return n, err
+}
+
+// Write bufs in order into file starting at offset with a single call
+// from a staging buffer, as vectored writes are only used on Linux
+func writev(file *os.File, bufs [][]byte, offset int64) error {
+	var staging []byte
+	for _, buf := range bufs {
+		staging = append(staging, buf...)
+	}
+	_, err := file.WriteAt(staging, offset)
+	return err
+}
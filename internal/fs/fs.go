@@ -12,9 +12,10 @@ import (
 
 const (
 	MAGIC_NUMBER       = 0xf0f03410
-	INODES_PER_BLOCK   = 128
 	POINTERS_PER_INODE = 5
-	POINTERS_PER_BLOCK = 1024
+	INODE_SIZE         = 32 // Size of an encoded inode (in bytes)
+	POINTER_SIZE       = 4  // Size of an encoded block pointer (in bytes)
+	MAX_BAD_BLOCKS     = 64 // Number of bad blocks the superblock can record
 )
 
 var (
@@ -22,9 +23,10 @@ var (
 )
 
 type FileSystem interface {
-	Debug(*disk.Disk) error
-	Format(*disk.Disk) bool
-	Mount(*disk.Disk) bool
+	Debug(disk.BlockDevice) error
+	Format(disk.BlockDevice) bool
+	Mount(disk.BlockDevice) bool
+	Unmount() bool
 
 	Create() (int, error)
 	Stat(int) (int, error)
@@ -36,7 +38,7 @@ type FileSystem interface {
 }
 
 type FS struct {
-	disk            *disk.Disk
+	disk            disk.BlockDevice
 	freeBlockBitMap []uint32 // Hold record of used or unused blocks
 	superBlock      SuperBlock
 	inodeBlocks     []*InodeBlock
@@ -49,6 +51,10 @@ type SuperBlock struct {
 	Blocks      uint32 // Number of blocks in file system
 	InodeBlocks uint32 // Number of blocks reserved for inodes in file system
 	Inodes      uint32 // Number of inodes in file system
+	BlockSize   uint32 // Size of a block (0 in file systems predating it, meaning 4096)
+
+	BadBlockCount uint32                 // Number of blocks the allocator skips
+	BadBlockList  [MAX_BAD_BLOCKS]uint32 // Blocks unable to hold data (zero in older file systems)
 }
 
 type Inode struct {
@@ -59,18 +65,37 @@ type Inode struct {
 }
 
 type InodeBlock struct {
-	Inodes [INODES_PER_BLOCK]Inode // Inode block
+	Inodes []Inode // Inode block
 }
 
 type DataBlock struct {
-	Data [disk.BLOCK_SIZE]byte // Data blockt
+	Data []byte // Data blockt
+}
+
+// Return number of inodes stored in a block of blockSize bytes
+func InodesPerBlock(blockSize int) int {
+	return blockSize / INODE_SIZE
+}
+
+// Return number of block pointers stored in a block of blockSize bytes
+func PointersPerBlock(blockSize int) int {
+	return blockSize / POINTER_SIZE
+}
+
+// Return block size recorded in superblock
+func (sblock *SuperBlock) blockSize() int {
+	if sblock.BlockSize == 0 {
+		return disk.BLOCK_SIZE
+	}
+	return int(sblock.BlockSize)
 }
 
 func NewFS() FileSystem {
 	return &FS{freeBlockBitMap: []uint32{}}
 }
 
-func (fs *FS) Debug(dsk *disk.Disk) error {
+func (fs *FS) Debug(dsk disk.BlockDevice) error {
+	disk.Annotate(dsk, "debug")
 	var sblock SuperBlock
 	var iblocks []*InodeBlock
 	// Ready Superblock
@@ -84,6 +109,10 @@ func (fs *FS) Debug(dsk *disk.Disk) error {
 	fmt.Printf("    %d blocks\n", sblock.Blocks)
 	fmt.Printf("    %d inode blocks\n", sblock.InodeBlocks)
 	fmt.Printf("    %d inodes\n", sblock.Inodes)
+	fmt.Printf("    %d bytes per block\n", sblock.blockSize())
+	if sblock.BadBlockCount > 0 {
+		fmt.Printf("    %d bad blocks: %s\n", sblock.BadBlockCount, mapToString(sblock.BadBlockList[:sblock.BadBlockCount]))
+	}
 	// set inode block size to read
 	iblocks = make([]*InodeBlock, sblock.InodeBlocks)
 	// Read Inode blocks
@@ -92,10 +121,10 @@ func (fs *FS) Debug(dsk *disk.Disk) error {
 		return err
 	}
 
-	for _, iblock := range iblocks {
+	for idx, iblock := range iblocks {
 		for id, v := range iblock.Inodes {
 			if v.Size > 0 {
-				fmt.Printf("inode %d:\n", id)
+				fmt.Printf("inode %d:\n", idx*len(iblock.Inodes)+id)
 				fmt.Printf("    size: %d bytes\n", v.Size)
 				fmt.Printf("    direct blocks: %s\n", mapToString(v.Direct[:]))
 				if v.Indirect > 0 {
@@ -106,19 +135,38 @@ func (fs *FS) Debug(dsk *disk.Disk) error {
 		}
 
 	}
-	fmt.Printf("%d disk block reads\n", dsk.Reads)
-	fmt.Printf("%d disk block writes\n", dsk.Writes)
+	stats := dsk.Stats()
+	fmt.Printf("%d disk block reads\n", stats.Reads)
+	fmt.Printf("%d disk block writes\n", stats.Writes)
+	fmt.Printf("%d disk block trims\n", stats.Trims)
+	for _, line := range disk.Report(dsk) {
+		fmt.Printf("%s\n", line)
+	}
 	fmt.Printf("Freeblock bitmap %v\n", fs.freeBlockBitMap)
 	return nil
 }
 
-func (fs *FS) Format(disk *disk.Disk) bool {
+func (fs *FS) Format(dsk disk.BlockDevice) bool {
+	disk.Annotate(dsk, "format")
 	var err error
 	var sblock = SuperBlock{
 		MagicNumber: MAGIC_NUMBER,
-		Blocks:      disk.Blocks,
-		InodeBlocks: uint32(math.Round(float64(disk.Blocks) * 0.1)),
+		Blocks:      dsk.Size(),
+		InodeBlocks: uint32(math.Round(float64(dsk.Size()) * 0.1)),
 		Inodes:      0,
+		BlockSize:   uint32(dsk.BlockSize()),
+	}
+	// blocks the device knows to be bad are never handed out
+	for _, blocknum := range disk.BadBlocks(dsk) {
+		if blocknum >= int(sblock.Blocks) {
+			continue
+		}
+		if sblock.BadBlockCount == MAX_BAD_BLOCKS {
+			fmt.Printf("could not format: more than %d bad blocks\n", MAX_BAD_BLOCKS)
+			return false
+		}
+		sblock.BadBlockList[sblock.BadBlockCount] = uint32(blocknum)
+		sblock.BadBlockCount++
 	}
 	buf := bytes.NewBuffer(make([]byte, 0))
 	// Write superblock
@@ -128,21 +176,21 @@ func (fs *FS) Format(disk *disk.Disk) bool {
 		return false
 	}
 
-	err = disk.Write(0, buf.Bytes())
+	err = dsk.Write(0, buf.Bytes())
 	if err != nil {
 		fmt.Println(fmt.Errorf("could not format: %s", err.Error()))
 		return false
 	}
 
 	// clear all inode blocks
-	err = fs.clearInodeBlocks(disk, &sblock, buf)
+	err = fs.clearInodeBlocks(dsk, &sblock, buf)
 	if err != nil {
 		fmt.Println(err.Error())
 		return false
 	}
 
 	// clear all data blocks
-	err = fs.clearDataBlocks(disk, &sblock, buf)
+	err = fs.clearDataBlocks(dsk, &sblock)
 	if err != nil {
 		fmt.Println(err.Error())
 		return false
@@ -150,33 +198,71 @@ func (fs *FS) Format(disk *disk.Disk) bool {
 	return true
 }
 
-func (fs *FS) Mount(disk *disk.Disk) bool {
+func (fs *FS) Mount(dsk disk.BlockDevice) bool {
+	disk.Annotate(dsk, "mount")
 	// Read superblock
-	err := fs.loadSuperBlock(disk, &fs.superBlock)
+	err := fs.loadSuperBlock(dsk, &fs.superBlock)
 	if err != nil {
 		fmt.Println(fmt.Errorf("failed to mount disk: %s", err.Error()))
 		return false
 	}
+	if fs.superBlock.MagicNumber != MAGIC_NUMBER {
+		fmt.Println("failed to mount disk: no file system found (invalid magic number)")
+		return false
+	}
+	if fs.superBlock.blockSize() != dsk.BlockSize() {
+		fmt.Printf("failed to mount disk: file system block size %d does not match disk block size %d\n", fs.superBlock.blockSize(), dsk.BlockSize())
+		return false
+	}
+	if fs.superBlock.Blocks > dsk.Size() {
+		fmt.Printf("failed to mount disk: file system has %d blocks, disk has %d\n", fs.superBlock.Blocks, dsk.Size())
+		return false
+	}
 	// copy Inode blocks
 	fs.inodeBlocks = make([]*InodeBlock, fs.superBlock.InodeBlocks)
-	err = fs.loadInodeBlocks(disk, int(fs.superBlock.InodeBlocks), fs.inodeBlocks)
+	err = fs.loadInodeBlocks(dsk, int(fs.superBlock.InodeBlocks), fs.inodeBlocks)
 	if err != nil {
 		fmt.Println(fmt.Errorf("failed to mount disk: %s", err.Error()))
 		return false
 	}
 
 	// initialize free block bitmap
-	err = fs.initFreeBlockBitMap(disk)
+	err = fs.initFreeBlockBitMap(dsk)
 	if err != nil {
 		fmt.Println(fmt.Errorf("failed to mount disk: %s", err.Error()))
 		return false
 	}
-	disk.Mount()
-	fs.disk = disk
+	dsk.Mount()
+	fs.disk = dsk
+	return true
+}
+
+func (fs *FS) Unmount() bool {
+	if fs.disk == nil {
+		fmt.Println("failed to unmount disk: disk is not mounted")
+		return false
+	}
+	disk.Annotate(fs.disk, "unmount")
+	// flush blocks buffered by the device
+	err := disk.Sync(fs.disk)
+	if err != nil {
+		fmt.Println(fmt.Errorf("failed to unmount disk: %s", err.Error()))
+		return false
+	}
+	fs.disk.UnMount()
+	fs.disk = nil
+	fs.superBlock = SuperBlock{}
+	fs.inodeBlocks = nil
+	fs.freeBlockBitMap = []uint32{}
 	return true
 }
 
 func (fs *FS) Read(inumber int) (inode *Inode, err error) {
+	disk.Annotate(fs.disk, "read")
+	return fs.readInode(inumber)
+}
+
+func (fs *FS) readInode(inumber int) (inode *Inode, err error) {
 	inode, err = fs.loadInode(inumber)
 	if err != nil {
 		return nil, fmt.Errorf("failed to read inode %d: %s", inumber, err.Error())
@@ -185,17 +271,49 @@ func (fs *FS) Read(inumber int) (inode *Inode, err error) {
 }
 
 func (fs *FS) ReadDataBlock(blocknum int) (data DataBlock, err error) {
-	var buf [disk.BLOCK_SIZE]byte
-	data = DataBlock{}
-	// read inode block from disk
-	_, err = fs.disk.Read(blocknum, buf[:])
+	buf := make([]byte, fs.disk.BlockSize())
+	// read data block from disk
+	_, err = fs.disk.Read(blocknum, buf)
 	if err != nil {
 		return
 	}
-	err = binary.Read(bytes.NewBuffer(buf[:]), enc, &data)
+	data = DataBlock{Data: buf}
 	return
 }
 
+// Read the data blocks at blocknums (skipping unused pointers), with one
+// vectored read for every run of consecutive blocks. The reads are
+// submitted together, so devices with a request queue may reorder them.
+func (fs *FS) ReadDataBlocks(blocknums []uint32) (data []DataBlock, err error) {
+	var used []uint32
+	for _, blocknum := range blocknums {
+		if blocknum > 0 {
+			used = append(used, blocknum)
+		}
+	}
+	bufs := make([][]byte, len(used))
+	for i := range bufs {
+		bufs[i] = make([]byte, fs.disk.BlockSize())
+	}
+	var reqs []*disk.Request
+	for start := 0; start < len(used); {
+		end := start + 1
+		for end < len(used) && used[end] == used[end-1]+1 {
+			end++
+		}
+		reqs = append(reqs, &disk.Request{Op: disk.OpRead, Block: int(used[start]), Bufs: bufs[start:end]})
+		start = end
+	}
+	err = disk.SubmitAll(fs.disk, reqs)
+	if err != nil {
+		return nil, err
+	}
+	for _, buf := range bufs {
+		data = append(data, DataBlock{Data: buf})
+	}
+	return data, nil
+}
+
 func (fs *FS) loadInode(inumber int) (inode *Inode, err error) {
 	iblocks := make([]*InodeBlock, fs.superBlock.InodeBlocks)
 	// Read Inode blocks
@@ -203,17 +321,18 @@ func (fs *FS) loadInode(inumber int) (inode *Inode, err error) {
 	if err != nil {
 		return
 	}
-	for _, iblock := range iblocks {
+	for idx, iblock := range iblocks {
 		for id, v := range iblock.Inodes {
-			if id == inumber {
+			if idx*len(iblock.Inodes)+id == inumber {
 				return &v, nil
 			}
 		}
 	}
-	return
+	return nil, fmt.Errorf("inode %d not found", inumber)
 }
 
 func (fs *FS) Write(inumber int, data []byte) (inode *Inode, err error) {
+	disk.Annotate(fs.disk, "write")
 
 	iblocks := make([]*InodeBlock, fs.superBlock.InodeBlocks)
 	// Read Inode blocks
@@ -223,13 +342,14 @@ func (fs *FS) Write(inumber int, data []byte) (inode *Inode, err error) {
 		return
 	}
 
-	var inodeBlockIdx int
+	var inodeBlockIdx, slot int
 	var inodeBlock *InodeBlock
 	for idx, iblock := range iblocks {
 		for id, v := range iblock.Inodes {
-			if id == inumber {
+			if idx*len(iblock.Inodes)+id == inumber {
 				inode = &v
 				inodeBlockIdx = idx + 1
+				slot = id
 				inodeBlock = iblock
 				break
 			}
@@ -254,11 +374,18 @@ func (fs *FS) Write(inumber int, data []byte) (inode *Inode, err error) {
 		}
 
 		if fs.isFreeblock(blocknum) {
-			break
+			err = fs.disk.Write(blocknum, data)
+			if !errors.Is(err, disk.ErrMedia) {
+				break
+			}
+			// block went bad: record it and move on to the next free one
+			err = fs.recordBadBlock(blocknum)
+			if err != nil {
+				return nil, err
+			}
 		}
 		blocknum += 1
 	}
-	err = fs.disk.Write(blocknum, data)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to inode block: %s", err.Error())
@@ -273,11 +400,10 @@ func (fs *FS) Write(inumber int, data []byte) (inode *Inode, err error) {
 		}
 	}
 
-	(*inodeBlock).Inodes[inumber] = *inode
+	(*inodeBlock).Inodes[slot] = *inode
 
-	var buf [disk.BLOCK_SIZE]byte
-	writeBuf := bytes.NewBuffer(buf[:0])
-	err = binary.Write(writeBuf, enc, inodeBlock)
+	writeBuf := bytes.NewBuffer(make([]byte, 0, fs.disk.BlockSize()))
+	err = binary.Write(writeBuf, enc, inodeBlock.Inodes)
 
 	if err != nil {
 		return nil, fmt.Errorf("failed to write to inode block: %s", err.Error())
@@ -296,6 +422,7 @@ func (fs *FS) Write(inumber int, data []byte) (inode *Inode, err error) {
 }
 
 func (fs *FS) Remove(inumber int) error {
+	disk.Annotate(fs.disk, "remove")
 	errMsg := "failed to remove to data block (%d): %s"
 
 	iblocks := make([]*InodeBlock, fs.superBlock.InodeBlocks)
@@ -307,24 +434,28 @@ func (fs *FS) Remove(inumber int) error {
 	}
 
 	var inode Inode
-	var inodeBlockIdx int
+	var inodeBlockIdx, slot int
 	var inodeBlock *InodeBlock
 	for idx, iblock := range iblocks {
 		for id, v := range iblock.Inodes {
-			if id == inumber {
+			if idx*len(iblock.Inodes)+id == inumber {
 				inode = v
 				inodeBlockIdx = idx + 1
+				slot = id
 				inodeBlock = iblock
 				break
 			}
 		}
 	}
 
-	var buf [disk.BLOCK_SIZE]byte
+	if inodeBlock == nil {
+		return fmt.Errorf("failed to remove inode %d: inode not found", inumber)
+	}
 
+	// release freed blocks on the device
 	for idx, blocknum := range inode.Direct {
 		if blocknum > 0 {
-			err = fs.disk.Write(int(blocknum), buf[:])
+			err = disk.Trim(fs.disk, int(blocknum), 1)
 			if err != nil {
 				return fmt.Errorf(errMsg, blocknum, err.Error())
 			}
@@ -336,7 +467,7 @@ func (fs *FS) Remove(inumber int) error {
 
 	if inode.Indirect > 0 {
 		blocknum := int(inode.Indirect)
-		err = fs.disk.Write(int(inode.Indirect), buf[:])
+		err = disk.Trim(fs.disk, blocknum, 1)
 		if err != nil {
 			return fmt.Errorf(errMsg, blocknum, err.Error())
 		}
@@ -349,9 +480,9 @@ func (fs *FS) Remove(inumber int) error {
 	inode.Indirect = 0
 
 	// write update inode back into disk
-	(*inodeBlock).Inodes[inumber] = inode
-	writeBuf := bytes.NewBuffer(buf[:0])
-	err = binary.Write(writeBuf, enc, inodeBlock)
+	(*inodeBlock).Inodes[slot] = inode
+	writeBuf := bytes.NewBuffer(make([]byte, 0, fs.disk.BlockSize()))
+	err = binary.Write(writeBuf, enc, inodeBlock.Inodes)
 
 	if err != nil {
 		return fmt.Errorf(errMsg, inumber, err.Error())
@@ -367,7 +498,8 @@ func (fs *FS) Remove(inumber int) error {
 }
 
 func (fs *FS) Stat(inumber int) (int, error) {
-	inode, err := fs.Read(inumber)
+	disk.Annotate(fs.disk, "stat")
+	inode, err := fs.readInode(inumber)
 	if err != nil {
 		return -1, fmt.Errorf("could not read inode block: %s", err.Error())
 	}
@@ -375,6 +507,7 @@ func (fs *FS) Stat(inumber int) (int, error) {
 }
 
 func (fs *FS) Create() (inumber int, err error) {
+	disk.Annotate(fs.disk, "create")
 	inumber = -1
 	iblocks := make([]*InodeBlock, fs.superBlock.InodeBlocks)
 	// Read Inode blocks
@@ -384,15 +517,17 @@ func (fs *FS) Create() (inumber int, err error) {
 	}
 
 	var inode Inode
-	var inodeBlockIdx int
+	var inodeBlockIdx, slot int
 	var inodeBlock *InodeBlock
 
 	for idx, iblock := range iblocks {
 		for id, v := range iblock.Inodes {
-			if id > 0 && v.Valid == 0 {
-				inumber = id
+			// inode 0 is never handed out
+			if idx+id > 0 && v.Valid == 0 {
+				inumber = idx*len(iblock.Inodes) + id
 				inode = v
 				inodeBlockIdx = idx + 1
+				slot = id
 				inodeBlock = iblock
 				break
 			}
@@ -404,13 +539,15 @@ func (fs *FS) Create() (inumber int, err error) {
 
 	}
 
-	var buf [disk.BLOCK_SIZE]byte
+	if inodeBlock == nil {
+		return inumber, errors.New("failed to create inode: no free inodes")
+	}
 
 	inode.Valid = 1
 
-	(*inodeBlock).Inodes[inumber] = inode
-	writeBuf := bytes.NewBuffer(buf[:0])
-	err = binary.Write(writeBuf, enc, inodeBlock)
+	(*inodeBlock).Inodes[slot] = inode
+	writeBuf := bytes.NewBuffer(make([]byte, 0, fs.disk.BlockSize()))
+	err = binary.Write(writeBuf, enc, inodeBlock.Inodes)
 
 	if err != nil {
 		return inumber, fmt.Errorf("failed to write to inode block: %s", err.Error())
@@ -428,20 +565,18 @@ func (fs *FS) Create() (inumber int, err error) {
 }
 
 func (fs *FS) Cat(inumber int) error {
-	inode, err := fs.Read(inumber)
+	disk.Annotate(fs.disk, "cat")
+	inode, err := fs.readInode(inumber)
 	if err != nil {
 		return fmt.Errorf("could not read inode block: %s", err.Error())
 	}
 
-	for _, dblockNum := range inode.Direct {
-		if dblockNum > 0 {
-			dblock, err := fs.ReadDataBlock(int(dblockNum))
-			if err != nil {
-				return fmt.Errorf("could not read inode block: %s", err.Error())
-			}
-			fmt.Printf("%s", dblock.Data[:])
-		}
-
+	dblocks, err := fs.ReadDataBlocks(inode.Direct[:])
+	if err != nil {
+		return fmt.Errorf("could not read inode block: %s", err.Error())
+	}
+	for _, dblock := range dblocks {
+		fmt.Printf("%s", dblock.Data[:])
 	}
 
 	return nil
@@ -449,12 +584,18 @@ func (fs *FS) Cat(inumber int) error {
 
 /* utillity filesystem functions */
 
-func (fs *FS) initFreeBlockBitMap(dsk *disk.Disk) error {
-	var Pointers [POINTERS_PER_BLOCK]uint32
-	var buf [disk.BLOCK_SIZE]byte
+func (fs *FS) initFreeBlockBitMap(dsk disk.BlockDevice) error {
+	Pointers := make([]uint32, PointersPerBlock(dsk.BlockSize()))
+	buf := make([]byte, dsk.BlockSize())
 	fs.freeBlockBitMap = make([]uint32, fs.superBlock.Blocks)
 	// set super block (0) as used
 	fs.freeBlockBitMap[0] = 1
+	// set bad blocks as used so they are never allocated
+	for _, blocknum := range fs.superBlock.BadBlockList[:fs.superBlock.BadBlockCount] {
+		if fs.isValidBlock(int(blocknum)) {
+			fs.freeBlockBitMap[blocknum] = 1
+		}
+	}
 	for idx, iblock := range fs.inodeBlocks {
 		// set inode blocks index in free block as used (reserve)
 		fs.freeBlockBitMap[idx+1] = 1
@@ -462,23 +603,31 @@ func (fs *FS) initFreeBlockBitMap(dsk *disk.Disk) error {
 			if inode.Size > 0 && inode.Valid == 1 {
 				for _, dblock := range inode.Direct {
 					if dblock > 0 {
+						if !fs.isValidBlock(int(dblock)) {
+							return fmt.Errorf("invalid direct block (%d) in inode block %d", dblock, idx+1)
+						}
 						fs.freeBlockBitMap[dblock] = 1
 					}
 
 				}
 				if inode.Indirect > 0 {
+					if !fs.isValidBlock(int(inode.Indirect)) {
+						return fmt.Errorf("invalid indirect block (%d) in inode block %d", inode.Indirect, idx+1)
+					}
 					fs.freeBlockBitMap[inode.Indirect] = 1
-					_, err := dsk.Read(int(inode.Indirect), buf[:])
+					_, err := dsk.Read(int(inode.Indirect), buf)
 					if err != nil {
 						return fmt.Errorf("failed to return indirect block (%d): %s", inode.Indirect, err.Error())
 					}
-					err = binary.Write(bytes.NewBuffer(buf[:]), enc, Pointers)
+					err = binary.Read(bytes.NewBuffer(buf), enc, Pointers)
 					if err != nil {
 						return fmt.Errorf("failed to return indirect block  pointers(%d): %s", inode.Indirect, err.Error())
 					}
-					fmt.Printf("Indirect block pointers: %v", Pointers)
 					for _, p := range Pointers {
 						if p != 0 {
+							if !fs.isValidBlock(int(p)) {
+								return fmt.Errorf("invalid block pointer (%d) in indirect block %d", p, inode.Indirect)
+							}
 							fs.freeBlockBitMap[p] = 1
 						}
 
@@ -492,41 +641,42 @@ func (fs *FS) initFreeBlockBitMap(dsk *disk.Disk) error {
 	return nil
 }
 
-func (fs *FS) clearInodeBlocks(dsk *disk.Disk, sblock *SuperBlock, buf *bytes.Buffer) error {
+func (fs *FS) clearInodeBlocks(dsk disk.BlockDevice, sblock *SuperBlock, buf *bytes.Buffer) error {
 	var err error
-	var iblock InodeBlock = InodeBlock{}
+	var iblock InodeBlock = InodeBlock{Inodes: make([]Inode, InodesPerBlock(dsk.BlockSize()))}
+	buf.Reset()
+	err = binary.Write(buf, enc, iblock.Inodes)
+	if err != nil {
+		return fmt.Errorf("could not format: %s", err.Error())
+	}
+	// every inode block gets the same empty block, written all at once
+	bufs := make([][]byte, sblock.InodeBlocks)
+	for i := range bufs {
+		bufs[i] = buf.Bytes()
+	}
+	err = disk.WriteBlocks(dsk, 1, bufs)
+	if err != nil {
+		return fmt.Errorf("could not format: %s", err.Error())
+	}
 	for i := uint32(1); i <= sblock.InodeBlocks; i++ {
-		buf.Reset()
-		err = binary.Write(buf, enc, &iblock)
-		if err != nil {
-			return fmt.Errorf("could not format: %s", err.Error())
-		}
-		err = dsk.Write(int(i), buf.Bytes())
-		if err != nil {
-			return fmt.Errorf("could not format: %s", err.Error())
-		}
 		if len(fs.freeBlockBitMap) > int(i) {
 			fs.freeBlockBitMap[i] = 0
 		}
-
 	}
 
 	return nil
 }
 
-func (fs *FS) clearDataBlocks(dsk *disk.Disk, sblock *SuperBlock, buf *bytes.Buffer) error {
-	var dblock DataBlock = DataBlock{}
-	var err error
-	for i := sblock.InodeBlocks + 1; i < sblock.Blocks; i++ {
-		buf.Reset()
-		err = binary.Write(buf, enc, &dblock)
-		if err != nil {
-			return fmt.Errorf("could not format: %s", err.Error())
-		}
-		err = dsk.Write(int(i), buf.Bytes())
+func (fs *FS) clearDataBlocks(dsk disk.BlockDevice, sblock *SuperBlock) error {
+	// data blocks are released rather than overwritten with zeros
+	first := sblock.InodeBlocks + 1
+	if first < sblock.Blocks {
+		err := disk.Trim(dsk, int(first), int(sblock.Blocks-first))
 		if err != nil {
 			return fmt.Errorf("could not format: %s", err.Error())
 		}
+	}
+	for i := first; i < sblock.Blocks; i++ {
 		if len(fs.freeBlockBitMap) > int(i) {
 			fs.freeBlockBitMap[i] = 0
 		}
@@ -534,21 +684,29 @@ func (fs *FS) clearDataBlocks(dsk *disk.Disk, sblock *SuperBlock, buf *bytes.Buf
 	return nil
 }
 
-func (fs *FS) loadInodeBlock(dsk *disk.Disk, blocknum int, block *InodeBlock) error {
-	var buf [disk.BLOCK_SIZE]byte
-	_, err := dsk.Read(blocknum, buf[:])
-	err = binary.Read(bytes.NewBuffer(buf[:]), enc, block)
+// decode the inodes held by the inode block in buf
+func (fs *FS) decodeInodeBlock(buf []byte, block *InodeBlock) error {
+	block.Inodes = make([]Inode, InodesPerBlock(len(buf)))
+	err := binary.Read(bytes.NewBuffer(buf), enc, block.Inodes)
 	if err != nil {
 		return fmt.Errorf("failed to read inode block: %s", err.Error())
 	}
 	return nil
 }
 
-func (fs *FS) loadInodeBlocks(dsk *disk.Disk, inodeblocks int, block []*InodeBlock) error {
-	var err error
-	for i := 1; i <= inodeblocks; i++ {
-		block[i-1] = &InodeBlock{}
-		err = fs.loadInodeBlock(dsk, i, block[i-1])
+// read the whole inode table with a single vectored read
+func (fs *FS) loadInodeBlocks(dsk disk.BlockDevice, inodeblocks int, block []*InodeBlock) error {
+	bufs := make([][]byte, inodeblocks)
+	for i := range bufs {
+		bufs[i] = make([]byte, dsk.BlockSize())
+	}
+	err := disk.ReadBlocks(dsk, 1, bufs)
+	if err != nil {
+		return fmt.Errorf("failed to read inode block: %s", err.Error())
+	}
+	for i, buf := range bufs {
+		block[i] = &InodeBlock{}
+		err = fs.decodeInodeBlock(buf, block[i])
 		if err != nil {
 			return err
 		}
@@ -556,24 +714,25 @@ func (fs *FS) loadInodeBlocks(dsk *disk.Disk, inodeblocks int, block []*InodeBlo
 	return nil
 }
 
-func (fs *FS) loadSuperBlock(dsk *disk.Disk, sblock *SuperBlock) error {
-	var buf [disk.BLOCK_SIZE]byte
-	_, err := dsk.Read(0, buf[:])
+func (fs *FS) loadSuperBlock(dsk disk.BlockDevice, sblock *SuperBlock) error {
+	buf := make([]byte, dsk.BlockSize())
+	_, err := dsk.Read(0, buf)
 	if err != nil {
 		return err
 	}
-	err = binary.Read(bytes.NewBuffer(buf[:]), enc, sblock)
+	err = binary.Read(bytes.NewBuffer(buf), enc, sblock)
 	if err != nil {
 		return fmt.Errorf("failed to read superblock: %s", err.Error())
 	}
+	if sblock.BadBlockCount > MAX_BAD_BLOCKS {
+		return fmt.Errorf("failed to read superblock: %d bad blocks", sblock.BadBlockCount)
+	}
 	return nil
 }
 
 func (fs *FS) writeSuperBlock() error {
 
-	var buf [disk.BLOCK_SIZE]byte
-
-	writeBuf := bytes.NewBuffer(buf[:0])
+	writeBuf := bytes.NewBuffer(make([]byte, 0, fs.disk.BlockSize()))
 	err := binary.Write(writeBuf, enc, fs.superBlock)
 
 	if err != nil {
@@ -588,6 +747,17 @@ func (fs *FS) writeSuperBlock() error {
 	return nil
 }
 
+// add blocknum to the bad blocks of the superblock
+func (fs *FS) recordBadBlock(blocknum int) error {
+	if fs.superBlock.BadBlockCount == MAX_BAD_BLOCKS {
+		return fmt.Errorf("failed to record bad block (%d): more than %d bad blocks", blocknum, MAX_BAD_BLOCKS)
+	}
+	fs.superBlock.BadBlockList[fs.superBlock.BadBlockCount] = uint32(blocknum)
+	fs.superBlock.BadBlockCount++
+	fs.freeBlockBitMap[blocknum] = 1
+	return fs.writeSuperBlock()
+}
+
 func (fs *FS) isValidBlock(blocknum int) bool {
 	return len(fs.freeBlockBitMap) > blocknum
 }
@@ -1,54 +1,144 @@
 package fs
 
 import (
-	"log"
-	"os"
+	"bytes"
+	"encoding/binary"
+	"flag"
+	"fmt"
+	"path/filepath"
 	"simplefs/internal/disk"
+	"simplefs/internal/nbd"
 	"testing"
 
 	"github.com/stretchr/testify/require"
 )
 
+// Layout of the devices the tests run on (see newTestDisk)
+var layout = flag.String("layout", "", "run the tests on `raid0`, raid5 or raid5-degraded devices built from in-memory disks")
+
+// return an empty in-memory device of at least nblocks blocks, striped as
+// asked by -layout
+func newTestDisk(t *testing.T, nblocks int) disk.BlockDevice {
+	dsk, err := newTestDiskWithBlockSize(nblocks, disk.BLOCK_SIZE)
+	require.NoError(t, err)
+	return dsk
+}
+
+// return an empty in-memory device of at least nblocks blocks of blockSize
+// bytes, striped as asked by -layout
+func newTestDiskWithBlockSize(nblocks int, blockSize int) (disk.BlockDevice, error) {
+	if *layout == "" {
+		return disk.NewMemDiskWithBlockSize(nblocks, blockSize)
+	}
+	// rows of three data units of two blocks, raid5 adds a parity unit
+	n := 3
+	if *layout != "raid0" {
+		n = 4
+	}
+	rows := (nblocks + 5) / 6
+	members := make([]disk.BlockDevice, n)
+	for i := range members {
+		mem, err := disk.NewMemDiskWithBlockSize(2*rows, blockSize)
+		if err != nil {
+			return nil, err
+		}
+		members[i] = mem
+	}
+	switch *layout {
+	case "raid0":
+		return disk.NewStripe(2, members...)
+	case "raid5":
+		return disk.NewParity(2, members...)
+	case "raid5-degraded":
+		members[2] = nil
+		return disk.NewParity(2, members...)
+	}
+	return nil, fmt.Errorf("unknown layout %q", *layout)
+}
+
+// return device holding the image at path, opened read-only unless the
+// image is copied onto a device striped as asked by -layout
+func openTestImage(t *testing.T, path string) disk.BlockDevice {
+	if *layout == "" {
+		dsk := &disk.Disk{}
+		require.NoError(t, dsk.OpenReadOnly(path))
+		return dsk
+	}
+	return loadTestImage(t, path)
+}
+
+// return writable in-memory copy of the image at path, striped as asked
+// by -layout
+func loadTestImage(t *testing.T, path string) disk.BlockDevice {
+	mem, err := disk.LoadMemDisk(path)
+	require.NoError(t, err)
+	if *layout == "" {
+		return mem
+	}
+	dsk, err := newTestDiskWithBlockSize(int(mem.Size()), mem.BlockSize())
+	require.NoError(t, err)
+	buf := make([]byte, mem.BlockSize())
+	for i := 0; i < int(mem.Size()); i++ {
+		_, err := mem.Read(i, buf)
+		require.NoError(t, err)
+		require.NoError(t, dsk.Write(i, buf))
+	}
+	return dsk
+}
+
 func TestFsDebug(t *testing.T) {
 	var fs FileSystem = NewFS()
-	disk := &disk.Disk{}
+	disk := openTestImage(t, "../../data/image.20")
 	defer disk.Close()
-	err := disk.Open("../../data/image.20", 20)
-	require.NoError(t, err)
-	err = fs.Debug(disk)
+	err := fs.Debug(disk)
 	require.NoError(t, err)
 }
 
 func TestFsMount(t *testing.T) {
 	var fs FileSystem = NewFS()
-	disk := &disk.Disk{}
+	disk := openTestImage(t, "../../data/image.200")
 	defer disk.Close()
-	err := disk.Open("../../data/image.200", 200)
-	require.NoError(t, err)
 	ok := fs.Mount(disk)
 	require.Equal(t, true, ok)
-	err = fs.Debug(disk)
+	err := fs.Debug(disk)
 	require.NoError(t, err)
 }
 
+func TestFsMountCorrupt(t *testing.T) {
+	// write inode 1 into the first inode block, and pointers into block 9
+	corrupt := func(inode Inode, pointers ...uint32) disk.BlockDevice {
+		dsk := formattedDisk(t, 10)
+		iblock := make([]Inode, InodesPerBlock(dsk.BlockSize()))
+		iblock[1] = inode
+		var buf bytes.Buffer
+		require.NoError(t, binary.Write(&buf, enc, iblock))
+		require.NoError(t, dsk.Write(1, buf.Bytes()))
+		buf.Reset()
+		require.NoError(t, binary.Write(&buf, enc, pointers))
+		require.NoError(t, dsk.Write(9, buf.Bytes()))
+		return dsk
+	}
+	// pointers past the end of the file system fail the mount
+	require.False(t, NewFS().Mount(corrupt(Inode{Valid: 1, Size: 10, Direct: [POINTERS_PER_INODE]uint32{1 << 20}})))
+	require.False(t, NewFS().Mount(corrupt(Inode{Valid: 1, Size: 10, Indirect: 1 << 20})))
+	require.False(t, NewFS().Mount(corrupt(Inode{Valid: 1, Size: 10, Indirect: 9}, 8, 1<<20)))
+	require.True(t, NewFS().Mount(corrupt(Inode{Valid: 1, Size: 10, Indirect: 9}, 8, 7)))
+}
+
 func TestFsFormat(t *testing.T) {
 	var fs FileSystem = NewFS()
-	disk := &disk.Disk{}
-	defer tearDown(disk)
-	err := disk.Open("test-image.10", 10)
-	require.NoError(t, err)
+	disk := newTestDisk(t, 10)
 	ok := fs.Format(disk)
 	require.Equal(t, true, ok)
-	err = fs.Debug(disk)
+	err := fs.Debug(disk)
 	require.NoError(t, err)
 }
 
 func TestFsRead(t *testing.T) {
 	var fs = NewFS()
-	disk := &disk.Disk{}
+	disk := openTestImage(t, "../../data/image.5")
 	defer disk.Close()
-	err := disk.Open("../../data/image.5", 5)
-	fs.Debug(disk)
+	err := fs.Debug(disk)
 	require.NoError(t, err)
 	ok := fs.Mount(disk)
 	require.Equal(t, true, ok)
@@ -60,9 +150,7 @@ func TestFsRead(t *testing.T) {
 
 func TestFsWrite(t *testing.T) {
 	var fs = NewFS()
-	disk := &disk.Disk{}
-	err := disk.Open("../../data/image-test.5", 5)
-	require.NoError(t, err)
+	disk := loadTestImage(t, "../../data/image-test.5")
 	ok := fs.Mount(disk)
 	require.Equal(t, true, ok)
 	ok = fs.Format(disk)
@@ -82,9 +170,7 @@ func TestFsWrite(t *testing.T) {
 
 func TestFsRemove(t *testing.T) {
 	var fs = NewFS()
-	disk := &disk.Disk{}
-	err := disk.Open("../../data/image-test.5", 5)
-	require.NoError(t, err)
+	disk := loadTestImage(t, "../../data/image-test.5")
 	ok := fs.Mount(disk)
 	require.Equal(t, true, ok)
 
@@ -94,10 +180,15 @@ func TestFsRemove(t *testing.T) {
 	// create inode
 	inodeNum, err := fs.Create()
 	require.NoError(t, err)
+	_, err = fs.Write(inodeNum, []byte("hello world"))
+	require.NoError(t, err)
+	trims := disk.Stats().Trims
 
 	err = fs.Remove(inodeNum)
 
 	require.NoError(t, err)
+	// the data block of the inode is released
+	require.Equal(t, trims+1, disk.Stats().Trims)
 
 	// trying to remove a non-existing inode
 	err = fs.Remove(inodeNum)
@@ -107,9 +198,7 @@ func TestFsRemove(t *testing.T) {
 func TestFsStat(t *testing.T) {
 	// inode 1 (965) bytes
 	var fs = NewFS()
-	disk := &disk.Disk{}
-	err := disk.Open("../../data/image.5", 5)
-	require.NoError(t, err)
+	disk := openTestImage(t, "../../data/image.5")
 	ok := fs.Mount(disk)
 	require.Equal(t, true, ok)
 
@@ -120,12 +209,607 @@ func TestFsStat(t *testing.T) {
 	require.Equal(t, 965, size)
 }
 
-func tearDown(disk *disk.Disk) {
-	err := disk.Close()
-	if err != nil {
-		log.Fatal(err)
+func TestFsFaults(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"format fails":          testFormatFault,
+		"mount fails":           testMountFault,
+		"create fails":          testCreateFault,
+		"write loses power":     testWritePowerLoss,
+		"remove fails":          testRemoveFault,
+		"read reports failures": testReadFault,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// return a formatted in-memory disk of nblocks blocks
+func formattedDisk(t *testing.T, nblocks int) disk.BlockDevice {
+	dsk := newTestDisk(t, nblocks)
+	require.True(t, NewFS().Format(dsk))
+	return dsk
+}
+
+func testFormatFault(t *testing.T) {
+	// superblock write
+	dsk := disk.NewFaultyDisk(newTestDisk(t, 10), disk.Fault{Op: disk.OpWrite, Nth: 1})
+	require.False(t, NewFS().Format(dsk))
+	// inode block write
+	dsk = disk.NewFaultyDisk(newTestDisk(t, 10), disk.Fault{Op: disk.OpWrite, Nth: 2})
+	require.False(t, NewFS().Format(dsk))
+	// data block trim
+	dsk = disk.NewFaultyDisk(newTestDisk(t, 10), disk.Fault{Op: disk.OpTrim, Nth: 1})
+	require.False(t, NewFS().Format(dsk))
+}
+
+func testMountFault(t *testing.T) {
+	for nth := 1; nth <= 2; nth++ {
+		dsk := disk.NewFaultyDisk(formattedDisk(t, 10), disk.Fault{Op: disk.OpRead, Nth: nth})
+		require.False(t, NewFS().Mount(dsk))
+		require.Equal(t, 0, int(dsk.Stats().Mounts))
+	}
+}
+
+func testCreateFault(t *testing.T) {
+	mem := formattedDisk(t, 10)
+	dsk := disk.NewFaultyDisk(mem, disk.Fault{Op: disk.OpWrite, Nth: 1})
+	fs := NewFS()
+	require.True(t, fs.Mount(dsk))
+	_, err := fs.Create()
+	require.Error(t, err)
+
+	// inode was not allocated on the image
+	fs = NewFS()
+	require.True(t, fs.Mount(mem))
+	inode, err := fs.Read(1)
+	require.NoError(t, err)
+	require.Equal(t, 0, int(inode.Valid))
+}
+
+func testWritePowerLoss(t *testing.T) {
+	mem := formattedDisk(t, 10)
+	dsk := disk.NewFaultyDisk(mem)
+	fs := NewFS()
+	require.True(t, fs.Mount(dsk))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+
+	// power is lost right after the data block lands
+	dsk.Inject(disk.Fault{Op: disk.OpWrite, Nth: 3, Kind: disk.PowerLoss})
+	_, err = fs.Write(inumber, []byte("hello world"))
+	require.ErrorContains(t, err, disk.ErrPowerLoss.Error())
+
+	// data block was written but never linked to the inode
+	fs = NewFS()
+	require.True(t, fs.Mount(mem))
+	inode, err := fs.Read(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 1, int(inode.Valid))
+	require.Equal(t, 0, int(inode.Size))
+	require.Equal(t, 0, int(inode.Direct[0]))
+	dblock, err := fs.(*FS).ReadDataBlock(2)
+	require.NoError(t, err)
+	require.Equal(t, "hello world", string(dblock.Data[:11]))
+}
+
+func testRemoveFault(t *testing.T) {
+	mem := formattedDisk(t, 10)
+	dsk := disk.NewFaultyDisk(mem)
+	fs := NewFS()
+	require.True(t, fs.Mount(dsk))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	_, err = fs.Write(inumber, []byte("hello world"))
+	require.NoError(t, err)
+
+	// fail clearing the data block
+	dsk.Inject(disk.Fault{Op: disk.OpTrim, Nth: 1})
+	require.Error(t, fs.Remove(inumber))
+	size, err := fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 11, size)
+
+	// fail writing back the inode block
+	dsk.Inject(disk.Fault{Op: disk.OpWrite, Nth: 5})
+	require.Error(t, fs.Remove(inumber))
+	size, err = fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 11, size)
+
+	require.NoError(t, fs.Remove(inumber))
+	size, err = fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 0, size)
+}
+
+func testReadFault(t *testing.T) {
+	dsk := disk.NewFaultyDisk(formattedDisk(t, 10))
+	fs := NewFS()
+	require.True(t, fs.Mount(dsk))
+	dsk.Inject(disk.Fault{Op: disk.OpRead, Nth: 3})
+	_, err := fs.Read(1)
+	require.ErrorContains(t, err, disk.ErrInjected.Error())
+	_, err = fs.Stat(1)
+	require.NoError(t, err)
+}
+
+func TestFsUnmount(t *testing.T) {
+	mem := formattedDisk(t, 10)
+	cache := disk.NewCache(mem, 4, disk.WriteBack)
+	var fs = NewFS()
+	ok := fs.Mount(cache)
+	require.Equal(t, true, ok)
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	_, err = fs.Write(inumber, []byte("hello world"))
+	require.NoError(t, err)
+	writes := mem.Stats().Writes
+
+	// dirty blocks reach the disk on unmount
+	ok = fs.Unmount()
+	require.Equal(t, true, ok)
+	require.Greater(t, mem.Stats().Writes, writes)
+	require.Equal(t, 0, cache.Dirty())
+	require.Equal(t, 0, int(cache.Stats().Mounts))
+	ok = fs.Unmount()
+	require.Equal(t, false, ok)
+
+	fs = NewFS()
+	ok = fs.Mount(mem)
+	require.Equal(t, true, ok)
+	size, err := fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 11, size)
+}
+
+func TestFsTrace(t *testing.T) {
+	var trace bytes.Buffer
+	tracer := disk.NewTracer(newTestDisk(t, 10), &trace)
+	var fs = NewFS()
+	ok := fs.Format(tracer)
+	require.Equal(t, true, ok)
+	ok = fs.Mount(tracer)
+	require.Equal(t, true, ok)
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	_, err = fs.Write(inumber, []byte("hello world"))
+	require.NoError(t, err)
+	require.NoError(t, tracer.Sync())
+
+	records, err := disk.ReadTrace(bytes.NewReader(trace.Bytes()))
+	require.NoError(t, err)
+	causes := map[string]int{}
+	for _, record := range records {
+		causes[record.Cause]++
+	}
+	// superblock, inode block and a single trim of the data blocks
+	require.Equal(t, 3, causes["format"])
+	require.Equal(t, 2, causes["mount"])
+	require.Equal(t, 3, causes["create"])
+	require.Equal(t, 3, causes["write"])
+
+	// replaying the trace rebuilds the filesystem
+	mem := newTestDisk(t, 10)
+	result, err := disk.Replay(bytes.NewReader(trace.Bytes()), mem)
+	require.NoError(t, err)
+	require.Empty(t, result.Mismatches)
+	fs = NewFS()
+	ok = fs.Mount(mem)
+	require.Equal(t, true, ok)
+	size, err := fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 11, size)
+}
+
+func TestFsBlockSize(t *testing.T) {
+	for _, bs := range []int{512, 1024, 4096} {
+		t.Run(fmt.Sprintf("%d bytes", bs), func(t *testing.T) {
+			mem, err := newTestDiskWithBlockSize(20, bs)
+			require.NoError(t, err)
+			var fs = NewFS()
+			ok := fs.Format(mem)
+			require.Equal(t, true, ok)
+			ok = fs.Mount(mem)
+			require.Equal(t, true, ok)
+
+			// inodes are numbered across inode blocks
+			inodes := InodesPerBlock(bs) + 1
+			var inumber int
+			for i := 0; i < inodes; i++ {
+				inumber, err = fs.Create()
+				require.NoError(t, err)
+			}
+			require.Equal(t, inodes, inumber)
+			data := bytes.Repeat([]byte("x"), bs)
+			_, err = fs.Write(inumber, data)
+			require.NoError(t, err)
+			require.True(t, fs.Unmount())
+
+			fs = NewFS()
+			ok = fs.Mount(mem)
+			require.Equal(t, true, ok)
+			size, err := fs.Stat(inumber)
+			require.NoError(t, err)
+			require.Equal(t, bs, size)
+			require.NoError(t, fs.Remove(inumber))
+			require.Error(t, fs.Remove(2*InodesPerBlock(bs)))
+		})
+	}
+
+	// a file system only mounts on disks with its block size
+	mem, err := newTestDiskWithBlockSize(20, 1024)
+	require.NoError(t, err)
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(mem))
+	other := newTestDisk(t, 20)
+	block := make([]byte, 1024)
+	_, err = mem.Read(0, block)
+	require.NoError(t, err)
+	require.NoError(t, other.Write(0, block))
+	require.Equal(t, false, NewFS().Mount(other))
+}
+
+func TestFsEncrypted(t *testing.T) {
+	mem := newTestDisk(t, 11)
+	crypt, err := disk.FormatCrypt(mem, "secret", disk.CryptParams{N: 1 << 10, R: 8, P: 1})
+	require.NoError(t, err)
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(crypt))
+	require.Equal(t, true, fs.Mount(crypt))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	_, err = fs.Write(inumber, []byte("customer fixture"))
+	require.NoError(t, err)
+	require.True(t, fs.Unmount())
+
+	// without the passphrase the disk does not hold a file system
+	require.Equal(t, false, NewFS().Mount(mem))
+
+	crypt, err = disk.OpenCrypt(mem, "secret")
+	require.NoError(t, err)
+	fs = NewFS()
+	require.Equal(t, true, fs.Mount(crypt))
+	size, err := fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 16, size)
+}
+
+func TestFsOverlay(t *testing.T) {
+	base := openTestImage(t, "../../data/image.200")
+	overlay, err := disk.NewOverlay(base, filepath.Join(t.TempDir(), "image.200.delta"))
+	require.NoError(t, err)
+	defer overlay.Close()
+
+	var fs = NewFS()
+	require.Equal(t, true, fs.Mount(overlay))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	_, err = fs.Write(inumber, []byte("scratch data"))
+	require.NoError(t, err)
+	require.NoError(t, fs.Remove(2))
+	require.Greater(t, overlay.Dirty(), 0)
+
+	// the golden image still has its files
+	fs = NewFS()
+	require.Equal(t, true, fs.Mount(base))
+	size, err := fs.Stat(2)
+	require.NoError(t, err)
+	require.Greater(t, size, 0)
+	inode, err := fs.Read(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 0, int(inode.Valid))
+}
+
+func TestFsMirror(t *testing.T) {
+	dir := t.TempDir()
+	var members []disk.BlockDevice
+	for _, name := range []string{"a.img", "b.img"} {
+		member := &disk.Disk{}
+		require.NoError(t, member.Open(filepath.Join(dir, name), 20))
+		members = append(members, member)
+	}
+	mirror, err := disk.NewMirror(members...)
+	require.NoError(t, err)
+
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(mirror))
+	require.Equal(t, true, fs.Mount(mirror))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+
+	// the filesystem keeps working while a member is out
+	require.NoError(t, mirror.Fail(0))
+	_, err = fs.Write(inumber, []byte("mirrored data"))
+	require.NoError(t, err)
+	size, err := fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 13, size)
+	require.NoError(t, mirror.Resync(0))
+	require.NoError(t, mirror.Fail(1))
+	require.Equal(t, true, fs.Unmount())
+
+	// the resynced member holds the whole filesystem
+	fs = NewFS()
+	require.Equal(t, true, fs.Mount(members[0]))
+	size, err = fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 13, size)
+	require.NoError(t, mirror.Close())
+}
+
+func TestFsPartitions(t *testing.T) {
+	mem := newTestDisk(t, 30)
+	_, err := disk.CreatePartitions(mem, 10, 19)
+	require.NoError(t, err)
+	var filesystems []FileSystem
+	for index, data := range []string{"first partition", "second"} {
+		partition, err := disk.OpenPartition(mem, index)
+		require.NoError(t, err)
+		fs := NewFS()
+		require.Equal(t, true, fs.Format(partition))
+		require.Equal(t, true, fs.Mount(partition))
+		inumber, err := fs.Create()
+		require.NoError(t, err)
+		_, err = fs.Write(inumber, []byte(data))
+		require.NoError(t, err)
+		filesystems = append(filesystems, fs)
 	}
-	if err := os.Remove(disk.Name); err != nil {
-		log.Fatal(err)
+
+	// formatting one partition leaves the other one alone
+	size, err := filesystems[0].Stat(1)
+	require.NoError(t, err)
+	require.Equal(t, 15, size)
+	size, err = filesystems[1].Stat(1)
+	require.NoError(t, err)
+	require.Equal(t, 6, size)
+
+	// the partitioned disk itself holds no file system
+	require.Equal(t, false, NewFS().Mount(mem))
+	table, err := disk.ReadPartitionTable(mem)
+	require.NoError(t, err)
+	require.Equal(t, 2, int(table.Count))
+}
+
+func TestFsNBD(t *testing.T) {
+	mem := newTestDisk(t, 20)
+	l, err := nbd.Listen("unix:" + filepath.Join(t.TempDir(), "nbd.sock"))
+	require.NoError(t, err)
+	server := nbd.NewServer(mem, "test")
+	go server.Serve(l)
+	defer server.Close()
+
+	// two clients share the image served by one process
+	var clients []*nbd.Client
+	for i := 0; i < 2; i++ {
+		client, err := nbd.Dial("nbd+unix:///test?socket=" + l.Addr().String())
+		require.NoError(t, err)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(clients[0]))
+	require.Equal(t, true, fs.Mount(clients[0]))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	_, err = fs.Write(inumber, []byte("remote data"))
+	require.NoError(t, err)
+	require.Equal(t, true, fs.Unmount())
+
+	fs = NewFS()
+	require.Equal(t, true, fs.Mount(clients[1]))
+	inode, err := fs.Read(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 11, int(inode.Size))
+	buf := make([]byte, mem.BlockSize())
+	_, err = clients[1].Read(int(inode.Direct[0]), buf)
+	require.NoError(t, err)
+	require.Equal(t, "remote data", string(buf[:inode.Size]))
+	require.Equal(t, true, fs.Unmount())
+}
+
+// in-memory disk counting ranged transfers
+type rangeCounter struct {
+	*disk.MemDisk
+	ranges []int // Number of blocks of every ranged transfer
+}
+
+func (r *rangeCounter) ReadBlocks(blocknum int, bufs [][]byte) error {
+	r.ranges = append(r.ranges, len(bufs))
+	return r.MemDisk.ReadBlocks(blocknum, bufs)
+}
+
+func (r *rangeCounter) WriteBlocks(blocknum int, bufs [][]byte) error {
+	r.ranges = append(r.ranges, len(bufs))
+	return r.MemDisk.WriteBlocks(blocknum, bufs)
+}
+
+func TestFsRanges(t *testing.T) {
+	dsk := &rangeCounter{MemDisk: disk.NewMemDisk(100)}
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(dsk))
+	require.Equal(t, []int{10}, dsk.ranges)
+	require.Equal(t, 1+10, int(dsk.Writes))
+
+	// the inode table is read at once
+	dsk.ranges = nil
+	require.Equal(t, true, fs.Mount(dsk))
+	require.Equal(t, []int{10}, dsk.ranges)
+	require.Equal(t, 1+10, int(dsk.Reads))
+
+	// consecutive data blocks of a file are read at once
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		_, err = fs.Write(inumber, []byte("data"))
+		require.NoError(t, err)
+	}
+	dsk.ranges = nil
+	require.NoError(t, fs.Cat(inumber))
+	require.Equal(t, []int{10, 3}, dsk.ranges)
+}
+
+func TestFsBadBlocks(t *testing.T) {
+	d := &disk.Disk{}
+	require.NoError(t, d.Open(filepath.Join(t.TempDir(), "disk.img"), 20))
+	defer d.Close()
+	require.NoError(t, d.MarkBad(3))
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(d))
+	require.Equal(t, true, fs.Mount(d))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+
+	// blocks known at format time are never allocated
+	inode, err := fs.Write(inumber, []byte("first"))
+	require.NoError(t, err)
+	require.Equal(t, 4, int(inode.Direct[0]))
+
+	// blocks going bad later are added to the list
+	require.NoError(t, d.MarkBad(5))
+	inode, err = fs.Write(inumber, []byte("second"))
+	require.NoError(t, err)
+	require.Equal(t, 6, int(inode.Direct[1]))
+	require.Equal(t, true, fs.Unmount())
+	require.Equal(t, true, fs.Mount(d))
+	inode, err = fs.Write(inumber, []byte("third"))
+	require.NoError(t, err)
+	require.Equal(t, 7, int(inode.Direct[2]))
+	var sblock SuperBlock
+	require.NoError(t, fs.(*FS).loadSuperBlock(d, &sblock))
+	require.Equal(t, []uint32{3, 5}, sblock.BadBlockList[:sblock.BadBlockCount])
+	require.NoError(t, fs.Debug(d))
+
+	// remapped devices hide bad blocks from the file system
+	require.Equal(t, true, fs.Unmount())
+	r, err := disk.NewRemap(d, 2)
+	require.NoError(t, err)
+	// the file system still spans the blocks taken by the spare area
+	require.Equal(t, false, fs.Mount(r))
+	require.Equal(t, true, fs.Format(r))
+	require.Equal(t, true, fs.Mount(r))
+	inumber, err = fs.Create()
+	require.NoError(t, err)
+	inode, err = fs.Write(inumber, []byte("remapped"))
+	require.NoError(t, err)
+	require.Equal(t, 3, int(inode.Direct[0]))
+	require.Equal(t, []disk.RemapEntry{{Block: 3, Spare: 17}}, r.Table())
+}
+
+func TestFsBadBlocksCached(t *testing.T) {
+	d := &disk.Disk{}
+	require.NoError(t, d.Open(filepath.Join(t.TempDir(), "disk.img"), 20))
+	defer d.Close()
+	require.NoError(t, d.MarkBad(3))
+	// wrappers pass the bad blocks of the disk on to format
+	cache := disk.NewCache(d, 4, disk.WriteBack)
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(cache))
+	require.NoError(t, disk.Sync(cache))
+	var sblock SuperBlock
+	require.NoError(t, fs.(*FS).loadSuperBlock(d, &sblock))
+	require.Equal(t, []uint32{3}, sblock.BadBlockList[:sblock.BadBlockCount])
+
+	// whole blocks written back later never reach the bad block
+	require.Equal(t, true, fs.Mount(cache))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	inode, err := fs.Write(inumber, make([]byte, disk.BLOCK_SIZE))
+	require.NoError(t, err)
+	require.Equal(t, 4, int(inode.Direct[0]))
+	require.Equal(t, true, fs.Unmount())
+	require.NoError(t, disk.Sync(cache))
+}
+
+func TestFsDedup(t *testing.T) {
+	store, err := disk.OpenDedupStore(filepath.Join(t.TempDir(), "store"), 0)
+	require.NoError(t, err)
+	defer store.Close()
+	for _, name := range []string{"first", "second"} {
+		d, err := store.Open(name, 50)
+		require.NoError(t, err)
+		fs := NewFS()
+		require.Equal(t, true, fs.Format(d))
+		require.Equal(t, true, fs.Mount(d))
+		inumber, err := fs.Create()
+		require.NoError(t, err)
+		_, err = fs.Write(inumber, bytes.Repeat([]byte("same data "), 100))
+		require.NoError(t, err)
+		_, err = fs.Write(inumber, []byte(name))
+		require.NoError(t, err)
+		require.Equal(t, true, fs.Unmount())
+	}
+
+	// the superblock and the first data block are shared, earlier versions
+	// of superblock and inode block are kept until collected
+	require.Equal(t, disk.DedupUsage{Stored: 9, References: 8, Unreferenced: 3}, store.Usage())
+	released, err := store.GC()
+	require.NoError(t, err)
+	require.Equal(t, 3, released)
+	require.Equal(t, disk.DedupUsage{Stored: 6, References: 8}, store.Usage())
+}
+
+func TestFsObjects(t *testing.T) {
+	store := disk.NewDirStore(t.TempDir())
+	d, err := disk.OpenObjectDisk(store, "disk", 100, 0, disk.DefaultObjectConfig)
+	require.NoError(t, err)
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(d))
+	require.Equal(t, true, fs.Mount(d))
+	inumber, err := fs.Create()
+	require.NoError(t, err)
+	_, err = fs.Write(inumber, []byte("kept as objects"))
+	require.NoError(t, err)
+	require.Equal(t, true, fs.Unmount())
+	require.NoError(t, d.Close())
+
+	// superblock, inode table and the data block share the first object,
+	// the other objects hold zeros only and are not stored
+	keys, err := store.List("disk/blocks/")
+	require.NoError(t, err)
+	require.Equal(t, []string{"disk/blocks/00000000"}, keys)
+
+	d, err = disk.OpenObjectDisk(store, "disk", 0, 0, disk.DefaultObjectConfig)
+	require.NoError(t, err)
+	defer d.Close()
+	fs = NewFS()
+	require.Equal(t, true, fs.Mount(d))
+	size, err := fs.Stat(inumber)
+	require.NoError(t, err)
+	require.Equal(t, 15, size)
+}
+
+func TestFsQueue(t *testing.T) {
+	q := disk.NewQueue(newTestDisk(t, 100), disk.NewElevator())
+	defer q.Close()
+	var fs = NewFS()
+	require.Equal(t, true, fs.Format(q))
+	require.Equal(t, true, fs.Mount(q))
+
+	// removing the second file leaves a hole the third block of the first
+	// one fills, so its blocks are not in order on disk
+	first, err := fs.Create()
+	require.NoError(t, err)
+	second, err := fs.Create()
+	require.NoError(t, err)
+	for i, inumber := range []int{first, second, first} {
+		_, err = fs.Write(inumber, []byte{byte('a' + i)})
+		require.NoError(t, err)
+	}
+	require.NoError(t, fs.Remove(second))
+	inode, err := fs.Write(first, []byte("d"))
+	require.NoError(t, err)
+	require.Less(t, inode.Direct[2], inode.Direct[1])
+
+	// the elevator reads the blocks in disk order, the data comes back in
+	// file order
+	q.ResetStats()
+	data, err := fs.(*FS).ReadDataBlocks(inode.Direct[:])
+	require.NoError(t, err)
+	require.Equal(t, 3, len(data))
+	for i, want := range []byte("acd") {
+		require.Equal(t, want, data[i].Data[0])
 	}
+	stats := q.QueueStats()["scan"]
+	require.Equal(t, uint32(3), stats.Requests)
+	require.Equal(t, uint32(1), stats.Reordered)
+	require.Equal(t, true, fs.Unmount())
 }
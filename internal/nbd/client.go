@@ -0,0 +1,466 @@
+package nbd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"simplefs/internal/disk"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+NBD client
+
+A Client is a block device whose blocks live on an NBD server. Requests
+are sent one at a time and wait for their reply.
+*/
+
+var _ disk.BlockDevice = (*Client)(nil)
+
+// Client is a block device backed by an NBD export
+type Client struct {
+	disk.Counters
+	Export    string // Name of the export
+	Address   string // Address of the server
+	mu        sync.Mutex
+	conn      net.Conn
+	r         *bufio.Reader
+	size      uint64 // Size of export (in bytes)
+	flags     uint16 // Transmission flags of export
+	blockSize int
+	handle    uint64 // Handle of the last request sent
+	err       error  // Error that broke the connection
+}
+
+// Connect to the export named by an NBD URI
+// (nbd://host[:port][/export] or nbd+unix:///[export]?socket=path)
+func Dial(uri string) (*Client, error) {
+	network, address, export, err := ParseURI(uri)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", uri, err.Error())
+	}
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %s", uri, err.Error())
+	}
+	c, err := NewClient(conn, export)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to connect to %s: %s", uri, err.Error())
+	}
+	return c, nil
+}
+
+// Negotiate export name on an established connection
+// conn: Connection to an NBD server
+// export: Name of the export ("" for the default export)
+func NewClient(conn net.Conn, export string) (*Client, error) {
+	c := &Client{Export: export, Address: conn.RemoteAddr().String(), conn: conn, r: bufio.NewReader(conn)}
+	if err := c.handshake(); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// haggle for the export, preferring NBD_OPT_GO over NBD_OPT_EXPORT_NAME
+func (c *Client) handshake() error {
+	var hello struct {
+		Magic     uint64
+		OptsMagic uint64
+		Flags     uint16
+	}
+	if err := receive(c.r, &hello); err != nil {
+		return fmt.Errorf("handshake failed: %s", err.Error())
+	}
+	if hello.Magic != NBD_MAGIC || hello.OptsMagic != NBD_OPTS_MAGIC {
+		return errors.New("handshake failed: not a newstyle NBD server")
+	}
+	if hello.Flags&NBD_FLAG_FIXED_NEWSTYLE == 0 {
+		return errors.New("handshake failed: server does not speak fixed newstyle")
+	}
+	clientFlags := uint32(NBD_FLAG_FIXED_NEWSTYLE | (hello.Flags & NBD_FLAG_NO_ZEROES))
+	if err := send(c.conn, clientFlags); err != nil {
+		return fmt.Errorf("handshake failed: %s", err.Error())
+	}
+
+	name := []byte(c.Export)
+	err := send(c.conn, optionHeader{NBD_OPTS_MAGIC, NBD_OPT_GO, uint32(4 + len(name) + 2 + 2)},
+		uint32(len(name)), name, uint16(1), uint16(NBD_INFO_BLOCK_SIZE))
+	if err != nil {
+		return fmt.Errorf("handshake failed: %s", err.Error())
+	}
+	for {
+		var reply optionReply
+		if err := receive(c.r, &reply); err != nil {
+			return fmt.Errorf("handshake failed: %s", err.Error())
+		}
+		if reply.Magic != NBD_REP_MAGIC || reply.Option != NBD_OPT_GO {
+			return errors.New("handshake failed: malformed option reply")
+		}
+		if reply.Length > NBD_MAX_OPTION_LEN {
+			return fmt.Errorf("handshake failed: option reply of %d bytes", reply.Length)
+		}
+		data := make([]byte, reply.Length)
+		if _, err := io.ReadFull(c.r, data); err != nil {
+			return fmt.Errorf("handshake failed: %s", err.Error())
+		}
+		switch reply.Type {
+		case NBD_REP_ACK:
+			if c.size == 0 && c.flags == 0 {
+				return errors.New("handshake failed: server did not describe the export")
+			}
+			return c.finishHandshake()
+		case NBD_REP_INFO:
+			c.parseInfo(data)
+		case NBD_REP_ERR_UNSUP:
+			return c.exportName(hello.Flags&NBD_FLAG_NO_ZEROES != 0)
+		case NBD_REP_ERR_UNKNOWN:
+			return fmt.Errorf("handshake failed: unknown export %q", c.Export)
+		default:
+			return fmt.Errorf("handshake failed: option reply type %#x", reply.Type)
+		}
+	}
+}
+
+// record export size, flags and block size sent with NBD_REP_INFO
+func (c *Client) parseInfo(data []byte) {
+	if len(data) < 2 {
+		return
+	}
+	switch be16(data) {
+	case NBD_INFO_EXPORT:
+		if len(data) == 12 {
+			c.size = be64(data[2:])
+			c.flags = be16(data[10:])
+		}
+	case NBD_INFO_BLOCK_SIZE:
+		if len(data) == 14 {
+			c.blockSize = int(be32(data[6:]))
+		}
+	}
+}
+
+// pick the export the old way for servers without NBD_OPT_GO
+func (c *Client) exportName(noZeroes bool) error {
+	name := []byte(c.Export)
+	if err := send(c.conn, optionHeader{NBD_OPTS_MAGIC, NBD_OPT_EXPORT_NAME, uint32(len(name))}, name); err != nil {
+		return fmt.Errorf("handshake failed: %s", err.Error())
+	}
+	var export struct {
+		Size  uint64
+		Flags uint16
+	}
+	if err := receive(c.r, &export); err != nil {
+		// the server drops the connection for unknown exports
+		return fmt.Errorf("handshake failed: export %q: %s", c.Export, err.Error())
+	}
+	if !noZeroes {
+		if _, err := io.ReadFull(c.r, make([]byte, 124)); err != nil {
+			return fmt.Errorf("handshake failed: %s", err.Error())
+		}
+	}
+	c.size, c.flags = export.Size, export.Flags
+	return c.finishHandshake()
+}
+
+// validate the geometry of the export
+func (c *Client) finishHandshake() error {
+	if c.blockSize == 0 {
+		c.blockSize = disk.BLOCK_SIZE
+	}
+	if err := disk.ValidBlockSize(c.blockSize); err != nil {
+		return fmt.Errorf("handshake failed: %s", err.Error())
+	}
+	if c.size%uint64(c.blockSize) != 0 || c.size/uint64(c.blockSize) > 1<<32-1 {
+		return fmt.Errorf("handshake failed: export of %d bytes is no whole number of %d byte blocks", c.size, c.blockSize)
+	}
+	return nil
+}
+
+// send request and wait for its reply, reading data of replies to reads
+// into data
+func (c *Client) request(typ uint16, flags uint16, offset uint64, payload []byte, length uint32, data []byte) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return c.err
+	}
+	c.handle++
+	req := Request{NBD_REQUEST_MAGIC, flags, typ, c.handle, offset, length}
+	var err error
+	if payload != nil {
+		err = send(c.conn, req, payload)
+	} else {
+		err = send(c.conn, req)
+	}
+	var reply Reply
+	if err == nil {
+		err = receive(c.r, &reply)
+	}
+	if err == nil && (reply.Magic != NBD_REPLY_MAGIC || reply.Handle != c.handle) {
+		err = errors.New("malformed reply")
+	}
+	if err == nil && reply.Error == 0 && data != nil {
+		_, err = io.ReadFull(c.r, data)
+	}
+	if err != nil {
+		// the stream is out of step with the server from here on
+		c.err = fmt.Errorf("connection to %s broken: %s", c.Address, err.Error())
+		return c.err
+	}
+	if reply.Error != 0 {
+		return Errno(reply.Error)
+	}
+	return nil
+}
+
+// Return whether or not the export refuses writes
+func (c *Client) ReadOnly() bool {
+	return c.flags&NBD_FLAG_READ_ONLY != 0
+}
+
+// Return status line of device
+func (c *Client) Report() []string {
+	mode := "read-write"
+	if c.ReadOnly() {
+		mode = "read-only"
+	}
+	return []string{fmt.Sprintf("nbd: export %q on %s, %d blocks of %d bytes, %s", c.Export, c.Address, c.Size(), c.blockSize, mode)}
+}
+
+// Return size of device (in terms of blocks)
+func (c *Client) Size() uint32 {
+	return uint32(c.size / uint64(c.blockSize))
+}
+
+// Return size of a single block (in bytes)
+func (c *Client) BlockSize() int {
+	return c.blockSize
+}
+
+// validate blocknum against the size of the export
+func (c *Client) checkBlock(blocknum int) error {
+	if blocknum < 0 {
+		return fmt.Errorf("blocknum (%d) is negative", blocknum)
+	}
+	if blocknum >= int(c.Size()) {
+		return fmt.Errorf("blocknum (%d) is too large", blocknum)
+	}
+	return nil
+}
+
+// Read block from server
+//
+// blocknum: Block to read from
+//
+// data: Buffer to read into
+func (c *Client) Read(blocknum int, data []byte) (int, error) {
+	if err := c.checkBlock(blocknum); err != nil {
+		return -1, err
+	}
+	if len(data) < c.blockSize {
+		return -1, fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum, c.blockSize)
+	}
+	offset := uint64(blocknum) * uint64(c.blockSize)
+	if err := c.request(NBD_CMD_READ, 0, offset, nil, uint32(c.blockSize), data[:c.blockSize]); err != nil {
+		return -1, fmt.Errorf("Unable to read %d: %w", blocknum, err)
+	}
+	atomic.AddUint32(&c.Reads, 1)
+	return c.blockSize, nil
+}
+
+// Write block to server
+//
+// blocknum: Block to write to
+//
+// data: Buffer to write from
+func (c *Client) Write(blocknum int, data []byte) error {
+	if len(data) > c.blockSize {
+		return fmt.Errorf("Unable to write to block (%d): size of data greater than %d bytes", blocknum, c.blockSize)
+	}
+	if err := c.checkBlock(blocknum); err != nil {
+		return err
+	}
+	if c.ReadOnly() {
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, disk.ErrReadOnly)
+	}
+	offset := uint64(blocknum) * uint64(c.blockSize)
+	if err := c.request(NBD_CMD_WRITE, 0, offset, data, uint32(len(data)), nil); err != nil {
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, err)
+	}
+	atomic.AddUint32(&c.Writes, 1)
+	return nil
+}
+
+// Read consecutive blocks from server, with one request per
+// NBD_MAX_REQUEST bytes
+//
+// blocknum: First block to read from
+//
+// bufs: Buffers to read into, one per block
+func (c *Client) ReadBlocks(blocknum int, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	if err := c.checkBlock(blocknum); err != nil {
+		return err
+	}
+	if err := c.checkBlock(blocknum + len(bufs) - 1); err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		if len(buf) < c.blockSize {
+			return fmt.Errorf("Unable to read %d: buffer smaller than %d bytes", blocknum+i, c.blockSize)
+		}
+	}
+	max := NBD_MAX_REQUEST / c.blockSize
+	for i := 0; i < len(bufs); i += max {
+		chunk := bufs[i:]
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		data := make([]byte, len(chunk)*c.blockSize)
+		offset := uint64(blocknum+i) * uint64(c.blockSize)
+		if err := c.request(NBD_CMD_READ, 0, offset, nil, uint32(len(data)), data); err != nil {
+			return fmt.Errorf("Unable to read %d-%d: %w", blocknum+i, blocknum+i+len(chunk)-1, err)
+		}
+		for j, buf := range chunk {
+			copy(buf, data[j*c.blockSize:(j+1)*c.blockSize])
+		}
+	}
+	atomic.AddUint32(&c.Reads, uint32(len(bufs)))
+	return nil
+}
+
+// Write consecutive blocks to server, with one request per
+// NBD_MAX_REQUEST bytes
+//
+// blocknum: First block to write to
+//
+// bufs: Buffers to write from, each holding a whole block
+func (c *Client) WriteBlocks(blocknum int, bufs [][]byte) error {
+	if len(bufs) == 0 {
+		return nil
+	}
+	if err := c.checkBlock(blocknum); err != nil {
+		return err
+	}
+	if err := c.checkBlock(blocknum + len(bufs) - 1); err != nil {
+		return err
+	}
+	for i, buf := range bufs {
+		if len(buf) != c.blockSize {
+			return fmt.Errorf("Unable to write to block (%d): buffer of %d bytes, not %d bytes", blocknum+i, len(buf), c.blockSize)
+		}
+	}
+	if c.ReadOnly() {
+		return fmt.Errorf("Unable to write to block (%d): %w", blocknum, disk.ErrReadOnly)
+	}
+	max := NBD_MAX_REQUEST / c.blockSize
+	for i := 0; i < len(bufs); i += max {
+		chunk := bufs[i:]
+		if len(chunk) > max {
+			chunk = chunk[:max]
+		}
+		data := make([]byte, 0, len(chunk)*c.blockSize)
+		for _, buf := range chunk {
+			data = append(data, buf...)
+		}
+		offset := uint64(blocknum+i) * uint64(c.blockSize)
+		if err := c.request(NBD_CMD_WRITE, 0, offset, data, uint32(len(data)), nil); err != nil {
+			return fmt.Errorf("Unable to write to blocks (%d-%d): %w", blocknum+i, blocknum+i+len(chunk)-1, err)
+		}
+	}
+	atomic.AddUint32(&c.Writes, uint32(len(bufs)))
+	return nil
+}
+
+// Release blocks on server (overwriting them with zeros if the server
+// can not trim)
+//
+// blocknum: First block to release
+//
+// count: Number of blocks to release
+func (c *Client) Trim(blocknum int, count int) error {
+	if count <= 0 {
+		return nil
+	}
+	if err := c.checkBlock(blocknum); err != nil {
+		return err
+	}
+	if err := c.checkBlock(blocknum + count - 1); err != nil {
+		return err
+	}
+	if c.ReadOnly() {
+		return fmt.Errorf("Unable to trim block (%d): %w", blocknum, disk.ErrReadOnly)
+	}
+	if c.flags&NBD_FLAG_SEND_TRIM == 0 {
+		zero := make([]byte, c.blockSize)
+		for i := blocknum; i < blocknum+count; i++ {
+			if err := c.Write(i, zero); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	for count > 0 {
+		n := count
+		if max := NBD_MAX_REQUEST / c.blockSize; n > max {
+			n = max
+		}
+		offset := uint64(blocknum) * uint64(c.blockSize)
+		if err := c.request(NBD_CMD_TRIM, 0, offset, nil, uint32(n*c.blockSize), nil); err != nil {
+			return fmt.Errorf("Unable to trim block (%d): %w", blocknum, err)
+		}
+		blocknum += n
+		count -= n
+	}
+	atomic.AddUint32(&c.Trims, 1)
+	return nil
+}
+
+// Ask server to flush its writes to stable storage
+func (c *Client) Sync() error {
+	if c.flags&NBD_FLAG_SEND_FLUSH == 0 {
+		return nil
+	}
+	if err := c.request(NBD_CMD_FLUSH, 0, 0, nil, 0, nil); err != nil {
+		return fmt.Errorf("Unable to sync: %w", err)
+	}
+	return nil
+}
+
+// Disconnect from server
+func (c *Client) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.conn == nil {
+		return nil
+	}
+	if c.err == nil {
+		// the server flushes its writes before it drops the connection
+		send(c.conn, Request{Magic: NBD_REQUEST_MAGIC, Type: NBD_CMD_DISC})
+	}
+	err := c.conn.Close()
+	c.conn = nil
+	c.err = errors.New("connection closed")
+	if err != nil {
+		return fmt.Errorf("Unable to close connection to %s: %s", c.Address, err.Error())
+	}
+	return nil
+}
+
+func be16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+func be32(b []byte) uint32 {
+	return uint32(be16(b))<<16 | uint32(be16(b[2:]))
+}
+
+func be64(b []byte) uint64 {
+	return uint64(be32(b))<<32 | uint64(be32(b[4:]))
+}
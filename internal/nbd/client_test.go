@@ -0,0 +1,207 @@
+package nbd
+
+import (
+	"path/filepath"
+	"simplefs/internal/disk"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestClient(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"uri":       testClientURI,
+		"blocks":    testClientBlocks,
+		"tcp":       testClientTCP,
+		"unknown":   testClientUnknown,
+		"read-only": testClientReadOnly,
+		"trim":      testClientTrim,
+		"vectored":  testClientBlocksAtOnce,
+		"image":     testClientImage,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// dial export "test" served on addr
+func dial(t *testing.T, addr string) *Client {
+	network, address := SplitAddress(addr)
+	uri := "nbd://" + address + "/test"
+	if network == "unix" {
+		uri = "nbd+unix:///test?socket=" + address
+	}
+	c, err := Dial(uri)
+	require.NoError(t, err)
+	t.Cleanup(func() { c.Close() })
+	return c
+}
+
+// write a block naming itself into every block of dev
+func fillBlocks(t *testing.T, dev disk.BlockDevice) {
+	for i := 0; i < int(dev.Size()); i++ {
+		require.NoError(t, dev.Write(i, []byte{byte(i), byte(i >> 8), 0xaa}))
+	}
+}
+
+// check that every block of dev still names itself
+func checkBlocks(t *testing.T, dev disk.BlockDevice) {
+	buf := make([]byte, dev.BlockSize())
+	for i := 0; i < int(dev.Size()); i++ {
+		_, err := dev.Read(i, buf)
+		require.NoError(t, err)
+		require.Equal(t, []byte{byte(i), byte(i >> 8), 0xaa}, buf[:3], "block %d", i)
+	}
+}
+
+func testClientURI(t *testing.T) {
+	for uri, want := range map[string][3]string{
+		"nbd://localhost":                       {"tcp", "localhost:10809", ""},
+		"nbd://127.0.0.1:2000/disk":             {"tcp", "127.0.0.1:2000", "disk"},
+		"nbd://[::1]:2000/a/b":                  {"tcp", "[::1]:2000", "a/b"},
+		"nbd+unix:///disk?socket=/tmp/nbd.sock": {"unix", "/tmp/nbd.sock", "disk"},
+	} {
+		require.True(t, IsURI(uri))
+		network, address, export, err := ParseURI(uri)
+		require.NoError(t, err, uri)
+		require.Equal(t, want, [3]string{network, address, export}, uri)
+	}
+	for _, uri := range []string{"nbd://", "nbd+unix:///disk", "http://localhost"} {
+		_, _, _, err := ParseURI(uri)
+		require.Error(t, err, uri)
+	}
+	require.False(t, IsURI("disk.img"))
+}
+
+func testClientBlocks(t *testing.T) {
+	mem, err := disk.NewMemDiskWithBlockSize(16, 1024)
+	require.NoError(t, err)
+	_, addr := serve(t, mem)
+	c := dial(t, addr)
+	require.Equal(t, 16, int(c.Size()))
+	require.Equal(t, 1024, c.BlockSize())
+
+	fillBlocks(t, c)
+	checkBlocks(t, c)
+	checkBlocks(t, mem)
+	require.Equal(t, 16, int(c.Stats().Writes))
+	require.Equal(t, 16, int(c.Stats().Reads))
+	require.Equal(t, 16, int(mem.Stats().Writes))
+	require.NoError(t, c.Sync())
+
+	buf := make([]byte, 1024)
+	_, err = c.Read(16, buf)
+	require.Error(t, err)
+	_, err = c.Read(0, buf[:10])
+	require.Error(t, err)
+	require.Error(t, c.Write(-1, buf))
+	require.Error(t, c.Write(0, make([]byte, 1025)))
+	require.Contains(t, c.Report()[0], `nbd: export "test"`)
+	require.Contains(t, c.Report()[0], "16 blocks of 1024 bytes, read-write")
+
+	require.NoError(t, c.Close())
+	_, err = c.Read(0, buf)
+	require.Error(t, err)
+}
+
+func testClientTCP(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewServer(disk.NewMemDisk(8), "test")
+	go s.Serve(l)
+	defer s.Close()
+
+	// clients share the device
+	a := dial(t, l.Addr().String())
+	b := dial(t, l.Addr().String())
+	fillBlocks(t, a)
+	checkBlocks(t, b)
+}
+
+func testClientUnknown(t *testing.T) {
+	_, addr := serve(t, disk.NewMemDisk(8))
+	_, address := SplitAddress(addr)
+	_, err := Dial("nbd+unix:///foo?socket=" + address)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), `unknown export "foo"`)
+	_, err = Dial("nbd+unix:///test?socket=" + filepath.Join(t.TempDir(), "missing"))
+	require.Error(t, err)
+
+	// the default export is available under any server name
+	c, err := Dial("nbd+unix:///?socket=" + address)
+	require.NoError(t, err)
+	require.Equal(t, 8, int(c.Size()))
+	require.NoError(t, c.Close())
+}
+
+func testClientReadOnly(t *testing.T) {
+	s, addr := serve(t, disk.NewMemDisk(8))
+	s.ReadOnly = true
+	c := dial(t, addr)
+	require.True(t, c.ReadOnly())
+	require.ErrorIs(t, c.Write(0, []byte{1}), disk.ErrReadOnly)
+	require.ErrorIs(t, c.Trim(0, 1), disk.ErrReadOnly)
+	require.True(t, strings.HasSuffix(c.Report()[0], "read-only"))
+	buf := make([]byte, c.BlockSize())
+	_, err := c.Read(0, buf)
+	require.NoError(t, err)
+}
+
+func testClientTrim(t *testing.T) {
+	mem := disk.NewMemDisk(8)
+	_, addr := serve(t, mem)
+	c := dial(t, addr)
+	fillBlocks(t, c)
+	require.NoError(t, c.Trim(2, 3))
+	require.Equal(t, 1, int(c.Stats().Trims))
+	require.Equal(t, 1, int(mem.Stats().Trims))
+	buf := make([]byte, c.BlockSize())
+	for i := 0; i < 8; i++ {
+		_, err := c.Read(i, buf)
+		require.NoError(t, err)
+		if i >= 2 && i < 5 {
+			require.Equal(t, make([]byte, len(buf)), buf, "block %d", i)
+		} else {
+			require.Equal(t, []byte{byte(i), 0, 0xaa}, buf[:3], "block %d", i)
+		}
+	}
+	require.Error(t, c.Trim(6, 3))
+}
+
+func testClientBlocksAtOnce(t *testing.T) {
+	mem := disk.NewMemDisk(8)
+	s, addr := serve(t, mem)
+	c := dial(t, addr)
+	bufs := make([][]byte, 8)
+	for i := range bufs {
+		bufs[i] = make([]byte, c.BlockSize())
+		bufs[i][0], bufs[i][1], bufs[i][2] = byte(i), 0, 0xaa
+	}
+	require.NoError(t, c.WriteBlocks(0, bufs))
+	require.Error(t, c.WriteBlocks(1, bufs))
+	require.Error(t, c.WriteBlocks(0, [][]byte{{1}}))
+	checkBlocks(t, mem)
+	require.NoError(t, c.ReadBlocks(2, bufs[:4]))
+	require.Equal(t, []byte{5, 0, 0xaa}, bufs[3][:3])
+	require.Error(t, c.ReadBlocks(7, bufs[:2]))
+
+	// a range goes out as a single request
+	require.Equal(t, 2, int(s.Requests))
+	require.Equal(t, disk.Stats{Reads: 4, Writes: 8}, c.Stats())
+}
+
+func testClientImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "disk.img")
+	d := &disk.Disk{}
+	require.NoError(t, d.Open(path, 8))
+	_, addr := serve(t, d)
+	c := dial(t, addr)
+	fillBlocks(t, c)
+	require.NoError(t, c.Close())
+
+	// disconnecting flushes the image
+	saved, err := disk.LoadMemDisk(path)
+	require.NoError(t, err)
+	checkBlocks(t, saved)
+	require.NoError(t, d.Close())
+}
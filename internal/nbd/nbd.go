@@ -0,0 +1,217 @@
+package nbd
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strings"
+)
+
+/*
+Network Block Device protocol
+
+Only the fixed newstyle handshake and simple replies are spoken. Numbers
+are sent in network byte order.
+*/
+
+const (
+	NBD_MAGIC          = 0x4e42444d41474943 // "NBDMAGIC"
+	NBD_OPTS_MAGIC     = 0x49484156454f5054 // "IHAVEOPT"
+	NBD_REP_MAGIC      = 0x0003e889045565a9 // Magic of option replies
+	NBD_REQUEST_MAGIC  = 0x25609513         // Magic of transmission requests
+	NBD_REPLY_MAGIC    = 0x67446698         // Magic of simple replies
+	NBD_DEFAULT_PORT   = "10809"            // Port registered for NBD
+	NBD_MAX_OPTION_LEN = 4096               // Longest option data accepted
+	NBD_MAX_REQUEST    = 32 << 20           // Longest read or write accepted (in bytes)
+)
+
+// Handshake flags sent by the server
+const (
+	NBD_FLAG_FIXED_NEWSTYLE = 1 << 0
+	NBD_FLAG_NO_ZEROES      = 1 << 1
+)
+
+// Options sent by the client during the handshake
+const (
+	NBD_OPT_EXPORT_NAME = 1
+	NBD_OPT_ABORT       = 2
+	NBD_OPT_LIST        = 3
+	NBD_OPT_INFO        = 6
+	NBD_OPT_GO          = 7
+)
+
+// Option reply types
+const (
+	NBD_REP_ACK         = 1
+	NBD_REP_SERVER      = 2
+	NBD_REP_INFO        = 3
+	NBD_REP_FLAG_ERROR  = 1 << 31
+	NBD_REP_ERR_UNSUP   = NBD_REP_FLAG_ERROR | 1
+	NBD_REP_ERR_INVALID = NBD_REP_FLAG_ERROR | 3
+	NBD_REP_ERR_UNKNOWN = NBD_REP_FLAG_ERROR | 6
+)
+
+// Information items of NBD_REP_INFO replies
+const (
+	NBD_INFO_EXPORT     = 0
+	NBD_INFO_BLOCK_SIZE = 3
+)
+
+// Transmission flags describing an export
+const (
+	NBD_FLAG_HAS_FLAGS  = 1 << 0
+	NBD_FLAG_READ_ONLY  = 1 << 1
+	NBD_FLAG_SEND_FLUSH = 1 << 2
+	NBD_FLAG_SEND_FUA   = 1 << 3
+	NBD_FLAG_SEND_TRIM  = 1 << 5
+)
+
+// Transmission commands
+const (
+	NBD_CMD_READ  = 0
+	NBD_CMD_WRITE = 1
+	NBD_CMD_DISC  = 2
+	NBD_CMD_FLUSH = 3
+	NBD_CMD_TRIM  = 4
+
+	NBD_CMD_FLAG_FUA = 1 << 0
+)
+
+// Errno is an error code carried by a reply
+type Errno uint32
+
+const (
+	EPERM     Errno = 1
+	EIO       Errno = 5
+	ENOMEM    Errno = 12
+	EINVAL    Errno = 22
+	ENOSPC    Errno = 28
+	ENOTSUP   Errno = 95
+	ESHUTDOWN Errno = 108
+)
+
+func (e Errno) Error() string {
+	switch e {
+	case EPERM:
+		return "operation not permitted"
+	case EIO:
+		return "input/output error"
+	case ENOMEM:
+		return "out of memory"
+	case EINVAL:
+		return "invalid argument"
+	case ENOSPC:
+		return "no space left on device"
+	case ENOTSUP:
+		return "operation not supported"
+	case ESHUTDOWN:
+		return "server is shutting down"
+	}
+	return fmt.Sprintf("error %d", uint32(e))
+}
+
+// Request is the header of a transmission request
+type Request struct {
+	Magic  uint32 // NBD_REQUEST_MAGIC
+	Flags  uint16 // Command flags
+	Type   uint16 // Command
+	Handle uint64 // Identifies the reply to the request
+	Offset uint64 // Offset into export (in bytes)
+	Length uint32 // Length of data (in bytes)
+}
+
+// Reply is the header of a simple reply
+type Reply struct {
+	Magic  uint32 // NBD_REPLY_MAGIC
+	Error  uint32 // Error code (0 on success)
+	Handle uint64 // Handle of the request
+}
+
+// optionHeader starts every option sent by the client
+type optionHeader struct {
+	Magic  uint64 // NBD_OPTS_MAGIC
+	Option uint32 // Option
+	Length uint32 // Length of option data
+}
+
+// optionReply starts every reply to an option
+type optionReply struct {
+	Magic  uint64 // NBD_REP_MAGIC
+	Option uint32 // Option replied to
+	Type   uint32 // Reply type
+	Length uint32 // Length of reply data
+}
+
+// write values (fixed size values or byte slices) in network byte order
+// with a single write
+func send(w io.Writer, values ...interface{}) error {
+	var buf bytes.Buffer
+	for _, v := range values {
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			return err
+		}
+	}
+	_, err := w.Write(buf.Bytes())
+	return err
+}
+
+// read fixed size value in network byte order
+func receive(r io.Reader, v interface{}) error {
+	return binary.Read(r, binary.BigEndian, v)
+}
+
+// Split address into the network and address to listen on or dial:
+// "unix:<path>" for a unix socket, "[host]:port" for TCP
+func SplitAddress(addr string) (network string, address string) {
+	if path := strings.TrimPrefix(addr, "unix:"); path != addr {
+		return "unix", path
+	}
+	return "tcp", addr
+}
+
+// Listen for NBD clients on addr ("unix:<path>" or "[host]:port")
+func Listen(addr string) (net.Listener, error) {
+	network, address := SplitAddress(addr)
+	l, err := net.Listen(network, address)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to listen on %s: %s", addr, err.Error())
+	}
+	return l, nil
+}
+
+// Return whether or not path is an NBD URI
+func IsURI(path string) bool {
+	return strings.HasPrefix(path, "nbd://") || strings.HasPrefix(path, "nbd+unix://")
+}
+
+// Parse NBD URI into the network and address to dial and the export name.
+// Supported are nbd://host[:port][/export] and
+// nbd+unix:///[export]?socket=path.
+func ParseURI(uri string) (network string, address string, export string, err error) {
+	u, err := url.Parse(uri)
+	if err != nil {
+		return "", "", "", fmt.Errorf("invalid NBD URI %q: %s", uri, err.Error())
+	}
+	export = strings.TrimPrefix(u.Path, "/")
+	switch u.Scheme {
+	case "nbd":
+		if u.Hostname() == "" {
+			return "", "", "", fmt.Errorf("invalid NBD URI %q: no host", uri)
+		}
+		port := u.Port()
+		if port == "" {
+			port = NBD_DEFAULT_PORT
+		}
+		return "tcp", net.JoinHostPort(u.Hostname(), port), export, nil
+	case "nbd+unix":
+		socket := u.Query().Get("socket")
+		if socket == "" {
+			return "", "", "", fmt.Errorf("invalid NBD URI %q: no socket", uri)
+		}
+		return "unix", socket, export, nil
+	}
+	return "", "", "", fmt.Errorf("invalid NBD URI %q: unsupported scheme %q", uri, u.Scheme)
+}
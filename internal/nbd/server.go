@@ -0,0 +1,396 @@
+package nbd
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"simplefs/internal/disk"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+NBD server
+
+A Server exports a single block device to any number of clients. Requests
+of all clients are applied to the device one at a time.
+*/
+
+var errAbort = errors.New("client aborted the handshake")
+
+// Server exports a block device over NBD
+type Server struct {
+	Name     string           // Name of the export (clients may also ask for "")
+	Device   disk.BlockDevice // Device to export
+	ReadOnly bool             // Refuse writes and trims
+	Requests uint32           // Number of total requests served
+	mu       sync.Mutex       // Serializes access to Device
+	conns    sync.WaitGroup
+	lock     sync.Mutex // Guards the fields below
+	listener net.Listener
+	open     map[net.Conn]struct{}
+	closed   bool
+}
+
+// Export dev under name
+func NewServer(dev disk.BlockDevice, name string) *Server {
+	return &Server{Name: name, Device: dev, open: make(map[net.Conn]struct{})}
+}
+
+// Serve clients connecting to l until the server is closed
+func (s *Server) Serve(l net.Listener) error {
+	s.lock.Lock()
+	if s.closed {
+		s.lock.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = l
+	s.lock.Unlock()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			s.lock.Lock()
+			closed := s.closed
+			s.lock.Unlock()
+			if closed {
+				return nil
+			}
+			return fmt.Errorf("Unable to accept client: %s", err.Error())
+		}
+		s.lock.Lock()
+		if s.closed {
+			s.lock.Unlock()
+			conn.Close()
+			return nil
+		}
+		s.open[conn] = struct{}{}
+		s.conns.Add(1)
+		s.lock.Unlock()
+		go func() {
+			defer s.conns.Done()
+			s.ServeConn(conn)
+			s.lock.Lock()
+			delete(s.open, conn)
+			s.lock.Unlock()
+		}()
+	}
+}
+
+// Stop accepting clients, disconnect connected clients and flush the device
+func (s *Server) Close() error {
+	s.lock.Lock()
+	s.closed = true
+	if s.listener != nil {
+		s.listener.Close()
+	}
+	for conn := range s.open {
+		conn.Close()
+	}
+	s.lock.Unlock()
+	s.conns.Wait()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return disk.Sync(s.Device)
+}
+
+// Serve a single client until it disconnects
+func (s *Server) ServeConn(conn net.Conn) error {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	if err := s.handshake(r, conn); err != nil {
+		if errors.Is(err, errAbort) {
+			return nil
+		}
+		return err
+	}
+	return s.transmit(r, conn)
+}
+
+// return transmission flags of export
+func (s *Server) flags() uint16 {
+	flags := uint16(NBD_FLAG_HAS_FLAGS | NBD_FLAG_SEND_FLUSH | NBD_FLAG_SEND_FUA | NBD_FLAG_SEND_TRIM)
+	if s.ReadOnly {
+		flags |= NBD_FLAG_READ_ONLY
+	}
+	return flags
+}
+
+// return size of export (in bytes)
+func (s *Server) size() uint64 {
+	return uint64(s.Device.Size()) * uint64(s.Device.BlockSize())
+}
+
+// haggle options with the client until it picks the export
+func (s *Server) handshake(r io.Reader, w io.Writer) error {
+	if err := send(w, uint64(NBD_MAGIC), uint64(NBD_OPTS_MAGIC), uint16(NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)); err != nil {
+		return err
+	}
+	var clientFlags uint32
+	if err := receive(r, &clientFlags); err != nil {
+		return err
+	}
+	if clientFlags&^(NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES) != 0 {
+		return fmt.Errorf("unknown client flags %#x", clientFlags)
+	}
+	noZeroes := clientFlags&NBD_FLAG_NO_ZEROES != 0
+
+	for {
+		var opt optionHeader
+		if err := receive(r, &opt); err != nil {
+			return err
+		}
+		if opt.Magic != NBD_OPTS_MAGIC {
+			return fmt.Errorf("bad option magic %#x", opt.Magic)
+		}
+		if opt.Length > NBD_MAX_OPTION_LEN {
+			return fmt.Errorf("option %d too long (%d bytes)", opt.Option, opt.Length)
+		}
+		data := make([]byte, opt.Length)
+		if _, err := io.ReadFull(r, data); err != nil {
+			return err
+		}
+
+		switch opt.Option {
+		case NBD_OPT_EXPORT_NAME:
+			if !s.exports(string(data)) {
+				return fmt.Errorf("unknown export %q", data)
+			}
+			values := []interface{}{s.size(), s.flags()}
+			if !noZeroes {
+				values = append(values, make([]byte, 124))
+			}
+			return send(w, values...)
+		case NBD_OPT_ABORT:
+			send(w, optionReply{NBD_REP_MAGIC, opt.Option, NBD_REP_ACK, 0})
+			return errAbort
+		case NBD_OPT_LIST:
+			name := []byte(s.Name)
+			err := send(w, optionReply{NBD_REP_MAGIC, opt.Option, NBD_REP_SERVER, uint32(4 + len(name))}, uint32(len(name)), name,
+				optionReply{NBD_REP_MAGIC, opt.Option, NBD_REP_ACK, 0})
+			if err != nil {
+				return err
+			}
+		case NBD_OPT_INFO, NBD_OPT_GO:
+			name, ok := parseInfoRequest(data)
+			reply := optionReply{Magic: NBD_REP_MAGIC, Option: opt.Option}
+			var err error
+			switch {
+			case !ok:
+				reply.Type = NBD_REP_ERR_INVALID
+				err = send(w, reply)
+			case !s.exports(name):
+				reply.Type = NBD_REP_ERR_UNKNOWN
+				err = send(w, reply)
+			default:
+				bs := uint32(s.Device.BlockSize())
+				err = send(w,
+					optionReply{NBD_REP_MAGIC, opt.Option, NBD_REP_INFO, 12}, uint16(NBD_INFO_EXPORT), s.size(), s.flags(),
+					optionReply{NBD_REP_MAGIC, opt.Option, NBD_REP_INFO, 14}, uint16(NBD_INFO_BLOCK_SIZE), uint32(1), bs, uint32(NBD_MAX_REQUEST),
+					optionReply{NBD_REP_MAGIC, opt.Option, NBD_REP_ACK, 0})
+				if err == nil && opt.Option == NBD_OPT_GO {
+					return nil
+				}
+			}
+			if err != nil {
+				return err
+			}
+		default:
+			if err := send(w, optionReply{NBD_REP_MAGIC, opt.Option, NBD_REP_ERR_UNSUP, 0}); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// return whether or not the server exports name
+func (s *Server) exports(name string) bool {
+	return name == s.Name || name == ""
+}
+
+// return export name asked for by the data of an NBD_OPT_INFO or NBD_OPT_GO
+func parseInfoRequest(data []byte) (string, bool) {
+	if len(data) < 4 {
+		return "", false
+	}
+	// the name length comes from the client, it may not fit in an int
+	length := uint64(be32(data))
+	if uint64(len(data)) < 4+length+2 {
+		return "", false
+	}
+	n := int(length)
+	requests := int(be16(data[4+n:]))
+	if len(data) != 4+n+2+2*requests {
+		return "", false
+	}
+	return string(data[4 : 4+n]), true
+}
+
+// serve requests until the client disconnects
+func (s *Server) transmit(r io.Reader, w io.Writer) error {
+	for {
+		var req Request
+		if err := receive(r, &req); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		if req.Magic != NBD_REQUEST_MAGIC {
+			return fmt.Errorf("bad request magic %#x", req.Magic)
+		}
+		var payload []byte
+		if req.Type == NBD_CMD_WRITE {
+			if req.Length > NBD_MAX_REQUEST {
+				// the payload can not be skipped safely
+				return fmt.Errorf("write of %d bytes too long", req.Length)
+			}
+			payload = make([]byte, req.Length)
+			if _, err := io.ReadFull(r, payload); err != nil {
+				return err
+			}
+		}
+		if req.Type == NBD_CMD_DISC {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return disk.Sync(s.Device)
+		}
+		atomic.AddUint32(&s.Requests, 1)
+		data, errno := s.handle(&req, payload)
+		reply := Reply{Magic: NBD_REPLY_MAGIC, Error: uint32(errno), Handle: req.Handle}
+		var err error
+		if errno == 0 && data != nil {
+			err = send(w, reply, data)
+		} else {
+			err = send(w, reply)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// apply request to device
+func (s *Server) handle(req *Request, payload []byte) ([]byte, Errno) {
+	switch req.Type {
+	case NBD_CMD_READ, NBD_CMD_WRITE, NBD_CMD_TRIM:
+		if req.Length > NBD_MAX_REQUEST || req.Offset+uint64(req.Length) > s.size() || req.Offset+uint64(req.Length) < req.Offset {
+			return nil, EINVAL
+		}
+	case NBD_CMD_FLUSH:
+	default:
+		return nil, EINVAL
+	}
+	if s.ReadOnly && (req.Type == NBD_CMD_WRITE || req.Type == NBD_CMD_TRIM) {
+		return nil, EPERM
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	var data []byte
+	switch req.Type {
+	case NBD_CMD_READ:
+		data = make([]byte, req.Length)
+		err = s.read(req.Offset, data)
+	case NBD_CMD_WRITE:
+		err = s.write(req.Offset, payload)
+	case NBD_CMD_TRIM:
+		err = s.trim(req.Offset, req.Length)
+	case NBD_CMD_FLUSH:
+		err = disk.Sync(s.Device)
+	}
+	if err == nil && req.Flags&NBD_CMD_FLAG_FUA != 0 {
+		err = disk.Sync(s.Device)
+	}
+	if err != nil {
+		if errors.Is(err, disk.ErrReadOnly) {
+			return nil, EPERM
+		}
+		return nil, EIO
+	}
+	return data, 0
+}
+
+// read bytes starting at byte offset of device into data
+func (s *Server) read(offset uint64, data []byte) error {
+	bs := uint64(s.Device.BlockSize())
+	if offset%bs == 0 && uint64(len(data))%bs == 0 {
+		return disk.ReadBlocks(s.Device, int(offset/bs), split(data, int(bs)))
+	}
+	buf := make([]byte, bs)
+	for len(data) > 0 {
+		blocknum, skip := offset/bs, offset%bs
+		if _, err := s.Device.Read(int(blocknum), buf); err != nil {
+			return err
+		}
+		n := copy(data, buf[skip:])
+		data = data[n:]
+		offset += uint64(n)
+	}
+	return nil
+}
+
+// write data to device starting at byte offset, keeping the rest of
+// partially written blocks
+func (s *Server) write(offset uint64, data []byte) error {
+	bs := uint64(s.Device.BlockSize())
+	if offset%bs == 0 && uint64(len(data))%bs == 0 {
+		return disk.WriteBlocks(s.Device, int(offset/bs), split(data, int(bs)))
+	}
+	buf := make([]byte, bs)
+	for len(data) > 0 {
+		blocknum, skip := offset/bs, offset%bs
+		block := data
+		if skip != 0 || uint64(len(data)) < bs {
+			if _, err := s.Device.Read(int(blocknum), buf); err != nil {
+				return err
+			}
+			n := copy(buf[skip:], data)
+			data = data[n:]
+			offset += uint64(n)
+			block = buf
+		} else {
+			block = data[:bs]
+			data = data[bs:]
+			offset += bs
+		}
+		if err := s.Device.Write(int(blocknum), block); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// cut data into blocks of bs bytes
+func split(data []byte, bs int) [][]byte {
+	bufs := make([][]byte, 0, len(data)/bs)
+	for len(data) > 0 {
+		bufs = append(bufs, data[:bs])
+		data = data[bs:]
+	}
+	return bufs
+}
+
+// release whole blocks in the byte range, zeroing partial blocks at its
+// ends
+func (s *Server) trim(offset uint64, length uint32) error {
+	bs := uint64(s.Device.BlockSize())
+	end := offset + uint64(length)
+	first := (offset + bs - 1) / bs
+	last := end / bs
+	if first >= last {
+		return s.write(offset, make([]byte, length))
+	}
+	if head := first*bs - offset; head > 0 {
+		if err := s.write(offset, make([]byte, head)); err != nil {
+			return err
+		}
+	}
+	if tail := end - last*bs; tail > 0 {
+		if err := s.write(last*bs, make([]byte, tail)); err != nil {
+			return err
+		}
+	}
+	return disk.Trim(s.Device, int(first), int(last-first))
+}
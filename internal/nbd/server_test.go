@@ -0,0 +1,271 @@
+package nbd
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"path/filepath"
+	"simplefs/internal/disk"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer(t *testing.T) {
+	for scenario, fn := range map[string]func(t *testing.T){
+		"handshake":   testServerHandshake,
+		"list":        testServerList,
+		"export name": testServerExportName,
+		"unaligned":   testServerUnaligned,
+		"read-only":   testServerReadOnly,
+		"bounds":      testServerBounds,
+		"close":       testServerClose,
+		"info":        testServerInfoRequest,
+	} {
+		t.Run(scenario, fn)
+	}
+}
+
+// serve dev as "test" on a unix socket, returning its address
+func serve(t *testing.T, dev disk.BlockDevice) (*Server, string) {
+	addr := "unix:" + filepath.Join(t.TempDir(), "nbd.sock")
+	l, err := Listen(addr)
+	require.NoError(t, err)
+	s := NewServer(dev, "test")
+	go s.Serve(l)
+	t.Cleanup(func() { s.Close() })
+	return s, addr
+}
+
+// raw connection to a server, speaking the protocol by hand
+type rawConn struct {
+	t    *testing.T
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// connect to addr and exchange handshake flags
+func dialRaw(t *testing.T, addr string, flags uint32) *rawConn {
+	network, address := SplitAddress(addr)
+	conn, err := net.Dial(network, address)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	c := &rawConn{t, conn, bufio.NewReader(conn)}
+	var hello struct {
+		Magic, OptsMagic uint64
+		Flags            uint16
+	}
+	require.NoError(t, receive(c.r, &hello))
+	require.Equal(t, uint64(NBD_MAGIC), hello.Magic)
+	require.Equal(t, uint64(NBD_OPTS_MAGIC), hello.OptsMagic)
+	require.Equal(t, uint16(NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES), hello.Flags)
+	require.NoError(t, send(conn, flags))
+	return c
+}
+
+// send option
+func (c *rawConn) option(option uint32, data []byte) {
+	require.NoError(c.t, send(c.conn, optionHeader{NBD_OPTS_MAGIC, option, uint32(len(data))}, data))
+}
+
+// receive option reply and its data
+func (c *rawConn) reply(option uint32) (uint32, []byte) {
+	var reply optionReply
+	require.NoError(c.t, receive(c.r, &reply))
+	require.Equal(c.t, uint64(NBD_REP_MAGIC), reply.Magic)
+	require.Equal(c.t, option, reply.Option)
+	data := make([]byte, reply.Length)
+	_, err := io.ReadFull(c.r, data)
+	require.NoError(c.t, err)
+	return reply.Type, data
+}
+
+// pick export with NBD_OPT_GO
+func (c *rawConn) goExport(name string) {
+	data := append([]byte{0, 0, 0, byte(len(name))}, name...)
+	c.option(NBD_OPT_GO, append(data, 0, 0))
+	for {
+		typ, _ := c.reply(NBD_OPT_GO)
+		if typ == NBD_REP_ACK {
+			return
+		}
+		require.Equal(c.t, uint32(NBD_REP_INFO), typ)
+	}
+}
+
+// send request and receive its reply, returning the error code
+func (c *rawConn) request(typ uint16, offset uint64, length uint32, payload []byte, data []byte) Errno {
+	values := []interface{}{Request{NBD_REQUEST_MAGIC, 0, typ, 7, offset, length}}
+	if payload != nil {
+		values = append(values, payload)
+	}
+	require.NoError(c.t, send(c.conn, values...))
+	var reply Reply
+	require.NoError(c.t, receive(c.r, &reply))
+	require.Equal(c.t, uint32(NBD_REPLY_MAGIC), reply.Magic)
+	require.Equal(c.t, uint64(7), reply.Handle)
+	if reply.Error == 0 && data != nil {
+		_, err := io.ReadFull(c.r, data)
+		require.NoError(c.t, err)
+	}
+	return Errno(reply.Error)
+}
+
+func testServerHandshake(t *testing.T) {
+	_, addr := serve(t, disk.NewMemDisk(8))
+	c := dialRaw(t, addr, NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)
+
+	// options the server does not know are refused without dropping the client
+	c.option(42, nil)
+	typ, _ := c.reply(42)
+	require.Equal(t, uint32(NBD_REP_ERR_UNSUP), typ)
+
+	c.option(NBD_OPT_INFO, []byte{0, 0, 0, 1})
+	typ, _ = c.reply(NBD_OPT_INFO)
+	require.Equal(t, uint32(NBD_REP_ERR_INVALID), typ)
+
+	c.option(NBD_OPT_INFO, []byte{0, 0, 0, 3, 'f', 'o', 'o', 0, 0})
+	typ, _ = c.reply(NBD_OPT_INFO)
+	require.Equal(t, uint32(NBD_REP_ERR_UNKNOWN), typ)
+
+	c.option(NBD_OPT_INFO, []byte{0, 0, 0, 4, 't', 'e', 's', 't', 0, 1, 0, NBD_INFO_BLOCK_SIZE})
+	typ, data := c.reply(NBD_OPT_INFO)
+	require.Equal(t, uint32(NBD_REP_INFO), typ)
+	require.Equal(t, uint16(NBD_INFO_EXPORT), be16(data))
+	require.Equal(t, uint64(8*disk.BLOCK_SIZE), be64(data[2:]))
+	typ, data = c.reply(NBD_OPT_INFO)
+	require.Equal(t, uint32(NBD_REP_INFO), typ)
+	require.Equal(t, uint16(NBD_INFO_BLOCK_SIZE), be16(data))
+	require.Equal(t, uint32(disk.BLOCK_SIZE), be32(data[6:]))
+	typ, _ = c.reply(NBD_OPT_INFO)
+	require.Equal(t, uint32(NBD_REP_ACK), typ)
+
+	c.goExport("")
+	require.Equal(t, Errno(0), c.request(NBD_CMD_FLUSH, 0, 0, nil, nil))
+	require.Equal(t, EINVAL, c.request(42, 0, 0, nil, nil))
+}
+
+func testServerList(t *testing.T) {
+	_, addr := serve(t, disk.NewMemDisk(8))
+	c := dialRaw(t, addr, NBD_FLAG_FIXED_NEWSTYLE)
+	c.option(NBD_OPT_LIST, nil)
+	typ, data := c.reply(NBD_OPT_LIST)
+	require.Equal(t, uint32(NBD_REP_SERVER), typ)
+	require.Equal(t, []byte{0, 0, 0, 4, 't', 'e', 's', 't'}, data)
+	typ, _ = c.reply(NBD_OPT_LIST)
+	require.Equal(t, uint32(NBD_REP_ACK), typ)
+
+	c.option(NBD_OPT_ABORT, nil)
+	typ, _ = c.reply(NBD_OPT_ABORT)
+	require.Equal(t, uint32(NBD_REP_ACK), typ)
+	_, err := c.r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func testServerExportName(t *testing.T) {
+	_, addr := serve(t, disk.NewMemDisk(8))
+
+	// without NBD_FLAG_NO_ZEROES the export is followed by 124 zero bytes
+	c := dialRaw(t, addr, NBD_FLAG_FIXED_NEWSTYLE)
+	c.option(NBD_OPT_EXPORT_NAME, []byte("test"))
+	var export struct {
+		Size  uint64
+		Flags uint16
+		Zeros [124]byte
+	}
+	require.NoError(t, receive(c.r, &export))
+	require.Equal(t, uint64(8*disk.BLOCK_SIZE), export.Size)
+	require.NotZero(t, export.Flags&NBD_FLAG_SEND_TRIM)
+	require.Zero(t, export.Flags&NBD_FLAG_READ_ONLY)
+	require.Equal(t, Errno(0), c.request(NBD_CMD_FLUSH, 0, 0, nil, nil))
+
+	// unknown exports drop the connection
+	c = dialRaw(t, addr, NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)
+	c.option(NBD_OPT_EXPORT_NAME, []byte("foo"))
+	_, err := c.r.ReadByte()
+	require.ErrorIs(t, err, io.EOF)
+}
+
+func testServerUnaligned(t *testing.T) {
+	mem := disk.NewMemDisk(4)
+	_, addr := serve(t, mem)
+	c := dialRaw(t, addr, NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)
+	c.goExport("test")
+
+	ones := make([]byte, 2*disk.BLOCK_SIZE)
+	for i := range ones {
+		ones[i] = 1
+	}
+	require.Equal(t, Errno(0), c.request(NBD_CMD_WRITE, disk.BLOCK_SIZE-10, uint32(len(ones)), ones, nil))
+	require.Equal(t, 3, int(mem.Stats().Writes))
+
+	data := make([]byte, 3*disk.BLOCK_SIZE)
+	require.Equal(t, Errno(0), c.request(NBD_CMD_READ, 0, uint32(len(data)), nil, data))
+	for i, b := range data {
+		want := byte(0)
+		if i >= disk.BLOCK_SIZE-10 && i < 3*disk.BLOCK_SIZE-10 {
+			want = 1
+		}
+		require.Equal(t, want, b, "byte %d", i)
+	}
+
+	// whole blocks are trimmed, partial ones zeroed
+	require.Equal(t, Errno(0), c.request(NBD_CMD_TRIM, disk.BLOCK_SIZE-10, 2*disk.BLOCK_SIZE, nil, nil))
+	require.Equal(t, 1, int(mem.Stats().Trims))
+	require.Equal(t, Errno(0), c.request(NBD_CMD_READ, 0, uint32(len(data)), nil, data))
+	require.Equal(t, make([]byte, len(data)), data)
+}
+
+func testServerReadOnly(t *testing.T) {
+	s, addr := serve(t, disk.NewMemDisk(4))
+	s.ReadOnly = true
+	c := dialRaw(t, addr, NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)
+	c.goExport("test")
+	require.Equal(t, EPERM, c.request(NBD_CMD_WRITE, 0, 3, []byte{1, 2, 3}, nil))
+	require.Equal(t, EPERM, c.request(NBD_CMD_TRIM, 0, disk.BLOCK_SIZE, nil, nil))
+	require.Equal(t, Errno(0), c.request(NBD_CMD_READ, 0, 3, nil, make([]byte, 3)))
+}
+
+func testServerBounds(t *testing.T) {
+	_, addr := serve(t, disk.NewMemDisk(4))
+	c := dialRaw(t, addr, NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)
+	c.goExport("test")
+	require.Equal(t, EINVAL, c.request(NBD_CMD_READ, 4*disk.BLOCK_SIZE-1, 2, nil, nil))
+	require.Equal(t, EINVAL, c.request(NBD_CMD_WRITE, 4*disk.BLOCK_SIZE, 1, []byte{1}, nil))
+	require.Equal(t, EINVAL, c.request(NBD_CMD_TRIM, 1<<63, 1<<31, nil, nil))
+	require.Equal(t, Errno(0), c.request(NBD_CMD_READ, 4*disk.BLOCK_SIZE-1, 1, nil, make([]byte, 1)))
+}
+
+func testServerClose(t *testing.T) {
+	l, err := Listen("127.0.0.1:0")
+	require.NoError(t, err)
+	s := NewServer(disk.NewMemDisk(4), "test")
+	done := make(chan error)
+	go func() { done <- s.Serve(l) }()
+	c := dialRaw(t, l.Addr().String(), NBD_FLAG_FIXED_NEWSTYLE|NBD_FLAG_NO_ZEROES)
+	c.goExport("test")
+
+	// connected clients are dropped
+	require.NoError(t, s.Close())
+	require.NoError(t, <-done)
+	_, err = c.r.ReadByte()
+	require.Error(t, err)
+	require.Error(t, s.Serve(l))
+}
+
+func testServerInfoRequest(t *testing.T) {
+	name, ok := parseInfoRequest([]byte{0, 0, 0, 4, 't', 'e', 's', 't', 0, 1, 0, 3})
+	require.True(t, ok)
+	require.Equal(t, "test", name)
+	for _, data := range [][]byte{
+		{0, 0, 0},
+		{0, 0, 0, 4, 't', 'e', 's', 't', 0},
+		{0, 0, 0, 4, 't', 'e', 's', 't', 0, 1},
+		// the name length must not wrap around where int has 32 bits
+		{0xff, 0xff, 0xff, 0xff, 0, 0},
+		{0x7f, 0xff, 0xff, 0xff, 0, 0},
+	} {
+		_, ok := parseInfoRequest(data)
+		require.False(t, ok, "%v", data)
+	}
+}
@@ -0,0 +1,76 @@
+package shell
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	ds "simplefs/internal/disk"
+	"strings"
+
+	"golang.org/x/term"
+)
+
+// Number of passphrase attempts before giving up on an encrypted image
+const UNLOCK_ATTEMPTS = 3
+
+// Unlock dev if it is encrypted, prompting for its passphrase. Devices
+// that are not encrypted are returned as is.
+func Unlock(dev ds.BlockDevice) (ds.BlockDevice, error) {
+	encrypted, err := ds.IsEncrypted(dev)
+	if err != nil || !encrypted {
+		return dev, err
+	}
+	for attempt := 1; ; attempt++ {
+		passphrase, err := readPassphrase("passphrase: ")
+		if err != nil {
+			return nil, err
+		}
+		crypt, err := ds.OpenCrypt(dev, passphrase)
+		if err == nil {
+			return crypt, nil
+		}
+		if !errors.Is(err, ds.ErrBadPassphrase) || attempt == UNLOCK_ATTEMPTS {
+			return nil, err
+		}
+		fmt.Println("wrong passphrase, try again.")
+	}
+}
+
+// Set up encryption on dev with a passphrase read from the user,
+// destroying its contents
+func Encrypt(dev ds.BlockDevice) (ds.BlockDevice, error) {
+	passphrase, err := readPassphrase("new passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if passphrase == "" {
+		return nil, errors.New("empty passphrase")
+	}
+	confirm, err := readPassphrase("repeat passphrase: ")
+	if err != nil {
+		return nil, err
+	}
+	if confirm != passphrase {
+		return nil, errors.New("passphrases do not match")
+	}
+	return ds.FormatCrypt(dev, passphrase, ds.DefaultCryptParams)
+}
+
+// read a line without echoing it when stdin is a terminal
+func readPassphrase(prompt string) (string, error) {
+	fmt.Print(prompt)
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		passphrase, err := term.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", fmt.Errorf("failed to read passphrase: %s", err.Error())
+		}
+		return string(passphrase), nil
+	}
+	line, err := stdin.ReadString('\n')
+	if err != nil {
+		return "", fmt.Errorf("failed to read passphrase: %s", err.Error())
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
@@ -3,6 +3,7 @@ package shell
 import (
 	"bufio"
 	"bytes"
+	"errors"
 	"fmt"
 	"io"
 	"os"
@@ -10,11 +11,20 @@ import (
 	"simplefs/internal/fs"
 	"strconv"
 	"strings"
+	"sync"
 )
 
+// Input of the shell, shared with the passphrase prompt
+var stdin = bufio.NewReader(os.Stdin)
+
 type Shell struct {
-	filesystem fs.FileSystem
-	disk       *ds.Disk
+	filesystem  fs.FileSystem
+	disk        ds.BlockDevice        // Device the filesystem commands work on
+	device      ds.BlockDevice        // Whole device, holding the partitions
+	partition   int                   // Partition in use (-1 for the whole device)
+	partitions  map[int]*ds.Partition // Partitions opened so far
+	filesystems map[int]fs.FileSystem // Filesystems of partitions not in use
+	resyncs     sync.WaitGroup        // Mirror resyncs running in the background
 }
 
 func NewShell(path string, nblocks int) *Shell {
@@ -24,19 +34,36 @@ func NewShell(path string, nblocks int) *Shell {
 		fmt.Printf("failed to open disk: %s\n", err.Error())
 		os.Exit(1)
 	}
+	dev, err := Unlock(disk)
+	if err != nil {
+		fmt.Printf("failed to unlock disk: %s\n", err.Error())
+		os.Exit(1)
+	}
+	return NewShellWithDevice(dev)
+}
+
+// Create a shell on top of an already opened block device
+func NewShellWithDevice(disk ds.BlockDevice) *Shell {
 	filesystem := fs.NewFS()
 	return &Shell{
-		filesystem: filesystem,
-		disk:       disk,
+		filesystem:  filesystem,
+		disk:        disk,
+		device:      disk,
+		partition:   -1,
+		partitions:  map[int]*ds.Partition{},
+		filesystems: map[int]fs.FileSystem{},
 	}
 }
 
 func (shell *Shell) Init() {
 	defer shell.Shutdown()
-	reader := bufio.NewReader(os.Stdin)
 	for {
-		fmt.Print("sfs> ")
-		input, err := reader.ReadString('\n')
+		if shell.partition >= 0 {
+			fmt.Printf("sfs[%d]> ", shell.partition)
+		} else {
+			fmt.Print("sfs> ")
+		}
+		input, err := stdin.ReadString('\n')
 		if err != nil {
 			fmt.Printf("failed to read input: %s\n", err.Error())
 			return
@@ -62,6 +89,159 @@ func (shell *Shell) Init() {
 				fmt.Println("disk mounted.")
 			}
 			break
+		case "unmount":
+			ok := shell.filesystem.Unmount()
+			if ok {
+				fmt.Println("disk unmounted.")
+			}
+			break
+		case "sync":
+			err := ds.Sync(shell.disk)
+			if err != nil {
+				fmt.Printf("failure on sync command: %s\n", err.Error())
+			} else {
+				fmt.Println("disk synced.")
+			}
+			break
+		case "commit":
+			err := shell.commit()
+			if err != nil {
+				fmt.Printf("failure on commit command: %s\n", err.Error())
+			} else {
+				fmt.Println("overlay committed.")
+			}
+			break
+		case "discard":
+			err := shell.discard()
+			if err != nil {
+				fmt.Printf("failure on discard command: %s\n", err.Error())
+			} else {
+				fmt.Println("overlay discarded.")
+			}
+			break
+		case "fail":
+			if len(args) < 2 {
+				fmt.Printf("Usage: fail <member>\n")
+			} else {
+				member, _ := strconv.Atoi(args[1])
+				err := shell.fail(member)
+				if err != nil {
+					fmt.Printf("failure on fail command: %s\n", err.Error())
+				} else {
+					fmt.Printf("member %d failed.\n", member)
+				}
+			}
+			break
+		case "resync":
+			if len(args) < 2 {
+				fmt.Printf("Usage: resync <member>\n")
+			} else {
+				member, _ := strconv.Atoi(args[1])
+				err := shell.resync(member)
+				if err != nil {
+					fmt.Printf("failure on resync command: %s\n", err.Error())
+				} else {
+					fmt.Printf("resyncing member %d (see debug for progress).\n", member)
+				}
+			}
+			break
+		case "rebuild":
+			if len(args) < 2 {
+				fmt.Printf("Usage: rebuild <member>\n")
+			} else {
+				member, _ := strconv.Atoi(args[1])
+				err := shell.rebuild(member)
+				if err != nil {
+					fmt.Printf("failure on rebuild command: %s\n", err.Error())
+				} else {
+					fmt.Printf("member %d rebuilt.\n", member)
+				}
+			}
+			break
+		case "markbad":
+			if len(args) < 2 {
+				fmt.Printf("Usage: markbad <block>\n")
+			} else {
+				blocknum, _ := strconv.Atoi(args[1])
+				err := shell.markBad(blocknum, true)
+				if err != nil {
+					fmt.Printf("failure on markbad command: %s\n", err.Error())
+				} else {
+					fmt.Printf("block %d marked bad.\n", blocknum)
+				}
+			}
+			break
+		case "clearbad":
+			if len(args) < 2 {
+				fmt.Printf("Usage: clearbad <block>\n")
+			} else {
+				blocknum, _ := strconv.Atoi(args[1])
+				err := shell.markBad(blocknum, false)
+				if err != nil {
+					fmt.Printf("failure on clearbad command: %s\n", err.Error())
+				} else {
+					fmt.Printf("block %d no longer bad.\n", blocknum)
+				}
+			}
+			break
+		case "badblocks":
+			err := shell.listBadBlocks()
+			if err != nil {
+				fmt.Printf("failure on badblocks command: %s\n", err.Error())
+			}
+			break
+		case "gc":
+			released, err := shell.gc()
+			if err != nil {
+				fmt.Printf("failure on gc command: %s\n", err.Error())
+			} else {
+				fmt.Printf("%d unreferenced blocks released.\n", released)
+			}
+			break
+		case "scheduler":
+			name := ""
+			if len(args) > 1 {
+				name = args[1]
+			}
+			current, err := shell.scheduler(name)
+			if err != nil {
+				fmt.Printf("failure on scheduler command: %s\n", err.Error())
+			} else {
+				fmt.Printf("using %s scheduler.\n", current)
+			}
+			break
+		case "partition":
+			if len(args) < 2 {
+				fmt.Printf("Usage: partition <blocks> [<blocks> ...]\n")
+			} else {
+				err := shell.createPartitions(args[1:])
+				if err != nil {
+					fmt.Printf("failure on partition command: %s\n", err.Error())
+				} else {
+					fmt.Printf("%d partitions created.\n", len(args)-1)
+				}
+			}
+			break
+		case "partitions":
+			err := shell.listPartitions()
+			if err != nil {
+				fmt.Printf("failure on partitions command: %s\n", err.Error())
+			}
+			break
+		case "use":
+			if len(args) < 2 {
+				fmt.Printf("Usage: use <partition|disk>\n")
+			} else {
+				err := shell.use(args[1])
+				if err != nil {
+					fmt.Printf("failure on use command: %s\n", err.Error())
+				} else if shell.partition >= 0 {
+					fmt.Printf("using partition %d.\n", shell.partition)
+				} else {
+					fmt.Println("using whole disk.")
+				}
+			}
+			break
 		case "debug":
 			err := shell.filesystem.Debug(shell.disk)
 			if err != nil {
@@ -163,13 +343,14 @@ func (shell *Shell) CopyOut(inumber int, filePath string) (int32, error) {
 		return -1, err
 	}
 
-	var readBuf [ds.BLOCK_SIZE]byte
+	ds.Annotate(shell.disk, "copyout")
+	readBuf := make([]byte, shell.disk.BlockSize())
 
 	bytesCopied := 0
 
 	for _, blocknum := range inode.Direct {
 		if blocknum > 0 {
-			n, err := shell.disk.Read(int(blocknum), readBuf[:])
+			n, err := shell.disk.Read(int(blocknum), readBuf)
 			if err != nil {
 				return -1, err
 			}
@@ -197,11 +378,11 @@ func (shell *Shell) CopyIn(filePath string, inumber int) (int32, error) {
 	}
 
 	//readBuf := bufio.NewReader(file)
-	var writeBuf [ds.BLOCK_SIZE]byte
+	writeBuf := make([]byte, shell.disk.BlockSize())
 	bytesCopied := 0
 
 	for {
-		n, err := file.Read(writeBuf[:])
+		n, err := file.Read(writeBuf)
 
 		if err == io.EOF {
 			return int32(bytesCopied), nil
@@ -211,7 +392,7 @@ func (shell *Shell) CopyIn(filePath string, inumber int) (int32, error) {
 			return -1, err
 		}
 
-		b := bytes.Trim(writeBuf[:], "\x00")
+		b := bytes.Trim(writeBuf, "\x00")
 		n = len(b)
 		_, err = shell.filesystem.Write(inumber, b)
 
@@ -229,6 +410,21 @@ func (shell *Shell) helpCmd() {
 	fmt.Println(`Commands are:
 	format
 	mount
+	unmount
+	sync
+	commit
+	discard
+	fail    <member>
+	resync  <member>
+	rebuild <member>
+	markbad  <block>
+	clearbad <block>
+	badblocks
+	gc
+	scheduler [fifo|scan|deadline]
+	partition <blocks> [<blocks> ...]
+	partitions
+	use     <partition|disk>
 	debug
 	create
 	remove  <inode>
@@ -241,8 +437,249 @@ func (shell *Shell) helpCmd() {
 	exit`)
 }
 
+// Write changes held by the overlay into its base image
+func (shell *Shell) commit() error {
+	overlay := find[*ds.Overlay](shell.disk)
+	if overlay == nil {
+		return errors.New("disk has no overlay")
+	}
+	// blocks cached above the overlay belong to the delta
+	if err := ds.Sync(shell.disk); err != nil {
+		return err
+	}
+	// the image below the overlay is shared read-only, it is locked for
+	// exclusive use only while the changes are written into it
+	if base := find[*ds.Disk](overlay.Unwrap()); base != nil && base.ReadOnly() {
+		if err := base.Open(base.Name, 0); err != nil {
+			return err
+		}
+		defer base.OpenReadOnly(base.Name)
+	}
+	return overlay.Commit()
+}
+
+// Drop changes held by the overlay, unmounting the filesystem first
+func (shell *Shell) discard() error {
+	overlay := find[*ds.Overlay](shell.disk)
+	if overlay == nil {
+		return errors.New("disk has no overlay")
+	}
+	shell.filesystem.Unmount()
+	if err := ds.Sync(shell.disk); err != nil {
+		return err
+	}
+	if err := overlay.Discard(); err != nil {
+		return err
+	}
+	// cached blocks may hold discarded data
+	for dev := shell.disk; dev != ds.BlockDevice(overlay); dev = dev.(ds.Wrapper).Unwrap() {
+		if cache, ok := dev.(*ds.Cache); ok {
+			if err := cache.Invalidate(); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Mark a member of the mirror or parity stripe as failed
+func (shell *Shell) fail(member int) error {
+	if mirror := find[*ds.Mirror](shell.disk); mirror != nil {
+		return mirror.Fail(member)
+	}
+	if parity := find[*ds.Parity](shell.disk); parity != nil {
+		return parity.Fail(member)
+	}
+	return errors.New("disk has no redundancy")
+}
+
+// Start copying a healthy member of the mirror into a failed one
+func (shell *Shell) resync(member int) error {
+	mirror := find[*ds.Mirror](shell.disk)
+	if mirror == nil {
+		return errors.New("disk is not mirrored")
+	}
+	done, err := mirror.StartResync(member)
+	if err != nil {
+		return err
+	}
+	shell.resyncs.Add(1)
+	go func() {
+		defer shell.resyncs.Done()
+		if err := <-done; err != nil {
+			fmt.Printf("\nfailure on resync command: %s\n", err.Error())
+		}
+	}()
+	return nil
+}
+
+// Rebuild a failed member of the parity stripe from the other members
+func (shell *Shell) rebuild(member int) error {
+	parity := find[*ds.Parity](shell.disk)
+	if parity == nil {
+		return errors.New("disk has no parity")
+	}
+	if member < 0 || member >= len(parity.Members) || parity.Members[member] == nil {
+		return fmt.Errorf("no image for member %d", member)
+	}
+	return parity.Rebuild(member, parity.Members[member])
+}
+
+// Set or clear the bad mark of a block of the disk image
+func (shell *Shell) markBad(blocknum int, bad bool) error {
+	disk := find[*ds.Disk](shell.device)
+	if disk == nil {
+		return errors.New("disk has no image to mark blocks in")
+	}
+	if bad {
+		return disk.MarkBad(blocknum)
+	}
+	return disk.ClearBad(blocknum)
+}
+
+// Print blocks marked bad in the disk image and blocks remapped to spares
+func (shell *Shell) listBadBlocks() error {
+	disk := find[*ds.Disk](shell.device)
+	if disk == nil {
+		return errors.New("disk has no image to mark blocks in")
+	}
+	fmt.Printf("bad blocks: %v\n", disk.BadBlocks())
+	if remap := find[*ds.Remap](shell.device); remap != nil {
+		for _, entry := range remap.Table() {
+			fmt.Printf("block %d remapped to spare %d\n", entry.Block, entry.Spare)
+		}
+	}
+	return nil
+}
+
+// Release blocks of the dedup store no image refers to any more
+func (shell *Shell) gc() (int, error) {
+	dedup := find[*ds.DedupDisk](shell.device)
+	if dedup == nil {
+		return 0, errors.New("disk is not kept in a dedup store")
+	}
+	// blocks buffered above the store may still refer to released blocks
+	if err := ds.Sync(shell.device); err != nil {
+		return 0, err
+	}
+	return dedup.Store.GC()
+}
+
+// Switch the request queue to the scheduler called name (if not empty),
+// returning the name of the scheduler in use
+func (shell *Shell) scheduler(name string) (string, error) {
+	queue := find[*ds.Queue](shell.device)
+	if queue == nil {
+		return "", errors.New("disk has no request queue")
+	}
+	if name != "" {
+		scheduler, err := ds.NewScheduler(name)
+		if err != nil {
+			return "", err
+		}
+		queue.SetScheduler(scheduler)
+	}
+	return queue.Scheduler().Name(), nil
+}
+
+// return device of type T in the device stack of dev (if any)
+func find[T ds.BlockDevice](dev ds.BlockDevice) T {
+	for {
+		if found, ok := dev.(T); ok {
+			return found
+		}
+		w, ok := dev.(ds.Wrapper)
+		if !ok {
+			var none T
+			return none
+		}
+		dev = w.Unwrap()
+	}
+}
+
+// Write a partition table with partitions of the given sizes onto the
+// whole device
+func (shell *Shell) createPartitions(args []string) error {
+	if shell.partition >= 0 {
+		return errors.New("not using the whole disk (see use)")
+	}
+	if shell.device.Stats().Mounts > 0 {
+		return errors.New("disk is mounted")
+	}
+	sizes := make([]int, len(args))
+	for i, arg := range args {
+		size, err := strconv.Atoi(arg)
+		if err != nil {
+			return fmt.Errorf("invalid number of blocks %q", arg)
+		}
+		sizes[i] = size
+	}
+	ds.Annotate(shell.device, "partition")
+	if _, err := ds.CreatePartitions(shell.device, sizes...); err != nil {
+		return err
+	}
+	// partitions opened before describe the old table
+	shell.partitions = map[int]*ds.Partition{}
+	shell.filesystems = map[int]fs.FileSystem{-1: shell.filesystem}
+	return nil
+}
+
+// Print partition table of the whole device
+func (shell *Shell) listPartitions() error {
+	table, err := ds.ReadPartitionTable(shell.device)
+	if err != nil {
+		return err
+	}
+	if table == nil {
+		return ds.ErrNoPartitionTable
+	}
+	for i, entry := range table.Partitions() {
+		marker := " "
+		if i == shell.partition {
+			marker = "*"
+		}
+		fmt.Printf("%s partition %d: blocks %d-%d (%d blocks)\n", marker, i, entry.Start, entry.Start+entry.Blocks-1, entry.Blocks)
+	}
+	return nil
+}
+
+// Switch filesystem commands to a partition ("disk" for the whole
+// device). Every partition keeps its own filesystem, mounted or not.
+func (shell *Shell) use(name string) error {
+	index := -1
+	if name != "disk" {
+		var err error
+		if index, err = strconv.Atoi(name); err != nil || index < 0 {
+			return fmt.Errorf("invalid partition %q", name)
+		}
+	}
+	if index == shell.partition {
+		return nil
+	}
+	dev := shell.device
+	if index >= 0 {
+		partition, ok := shell.partitions[index]
+		if !ok {
+			var err error
+			if partition, err = ds.OpenPartition(shell.device, index); err != nil {
+				return err
+			}
+			shell.partitions[index] = partition
+		}
+		dev = partition
+	}
+	shell.filesystems[shell.partition] = shell.filesystem
+	filesystem, ok := shell.filesystems[index]
+	if !ok {
+		filesystem = fs.NewFS()
+	}
+	shell.filesystem, shell.disk, shell.partition = filesystem, dev, index
+	return nil
+}
+
 func (shell *Shell) Shutdown() {
-	err := shell.disk.Close()
+	shell.resyncs.Wait()
+	err := shell.device.Close()
 
 	if err != nil {
 		fmt.Printf("Failed to close disk: %s\n", err)
@@ -1,28 +1,403 @@
 package main
 
 import (
+	"errors"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"simplefs/internal/disk"
+	"simplefs/internal/nbd"
 	fs "simplefs/internal/shell"
 	"strconv"
+	"strings"
 )
 
 func main() {
+	cacheBlocks := flag.Int("cache", 0, "number of blocks to cache in memory (0 disables the cache)")
+	writeBack := flag.Bool("writeback", false, "delay cached writes until sync, unmount or exit")
+	hdd := flag.Bool("hdd", false, "simulate rotational disk latency (shown by the debug command)")
+	flash := flag.Bool("flash", false, "simulate a flash device with erase blocks and wear tracking")
+	iops := flag.Float64("iops", 0, "limit the disk to `operations` per second (0 for no limit)")
+	bandwidth := flag.String("bandwidth", "", "limit the disk to `bytes` per second (k, m and g suffixes allowed)")
+	jitter := flag.Duration("jitter", 0, "delay every disk operation by a random time of up to `duration`")
+	scheduler := flag.String("scheduler", "", "queue disk requests, dispatching them in the order of `scheduler` fifo, scan or deadline")
+	tracePath := flag.String("trace", "", "record every block read and write into `file`")
+	replayPath := flag.String("replay", "", "replay the trace in `file` against the disk image and exit")
+	concatPaths := flag.String("concat", "", "append the comma separated disk images `files` to the disk image, forming one larger disk")
+	mirrorPaths := flag.String("mirror", "", "mirror the disk image onto the comma separated disk images `files` (see fail and resync)")
+	verify := flag.Bool("verify", false, "read every copy of a mirrored block and compare them")
+	stripePaths := flag.String("stripe", "", "stripe the disk image with the comma separated disk images `files` (RAID-0)")
+	parity := flag.Bool("parity", false, "keep rotating parity across the striped disk images (RAID-5, see fail and rebuild)")
+	unit := flag.Int("unit", 4, "number of `blocks` per stripe unit")
+	overlayPath := flag.String("overlay", "", "keep the disk image unchanged and write changes into delta `file` (see commit and discard)")
+	convertPath := flag.String("convert", "", "convert the disk image into `file` (raw images become compact images and back) and exit")
+	compress := flag.String("compress", "zstd", "compression of compact images written by -convert (none, deflate or zstd)")
+	encrypt := flag.Bool("encrypt", false, "encrypt the disk image with a passphrase (destroys its contents)")
+	readOnly := flag.Bool("readonly", false, "open the disk image read-only, sharing it with other read-only shells")
+	serveAddr := flag.String("serve", "", "export the disk over NBD on `address` (host:port or unix:<path>) instead of starting the shell")
+	dedupDir := flag.String("dedup", "", "keep the disk image as a named image in the deduplicating block store in `directory` (see gc)")
+	objectDir := flag.String("objects", "", "keep the disk image as objects of the directory object store in `directory`, named after the image")
+	spares := flag.Int("spares", 0, "reserve `blocks` at the end of the disk image to remap bad blocks into (kept by images remapped before)")
+	blockSize := flag.Int("blocksize", 0, "block size in `bytes` of a new disk image (power of two from 512 to 65536, default 4096)")
+	flag.Usage = func() {
+		fmt.Println("Usage: simplefs [options] <path_to_data_file|nbd_uri> [<number_of_blocks>]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
 
-	if len(os.Args) < 3 {
-		fmt.Println("Usage: simplefs <path_to_data_file> <number_of_blocks>")
+	if flag.NArg() < 1 {
+		flag.Usage()
 		return
 	}
 
-	dataPath := os.Args[1]
-	numberOfBlocks := os.Args[2]
+	dataPath := flag.Arg(0)
+	// existing images know their own size
+	numberOfBlocksInt := 0
+	if flag.NArg() > 1 {
+		var err error
+		numberOfBlocksInt, err = strconv.Atoi(flag.Arg(1))
+		if err != nil {
+			fmt.Println("error: invalid number_of_blocks value (use a valid number)")
+			os.Exit(1)
+		}
+	}
+
+	if *convertPath != "" {
+		convert(dataPath, *convertPath, *compress)
+		return
+	}
 
-	numberOfBlocksInt, err := strconv.Atoi(numberOfBlocks)
+	var dev disk.BlockDevice
+	var err error
+	if (*dedupDir != "" || *objectDir != "") && *readOnly {
+		err = errors.New("images in a dedup or object store can not be opened read-only")
+	} else if *objectDir != "" {
+		dev, err = disk.OpenObjectDisk(disk.NewDirStore(*objectDir), dataPath, numberOfBlocksInt, *blockSize, disk.DefaultObjectConfig)
+	} else if *dedupDir != "" {
+		dev, err = disk.OpenDedup(*dedupDir, dataPath, numberOfBlocksInt, *blockSize)
+	} else if *readOnly {
+		dev, err = openReadOnly(dataPath)
+	} else if *overlayPath != "" {
+		dev, err = openBase(dataPath, numberOfBlocksInt, *blockSize)
+	} else {
+		dev, err = open(dataPath, numberOfBlocksInt, *blockSize)
+	}
 	if err != nil {
-		fmt.Println("error: invalid number_of_blocks value (use a valid number)")
+		fmt.Printf("failed to open disk: %s\n", err.Error())
 		os.Exit(1)
 	}
-	shell := fs.NewShell(dataPath, numberOfBlocksInt)
+	if *spares > 0 {
+		dev, err = disk.NewRemap(dev, *spares)
+		if err != nil {
+			fmt.Printf("failed to open disk: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *concatPaths != "" {
+		dev, err = concat(dev, strings.Split(*concatPaths, ","), numberOfBlocksInt)
+		if err != nil {
+			fmt.Printf("failed to open disk: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *mirrorPaths != "" {
+		m, err := mirror(dev, strings.Split(*mirrorPaths, ","))
+		if err != nil {
+			fmt.Printf("failed to open disk: %s\n", err.Error())
+			os.Exit(1)
+		}
+		m.Verify = *verify
+		dev = m
+	}
+	if *stripePaths != "" {
+		dev, err = stripe(dev, strings.Split(*stripePaths, ","), *unit, *parity)
+		if err != nil {
+			fmt.Printf("failed to open disk: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *overlayPath != "" {
+		dev, err = disk.NewOverlay(dev, *overlayPath)
+		if err != nil {
+			fmt.Printf("failed to open disk: %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if *encrypt {
+		dev, err = fs.Encrypt(dev)
+	} else {
+		dev, err = fs.Unlock(dev)
+	}
+	if err != nil {
+		fmt.Printf("failed to open disk: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if *replayPath != "" {
+		replay(dev, *replayPath)
+		return
+	}
+	if *flash {
+		f, err := disk.NewFlashDiskFrom(dev, disk.DefaultFlashConfig)
+		if err != nil {
+			fmt.Printf("failed to open disk: %s\n", err.Error())
+			os.Exit(1)
+		}
+		dev = f
+	}
+	if *tracePath != "" {
+		trace, err := os.Create(*tracePath)
+		if err != nil {
+			fmt.Printf("failed to create trace: %s\n", err.Error())
+			os.Exit(1)
+		}
+		dev = disk.NewTracer(dev, trace)
+	}
+	if *hdd {
+		dev = disk.NewRotationalDisk(dev, disk.DefaultHDDModel)
+	}
+	if *iops > 0 || *bandwidth != "" || *jitter > 0 {
+		bytesPerSecond, err := parseBytes(*bandwidth)
+		if err != nil {
+			fmt.Printf("error: invalid bandwidth %q (use a number of bytes)\n", *bandwidth)
+			os.Exit(1)
+		}
+		dev = disk.NewThrottle(dev, disk.ThrottleConfig{IOPS: *iops, Bandwidth: float64(bytesPerSecond), Jitter: *jitter})
+	}
+	if *cacheBlocks > 0 {
+		policy := disk.WriteThrough
+		if *writeBack {
+			policy = disk.WriteBack
+		}
+		dev = disk.NewCache(dev, *cacheBlocks, policy)
+	}
+	if *scheduler != "" {
+		s, err := disk.NewScheduler(*scheduler)
+		if err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+		dev = disk.NewQueue(dev, s)
+	}
+	if *serveAddr != "" {
+		serve(dev, *serveAddr, filepath.Base(dataPath), *readOnly)
+		return
+	}
+
+	shell := fs.NewShellWithDevice(dev)
 	shell.Init()
 
 }
+
+// parse number of bytes with an optional k, m or g suffix ("" is 0)
+func parseBytes(s string) (int64, error) {
+	if s == "" {
+		return 0, nil
+	}
+	shift := 0
+	switch strings.ToLower(s[len(s)-1:]) {
+	case "k":
+		shift = 10
+	case "m":
+		shift = 20
+	case "g":
+		shift = 30
+	}
+	if shift > 0 {
+		s = s[:len(s)-1]
+	}
+	n, err := strconv.ParseInt(s, 10, 64)
+	if err != nil || n < 0 {
+		return 0, errors.New("invalid number of bytes")
+	}
+	return n << shift, nil
+}
+
+// open raw or compact disk image, or connect to an NBD export
+func open(path string, nblocks int, blockSize int) (disk.BlockDevice, error) {
+	if nbd.IsURI(path) {
+		return nbd.Dial(path)
+	}
+	compact, err := disk.IsCompact(path)
+	if err == nil && compact {
+		return disk.OpenCompact(path)
+	}
+	dsk := &disk.Disk{}
+	if err := dsk.OpenWithBlockSize(path, nblocks, blockSize); err != nil {
+		return nil, err
+	}
+	return dsk, nil
+}
+
+// open existing raw disk image without write access, or connect to an NBD
+// export
+func openReadOnly(path string) (disk.BlockDevice, error) {
+	if nbd.IsURI(path) {
+		return nbd.Dial(path)
+	}
+	compact, err := disk.IsCompact(path)
+	if err == nil && compact {
+		return nil, fmt.Errorf("Unable to open %s: compact images can not be opened read-only", path)
+	}
+	dsk := &disk.Disk{}
+	if err := dsk.OpenReadOnly(path); err != nil {
+		return nil, err
+	}
+	return dsk, nil
+}
+
+// open disk image below an overlay, which leaves it unchanged until a
+// commit: existing raw images are opened read-only and shared with
+// read-only shells
+func openBase(path string, nblocks int, blockSize int) (disk.BlockDevice, error) {
+	if nbd.IsURI(path) {
+		return nbd.Dial(path)
+	}
+	compact, err := disk.IsCompact(path)
+	if err != nil || compact {
+		return open(path, nblocks, blockSize)
+	}
+	return openReadOnly(path)
+}
+
+// concatenate dev and the disk images at paths. Images that do not exist
+// yet are created with nblocks blocks of the block size of dev.
+func concat(dev disk.BlockDevice, paths []string, nblocks int) (disk.BlockDevice, error) {
+	members := []disk.BlockDevice{dev}
+	for _, path := range paths {
+		member, err := open(path, nblocks, dev.BlockSize())
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	return disk.NewConcat(members...)
+}
+
+// mirror dev onto the disk images at paths. Images that do not exist yet
+// are created with the geometry of dev and start out failed, so they get
+// their contents from a resync.
+func mirror(dev disk.BlockDevice, paths []string) (*disk.Mirror, error) {
+	members := []disk.BlockDevice{dev}
+	var missing []int
+	for _, path := range paths {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			missing = append(missing, len(members))
+		}
+		member, err := open(path, int(dev.Size()), dev.BlockSize())
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	m, err := disk.NewMirror(members...)
+	if err != nil {
+		return nil, err
+	}
+	for _, member := range missing {
+		if err := m.Fail(member); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+// stripe dev with the disk images at paths. Images that do not exist yet
+// are created with the geometry of dev; with parity they start out failed,
+// so they get their contents from a rebuild.
+func stripe(dev disk.BlockDevice, paths []string, unit int, parity bool) (disk.BlockDevice, error) {
+	members := []disk.BlockDevice{dev}
+	missing := -1
+	for _, path := range paths {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			missing = len(members)
+		}
+		member, err := open(path, int(dev.Size()), dev.BlockSize())
+		if err != nil {
+			return nil, err
+		}
+		members = append(members, member)
+	}
+	if !parity {
+		return disk.NewStripe(unit, members...)
+	}
+	p, err := disk.NewParity(unit, members...)
+	if err != nil {
+		return nil, err
+	}
+	if missing >= 0 {
+		if err := p.Fail(missing); err != nil {
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+// convert raw image at src into a compact image at dst or the other way round
+func convert(src, dst string, compress string) {
+	compact, err := disk.IsCompact(src)
+	if err != nil {
+		fmt.Printf("failed to open disk: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if compact {
+		err = disk.ConvertToRaw(src, dst)
+	} else {
+		var c disk.Compression
+		if c, err = disk.ParseCompression(compress); err == nil {
+			err = disk.ConvertToCompact(src, dst, c)
+		}
+	}
+	if err != nil {
+		fmt.Printf("failed to convert disk: %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// export dev over NBD on addr until interrupted
+func serve(dev disk.BlockDevice, addr string, name string, readOnly bool) {
+	defer dev.Close()
+	l, err := nbd.Listen(addr)
+	if err != nil {
+		fmt.Printf("failed to serve disk: %s\n", err.Error())
+		os.Exit(1)
+	}
+	server := nbd.NewServer(dev, name)
+	server.ReadOnly = readOnly
+	interrupt := make(chan os.Signal, 1)
+	signal.Notify(interrupt, os.Interrupt)
+	go func() {
+		<-interrupt
+		server.Close()
+	}()
+	fmt.Printf("serving export %q (%d blocks of %d bytes) on %s\n", name, dev.Size(), dev.BlockSize(), addr)
+	if err := server.Serve(l); err != nil {
+		fmt.Printf("failed to serve disk: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := server.Close(); err != nil {
+		fmt.Printf("failed to sync disk: %s\n", err.Error())
+	}
+	fmt.Printf("served %d requests\n", server.Requests)
+}
+
+func replay(dsk disk.BlockDevice, path string) {
+	defer dsk.Close()
+	trace, err := os.Open(path)
+	if err != nil {
+		fmt.Printf("failed to open trace: %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer trace.Close()
+	result, err := disk.Replay(trace, dsk)
+	fmt.Printf("replayed %d reads, %d writes and %d trims, skipped %d failed operations\n", result.Reads, result.Writes, result.Trims, result.Skipped)
+	if err != nil {
+		fmt.Printf("failed to replay trace: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if len(result.Mismatches) > 0 {
+		fmt.Printf("%d reads returned different data than traced: records %v\n", len(result.Mismatches), result.Mismatches)
+		os.Exit(1)
+	}
+}